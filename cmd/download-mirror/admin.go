@@ -0,0 +1,194 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/adrg/xdg"
+	"github.com/gpu-ninja/download-mirror/pkg/client"
+	"github.com/urfave/cli/v2"
+)
+
+// clientConfig is the client section of a configuration file, so that the
+// server and tokens don't need to be passed to every invocation of the client
+// subcommands. It's keyed by the flags that take precedence over it.
+type clientConfig map[string]string
+
+func clientConfigFlag() cli.Flag {
+	return &cli.StringFlag{
+		Name:    "client-config",
+		Usage:   "Configuration file with a client section (default: --config or $XDG_CONFIG_HOME/download-mirror/client.yaml)",
+		EnvVars: []string{"DOWNLOAD_MIRROR_CONFIG"},
+	}
+}
+
+// loadClientConfig loads the client section of the configuration file, the
+// default file is optional.
+func loadClientConfig(cCtx *cli.Context) (clientConfig, string, error) {
+	path := cCtx.String("client-config")
+	explicit := path != ""
+	if path == "" {
+		path = cCtx.String("config")
+		explicit = path != ""
+	}
+	if path == "" {
+		path = filepath.Join(xdg.ConfigHome, "download-mirror", "client.yaml")
+	}
+
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) && !explicit {
+		return clientConfig{}, path, nil
+	}
+
+	values, err := readConfig(path)
+	if err != nil {
+		return nil, "", err
+	}
+
+	config := make(clientConfig)
+	for _, v := range values {
+		if strings.HasPrefix(v.Path, clientSection) {
+			config[v.Flag] = v.Values[0]
+		}
+	}
+
+	return config, path, nil
+}
+
+// value returns the value of a flag, falling back to the configuration file.
+// Token flags also fall back to the token file in the configuration file.
+func (config clientConfig) value(cCtx *cli.Context, flag string) (string, error) {
+	if cCtx.IsSet(flag) {
+		return cCtx.String(flag), nil
+	}
+
+	if value := config[flag]; value != "" {
+		return value, nil
+	}
+
+	if path := config[flag+"-file"]; path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("failed to read %s file: %w", flag, err)
+		}
+
+		return strings.TrimSpace(string(data)), nil
+	}
+
+	return "", nil
+}
+
+// newClient creates a client for the configured server, authenticated by the
+// token in the named flag (if any).
+func newClient(cCtx *cli.Context, tokenFlag string, tokenRequired bool) (*client.Client, error) {
+	config, path, err := loadClientConfig(cCtx)
+	if err != nil {
+		return nil, err
+	}
+
+	server, err := config.value(cCtx, "server")
+	if err != nil {
+		return nil, err
+	}
+
+	if server == "" {
+		return nil, fmt.Errorf("server is required (--server, DOWNLOAD_MIRROR_SERVER or client.server in %s)", path)
+	}
+
+	var opts []client.Option
+	if tokenFlag != "" {
+		token, err := config.value(cCtx, tokenFlag)
+		if err != nil {
+			return nil, err
+		}
+
+		if token == "" && tokenRequired {
+			return nil, fmt.Errorf("%s is required", tokenFlag)
+		}
+
+		opts = append(opts, client.WithToken(token))
+	}
+
+	return client.New(server, opts...), nil
+}
+
+func serverFlag() cli.Flag {
+	return &cli.StringFlag{
+		Name:    "server",
+		Usage:   "Base URL of the download mirror (eg. https://download.example.com)",
+		EnvVars: []string{"DOWNLOAD_MIRROR_SERVER"},
+	}
+}
+
+// adminFlags are the flags used by subcommands that talk to the admin API of
+// a running mirror.
+func adminFlags() []cli.Flag {
+	return []cli.Flag{
+		serverFlag(),
+		&cli.StringFlag{
+			Name:    "admin-token",
+			Usage:   "Bearer token for the admin API",
+			EnvVars: []string{"DOWNLOAD_MIRROR_ADMIN_TOKEN"},
+		},
+		clientConfigFlag(),
+	}
+}
+
+func newAdminClient(cCtx *cli.Context) (*client.Client, error) {
+	return newClient(cCtx, "admin-token", true)
+}
+
+// uploadFlags are the flags used by subcommands that publish to a running
+// mirror.
+func uploadFlags() []cli.Flag {
+	return []cli.Flag{
+		serverFlag(),
+		&cli.StringFlag{
+			Name:    "token",
+			Usage:   "Bearer token for uploads",
+			EnvVars: []string{"DOWNLOAD_MIRROR_TOKEN"},
+		},
+		clientConfigFlag(),
+	}
+}
+
+func newUploadClient(cCtx *cli.Context) (*client.Client, error) {
+	return newClient(cCtx, "token", true)
+}
+
+// readFlags are the flags used by subcommands that only read public content
+// from a running mirror.
+func readFlags() []cli.Flag {
+	return []cli.Flag{
+		serverFlag(),
+		&cli.StringFlag{
+			Name:    "token",
+			Usage:   "Bearer token, if the mirror requires one",
+			EnvVars: []string{"DOWNLOAD_MIRROR_TOKEN"},
+		},
+		clientConfigFlag(),
+	}
+}
+
+func newReadClient(cCtx *cli.Context) (*client.Client, error) {
+	return newClient(cCtx, "token", false)
+}
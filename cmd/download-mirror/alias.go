@@ -0,0 +1,145 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gpu-ninja/download-mirror/pkg/api"
+	"github.com/urfave/cli/v2"
+)
+
+func aliasCommand() *cli.Command {
+	flags := uploadFlags()
+
+	printAlias := func(alias *api.Alias) {
+		fmt.Printf("%s -> %s (revision %d)\n", alias.Path, alias.URL, alias.Revision)
+	}
+
+	return &cli.Command{
+		Name:  "alias",
+		Usage: "Manage the mutable aliases of a running mirror",
+		Subcommands: []*cli.Command{
+			{
+				Name:      "get",
+				Usage:     "Show an alias and its history",
+				ArgsUsage: "<path>",
+				Flags:     flags,
+				Action: func(cCtx *cli.Context) error {
+					if cCtx.NArg() != 1 {
+						return fmt.Errorf("expected an alias path")
+					}
+
+					c, err := newUploadClient(cCtx)
+					if err != nil {
+						return err
+					}
+
+					alias, err := c.GetAlias(cCtx.Context, cCtx.Args().First())
+					if err != nil {
+						return fmt.Errorf("failed to get alias: %w", err)
+					}
+
+					printAlias(alias)
+					fmt.Println()
+
+					w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+					fmt.Fprintln(w, "REVISION\tID\tNAME\tUPDATED BY\tCREATED\tNOTE")
+					for i := len(alias.History) - 1; i >= 0; i-- {
+						r := alias.History[i]
+
+						var note string
+						if r.RollbackOf != 0 {
+							note = fmt.Sprintf("rollback to %d", r.RollbackOf)
+						}
+
+						fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\n", r.Revision, r.ID, r.Name,
+							r.UpdatedBy, r.CreatedAt.Local().Format(time.RFC3339), note)
+					}
+
+					return w.Flush()
+				},
+			},
+			{
+				Name:      "set",
+				Usage:     "Point an alias at a blob",
+				ArgsUsage: "<path> <id>",
+				Flags: append([]cli.Flag{
+					&cli.StringFlag{
+						Name:  "name",
+						Usage: "Filename to serve the blob under, defaults to the name it was uploaded with",
+					},
+				}, flags...),
+				Action: func(cCtx *cli.Context) error {
+					if cCtx.NArg() != 2 {
+						return fmt.Errorf("expected an alias path and a blob id")
+					}
+
+					c, err := newUploadClient(cCtx)
+					if err != nil {
+						return err
+					}
+
+					alias, err := c.SetAlias(cCtx.Context, cCtx.Args().First(),
+						cCtx.Args().Get(1), cCtx.String("name"))
+					if err != nil {
+						return fmt.Errorf("failed to set alias: %w", err)
+					}
+
+					printAlias(alias)
+
+					return nil
+				},
+			},
+			{
+				Name:      "rollback",
+				Usage:     "Point an alias back at the target of an earlier revision",
+				ArgsUsage: "<path> <revision>",
+				Flags:     flags,
+				Action: func(cCtx *cli.Context) error {
+					if cCtx.NArg() != 2 {
+						return fmt.Errorf("expected an alias path and a revision")
+					}
+
+					revision, err := strconv.Atoi(cCtx.Args().Get(1))
+					if err != nil {
+						return fmt.Errorf("invalid revision: %w", err)
+					}
+
+					c, err := newUploadClient(cCtx)
+					if err != nil {
+						return err
+					}
+
+					alias, err := c.RollbackAlias(cCtx.Context, cCtx.Args().First(), revision)
+					if err != nil {
+						return fmt.Errorf("failed to roll back alias: %w", err)
+					}
+
+					printAlias(alias)
+
+					return nil
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,356 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/docker/go-units"
+	"github.com/gpu-ninja/download-mirror/pkg/api"
+	"github.com/urfave/cli/v2"
+)
+
+func cacheCommand() *cli.Command {
+	flags := adminFlags()
+
+	requireID := func(cCtx *cli.Context) (string, error) {
+		if cCtx.NArg() != 1 {
+			return "", fmt.Errorf("expected a single blob id")
+		}
+
+		return cCtx.Args().First(), nil
+	}
+
+	return &cli.Command{
+		Name:  "cache",
+		Usage: "Inspect and manage the local cache of a running mirror",
+		Subcommands: []*cli.Command{
+			{
+				Name:  "list",
+				Usage: "List cached blobs",
+				Flags: flags,
+				Action: func(cCtx *cli.Context) error {
+					c, err := newAdminClient(cCtx)
+					if err != nil {
+						return err
+					}
+
+					entries, err := c.ListCache(cCtx.Context)
+					if err != nil {
+						return fmt.Errorf("failed to list cache: %w", err)
+					}
+
+					w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+					fmt.Fprintln(w, "ID\tSIZE\tLAST ACCESS\tHITS\tPRIORITY\tPINNED")
+					for _, entry := range entries {
+						fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%t\n", entry.ID,
+							units.BytesSize(float64(entry.Size)),
+							entry.LastAccess.Local().Format(time.RFC3339),
+							entry.Hits, entry.Priority, entry.Pinned)
+					}
+
+					return w.Flush()
+				},
+			},
+			{
+				Name:  "usage",
+				Usage: "Show the current cache usage",
+				Flags: flags,
+				Action: func(cCtx *cli.Context) error {
+					c, err := newAdminClient(cCtx)
+					if err != nil {
+						return err
+					}
+
+					usage, err := c.CacheUsage(cCtx.Context)
+					if err != nil {
+						return fmt.Errorf("failed to get cache usage: %w", err)
+					}
+
+					maxSize := "unlimited"
+					if usage.MaxBytes > 0 {
+						maxSize = units.BytesSize(float64(usage.MaxBytes))
+					}
+
+					fmt.Printf("Size:    %s / %s\n", units.BytesSize(float64(usage.SizeBytes)), maxSize)
+					fmt.Printf("Entries: %d\n", usage.Entries)
+					fmt.Printf("Pinned:  %d (%s)\n", usage.Pinned, units.BytesSize(float64(usage.PinnedBytes)))
+
+					if usage.Memory != nil {
+						var hitRatio float64
+						if lookups := usage.Memory.Hits + usage.Memory.Misses; lookups > 0 {
+							hitRatio = 100 * float64(usage.Memory.Hits) / float64(lookups)
+						}
+
+						fmt.Printf("Memory:  %s / %s (%d entries)\n", units.BytesSize(float64(usage.Memory.SizeBytes)),
+							units.BytesSize(float64(usage.Memory.MaxBytes)), usage.Memory.Entries)
+						fmt.Printf("Hits:    %d (%.1f%%), %d misses, %d evictions\n", usage.Memory.Hits,
+							hitRatio, usage.Memory.Misses, usage.Memory.Evictions)
+					}
+
+					return nil
+				},
+			},
+			{
+				Name:  "trim",
+				Usage: "Trim the cache immediately",
+				Flags: flags,
+				Action: func(cCtx *cli.Context) error {
+					c, err := newAdminClient(cCtx)
+					if err != nil {
+						return err
+					}
+
+					result, err := c.TrimCache(cCtx.Context)
+					if err != nil {
+						return fmt.Errorf("failed to trim cache: %w", err)
+					}
+
+					fmt.Printf("Evicted %d blobs (%s), cache is now %s\n", result.Evicted,
+						units.BytesSize(float64(result.EvictedBytes)),
+						units.BytesSize(float64(result.SizeBytes)))
+
+					return nil
+				},
+			},
+			{
+				Name:      "pin",
+				Usage:     "Pin a blob so that it is never evicted",
+				ArgsUsage: "<id>",
+				Flags:     flags,
+				Action: func(cCtx *cli.Context) error {
+					id, err := requireID(cCtx)
+					if err != nil {
+						return err
+					}
+
+					c, err := newAdminClient(cCtx)
+					if err != nil {
+						return err
+					}
+
+					if err := c.PinCacheEntry(cCtx.Context, id); err != nil {
+						return fmt.Errorf("failed to pin blob: %w", err)
+					}
+
+					return nil
+				},
+			},
+			{
+				Name:      "unpin",
+				Usage:     "Unpin a previously pinned blob",
+				ArgsUsage: "<id>",
+				Flags:     flags,
+				Action: func(cCtx *cli.Context) error {
+					id, err := requireID(cCtx)
+					if err != nil {
+						return err
+					}
+
+					c, err := newAdminClient(cCtx)
+					if err != nil {
+						return err
+					}
+
+					if err := c.UnpinCacheEntry(cCtx.Context, id); err != nil {
+						return fmt.Errorf("failed to unpin blob: %w", err)
+					}
+
+					return nil
+				},
+			},
+			{
+				Name:      "priority",
+				Usage:     "Set the eviction priority of a blob, lower priority blobs are evicted first",
+				ArgsUsage: "<id> <priority>",
+				Flags:     flags,
+				Action: func(cCtx *cli.Context) error {
+					if cCtx.NArg() != 2 {
+						return fmt.Errorf("expected a blob id and a priority")
+					}
+
+					priority, err := strconv.Atoi(cCtx.Args().Get(1))
+					if err != nil {
+						return fmt.Errorf("invalid priority: %w", err)
+					}
+
+					c, err := newAdminClient(cCtx)
+					if err != nil {
+						return err
+					}
+
+					if err := c.SetCacheEntryPriority(cCtx.Context, cCtx.Args().First(), priority); err != nil {
+						return fmt.Errorf("failed to set blob priority: %w", err)
+					}
+
+					return nil
+				},
+			},
+			{
+				Name:      "evict",
+				Usage:     "Evict a blob from the cache",
+				ArgsUsage: "<id>",
+				Flags:     flags,
+				Action: func(cCtx *cli.Context) error {
+					id, err := requireID(cCtx)
+					if err != nil {
+						return err
+					}
+
+					c, err := newAdminClient(cCtx)
+					if err != nil {
+						return err
+					}
+
+					if err := c.EvictCacheEntry(cCtx.Context, id); err != nil {
+						return fmt.Errorf("failed to evict blob: %w", err)
+					}
+
+					return nil
+				},
+			},
+			{
+				Name:      "prefetch",
+				Usage:     "Warm the cache by pulling blobs from the upstream in the background",
+				ArgsUsage: "[<id>...]",
+				Flags: append([]cli.Flag{
+					&cli.StringFlag{
+						Name:    "selector",
+						Aliases: []string{"l"},
+						Usage:   "Label selector of blobs to prefetch (eg. release=v1.2.0,os=linux)",
+					},
+					&cli.BoolFlag{
+						Name:  "wait",
+						Usage: "Wait for the prefetch job to complete, reporting progress",
+					},
+				}, flags...),
+				Action: func(cCtx *cli.Context) error {
+					if cCtx.NArg() == 0 && cCtx.String("selector") == "" {
+						return fmt.Errorf("expected blob ids or a label selector")
+					}
+
+					c, err := newAdminClient(cCtx)
+					if err != nil {
+						return err
+					}
+
+					job, err := c.Prefetch(cCtx.Context, api.PrefetchRequest{
+						IDs:      cCtx.Args().Slice(),
+						Selector: cCtx.String("selector"),
+					})
+					if err != nil {
+						return fmt.Errorf("failed to start prefetch: %w", err)
+					}
+
+					if !cCtx.Bool("wait") {
+						fmt.Printf("Started prefetch job %s for %d blobs\n", job.ID, job.Total)
+
+						return nil
+					}
+
+					ticker := time.NewTicker(prefetchPollInterval)
+					defer ticker.Stop()
+
+					for job.State == api.PrefetchStateRunning {
+						printPrefetchProgress(job)
+
+						select {
+						case <-cCtx.Context.Done():
+							return cCtx.Context.Err()
+						case <-ticker.C:
+						}
+
+						job, err = c.PrefetchJob(cCtx.Context, job.ID)
+						if err != nil {
+							return fmt.Errorf("failed to get prefetch job: %w", err)
+						}
+					}
+
+					printPrefetchProgress(job)
+
+					for _, failure := range job.Failures {
+						fmt.Fprintf(os.Stderr, "%s: %s\n", failure.ID, failure.Error)
+					}
+
+					if job.Failed > 0 {
+						return fmt.Errorf("failed to prefetch %d blobs", job.Failed)
+					}
+
+					if job.State != api.PrefetchStateCompleted {
+						return fmt.Errorf("prefetch job %s", job.State)
+					}
+
+					return nil
+				},
+			},
+			{
+				Name:      "prefetch-status",
+				Usage:     "Show the progress of prefetch jobs",
+				ArgsUsage: "[<job>]",
+				Flags:     flags,
+				Action: func(cCtx *cli.Context) error {
+					c, err := newAdminClient(cCtx)
+					if err != nil {
+						return err
+					}
+
+					var jobs []api.PrefetchJob
+					if cCtx.NArg() > 0 {
+						job, err := c.PrefetchJob(cCtx.Context, cCtx.Args().First())
+						if err != nil {
+							return fmt.Errorf("failed to get prefetch job: %w", err)
+						}
+
+						jobs = append(jobs, *job)
+					} else {
+						var err error
+						jobs, err = c.ListPrefetchJobs(cCtx.Context)
+						if err != nil {
+							return fmt.Errorf("failed to list prefetch jobs: %w", err)
+						}
+					}
+
+					w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+					fmt.Fprintln(w, "JOB\tSTATE\tTOTAL\tFETCHED\tCACHED\tFAILED\tBYTES\tSTARTED")
+					for _, job := range jobs {
+						fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%d\t%s\t%s\n", job.ID, job.State,
+							job.Total, job.Fetched, job.Cached, job.Failed,
+							units.BytesSize(float64(job.Bytes)),
+							job.StartedAt.Local().Format(time.RFC3339))
+					}
+
+					return w.Flush()
+				},
+			},
+		},
+	}
+}
+
+// prefetchPollInterval is how often to poll the progress of a prefetch job.
+const prefetchPollInterval = time.Second
+
+func printPrefetchProgress(job *api.PrefetchJob) {
+	done := job.Fetched + job.Cached + job.Failed
+	fmt.Printf("%s: %d/%d blobs (%d fetched, %d cached, %d failed), %s transferred\n",
+		job.State, done, job.Total, job.Fetched, job.Cached, job.Failed,
+		units.BytesSize(float64(job.Bytes)))
+}
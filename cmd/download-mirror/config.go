@@ -0,0 +1,265 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/gpu-ninja/download-mirror/internal/cache"
+	"github.com/gpu-ninja/download-mirror/internal/config"
+	"github.com/urfave/cli/v2"
+)
+
+// settings maps the sections of the configuration file onto flags.
+var settings = []config.Setting{
+	{Path: "log.level", Flag: "log-level", Check: config.OneOf("debug", "info", "warn", "error")},
+	{Path: "log.accessLog.output", Flag: "access-log"},
+	{Path: "log.accessLog.format", Flag: "access-log-format", Check: config.OneOf("logfmt", "json")},
+	{Path: "log.accessLog.maxSize", Flag: "access-log-max-size", Check: config.Int},
+	{Path: "log.accessLog.maxBackups", Flag: "access-log-max-backups", Check: config.Int},
+
+	{Path: "server.dev", Flag: "dev", Check: config.Bool},
+	{Path: "server.plainHTTP", Flag: "plain-http", Check: config.Bool},
+	{Path: "server.listen", Flag: "listen"},
+	{Path: "server.metricsListen", Flag: "metrics-listen"},
+	{Path: "server.publicBaseURL", Flag: "public-base-url"},
+	{Path: "server.trustedProxies", Flag: "trusted-proxies", List: true},
+	{Path: "server.shutdownTimeout", Flag: "shutdown-timeout", Check: config.Duration},
+	{Path: "server.serveAliasesDirectly", Flag: "serve-aliases-directly", Check: config.Bool},
+
+	{Path: "rateLimit.client.requests", Flag: "rate-limit-requests", Check: config.Float},
+	{Path: "rateLimit.client.burst", Flag: "rate-limit-burst", Check: config.Int},
+	{Path: "rateLimit.client.bytes", Flag: "rate-limit-bytes", Check: config.Size},
+	{Path: "rateLimit.token.requests", Flag: "token-rate-limit-requests", Check: config.Float},
+	{Path: "rateLimit.token.burst", Flag: "token-rate-limit-burst", Check: config.Int},
+	{Path: "rateLimit.token.bytes", Flag: "token-rate-limit-bytes", Check: config.Size},
+	{Path: "rateLimit.cacheMiss.requests", Flag: "cache-miss-rate-limit-requests", Check: config.Float},
+	{Path: "rateLimit.cacheMiss.burst", Flag: "cache-miss-rate-limit-burst", Check: config.Int},
+	{Path: "rateLimit.cacheMiss.bytes", Flag: "cache-miss-rate-limit-bytes", Check: config.Size},
+	{Path: "rateLimit.ipv4Prefix", Flag: "rate-limit-ipv4-prefix", Check: config.Int},
+	{Path: "rateLimit.ipv6Prefix", Flag: "rate-limit-ipv6-prefix", Check: config.Int},
+	{Path: "rateLimit.egress", Flag: "egress-rate-limit", Check: config.Size},
+
+	{Path: "tls.listen", Flag: "tls-listen"},
+	{Path: "tls.domain", Flag: "domain"},
+	{Path: "tls.email", Flag: "email"},
+
+	{Path: "tracing.otlpEndpoint", Flag: "otlp-endpoint"},
+	{Path: "tracing.otlpInsecure", Flag: "otlp-insecure", Check: config.Bool},
+
+	{Path: "auth.token", Flag: "token"},
+	{Path: "auth.tokenFile", Flag: "token-file"},
+	{Path: "auth.adminToken", Flag: "admin-token"},
+	{Path: "auth.adminTokenFile", Flag: "admin-token-file"},
+
+	{Path: "quotas.maxBlobSize", Flag: "max-blob-size", Check: config.Size},
+	{Path: "quotas.tokens", Flag: "token-quota", List: true},
+
+	{Path: "cache.dir", Flag: "cache"},
+	{Path: "cache.size", Flag: "cache-size", Check: config.Size},
+	{Path: "cache.evictionPolicy", Flag: "cache-eviction-policy", Check: checkEvictionPolicy},
+	{Path: "cache.highWatermark", Flag: "cache-high-watermark", Check: config.Float},
+	{Path: "cache.lowWatermark", Flag: "cache-low-watermark", Check: config.Float},
+	{Path: "cache.freeSpaceFloor", Flag: "cache-free-space-floor", Check: config.Size},
+	{Path: "cache.minFreeSpace", Flag: "min-free-space", Check: config.Size},
+	{Path: "cache.memory.size", Flag: "memory-cache-size", Check: config.Size},
+	{Path: "cache.memory.maxBlobSize", Flag: "memory-cache-max-blob-size", Check: config.Size},
+	{Path: "cache.verifyOnServe", Flag: "verify-on-serve", Check: config.Bool},
+	{Path: "cache.prefetchConcurrency", Flag: "prefetch-concurrency", Check: config.Int},
+
+	{Path: "scrub.interval", Flag: "scrub-interval", Check: config.Duration},
+	{Path: "scrub.rateLimit", Flag: "scrub-rate-limit", Check: config.Size},
+
+	{Path: "hashing.secret", Flag: "hash-secret"},
+	{Path: "hashing.secretFile", Flag: "hash-secret-file"},
+	{Path: "hashing.legacySecrets", Flag: "legacy-hash-secret", List: true},
+	{Path: "hashing.legacySecretFile", Flag: "legacy-hash-secret-file"},
+	{Path: "hashing.allowNewSecret", Flag: "allow-new-hash-secret", Check: config.Bool},
+	{Path: "hashing.legacyIDs", Flag: "legacy-ids", Check: config.Bool},
+	{Path: "hashing.sha512Digests", Flag: "sha512-digests", Check: config.Bool},
+
+	{Path: "signing.keyFile", Flag: "signing-key-file"},
+	{Path: "signing.keyPasswordFile", Flag: "signing-key-password-file"},
+	{Path: "signing.trustedPublicKeyFiles", Flag: "trusted-public-key-file", List: true},
+
+	{Path: "upstreams.webdav.uri", Flag: "webdav-uri"},
+	{Path: "upstreams.webdav.user", Flag: "webdav-user"},
+	{Path: "upstreams.webdav.password", Flag: "webdav-password"},
+	{Path: "upstreams.webdav.passwordFile", Flag: "webdav-password-file"},
+	{Path: "upstreams.replicas", Flag: "replica-uri", List: true, Fields: replicaFields, CheckFields: checkReplica},
+
+	{Path: "mirror.origins", Flag: "origin", List: true},
+	{Path: "mirror.fetchTimeout", Flag: "origin-fetch-timeout", Check: config.Duration},
+
+	{Path: "client.server", Flag: "server"},
+	{Path: "client.token", Flag: "token"},
+	{Path: "client.tokenFile", Flag: "token-file"},
+	{Path: "client.adminToken", Flag: "admin-token"},
+	{Path: "client.adminTokenFile", Flag: "admin-token-file"},
+}
+
+// clientSection holds the settings of the client subcommands, they map onto
+// the flags of the subcommands rather than those of the server.
+const clientSection = "client."
+
+// replicaFields are the settings of a replica given as a section, so that each
+// replica can have its own credentials.
+var replicaFields = []string{"uri", "user", "password", "passwordFile"}
+
+func checkReplica(fields map[string]string) error {
+	if fields["uri"] == "" {
+		return errors.New("uri is required")
+	}
+
+	if _, err := url.Parse(fields["uri"]); err != nil {
+		return fmt.Errorf("invalid uri: %w", err)
+	}
+
+	if fields["password"] != "" && fields["passwordFile"] != "" {
+		return errors.New("only one of password and passwordFile can be set")
+	}
+
+	return nil
+}
+
+// replicaURI returns the URI of a replica section, with its credentials.
+func replicaURI(fields map[string]string) (string, error) {
+	u, err := url.Parse(fields["uri"])
+	if err != nil {
+		return "", fmt.Errorf("invalid uri: %w", err)
+	}
+
+	password := fields["password"]
+	if path := fields["passwordFile"]; path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("failed to read password file: %w", err)
+		}
+
+		password = strings.TrimSpace(string(data))
+	}
+
+	if fields["user"] != "" || password != "" {
+		u.User = url.UserPassword(fields["user"], password)
+	}
+
+	return u.String(), nil
+}
+
+func checkEvictionPolicy(value string) error {
+	_, err := cache.ParsePolicy(value)
+	return err
+}
+
+// loadConfig applies the configuration file (if any) to the flags that
+// haven't been set on the command line or by environment variables.
+func loadConfig(cCtx *cli.Context) error {
+	path := cCtx.String("config")
+	if path == "" {
+		return nil
+	}
+
+	values, err := readConfig(path)
+	if err != nil {
+		return err
+	}
+
+	for _, v := range values {
+		if strings.HasPrefix(v.Path, clientSection) || cCtx.IsSet(v.Flag) {
+			continue
+		}
+
+		for i, value := range v.Values {
+			if v.Fields != nil && v.Fields[i] != nil {
+				var err error
+				if value, err = replicaURI(v.Fields[i]); err != nil {
+					return fmt.Errorf("%s:%d: %s: %w", path, v.Line, v.Path, err)
+				}
+			}
+
+			if err := cCtx.Set(v.Flag, value); err != nil {
+				return fmt.Errorf("%s:%d: %s: %w", path, v.Line, v.Path, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func readConfig(path string) ([]config.Value, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	values, err := config.Parse(data, settings)
+	if err != nil {
+		var errs config.Errors
+		if errors.As(err, &errs) {
+			var msg string
+			for i, e := range errs {
+				if i > 0 {
+					msg += "\n"
+				}
+				msg += fmt.Sprintf("%s:%d: %s", path, e.Line, e.Message)
+			}
+
+			return nil, errors.New(msg)
+		}
+
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return values, nil
+}
+
+func configCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "config",
+		Usage: "Manage the configuration file",
+		Subcommands: []*cli.Command{
+			{
+				Name:      "validate",
+				Usage:     "Check a configuration file for errors",
+				ArgsUsage: "[file]",
+				Action: func(cCtx *cli.Context) error {
+					path := cCtx.Args().First()
+					if path == "" {
+						path = cCtx.String("config")
+					}
+					if path == "" {
+						return fmt.Errorf("no configuration file specified")
+					}
+
+					if _, err := readConfig(path); err != nil {
+						fmt.Fprintln(os.Stderr, err)
+						return cli.Exit("", 1)
+					}
+
+					fmt.Printf("%s: OK\n", path)
+
+					return nil
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,214 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/build"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gpu-ninja/download-mirror/pkg/api"
+	"github.com/gpu-ninja/download-mirror/pkg/client"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+	modzip "golang.org/x/mod/zip"
+)
+
+func goproxyCommand() *cli.Command {
+	flags := uploadFlags()
+
+	return &cli.Command{
+		Name:  "goproxy",
+		Usage: "Publish Go modules to the module proxy of a running mirror",
+		Subcommands: []*cli.Command{
+			{
+				Name:  "publish",
+				Usage: "Publish a version of the Go module in a directory",
+				Flags: append([]cli.Flag{
+					&cli.StringFlag{
+						Name:  "dir",
+						Usage: "Module root directory (containing go.mod)",
+						Value: ".",
+					},
+					&cli.StringFlag{
+						Name:     "version",
+						Usage:    "Version to publish (eg. v1.2.3)",
+						Required: true,
+					},
+					&cli.TimestampFlag{
+						Name:   "time",
+						Usage:  "Commit time to report for the version, defaults to the time of publication",
+						Layout: time.RFC3339,
+					},
+				}, flags...),
+				Action: func(cCtx *cli.Context) error {
+					dir := cCtx.String("dir")
+
+					modData, err := os.ReadFile(filepath.Join(dir, "go.mod"))
+					if err != nil {
+						return fmt.Errorf("failed to read go.mod: %w", err)
+					}
+
+					mv := module.Version{
+						Path:    modfile.ModulePath(modData),
+						Version: cCtx.String("version"),
+					}
+
+					if mv.Path == "" {
+						return fmt.Errorf("go.mod does not declare a module path")
+					}
+
+					zipFile, err := os.CreateTemp("", "goproxy-")
+					if err != nil {
+						return fmt.Errorf("failed to create temporary file: %w", err)
+					}
+					defer func() {
+						_ = zipFile.Close()
+						_ = os.Remove(zipFile.Name())
+					}()
+
+					if err := modzip.CreateFromDir(zipFile, mv, dir); err != nil {
+						return fmt.Errorf("failed to create module zip: %w", err)
+					}
+
+					if _, err := zipFile.Seek(0, io.SeekStart); err != nil {
+						return fmt.Errorf("failed to rewind module zip: %w", err)
+					}
+
+					var publishedAt time.Time
+					if t := cCtx.Timestamp("time"); t != nil {
+						publishedAt = *t
+					}
+
+					c, err := newUploadClient(cCtx)
+					if err != nil {
+						return err
+					}
+
+					info, err := c.PublishGoModule(cCtx.Context, mv.Path, mv.Version,
+						bytes.NewReader(modData), zipFile, publishedAt)
+					if err != nil {
+						return fmt.Errorf("failed to publish %s: %w", mv, err)
+					}
+
+					fmt.Printf("Published %s@%s\n", mv.Path, info.Version)
+
+					return nil
+				},
+			},
+			{
+				Name:      "mirror",
+				Usage:     "Publish module versions from the local Go module cache (eg. after go mod download)",
+				ArgsUsage: "<module>@<version>...",
+				Flags: append([]cli.Flag{
+					&cli.StringFlag{
+						Name:    "modcache",
+						Usage:   "Go module cache directory",
+						EnvVars: []string{"GOMODCACHE"},
+						Value:   filepath.Join(filepath.SplitList(build.Default.GOPATH)[0], "pkg", "mod"),
+					},
+				}, flags...),
+				Action: func(cCtx *cli.Context) error {
+					if cCtx.NArg() == 0 {
+						return fmt.Errorf("expected at least one module version")
+					}
+
+					c, err := newUploadClient(cCtx)
+					if err != nil {
+						return err
+					}
+
+					for _, arg := range cCtx.Args().Slice() {
+						if err := mirrorModule(cCtx, c, arg); err != nil {
+							return err
+						}
+
+						fmt.Printf("Published %s\n", arg)
+					}
+
+					return nil
+				},
+			},
+		},
+	}
+}
+
+// mirrorModule publishes a module version from the local module cache, the
+// original zip is published so that its hash matches existing go.sum files.
+func mirrorModule(cCtx *cli.Context, c *client.Client, arg string) error {
+	modulePath, version, ok := strings.Cut(arg, "@")
+	if !ok {
+		return fmt.Errorf("invalid module version %q", arg)
+	}
+
+	prefix, err := modcachePrefix(cCtx.String("modcache"), modulePath, version)
+	if err != nil {
+		return fmt.Errorf("invalid module version %q: %w", arg, err)
+	}
+
+	infoData, err := os.ReadFile(prefix + ".info")
+	if err != nil {
+		return fmt.Errorf("module %s is not in the module cache: %w", arg, err)
+	}
+
+	var info api.GoModuleInfo
+	if err := json.Unmarshal(infoData, &info); err != nil {
+		return fmt.Errorf("failed to decode %s.info: %w", prefix, err)
+	}
+
+	mod, err := os.Open(prefix + ".mod")
+	if err != nil {
+		return fmt.Errorf("failed to open go.mod: %w", err)
+	}
+	defer mod.Close()
+
+	zip, err := os.Open(prefix + ".zip")
+	if err != nil {
+		return fmt.Errorf("failed to open module zip: %w", err)
+	}
+	defer zip.Close()
+
+	if _, err := c.PublishGoModule(cCtx.Context, modulePath, version, mod, zip, info.Time); err != nil {
+		return fmt.Errorf("failed to publish %s: %w", arg, err)
+	}
+
+	return nil
+}
+
+// modcachePrefix returns the path (without the extension) of the files for a
+// module version in the download cache of the Go module cache.
+func modcachePrefix(modcache, modulePath, version string) (string, error) {
+	escapedPath, err := module.EscapePath(modulePath)
+	if err != nil {
+		return "", err
+	}
+
+	escapedVersion, err := module.EscapeVersion(version)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(modcache, "cache", "download", filepath.FromSlash(escapedPath), "@v", escapedVersion), nil
+}
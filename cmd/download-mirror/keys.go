@@ -0,0 +1,151 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/gpu-ninja/download-mirror/internal/meta"
+	"github.com/gpu-ninja/download-mirror/internal/metrics"
+	"github.com/gpu-ninja/download-mirror/internal/rekey"
+	"github.com/gpu-ninja/download-mirror/internal/securehash"
+	"github.com/gpu-ninja/download-mirror/internal/upstream"
+	"github.com/urfave/cli/v2"
+	"go.uber.org/zap"
+)
+
+// loadKeyring loads the primary and legacy secure hash secrets.
+func loadKeyring(cCtx *cli.Context) (*securehash.Keyring, error) {
+	secureHashSecret := cCtx.String("hash-secret")
+	if cCtx.IsSet("hash-secret-file") {
+		data, err := os.ReadFile(cCtx.String("hash-secret-file"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read secure hash secret file: %w", err)
+		}
+
+		secureHashSecret = strings.TrimSpace(string(data))
+	}
+
+	if secureHashSecret == "" {
+		return nil, fmt.Errorf("secure hash secret is required")
+	}
+
+	legacySecrets := cCtx.StringSlice("legacy-hash-secret")
+	if cCtx.IsSet("legacy-hash-secret-file") {
+		data, err := os.ReadFile(cCtx.String("legacy-hash-secret-file"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read legacy secure hash secret file: %w", err)
+		}
+
+		for _, line := range strings.Split(string(data), "\n") {
+			if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+				legacySecrets = append(legacySecrets, line)
+			}
+		}
+	}
+
+	var legacy [][]byte
+	for _, secret := range legacySecrets {
+		legacy = append(legacy, []byte(secret))
+	}
+
+	return securehash.NewKeyring([]byte(secureHashSecret), legacy...), nil
+}
+
+func keysCommand(logger *zap.Logger) *cli.Command {
+	return &cli.Command{
+		Name:  "keys",
+		Usage: "Manage secure hash keys",
+		Subcommands: []*cli.Command{
+			{
+				Name:  "list",
+				Usage: "List the ids of the configured secure hash keys",
+				Action: func(cCtx *cli.Context) error {
+					keyring, err := loadKeyring(cCtx)
+					if err != nil {
+						return err
+					}
+
+					w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+					fmt.Fprintln(w, "KEY ID\tROLE")
+
+					for i, key := range keyring.Keys() {
+						role := "legacy"
+						if i == 0 {
+							role = "primary"
+						}
+
+						fmt.Fprintf(w, "%s\t%s\n", key.ID, role)
+					}
+
+					return w.Flush()
+				},
+			},
+			{
+				Name:  "migrate",
+				Usage: "Re-key blobs addressed under legacy keys to the primary key, redirecting old URLs",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "dry-run",
+						Usage: "Report which blobs would be re-keyed, without changing anything",
+					},
+				},
+				Action: func(cCtx *cli.Context) error {
+					keyring, err := loadKeyring(cCtx)
+					if err != nil {
+						return err
+					}
+
+					webdav, replicas, err := openUpstreams(cCtx)
+					if err != nil {
+						return err
+					}
+
+					ups := metrics.InstrumentUpstream(upstream.NewReplicated(logger, keyring.NewHash, webdav, replicas...))
+
+					report, err := rekey.Migrate(cCtx.Context, logger, ups, meta.NewStore(ups), keyring, rekey.Options{
+						DryRun: cCtx.Bool("dry-run"),
+					})
+					if err != nil {
+						return fmt.Errorf("failed to migrate blobs: %w", err)
+					}
+
+					fmt.Printf("Scanned %d blobs: %d current, %d already re-keyed, %d re-keyed, %d unknown, %d failed\n",
+						report.Scanned, report.Current, report.Redirected, report.Rekeyed, len(report.Unknown), len(report.Failed))
+
+					for _, id := range report.Unknown {
+						fmt.Printf("unknown\t%s\n", id)
+					}
+
+					for _, id := range report.Failed {
+						fmt.Printf("failed\t%s\n", id)
+					}
+
+					if len(report.Failed) > 0 {
+						return fmt.Errorf("failed to re-key %d blobs", len(report.Failed))
+					}
+
+					return nil
+				},
+			},
+		},
+	}
+}
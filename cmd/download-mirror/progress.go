@@ -0,0 +1,72 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/docker/go-units"
+	"github.com/gpu-ninja/download-mirror/pkg/client"
+	"github.com/mattn/go-isatty"
+)
+
+const (
+	progressBarWidth    = 30
+	progressBarInterval = 100 * time.Millisecond
+)
+
+// newProgressBar returns a function that renders the progress of a transfer
+// on stderr, or nil if stderr isn't a terminal (eg. in CI logs).
+func newProgressBar(name string) client.ProgressFunc {
+	if !isatty.IsTerminal(os.Stderr.Fd()) {
+		return nil
+	}
+
+	start := time.Now()
+	var last time.Time
+	var finished bool
+
+	return func(transferred, total int64) {
+		now := time.Now()
+		done := total >= 0 && transferred >= total
+		if finished || (!done && now.Sub(last) < progressBarInterval) {
+			return
+		}
+		last, finished = now, done
+
+		rate := units.BytesSize(float64(transferred) / now.Sub(start).Seconds())
+
+		var line string
+		if total > 0 {
+			filled := int(progressBarWidth * transferred / total)
+			line = fmt.Sprintf("[%s%s] %3d%% %s / %s %s/s", strings.Repeat("=", filled),
+				strings.Repeat(" ", progressBarWidth-filled), 100*transferred/total,
+				units.BytesSize(float64(transferred)), units.BytesSize(float64(total)), rate)
+		} else {
+			line = fmt.Sprintf("%s %s/s", units.BytesSize(float64(transferred)), rate)
+		}
+
+		fmt.Fprintf(os.Stderr, "\r%s %s\x1b[K", name, line)
+		if done {
+			fmt.Fprintln(os.Stderr)
+		}
+	}
+}
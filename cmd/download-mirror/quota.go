@@ -0,0 +1,93 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/docker/go-units"
+	"github.com/urfave/cli/v2"
+)
+
+func quotaCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "quota",
+		Usage: "Show the storage used by a token, and its quota",
+		Flags: uploadFlags(),
+		Action: func(cCtx *cli.Context) error {
+			c, err := newUploadClient(cCtx)
+			if err != nil {
+				return err
+			}
+
+			quota, err := c.GetQuota(cCtx.Context)
+			if err != nil {
+				return fmt.Errorf("failed to get quota: %w", err)
+			}
+
+			fmt.Printf("Token:         %s\n", quota.Token)
+			fmt.Printf("Storage:       %s / %s\n", units.BytesSize(float64(quota.Bytes)), formatLimit(quota.MaxBytes, true))
+			fmt.Printf("Blobs:         %d / %s\n", quota.Blobs, formatLimit(quota.MaxBlobs, false))
+			fmt.Printf("Max blob size: %s\n", formatLimit(quota.MaxBlobSize, true))
+
+			return nil
+		},
+		Subcommands: []*cli.Command{
+			{
+				Name:  "list",
+				Usage: "List the storage used by every token, and their quotas",
+				Flags: adminFlags(),
+				Action: func(cCtx *cli.Context) error {
+					c, err := newAdminClient(cCtx)
+					if err != nil {
+						return err
+					}
+
+					quotas, err := c.ListQuotas(cCtx.Context)
+					if err != nil {
+						return fmt.Errorf("failed to list quotas: %w", err)
+					}
+
+					w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+					fmt.Fprintln(w, "TOKEN\tSTORAGE\tMAX STORAGE\tBLOBS\tMAX BLOBS")
+					for _, quota := range quotas {
+						fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n", quota.Token,
+							units.BytesSize(float64(quota.Bytes)), formatLimit(quota.MaxBytes, true),
+							quota.Blobs, formatLimit(quota.MaxBlobs, false))
+					}
+
+					return w.Flush()
+				},
+			},
+		},
+	}
+}
+
+func formatLimit(limit int64, size bool) string {
+	switch {
+	case limit == 0:
+		return "unlimited"
+	case size:
+		return units.BytesSize(float64(limit))
+	default:
+		return strconv.FormatInt(limit, 10)
+	}
+}
@@ -0,0 +1,152 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/docker/go-units"
+	"github.com/gpu-ninja/download-mirror/pkg/api"
+	"github.com/gpu-ninja/download-mirror/pkg/client"
+	"github.com/urfave/cli/v2"
+)
+
+func releaseCommand() *cli.Command {
+	flags := uploadFlags()
+
+	return &cli.Command{
+		Name:  "release",
+		Usage: "Publish and inspect releases on a running mirror",
+		Subcommands: []*cli.Command{
+			{
+				Name:      "create",
+				Usage:     "Atomically create a release from a set of files",
+				ArgsUsage: "<product> <version> <file>[=<platform>]...",
+				Flags: append([]cli.Flag{
+					&cli.StringSliceFlag{
+						Name:  "channel",
+						Usage: "Channel to move to the release once it has been created (eg. stable)",
+					},
+				}, flags...),
+				Action: func(cCtx *cli.Context) error {
+					if cCtx.NArg() < 3 {
+						return fmt.Errorf("expected a product, a version and at least one file")
+					}
+
+					releaseReq := api.ReleaseRequest{
+						Channels: cCtx.StringSlice("channel"),
+					}
+
+					var uploads []client.ReleaseUpload
+					for _, arg := range cCtx.Args().Slice()[2:] {
+						path, platform, _ := strings.Cut(arg, "=")
+
+						f, err := os.Open(path)
+						if err != nil {
+							return fmt.Errorf("failed to open file: %w", err)
+						}
+						defer f.Close()
+
+						name := filepath.Base(path)
+						releaseReq.Files = append(releaseReq.Files, api.ReleaseFileRequest{
+							Name:     name,
+							Platform: platform,
+						})
+						uploads = append(uploads, client.ReleaseUpload{Name: name, Reader: f})
+					}
+
+					c, err := newUploadClient(cCtx)
+					if err != nil {
+						return err
+					}
+
+					release, err := c.CreateRelease(cCtx.Context,
+						cCtx.Args().Get(0), cCtx.Args().Get(1), releaseReq, uploads)
+					if err != nil {
+						return fmt.Errorf("failed to create release: %w", err)
+					}
+
+					return printRelease(release)
+				},
+			},
+			{
+				Name:      "get",
+				Usage:     "Show the manifest of a release",
+				ArgsUsage: "<product> <version or channel>",
+				Flags:     flags,
+				Action: func(cCtx *cli.Context) error {
+					if cCtx.NArg() != 2 {
+						return fmt.Errorf("expected a product and a version")
+					}
+
+					c, err := newUploadClient(cCtx)
+					if err != nil {
+						return err
+					}
+
+					release, err := c.GetRelease(cCtx.Context, cCtx.Args().Get(0), cCtx.Args().Get(1))
+					if err != nil {
+						return fmt.Errorf("failed to get release: %w", err)
+					}
+
+					return printRelease(release)
+				},
+			},
+			{
+				Name:      "promote",
+				Usage:     "Point a release channel at a release",
+				ArgsUsage: "<product> <channel> <version>",
+				Flags:     flags,
+				Action: func(cCtx *cli.Context) error {
+					if cCtx.NArg() != 3 {
+						return fmt.Errorf("expected a product, a channel and a version")
+					}
+
+					c, err := newUploadClient(cCtx)
+					if err != nil {
+						return err
+					}
+
+					if _, err := c.SetReleaseChannel(cCtx.Context, cCtx.Args().Get(0),
+						cCtx.Args().Get(1), cCtx.Args().Get(2)); err != nil {
+						return fmt.Errorf("failed to promote release: %w", err)
+					}
+
+					return nil
+				},
+			},
+		},
+	}
+}
+
+func printRelease(release *api.Release) error {
+	fmt.Printf("%s %s\n\n", release.Product, release.Version)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tPLATFORM\tSIZE\tSHA256\tURL")
+	for _, f := range release.Files {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", f.Name, f.Platform,
+			units.BytesSize(float64(f.Size)), f.SHA256, f.URL)
+	}
+
+	return w.Flush()
+}
@@ -0,0 +1,157 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/docker/go-units"
+	"github.com/gpu-ninja/download-mirror/pkg/api"
+	"github.com/urfave/cli/v2"
+)
+
+// scrubPollInterval is how often to poll the progress of a scrub.
+const scrubPollInterval = 5 * time.Second
+
+func scrubCommand() *cli.Command {
+	flags := adminFlags()
+
+	return &cli.Command{
+		Name:  "scrub",
+		Usage: "Audit the integrity of every blob in the upstream store",
+		Subcommands: []*cli.Command{
+			{
+				Name:  "start",
+				Usage: "Start a scrub, repairing missing or corrupt blobs where possible",
+				Flags: append([]cli.Flag{
+					&cli.BoolFlag{
+						Name:  "wait",
+						Usage: "Wait for the scrub to complete, reporting progress",
+					},
+				}, flags...),
+				Action: func(cCtx *cli.Context) error {
+					c, err := newAdminClient(cCtx)
+					if err != nil {
+						return err
+					}
+
+					report, err := c.StartScrub(cCtx.Context)
+					if err != nil {
+						return fmt.Errorf("failed to start scrub: %w", err)
+					}
+
+					if !cCtx.Bool("wait") {
+						fmt.Println("Started scrub")
+
+						return nil
+					}
+
+					ticker := time.NewTicker(scrubPollInterval)
+					defer ticker.Stop()
+
+					for report.State == api.ScrubStateRunning {
+						printScrubProgress(report)
+
+						select {
+						case <-cCtx.Context.Done():
+							return cCtx.Context.Err()
+						case <-ticker.C:
+						}
+
+						report, err = c.ScrubStatus(cCtx.Context)
+						if err != nil {
+							return fmt.Errorf("failed to get scrub status: %w", err)
+						}
+					}
+
+					return printScrubReport(report)
+				},
+			},
+			{
+				Name:  "status",
+				Usage: "Show the progress of the running scrub, or the report of the last scrub",
+				Flags: flags,
+				Action: func(cCtx *cli.Context) error {
+					c, err := newAdminClient(cCtx)
+					if err != nil {
+						return err
+					}
+
+					report, err := c.ScrubStatus(cCtx.Context)
+					if err != nil {
+						return fmt.Errorf("failed to get scrub status: %w", err)
+					}
+
+					if report.State == api.ScrubStateRunning {
+						printScrubProgress(report)
+					}
+
+					return printScrubReport(report)
+				},
+			},
+		},
+	}
+}
+
+func printScrubProgress(report *api.ScrubReport) {
+	fmt.Printf("%s: %d/%d blobs (%s read), %d missing, %d corrupt, %d repaired\n",
+		report.State, report.Scanned, report.Total, units.BytesSize(float64(report.Bytes)),
+		report.Missing, report.Corrupt, report.Repaired)
+}
+
+func printScrubReport(report *api.ScrubReport) error {
+	fmt.Printf("State:    %s\n", report.State)
+	fmt.Printf("Started:  %s\n", report.StartedAt.Local().Format(time.RFC3339))
+	if report.FinishedAt != nil {
+		fmt.Printf("Finished: %s\n", report.FinishedAt.Local().Format(time.RFC3339))
+	}
+	fmt.Printf("Scanned:  %d/%d blobs (%s)\n", report.Scanned, report.Total, units.BytesSize(float64(report.Bytes)))
+	fmt.Printf("Healthy:  %d\n", report.Healthy)
+	fmt.Printf("Skipped:  %d\n", report.Skipped)
+	fmt.Printf("Missing:  %d\n", report.Missing)
+	fmt.Printf("Corrupt:  %d\n", report.Corrupt)
+	fmt.Printf("Errors:   %d\n", report.Errors)
+	fmt.Printf("Repaired: %d\n", report.Repaired)
+	if report.Error != "" {
+		fmt.Printf("Error:    %s\n", report.Error)
+	}
+
+	if len(report.Problems) > 0 {
+		fmt.Println()
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tREPLICA\tPROBLEM\tREPAIRED\tSOURCE\tERROR")
+		for _, problem := range report.Problems {
+			fmt.Fprintf(w, "%s\t%d\t%s\t%t\t%s\t%s\n", problem.ID, problem.Replica,
+				problem.Problem, problem.Repaired, problem.RepairedFrom, problem.Error)
+		}
+
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+
+	if report.State == api.ScrubStateFailed {
+		return fmt.Errorf("scrub failed")
+	}
+
+	return nil
+}
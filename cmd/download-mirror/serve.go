@@ -0,0 +1,623 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/docker/go-units"
+	"github.com/gpu-ninja/download-mirror/internal/accesslog"
+	"github.com/gpu-ninja/download-mirror/internal/admin"
+	"github.com/gpu-ninja/download-mirror/internal/aliases"
+	"github.com/gpu-ninja/download-mirror/internal/auth"
+	"github.com/gpu-ninja/download-mirror/internal/cache"
+	"github.com/gpu-ninja/download-mirror/internal/cas"
+	"github.com/gpu-ninja/download-mirror/internal/goproxy"
+	"github.com/gpu-ninja/download-mirror/internal/health"
+	"github.com/gpu-ninja/download-mirror/internal/listener"
+	"github.com/gpu-ninja/download-mirror/internal/meta"
+	"github.com/gpu-ninja/download-mirror/internal/metrics"
+	"github.com/gpu-ninja/download-mirror/internal/oci"
+	"github.com/gpu-ninja/download-mirror/internal/prefetch"
+	"github.com/gpu-ninja/download-mirror/internal/pullthrough"
+	"github.com/gpu-ninja/download-mirror/internal/quota"
+	"github.com/gpu-ninja/download-mirror/internal/ratelimit"
+	"github.com/gpu-ninja/download-mirror/internal/rekey"
+	"github.com/gpu-ninja/download-mirror/internal/releases"
+	"github.com/gpu-ninja/download-mirror/internal/scrub"
+	"github.com/gpu-ninja/download-mirror/internal/securehash"
+	"github.com/gpu-ninja/download-mirror/internal/tracing"
+	"github.com/gpu-ninja/download-mirror/internal/trustedproxy"
+	"github.com/gpu-ninja/download-mirror/internal/upstream"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/urfave/cli/v2"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	readinessCheckTimeout = 5 * time.Second
+	// Certificates are renewed 30 days before they expire, so if one is about
+	// to expire something has gone wrong.
+	minCertificateValidity = 7 * 24 * time.Hour
+)
+
+// openUpstreams opens the WebDAV upstream and any replicas.
+func openUpstreams(cCtx *cli.Context) (upstream.Upstream, []upstream.Upstream, error) {
+	if cCtx.String("webdav-uri") == "" || cCtx.String("webdav-user") == "" {
+		return nil, nil, fmt.Errorf("WebDAV URI and username are required")
+	}
+
+	webdavPassword := cCtx.String("webdav-password")
+	if cCtx.IsSet("webdav-password-file") {
+		data, err := os.ReadFile(cCtx.String("webdav-password-file"))
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read WebDAV password file: %w", err)
+		}
+
+		webdavPassword = strings.TrimSpace(string(data))
+	}
+
+	if webdavPassword == "" {
+		return nil, nil, fmt.Errorf("WebDAV password is required")
+	}
+
+	webdav, err := upstream.NewWebDAV(cCtx.String("webdav-uri"),
+		cCtx.String("webdav-user"), webdavPassword)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create WebDAV upstream: %w", err)
+	}
+
+	var replicas []upstream.Upstream
+	for _, uri := range cCtx.StringSlice("replica-uri") {
+		replica, err := upstream.Open(uri)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to open replica upstream: %w", err)
+		}
+
+		replicas = append(replicas, replica)
+	}
+
+	return webdav, replicas, nil
+}
+
+// rateLimits parses the rate limits configured by the flags with a prefix.
+func rateLimits(cCtx *cli.Context, prefix string) (ratelimit.Limits, error) {
+	limits := ratelimit.Limits{
+		RequestsPerSecond: cCtx.Float64(prefix + "-requests"),
+		Burst:             cCtx.Int(prefix + "-burst"),
+	}
+
+	if cCtx.IsSet(prefix + "-bytes") {
+		bytesPerSecond, err := units.FromHumanSize(cCtx.String(prefix + "-bytes"))
+		if err != nil {
+			return limits, fmt.Errorf("unable to parse %s bytes: %w", prefix, err)
+		}
+
+		limits.BytesPerSecond = bytesPerSecond
+	}
+
+	return limits, nil
+}
+
+// flagTokens returns the token passed on the command line, it's used verbatim
+// as the <name>:<token> form is only supported in token files.
+func flagTokens(value string) auth.Tokens {
+	if value == "" {
+		return nil
+	}
+
+	return auth.Tokens{{Name: auth.DefaultTokenName, Value: value}}
+}
+
+// serve runs the download mirror server.
+func serve(cCtx *cli.Context, logger *zap.Logger) error {
+	tokens := flagTokens(cCtx.String("token"))
+	if cCtx.IsSet("token-file") {
+		data, err := os.ReadFile(cCtx.String("token-file"))
+		if err != nil {
+			return fmt.Errorf("failed to read token file: %w", err)
+		}
+
+		tokens, err = auth.ParseTokenFile(string(data))
+		if err != nil {
+			return fmt.Errorf("failed to parse token file: %w", err)
+		}
+	}
+
+	if len(tokens) == 0 {
+		return fmt.Errorf("authentication token is required")
+	}
+
+	adminTokens := flagTokens(cCtx.String("admin-token"))
+	if cCtx.IsSet("admin-token-file") {
+		data, err := os.ReadFile(cCtx.String("admin-token-file"))
+		if err != nil {
+			return fmt.Errorf("failed to read admin token file: %w", err)
+		}
+
+		adminTokens, err = auth.ParseTokenFile(string(data))
+		if err != nil {
+			return fmt.Errorf("failed to parse admin token file: %w", err)
+		}
+	}
+
+	accessLogger, accessLogCloser, err := accesslog.New(accesslog.Options{
+		Output:     cCtx.String("access-log"),
+		Format:     cCtx.String("access-log-format"),
+		MaxSizeMB:  cCtx.Int("access-log-max-size"),
+		MaxBackups: cCtx.Int("access-log-max-backups"),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create access logger: %w", err)
+	}
+	defer func() {
+		_ = accessLogger.Sync()
+		_ = accessLogCloser.Close()
+	}()
+
+	keyring, err := loadKeyring(cCtx)
+	if err != nil {
+		return err
+	}
+
+	webdav, replicas, err := openUpstreams(cCtx)
+	if err != nil {
+		return err
+	}
+
+	if cCtx.IsSet("otlp-endpoint") {
+		shutdownTracing, err := tracing.Setup(cCtx.Context, cCtx.String("otlp-endpoint"), cCtx.Bool("otlp-insecure"))
+		if err != nil {
+			return fmt.Errorf("failed to setup tracing: %w", err)
+		}
+		defer func() {
+			// Flush any buffered spans.
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			if err := shutdownTracing(shutdownCtx); err != nil {
+				logger.Warn("Failed to shutdown tracing", zap.Error(err))
+			}
+		}()
+	}
+
+	newHash := keyring.NewHash
+
+	logger.Info("Loaded secure hash keyring", zap.String("primaryKeyId", keyring.Primary().ID),
+		zap.Int("legacyKeys", len(keyring.Keys())-1))
+
+	ups := metrics.InstrumentUpstream(upstream.NewReplicated(logger, newHash, webdav, replicas...))
+
+	plainHTTP := cCtx.Bool("dev") || cCtx.Bool("plain-http")
+
+	// When no public base URL is configured, blob URLs are derived from
+	// the request itself (this also covers development mode).
+	var baseURL string
+	if cCtx.IsSet("public-base-url") {
+		baseURL = strings.TrimSuffix(cCtx.String("public-base-url"), "/") + "/blobs"
+	} else if !plainHTTP {
+		baseURL = fmt.Sprintf("https://%s/blobs", cCtx.String("domain"))
+	}
+
+	trustedProxies, err := trustedproxy.Parse(cCtx.StringSlice("trusted-proxies"))
+	if err != nil {
+		return err
+	}
+
+	cacheMaxBytes, err := units.FromHumanSize(cCtx.String("cache-size"))
+	if err != nil {
+		return fmt.Errorf("unable to parse cache size: %w", err)
+	}
+
+	evictionPolicy, err := cache.ParsePolicy(cCtx.String("cache-eviction-policy"))
+	if err != nil {
+		return err
+	}
+
+	highWatermark := cCtx.Float64("cache-high-watermark")
+	lowWatermark := cCtx.Float64("cache-low-watermark")
+	if highWatermark <= 0 || highWatermark > 1 || lowWatermark <= 0 || lowWatermark > highWatermark {
+		return fmt.Errorf("cache watermarks must satisfy 0 < low <= high <= 1")
+	}
+
+	var freeSpaceFloor int64
+	if cCtx.IsSet("cache-free-space-floor") {
+		freeSpaceFloor, err = units.FromHumanSize(cCtx.String("cache-free-space-floor"))
+		if err != nil {
+			return fmt.Errorf("unable to parse cache free space floor: %w", err)
+		}
+	}
+
+	var memoryMaxBytes int64
+	if cCtx.IsSet("memory-cache-size") {
+		memoryMaxBytes, err = units.FromHumanSize(cCtx.String("memory-cache-size"))
+		if err != nil {
+			return fmt.Errorf("unable to parse memory cache size: %w", err)
+		}
+	}
+
+	memoryMaxBlobSize, err := units.FromHumanSize(cCtx.String("memory-cache-max-blob-size"))
+	if err != nil {
+		return fmt.Errorf("unable to parse memory cache max blob size: %w", err)
+	}
+
+	localCache, err := cache.New(logger, cache.Options{
+		Dir:               cCtx.String("cache"),
+		MaxBytes:          cacheMaxBytes,
+		TrimInterval:      cache.DefaultTrimInterval,
+		Policy:            evictionPolicy,
+		HighWatermark:     highWatermark,
+		LowWatermark:      lowWatermark,
+		MinFreeBytes:      freeSpaceFloor,
+		MemoryMaxBytes:    memoryMaxBytes,
+		MemoryMaxBlobSize: memoryMaxBlobSize,
+		NewHash:           newHash,
+		HashSize:          securehash.Size,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to open local cache: %w", err)
+	}
+
+	metaStore := meta.NewStore(ups)
+
+	if err := rekey.CheckKeyring(cCtx.Context, logger, metaStore, keyring, cCtx.Bool("allow-new-hash-secret")); errors.Is(err, rekey.ErrUnknownPrimaryKey) {
+		return fmt.Errorf("%w, check the secret, run \"download-mirror keys migrate\", or pass --allow-new-hash-secret", err)
+	} else if err != nil {
+		logger.Warn("Failed to check secure hash keyring", zap.Error(err))
+	}
+
+	signer, err := loadSigner(cCtx, logger, metaStore)
+	if err != nil {
+		return err
+	}
+
+	var maxBlobSize int64
+	if cCtx.IsSet("max-blob-size") {
+		maxBlobSize, err = units.FromHumanSize(cCtx.String("max-blob-size"))
+		if err != nil {
+			return fmt.Errorf("unable to parse max blob size: %w", err)
+		}
+	}
+
+	quotaLimits, err := quota.ParseLimits(cCtx.StringSlice("token-quota"))
+	if err != nil {
+		return err
+	}
+
+	quotas := quota.NewQuotas(logger, metaStore, quota.Options{
+		MaxBlobSize: maxBlobSize,
+		Limits:      quotaLimits,
+		Tokens:      tokens,
+	})
+
+	storage := cas.NewStorage(logger, localCache, ups, metaStore, cas.Options{
+		BaseURL:       baseURL,
+		VerifyOnServe: cCtx.Bool("verify-on-serve"),
+		KeyID:         keyring.Primary().ID,
+		LegacyIDs:     cCtx.Bool("legacy-ids"),
+		SHA512:        cCtx.Bool("sha512-digests"),
+		Signer:        signer,
+		Quotas:        quotas,
+	})
+
+	registry, err := oci.NewRegistry(logger, storage, metaStore)
+	if err != nil {
+		return fmt.Errorf("failed to create OCI registry: %w", err)
+	}
+	defer func() {
+		if err := registry.Close(); err != nil {
+			logger.Warn("Failed to close OCI registry", zap.Error(err))
+		}
+	}()
+
+	blobAliases := aliases.NewAliases(logger, storage, metaStore, aliases.Options{
+		ServeDirectly: cCtx.Bool("serve-aliases-directly"),
+	})
+
+	var mirror *pullthrough.Mirror
+	if origins := cCtx.StringSlice("origin"); len(origins) > 0 {
+		mirror, err = pullthrough.NewMirror(logger, storage, metaStore, pullthrough.Options{
+			Origins:      origins,
+			FetchTimeout: cCtx.Duration("origin-fetch-timeout"),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create pull-through mirror: %w", err)
+		}
+	}
+
+	prefetcher := prefetch.NewPrefetcher(logger, storage, cCtx.Int("prefetch-concurrency"))
+
+	scrubRateLimit, err := units.FromHumanSize(cCtx.String("scrub-rate-limit"))
+	if err != nil {
+		return fmt.Errorf("unable to parse scrub rate limit: %w", err)
+	}
+
+	scrubber := scrub.NewScrubber(logger, append([]upstream.Upstream{webdav}, replicas...),
+		localCache, metaStore, newHash, scrub.Options{
+			Interval:       cCtx.Duration("scrub-interval"),
+			BytesPerSecond: scrubRateLimit,
+		})
+
+	minFreeBytes, err := units.FromHumanSize(cCtx.String("min-free-space"))
+	if err != nil {
+		return fmt.Errorf("unable to parse minimum free space: %w", err)
+	}
+
+	clientLimits, err := rateLimits(cCtx, "rate-limit")
+	if err != nil {
+		return err
+	}
+
+	tokenLimits, err := rateLimits(cCtx, "token-rate-limit")
+	if err != nil {
+		return err
+	}
+
+	cacheMissLimits, err := rateLimits(cCtx, "cache-miss-rate-limit")
+	if err != nil {
+		return err
+	}
+
+	var egressBytesPerSecond int64
+	if cCtx.IsSet("egress-rate-limit") {
+		egressBytesPerSecond, err = units.FromHumanSize(cCtx.String("egress-rate-limit"))
+		if err != nil {
+			return fmt.Errorf("unable to parse egress rate limit: %w", err)
+		}
+	}
+
+	limiter := ratelimit.NewLimiter(ratelimit.Options{
+		Client:               clientLimits,
+		Token:                tokenLimits,
+		CacheMiss:            cacheMissLimits,
+		Tokens:               tokens,
+		IPv4Prefix:           cCtx.Int("rate-limit-ipv4-prefix"),
+		IPv6Prefix:           cCtx.Int("rate-limit-ipv6-prefix"),
+		EgressBytesPerSecond: egressBytesPerSecond,
+		Skipper: func(c echo.Context) bool {
+			switch c.Path() {
+			case "/healthz", "/readyz":
+				return true
+			default:
+				return false
+			}
+		},
+	})
+
+	checker := health.NewChecker(logger, readinessCheckTimeout)
+	checker.Add("cache", health.DiskCheck(cCtx.String("cache"), minFreeBytes))
+	checker.Add("upstream", health.UpstreamCheck(ups))
+
+	e := echo.New()
+	e.IPExtractor = trustedProxies.IPExtractor()
+	e.Pre(trustedProxies.Middleware())
+	e.Use(middleware.Recover())
+	e.Use(accesslog.Middleware(accessLogger))
+	e.Use(metrics.Middleware())
+	e.Use(tracing.Middleware())
+	e.Use(limiter.Middleware())
+
+	e.GET("/healthz", checker.Liveness)
+	e.GET("/readyz", checker.Readiness)
+	e.GET("/blobs/:id/:name", storage.Get)
+	e.GET("/sha256/:digest", storage.GetByDigest)
+	e.GET("/sha512/:digest", storage.GetByDigest)
+	e.GET("/blobs/:file", signer.GetBlobSignature)
+	e.PUT("/blobs/:file", signer.PutBlobSignature(storage), tokens.Middleware())
+	e.POST("/blob", storage.Put, tokens.Middleware())
+	e.GET("/blob/:id", storage.Stat)
+	e.GET("/quota", quotas.Get, tokens.Middleware())
+	e.GET("/dl/*", blobAliases.Download)
+	blobAliases.Register(e.Group("/aliases", tokens.Middleware()))
+	releases.NewReleases(logger, storage, metaStore, signer).Register(e.Group("/releases"), tokens.Middleware())
+
+	registry.Register(e.Group("/v2"), tokens.BasicMiddleware("download-mirror"))
+	goproxy.NewProxy(logger, storage, metaStore).Register(e.Group("/goproxy"), tokens.Middleware())
+
+	if mirror != nil {
+		e.GET("/mirror/*", mirror.Get)
+	}
+
+	if len(adminTokens) > 0 {
+		adminGroup := e.Group("/admin", adminTokens.Middleware())
+		admin.NewAdmin(logger, localCache, metaStore, prefetcher, scrubber).Register(adminGroup)
+		adminGroup.GET("/quotas", quotas.List)
+	}
+
+	var servers []*http.Server
+	g, ctx := errgroup.WithContext(cCtx.Context)
+
+	if cCtx.IsSet("metrics-listen") {
+		lis, err := listener.Listen(cCtx.String("metrics-listen"))
+		if err != nil {
+			return fmt.Errorf("failed to listen: %w", err)
+		}
+
+		e := echo.New()
+		e.Use(middleware.Recover())
+		e.GET("/metrics", metrics.Handler())
+
+		s := &http.Server{
+			Handler: e,
+		}
+		servers = append(servers, s)
+
+		logger.Info("Serving metrics", zap.Stringer("addr", lis.Addr()))
+
+		g.Go(func() error {
+			if err := s.Serve(lis); err != http.ErrServerClosed {
+				return fmt.Errorf("failed to start metrics server: %w", err)
+			}
+
+			return nil
+		})
+	} else if len(adminTokens) > 0 {
+		// The main listener is public, so metrics require an admin token.
+		e.GET("/metrics", metrics.Handler(), adminTokens.Middleware())
+	} else {
+		logger.Info("Metrics are disabled, as neither a metrics listener nor an admin token is configured")
+	}
+
+	if plainHTTP {
+		lis, err := listener.Listen(cCtx.String("listen"))
+		if err != nil {
+			return fmt.Errorf("failed to listen: %w", err)
+		}
+
+		s := &http.Server{
+			Handler: e,
+		}
+		servers = append(servers, s)
+
+		logger.Info("Listening for connections", zap.Stringer("addr", lis.Addr()))
+
+		g.Go(func() error {
+			if err := s.Serve(lis); err != http.ErrServerClosed {
+				return fmt.Errorf("failed to start server: %w", err)
+			}
+
+			return nil
+		})
+	} else {
+		if !cCtx.IsSet("email") {
+			return fmt.Errorf("email address is required when not in plain HTTP mode")
+		}
+
+		autoTLSManager := autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache("/var/www/.cache"),
+			HostPolicy: autocert.HostWhitelist(cCtx.String("domain")),
+			Email:      cCtx.String("email"),
+		}
+
+		checker.Add("certificate", health.CertificateCheck(autoTLSManager.Cache,
+			cCtx.String("domain"), minCertificateValidity))
+
+		acmeLis, err := listener.Listen(cCtx.String("listen"))
+		if err != nil {
+			return fmt.Errorf("failed to listen: %w", err)
+		}
+
+		lis, err := listener.Listen(cCtx.String("tls-listen"))
+		if err != nil {
+			return fmt.Errorf("failed to listen: %w", err)
+		}
+
+		{
+			e := echo.New()
+			e.IPExtractor = trustedProxies.IPExtractor()
+			e.Pre(trustedProxies.Middleware())
+			e.Use(middleware.Recover())
+			e.Pre(middleware.HTTPSRedirect())
+
+			// Serve the ACME challenge over HTTP.
+			s := &http.Server{
+				Handler: autoTLSManager.HTTPHandler(e),
+			}
+			servers = append(servers, s)
+
+			g.Go(func() error {
+				if err := s.Serve(acmeLis); err != http.ErrServerClosed {
+					return fmt.Errorf("failed to start ACME server: %w", err)
+				}
+
+				return nil
+			})
+		}
+
+		s := &http.Server{
+			Handler: e,
+			TLSConfig: &tls.Config{
+				ServerName:     cCtx.String("domain"),
+				GetCertificate: autoTLSManager.GetCertificate,
+				NextProtos:     []string{acme.ALPNProto},
+			},
+		}
+		servers = append(servers, s)
+
+		logger.Info("Listening for connections", zap.Stringer("addr", lis.Addr()))
+
+		g.Go(func() error {
+			if err := s.ServeTLS(lis, "", ""); err != http.ErrServerClosed {
+				return fmt.Errorf("failed to start server: %w", err)
+			}
+
+			return nil
+		})
+	}
+
+	g.Go(func() error {
+		<-ctx.Done()
+
+		logger.Info("Shutting down, waiting for in-flight transfers to complete",
+			zap.Duration("timeout", cCtx.Duration("shutdown-timeout")))
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), cCtx.Duration("shutdown-timeout"))
+		defer cancel()
+
+		// Stop accepting new connections and drain the existing ones.
+		var shutdownErrs []error
+		for _, s := range servers {
+			if err := s.Shutdown(shutdownCtx); err != nil {
+				shutdownErrs = append(shutdownErrs, err)
+
+				// Forcibly close any connections that didn't drain in time.
+				_ = s.Close()
+			}
+		}
+
+		if err := errors.Join(shutdownErrs...); err != nil {
+			logger.Warn("Timed out waiting for in-flight transfers", zap.Error(err))
+		}
+
+		return nil
+	})
+
+	serveErr := g.Wait()
+
+	if err := prefetcher.Close(); err != nil {
+		logger.Error("Failed to stop prefetcher", zap.Error(err))
+	}
+
+	if err := scrubber.Close(); err != nil {
+		logger.Error("Failed to stop scrubber", zap.Error(err))
+	}
+
+	if err := localCache.Close(); err != nil {
+		logger.Error("Failed to close local cache", zap.Error(err))
+	}
+
+	if serveErr != nil {
+		return serveErr
+	}
+
+	logger.Info("Shutdown complete")
+
+	return nil
+}
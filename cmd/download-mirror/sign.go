@@ -0,0 +1,320 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"aead.dev/minisign"
+	"github.com/gpu-ninja/download-mirror/internal/meta"
+	"github.com/gpu-ninja/download-mirror/internal/releases"
+	"github.com/gpu-ninja/download-mirror/internal/signatures"
+	"github.com/urfave/cli/v2"
+	"go.uber.org/zap"
+)
+
+// loadSigner loads the server's signing key and the trusted public keys.
+func loadSigner(cCtx *cli.Context, logger *zap.Logger, metadata *meta.Store) (*signatures.Signer, error) {
+	var key *minisign.PrivateKey
+	if cCtx.IsSet("signing-key-file") {
+		privateKey, err := loadPrivateKey(cCtx.String("signing-key-file"), cCtx.String("signing-key-password-file"))
+		if err != nil {
+			return nil, err
+		}
+
+		logger.Info("Loaded signing key", zap.String("keyId", signatures.KeyID(privateKey.ID())))
+
+		key = &privateKey
+	}
+
+	var trusted []minisign.PublicKey
+	for _, path := range cCtx.StringSlice("trusted-public-key-file") {
+		publicKey, err := loadPublicKey(path)
+		if err != nil {
+			return nil, err
+		}
+
+		logger.Info("Loaded trusted public key", zap.String("keyId", signatures.KeyID(publicKey.ID())))
+
+		trusted = append(trusted, publicKey)
+	}
+
+	return signatures.NewSigner(logger, metadata, key, trusted), nil
+}
+
+// loadPrivateKey loads and decrypts a minisign secret key, the password is
+// read from passwordPath (if it's empty, the password is empty).
+func loadPrivateKey(path, passwordPath string) (minisign.PrivateKey, error) {
+	password, err := readPassword(passwordPath)
+	if err != nil {
+		return minisign.PrivateKey{}, err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return minisign.PrivateKey{}, fmt.Errorf("failed to read secret key file: %w", err)
+	}
+
+	key, err := minisign.DecryptKey(password, data)
+	if err != nil {
+		return minisign.PrivateKey{}, fmt.Errorf("failed to decrypt secret key file %q: %w", path, err)
+	}
+
+	return key, nil
+}
+
+func loadPublicKey(path string) (minisign.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return minisign.PublicKey{}, fmt.Errorf("failed to read public key file: %w", err)
+	}
+
+	var key minisign.PublicKey
+	if err := key.UnmarshalText(data); err != nil {
+		return minisign.PublicKey{}, fmt.Errorf("failed to parse public key file %q: %w", path, err)
+	}
+
+	return key, nil
+}
+
+func readPassword(path string) (string, error) {
+	if path == "" {
+		return "", nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read password file: %w", err)
+	}
+
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+func signCommand() *cli.Command {
+	keyFlag := &cli.StringFlag{
+		Name:     "key",
+		Usage:    "File containing the minisign secret key to sign with",
+		EnvVars:  []string{"DOWNLOAD_MIRROR_SIGNING_KEY_FILE"},
+		Required: true,
+	}
+
+	passwordFlag := &cli.StringFlag{
+		Name:    "password-file",
+		Usage:   "File containing the password of the secret key, if unset the password is empty",
+		EnvVars: []string{"DOWNLOAD_MIRROR_SIGNING_KEY_PASSWORD_FILE"},
+	}
+
+	return &cli.Command{
+		Name:  "sign",
+		Usage: "Generate signing keys and sign blobs, releases and files offline",
+		Subcommands: []*cli.Command{
+			{
+				Name:  "keygen",
+				Usage: "Generate a minisign compatible key pair",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "output",
+						Usage: "Path to write the secret key to, the public key is written alongside it with a .pub extension",
+						Value: "download-mirror.key",
+					},
+					passwordFlag,
+				},
+				Action: func(cCtx *cli.Context) error {
+					password, err := readPassword(cCtx.String("password-file"))
+					if err != nil {
+						return err
+					}
+
+					public, key, err := minisign.GenerateKey(rand.Reader)
+					if err != nil {
+						return fmt.Errorf("failed to generate key: %w", err)
+					}
+
+					secretKey, err := minisign.EncryptKey(password, key)
+					if err != nil {
+						return fmt.Errorf("failed to encrypt key: %w", err)
+					}
+
+					publicKey, err := public.MarshalText()
+					if err != nil {
+						return err
+					}
+
+					path := cCtx.String("output")
+					if err := writeNewFile(path, secretKey, 0o600); err != nil {
+						return err
+					}
+
+					if err := writeNewFile(path+".pub", publicKey, 0o644); err != nil {
+						return err
+					}
+
+					fmt.Printf("Generated key %s, the public key is in %s\n", signatures.KeyID(key.ID()), path+".pub")
+
+					return nil
+				},
+			},
+			{
+				Name:      "file",
+				Usage:     "Sign local files, the signatures are written to <file>.minisig",
+				ArgsUsage: "<file>...",
+				Flags:     []cli.Flag{keyFlag, passwordFlag},
+				Action: func(cCtx *cli.Context) error {
+					if cCtx.NArg() == 0 {
+						return fmt.Errorf("expected at least one file")
+					}
+
+					key, err := loadPrivateKey(cCtx.String("key"), cCtx.String("password-file"))
+					if err != nil {
+						return err
+					}
+
+					for _, path := range cCtx.Args().Slice() {
+						sig, err := signFile(key, path)
+						if err != nil {
+							return err
+						}
+
+						if err := os.WriteFile(path+signatures.Extension, sig, 0o644); err != nil {
+							return fmt.Errorf("failed to write signature: %w", err)
+						}
+					}
+
+					return nil
+				},
+			},
+			{
+				Name:      "blob",
+				Usage:     "Sign blobs on a running mirror, and upload the signatures",
+				ArgsUsage: "<id>...",
+				Flags:     append([]cli.Flag{keyFlag, passwordFlag}, uploadFlags()...),
+				Action: func(cCtx *cli.Context) error {
+					if cCtx.NArg() == 0 {
+						return fmt.Errorf("expected at least one blob id")
+					}
+
+					key, err := loadPrivateKey(cCtx.String("key"), cCtx.String("password-file"))
+					if err != nil {
+						return err
+					}
+
+					c, err := newUploadClient(cCtx)
+					if err != nil {
+						return err
+					}
+
+					for _, id := range cCtx.Args().Slice() {
+						body, err := c.OpenBlob(cCtx.Context, id)
+						if err != nil {
+							return fmt.Errorf("failed to download blob %s: %w", id, err)
+						}
+
+						sig, err := signatures.SignReader(key, body, id)
+						_ = body.Close()
+						if err != nil {
+							return fmt.Errorf("failed to sign blob %s: %w", id, err)
+						}
+
+						if err := c.PutBlobSignature(cCtx.Context, id, sig); err != nil {
+							return fmt.Errorf("failed to upload signature of blob %s: %w", id, err)
+						}
+					}
+
+					return nil
+				},
+			},
+			{
+				Name:      "release",
+				Usage:     "Sign the manifest and checksums of a release on a running mirror",
+				ArgsUsage: "<product> <version>",
+				Flags:     append([]cli.Flag{keyFlag, passwordFlag}, uploadFlags()...),
+				Action: func(cCtx *cli.Context) error {
+					if cCtx.NArg() != 2 {
+						return fmt.Errorf("expected a product and a version")
+					}
+
+					key, err := loadPrivateKey(cCtx.String("key"), cCtx.String("password-file"))
+					if err != nil {
+						return err
+					}
+
+					c, err := newUploadClient(cCtx)
+					if err != nil {
+						return err
+					}
+
+					product, version := cCtx.Args().Get(0), cCtx.Args().Get(1)
+					for _, name := range []string{releases.ManifestFile, releases.ChecksumsFile} {
+						body, err := c.OpenReleaseFile(cCtx.Context, product, version, name)
+						if err != nil {
+							return fmt.Errorf("failed to download %s: %w", name, err)
+						}
+
+						sig, err := signatures.SignReader(key, body, product+"/"+version+"/"+name)
+						_ = body.Close()
+						if err != nil {
+							return fmt.Errorf("failed to sign %s: %w", name, err)
+						}
+
+						if err := c.PutReleaseSignature(cCtx.Context, product, version, name, sig); err != nil {
+							return fmt.Errorf("failed to upload signature of %s: %w", name, err)
+						}
+					}
+
+					return nil
+				},
+			},
+		},
+	}
+}
+
+func signFile(key minisign.PrivateKey, path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer f.Close()
+
+	sig, err := signatures.SignReader(key, f, path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign %s: %w", path, err)
+	}
+
+	return sig, nil
+}
+
+// writeNewFile writes a file, refusing to overwrite an existing one.
+func writeNewFile(path string, data []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if errors.Is(err, os.ErrExist) {
+		return fmt.Errorf("refusing to overwrite %s", path)
+	} else if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	return f.Close()
+}
@@ -0,0 +1,356 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/go-units"
+	"github.com/gpu-ninja/download-mirror/internal/meta"
+	"github.com/gpu-ninja/download-mirror/pkg/api"
+	"github.com/gpu-ninja/download-mirror/pkg/client"
+	"github.com/urfave/cli/v2"
+)
+
+func uploadCommand() *cli.Command {
+	return &cli.Command{
+		Name:      "upload",
+		Usage:     "Upload files and directories to a running mirror, and print the URLs of the blobs",
+		ArgsUsage: "<file or directory>...",
+		Flags: append([]cli.Flag{
+			&cli.StringSliceFlag{
+				Name:  "label",
+				Usage: "Label to attach to the uploaded blobs (key=value)",
+			},
+			&cli.StringFlag{
+				Name:  "manifest",
+				Usage: "Write a JSON manifest of the uploaded blobs to this file ('-' for stdout)",
+			},
+		}, uploadFlags()...),
+		Action: func(cCtx *cli.Context) error {
+			if cCtx.NArg() == 0 {
+				return fmt.Errorf("expected at least one file or directory")
+			}
+
+			labels, err := meta.ParseLabels(cCtx.StringSlice("label"))
+			if err != nil {
+				return err
+			}
+
+			c, err := newUploadClient(cCtx)
+			if err != nil {
+				return err
+			}
+
+			var manifest client.Manifest
+			for _, path := range cCtx.Args().Slice() {
+				fi, err := os.Stat(path)
+				if err != nil {
+					return err
+				}
+
+				if fi.IsDir() {
+					dirManifest, err := c.UploadDir(cCtx.Context, path, client.UploadDirOptions{
+						Labels:   labels,
+						Progress: newProgressBar,
+					})
+					if err != nil {
+						return err
+					}
+
+					manifest.Files = append(manifest.Files, dirManifest.Files...)
+					continue
+				}
+
+				blob, err := c.UploadFile(cCtx.Context, path, client.UploadOptions{
+					Labels:   labels,
+					Progress: newProgressBar(filepath.Base(path)),
+				})
+				if err != nil {
+					return fmt.Errorf("failed to upload %s: %w", path, err)
+				}
+
+				manifest.Files = append(manifest.Files, client.ManifestFile{
+					Path:   filepath.Base(path),
+					ID:     blob.ID,
+					URL:    blob.URL,
+					Size:   blob.Size,
+					SHA256: blob.SHA256,
+				})
+			}
+
+			switch output := cCtx.String("manifest"); output {
+			case "-":
+				return writeManifest(os.Stdout, &manifest)
+			case "":
+			default:
+				f, err := os.Create(output)
+				if err != nil {
+					return fmt.Errorf("failed to create manifest: %w", err)
+				}
+				defer f.Close()
+
+				if err := writeManifest(f, &manifest); err != nil {
+					return err
+				}
+
+				if err := f.Close(); err != nil {
+					return err
+				}
+			}
+
+			for _, f := range manifest.Files {
+				fmt.Println(f.URL)
+			}
+
+			return nil
+		},
+	}
+}
+
+func downloadCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "download",
+		Usage: "Download blobs from a running mirror, verifying their checksums",
+		Description: "Blobs are downloaded in ranges, in parallel. Interrupted downloads are resumed " +
+			"when the same download is attempted again.",
+		ArgsUsage: "<id or URL>...",
+		Flags: append([]cli.Flag{
+			&cli.StringFlag{
+				Name:    "output",
+				Aliases: []string{"o"},
+				Usage:   "Path to write the blob to (only when downloading a single blob)",
+			},
+			&cli.StringFlag{
+				Name:  "dir",
+				Usage: "Directory to download blobs to, they are named after the name they were uploaded with",
+				Value: ".",
+			},
+			&cli.StringFlag{
+				Name:  "manifest",
+				Usage: "Download every file in a manifest written by upload, to its path under --dir",
+			},
+			&cli.IntFlag{
+				Name:  "concurrency",
+				Usage: "Number of ranges of a blob to download in parallel",
+				Value: client.DefaultDownloadConcurrency,
+			},
+			&cli.StringFlag{
+				Name:  "chunk-size",
+				Usage: "Size of each downloaded range",
+				Value: units.BytesSize(client.DefaultChunkSize),
+			},
+		}, readFlags()...),
+		Action: func(cCtx *cli.Context) error {
+			if cCtx.NArg() == 0 && !cCtx.IsSet("manifest") {
+				return fmt.Errorf("expected at least one blob id or URL, or a manifest")
+			} else if cCtx.IsSet("output") && (cCtx.NArg() != 1 || cCtx.IsSet("manifest")) {
+				return fmt.Errorf("--output can only be used when downloading a single blob")
+			}
+
+			chunkSize, err := units.RAMInBytes(cCtx.String("chunk-size"))
+			if err != nil {
+				return fmt.Errorf("unable to parse chunk size: %w", err)
+			}
+
+			c, err := newReadClient(cCtx)
+			if err != nil {
+				return err
+			}
+
+			download := func(id, path, expectedSHA256 string) error {
+				blob, err := c.DownloadBlob(cCtx.Context, id, path, client.DownloadOptions{
+					Concurrency: cCtx.Int("concurrency"),
+					ChunkSize:   chunkSize,
+					Progress:    newProgressBar(filepath.Base(path)),
+				})
+				if err != nil {
+					return fmt.Errorf("failed to download %s: %w", id, err)
+				}
+
+				if expectedSHA256 != "" && blob.SHA256 != expectedSHA256 {
+					return fmt.Errorf("%s: checksum does not match the manifest", path)
+				}
+
+				return nil
+			}
+
+			dir := cCtx.String("dir")
+
+			if cCtx.IsSet("manifest") {
+				manifest, err := readManifest(cCtx.String("manifest"))
+				if err != nil {
+					return err
+				}
+
+				for _, f := range manifest.Files {
+					if !filepath.IsLocal(filepath.FromSlash(f.Path)) {
+						return fmt.Errorf("refusing to download to %q, it is outside of the directory", f.Path)
+					}
+
+					path := filepath.Join(dir, filepath.FromSlash(f.Path))
+					if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+						return err
+					}
+
+					if err := download(f.ID, path, f.SHA256); err != nil {
+						return err
+					}
+				}
+			}
+
+			for _, ref := range cCtx.Args().Slice() {
+				id := blobID(ref)
+
+				path := cCtx.String("output")
+				if path == "" {
+					blob, err := c.StatBlob(cCtx.Context, id)
+					if err != nil {
+						return fmt.Errorf("failed to get blob %s: %w", id, err)
+					}
+
+					name := filepath.Base(blob.Name)
+					if name == "." || name == "/" || name == ".." {
+						name = blob.ID
+					}
+
+					path = filepath.Join(dir, name)
+				}
+
+				if err := download(id, path, ""); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		},
+	}
+}
+
+func statCommand() *cli.Command {
+	return &cli.Command{
+		Name:      "stat",
+		Usage:     "Show the metadata of blobs on a running mirror",
+		ArgsUsage: "<id or URL>...",
+		Flags: append([]cli.Flag{
+			&cli.BoolFlag{
+				Name:  "json",
+				Usage: "Print the metadata as JSON",
+			},
+		}, readFlags()...),
+		Action: func(cCtx *cli.Context) error {
+			if cCtx.NArg() == 0 {
+				return fmt.Errorf("expected at least one blob id or URL")
+			}
+
+			c, err := newReadClient(cCtx)
+			if err != nil {
+				return err
+			}
+
+			for i, ref := range cCtx.Args().Slice() {
+				blob, err := c.StatBlob(cCtx.Context, blobID(ref))
+				if err != nil {
+					return fmt.Errorf("failed to get blob %s: %w", ref, err)
+				}
+
+				if cCtx.Bool("json") {
+					enc := json.NewEncoder(os.Stdout)
+					enc.SetIndent("", "  ")
+					if err := enc.Encode(blob); err != nil {
+						return err
+					}
+
+					continue
+				}
+
+				if i > 0 {
+					fmt.Println()
+				}
+
+				printBlob(blob)
+			}
+
+			return nil
+		},
+	}
+}
+
+func printBlob(blob *api.Blob) {
+	fmt.Printf("ID:      %s\n", blob.ID)
+	fmt.Printf("Name:    %s\n", blob.Name)
+	fmt.Printf("Size:    %s (%d bytes)\n", units.BytesSize(float64(blob.Size)), blob.Size)
+	if blob.SHA256 != "" {
+		fmt.Printf("SHA256:  %s\n", blob.SHA256)
+	}
+	if blob.SHA512 != "" {
+		fmt.Printf("SHA512:  %s\n", blob.SHA512)
+	}
+	if len(blob.Labels) > 0 {
+		var labels []string
+		for key, value := range blob.Labels {
+			labels = append(labels, key+"="+value)
+		}
+		sort.Strings(labels)
+
+		fmt.Printf("Labels:  %s\n", strings.Join(labels, ","))
+	}
+	fmt.Printf("Created: %s\n", blob.CreatedAt.Local().Format(time.RFC3339))
+	fmt.Printf("URL:     %s\n", blob.URL)
+}
+
+// blobID returns the id of a blob, given either its id or its URL.
+func blobID(ref string) string {
+	if _, after, ok := strings.Cut(ref, "/blobs/"); ok {
+		id, _, _ := strings.Cut(after, "/")
+		return id
+	}
+
+	return ref
+}
+
+func readManifest(path string) (*client.Manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+
+	var manifest client.Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest: %w", err)
+	}
+
+	return &manifest, nil
+}
+
+func writeManifest(f *os.File, manifest *client.Manifest) error {
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+
+	if err := enc.Encode(manifest); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+
+	return nil
+}
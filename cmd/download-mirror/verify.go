@@ -0,0 +1,317 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"aead.dev/minisign"
+	"github.com/gpu-ninja/download-mirror/internal/releases"
+	"github.com/gpu-ninja/download-mirror/internal/signatures"
+	"github.com/urfave/cli/v2"
+)
+
+func verifyCommand() *cli.Command {
+	publicKeyFlag := &cli.StringFlag{
+		Name:     "public-key",
+		Usage:    "File containing the minisign public key signatures must be made by",
+		EnvVars:  []string{"DOWNLOAD_MIRROR_PUBLIC_KEY_FILE"},
+		Required: true,
+	}
+
+	return &cli.Command{
+		Name:  "verify",
+		Usage: "Verify the checksums and signatures of blobs, releases and files",
+		Subcommands: []*cli.Command{
+			{
+				Name:      "file",
+				Usage:     "Verify the signature of a local file",
+				ArgsUsage: "<file>",
+				Flags: []cli.Flag{
+					publicKeyFlag,
+					&cli.StringFlag{
+						Name:  "signature",
+						Usage: "Signature file, defaults to <file>.minisig",
+					},
+				},
+				Action: func(cCtx *cli.Context) error {
+					if cCtx.NArg() != 1 {
+						return fmt.Errorf("expected a file")
+					}
+
+					key, err := loadPublicKey(cCtx.String("public-key"))
+					if err != nil {
+						return err
+					}
+
+					path := cCtx.Args().First()
+					sigPath := path + signatures.Extension
+					if cCtx.IsSet("signature") {
+						sigPath = cCtx.String("signature")
+					}
+
+					sig, err := os.ReadFile(sigPath)
+					if err != nil {
+						return fmt.Errorf("failed to read signature: %w", err)
+					}
+
+					f, err := os.Open(path)
+					if err != nil {
+						return fmt.Errorf("failed to open file: %w", err)
+					}
+					defer f.Close()
+
+					return verifySignature(key, path, f, sig)
+				},
+			},
+			{
+				Name:      "checksum",
+				Usage:     "Check that a local file matches the checksum of a blob on a running mirror",
+				ArgsUsage: "<file> <id or URL>",
+				Flags:     readFlags(),
+				Action: func(cCtx *cli.Context) error {
+					if cCtx.NArg() != 2 {
+						return fmt.Errorf("expected a file and a blob id or URL")
+					}
+
+					c, err := newReadClient(cCtx)
+					if err != nil {
+						return err
+					}
+
+					blob, err := c.StatBlob(cCtx.Context, blobID(cCtx.Args().Get(1)))
+					if err != nil {
+						return fmt.Errorf("failed to get blob: %w", err)
+					} else if blob.SHA256 == "" {
+						return fmt.Errorf("blob %s has no recorded sha256 digest", blob.ID)
+					}
+
+					return verifyChecksum(cCtx.Args().Get(0), blob.SHA256)
+				},
+			},
+			{
+				Name:      "manifest",
+				Usage:     "Check local files against the checksums in a manifest written by upload",
+				ArgsUsage: "<manifest>",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "dir",
+						Usage: "Directory the paths in the manifest are relative to",
+						Value: ".",
+					},
+				},
+				Action: func(cCtx *cli.Context) error {
+					if cCtx.NArg() != 1 {
+						return fmt.Errorf("expected a manifest")
+					}
+
+					manifest, err := readManifest(cCtx.Args().First())
+					if err != nil {
+						return err
+					}
+
+					var failed int
+					for _, f := range manifest.Files {
+						if err := verifyChecksum(filepath.Join(cCtx.String("dir"), filepath.FromSlash(f.Path)), f.SHA256); err != nil {
+							fmt.Println(err)
+							failed++
+						}
+					}
+
+					if failed > 0 {
+						return fmt.Errorf("%d of %d files failed verification", failed, len(manifest.Files))
+					}
+
+					return nil
+				},
+			},
+			{
+				Name:      "blob",
+				Usage:     "Download blobs from a running mirror and verify their signatures",
+				ArgsUsage: "<id>...",
+				Flags:     append([]cli.Flag{publicKeyFlag}, readFlags()...),
+				Action: func(cCtx *cli.Context) error {
+					if cCtx.NArg() == 0 {
+						return fmt.Errorf("expected at least one blob id")
+					}
+
+					key, err := loadPublicKey(cCtx.String("public-key"))
+					if err != nil {
+						return err
+					}
+
+					c, err := newReadClient(cCtx)
+					if err != nil {
+						return err
+					}
+
+					for _, id := range cCtx.Args().Slice() {
+						sig, err := c.GetBlobSignature(cCtx.Context, id)
+						if err != nil {
+							return fmt.Errorf("failed to get signature of blob %s: %w", id, err)
+						}
+
+						body, err := c.OpenBlob(cCtx.Context, id)
+						if err != nil {
+							return fmt.Errorf("failed to download blob %s: %w", id, err)
+						}
+
+						err = verifySignature(key, id, body, sig)
+						_ = body.Close()
+						if err != nil {
+							return err
+						}
+					}
+
+					return nil
+				},
+			},
+			{
+				Name:      "release",
+				Usage:     "Verify the signed manifest and checksums of a release on a running mirror",
+				ArgsUsage: "<product> <version or channel>",
+				Flags: append([]cli.Flag{
+					publicKeyFlag,
+					&cli.BoolFlag{
+						Name:  "files",
+						Usage: "Also download every file of the release, and check it against the signed checksums",
+					},
+				}, readFlags()...),
+				Action: func(cCtx *cli.Context) error {
+					if cCtx.NArg() != 2 {
+						return fmt.Errorf("expected a product and a version")
+					}
+
+					key, err := loadPublicKey(cCtx.String("public-key"))
+					if err != nil {
+						return err
+					}
+
+					c, err := newReadClient(cCtx)
+					if err != nil {
+						return err
+					}
+
+					product, version := cCtx.Args().Get(0), cCtx.Args().Get(1)
+
+					var checksums []byte
+					for _, name := range []string{releases.ManifestFile, releases.ChecksumsFile} {
+						sig, err := c.GetReleaseSignature(cCtx.Context, product, version, name)
+						if err != nil {
+							return fmt.Errorf("failed to get signature of %s: %w", name, err)
+						}
+
+						body, err := c.OpenReleaseFile(cCtx.Context, product, version, name)
+						if err != nil {
+							return fmt.Errorf("failed to download %s: %w", name, err)
+						}
+
+						content, err := io.ReadAll(body)
+						_ = body.Close()
+						if err != nil {
+							return fmt.Errorf("failed to download %s: %w", name, err)
+						}
+
+						if err := verifySignature(key, name, bytes.NewReader(content), sig); err != nil {
+							return err
+						}
+
+						if name == releases.ChecksumsFile {
+							checksums = content
+						}
+					}
+
+					if !cCtx.Bool("files") {
+						return nil
+					}
+
+					scanner := bufio.NewScanner(bytes.NewReader(checksums))
+					for scanner.Scan() {
+						expected, name, ok := strings.Cut(scanner.Text(), "  ")
+						if !ok {
+							return fmt.Errorf("malformed checksums file")
+						}
+
+						body, err := c.OpenReleaseFile(cCtx.Context, product, version, name)
+						if err != nil {
+							return fmt.Errorf("failed to download %s: %w", name, err)
+						}
+
+						h := sha256.New()
+						_, err = io.Copy(h, body)
+						_ = body.Close()
+						if err != nil {
+							return fmt.Errorf("failed to download %s: %w", name, err)
+						}
+
+						if actual := hex.EncodeToString(h.Sum(nil)); actual != expected {
+							return fmt.Errorf("%s: checksum mismatch, expected %s but got %s", name, expected, actual)
+						}
+
+						fmt.Printf("%s: checksum OK\n", name)
+					}
+
+					return scanner.Err()
+				},
+			},
+		},
+	}
+}
+
+// verifySignature verifies a minisign signature over the content of r, and
+// prints the trusted comment.
+func verifySignature(key minisign.PublicKey, name string, r io.Reader, data []byte) error {
+	sig, err := signatures.Verify(key, r, data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+
+	fmt.Printf("%s: signature OK (key %s, trusted comment: %s)\n", name, signatures.KeyID(sig.KeyID), sig.TrustedComment)
+
+	return nil
+}
+
+// verifyChecksum checks a local file against an expected SHA-256 digest.
+func verifyChecksum(path, expected string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	if actual := hex.EncodeToString(h.Sum(nil)); actual != expected {
+		return fmt.Errorf("%s: checksum mismatch, expected %s but got %s", path, expected, actual)
+	}
+
+	fmt.Printf("%s: checksum OK\n", path)
+
+	return nil
+}
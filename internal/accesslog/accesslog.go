@@ -0,0 +1,169 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package accesslog
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gpu-ninja/download-mirror/internal/auth"
+	zaplogfmt "github.com/jsternberg/zap-logfmt"
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+const (
+	cacheStatusKey      = "accesslog.cacheStatus"
+	upstreamDurationKey = "accesslog.upstreamDuration"
+)
+
+// Options configures the access log.
+type Options struct {
+	// Output is one of "stdout", "stderr", "syslog", "syslog://<host>:<port>"
+	// or the path to a file.
+	Output string
+	// Format is either "logfmt" or "json".
+	Format string
+	// MaxSizeMB is the maximum size of a log file before it is rotated.
+	MaxSizeMB int
+	// MaxBackups is the maximum number of rotated log files to retain.
+	MaxBackups int
+}
+
+// New creates a new access logger.
+func New(opts Options) (*zap.Logger, io.Closer, error) {
+	config := zap.NewProductionEncoderConfig()
+	config.TimeKey = "time"
+	config.EncodeTime = zapcore.RFC3339NanoTimeEncoder
+	config.MessageKey = ""
+	config.LevelKey = ""
+	config.CallerKey = ""
+	config.StacktraceKey = ""
+
+	var encoder zapcore.Encoder
+	switch opts.Format {
+	case "", "logfmt":
+		encoder = zaplogfmt.NewEncoder(config)
+	case "json":
+		encoder = zapcore.NewJSONEncoder(config)
+	default:
+		return nil, nil, fmt.Errorf("unsupported access log format: %q", opts.Format)
+	}
+
+	var w io.WriteCloser
+	switch {
+	case opts.Output == "" || opts.Output == "stdout":
+		w = nopCloser{os.Stdout}
+	case opts.Output == "stderr":
+		w = nopCloser{os.Stderr}
+	case opts.Output == "syslog" || strings.HasPrefix(opts.Output, "syslog://"):
+		var err error
+		w, err = newSyslogWriter(strings.TrimPrefix(strings.TrimPrefix(opts.Output, "syslog"), "://"))
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to connect to syslog: %w", err)
+		}
+	default:
+		w = &lumberjack.Logger{
+			Filename:   opts.Output,
+			MaxSize:    opts.MaxSizeMB,
+			MaxBackups: opts.MaxBackups,
+			Compress:   true,
+		}
+	}
+
+	logger := zap.New(zapcore.NewCore(encoder, zapcore.AddSync(w), zapcore.InfoLevel))
+
+	return logger, w, nil
+}
+
+// Middleware returns an echo middleware that writes a structured access log
+// entry for every request.
+func Middleware(logger *zap.Logger) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			start := time.Now()
+
+			err := next(c)
+			if err != nil {
+				// Commit the error response so that the status and size are known.
+				c.Error(err)
+			}
+
+			req := c.Request()
+			res := c.Response()
+
+			fields := []zap.Field{
+				zap.String("method", req.Method),
+				zap.String("uri", req.RequestURI),
+				zap.String("route", c.Path()),
+				zap.Int("status", res.Status),
+				zap.String("remote_ip", c.RealIP()),
+				zap.String("user_agent", req.UserAgent()),
+				zap.Int64("bytes_in", req.ContentLength),
+				zap.Int64("bytes_out", res.Size),
+				zap.Duration("duration", time.Since(start)),
+			}
+
+			if id := c.Param("id"); id != "" {
+				fields = append(fields, zap.String("blob_id", id))
+			}
+
+			if token := auth.TokenName(c); token != "" {
+				fields = append(fields, zap.String("token", token))
+			}
+
+			if cacheStatus, ok := c.Get(cacheStatusKey).(string); ok {
+				fields = append(fields, zap.String("cache", cacheStatus))
+			}
+
+			if upstreamDuration, ok := c.Get(upstreamDurationKey).(time.Duration); ok {
+				fields = append(fields, zap.Duration("upstream_duration", upstreamDuration))
+			}
+
+			logger.Info("", fields...)
+
+			return err
+		}
+	}
+}
+
+// SetCacheHit records whether the request was served from the local cache.
+func SetCacheHit(c echo.Context, hit bool) {
+	if hit {
+		c.Set(cacheStatusKey, "hit")
+	} else {
+		c.Set(cacheStatusKey, "miss")
+	}
+}
+
+// SetUpstreamDuration records the time spent transferring data from the
+// upstream.
+func SetUpstreamDuration(c echo.Context, d time.Duration) {
+	c.Set(upstreamDurationKey, d)
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
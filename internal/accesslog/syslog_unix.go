@@ -0,0 +1,35 @@
+//go:build !windows && !plan9
+
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package accesslog
+
+import (
+	"io"
+	"log/syslog"
+)
+
+// newSyslogWriter connects to the local syslog daemon, or to a remote one
+// (over UDP) if an address is given.
+func newSyslogWriter(addr string) (io.WriteCloser, error) {
+	if addr == "" {
+		return syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, "download-mirror")
+	}
+
+	return syslog.Dial("udp", addr, syslog.LOG_INFO|syslog.LOG_DAEMON, "download-mirror")
+}
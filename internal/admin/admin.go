@@ -0,0 +1,348 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package admin
+
+import (
+	"errors"
+	"net/http"
+	"os"
+
+	"github.com/akamensky/base58"
+	"github.com/gpu-ninja/download-mirror/internal/blobid"
+	"github.com/gpu-ninja/download-mirror/internal/cache"
+	"github.com/gpu-ninja/download-mirror/internal/meta"
+	"github.com/gpu-ninja/download-mirror/internal/prefetch"
+	"github.com/gpu-ninja/download-mirror/internal/scrub"
+	"github.com/gpu-ninja/download-mirror/pkg/api"
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+// Admin is the handler for the administrative API.
+type Admin struct {
+	logger     *zap.Logger
+	localCache *cache.Cache
+	metadata   *meta.Store
+	prefetcher *prefetch.Prefetcher
+	scrubber   *scrub.Scrubber
+}
+
+func NewAdmin(logger *zap.Logger, localCache *cache.Cache, metadata *meta.Store,
+	prefetcher *prefetch.Prefetcher, scrubber *scrub.Scrubber) *Admin {
+	return &Admin{
+		logger:     logger,
+		localCache: localCache,
+		metadata:   metadata,
+		prefetcher: prefetcher,
+		scrubber:   scrubber,
+	}
+}
+
+// Register adds the administrative routes to the group.
+func (a *Admin) Register(g *echo.Group) {
+	g.GET("/cache", a.ListCache)
+	g.GET("/cache/usage", a.CacheUsage)
+	g.POST("/cache/trim", a.TrimCache)
+	g.DELETE("/cache/:id", a.EvictCacheEntry)
+	g.PUT("/cache/:id/pin", a.PinCacheEntry)
+	g.DELETE("/cache/:id/pin", a.UnpinCacheEntry)
+	g.PUT("/cache/:id/priority", a.SetCacheEntryPriority)
+	g.POST("/prefetch", a.StartPrefetch)
+	g.GET("/prefetch", a.ListPrefetchJobs)
+	g.GET("/prefetch/:job", a.GetPrefetchJob)
+	g.POST("/scrub", a.StartScrub)
+	g.GET("/scrub", a.ScrubStatus)
+}
+
+func (a *Admin) ListCache(c echo.Context) error {
+	entries, err := a.localCache.List()
+	if err != nil {
+		a.logger.Error("Failed to list cache entries", zap.Error(err))
+
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	resp := make([]api.CacheEntry, 0, len(entries))
+	for _, entry := range entries {
+		resp = append(resp, toAPICacheEntry(entry))
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
+
+func (a *Admin) CacheUsage(c echo.Context) error {
+	usage, err := a.localCache.Usage()
+	if err != nil {
+		a.logger.Error("Failed to get cache usage", zap.Error(err))
+
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	resp := api.CacheUsage{
+		SizeBytes:   usage.SizeBytes,
+		MaxBytes:    usage.MaxBytes,
+		Entries:     usage.Entries,
+		PinnedBytes: usage.PinnedBytes,
+		Pinned:      usage.Pinned,
+	}
+
+	if usage.Memory != nil {
+		resp.Memory = &api.MemoryCacheUsage{
+			SizeBytes: usage.Memory.SizeBytes,
+			MaxBytes:  usage.Memory.MaxBytes,
+			Entries:   usage.Memory.Entries,
+			Hits:      usage.Memory.Hits,
+			Misses:    usage.Memory.Misses,
+			Evictions: usage.Memory.Evictions,
+		}
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
+
+func (a *Admin) TrimCache(c echo.Context) error {
+	result, err := a.localCache.Trim()
+	if err != nil {
+		a.logger.Error("Failed to trim cache", zap.Error(err))
+
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusOK, api.TrimResult{
+		Evicted:      result.Evicted,
+		EvictedBytes: result.EvictedBytes,
+		SizeBytes:    result.SizeBytes,
+	})
+}
+
+func (a *Admin) EvictCacheEntry(c echo.Context) error {
+	id, err := decodeID(c)
+	if err != nil {
+		return err
+	}
+
+	if err := a.localCache.Evict(id); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return echo.NewHTTPError(http.StatusNotFound)
+		}
+
+		a.logger.Error("Failed to evict cache entry", zap.Error(err))
+
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	a.logger.Info("Evicted cache entry", zap.String("id", c.Param("id")))
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (a *Admin) PinCacheEntry(c echo.Context) error {
+	id, err := decodeID(c)
+	if err != nil {
+		return err
+	}
+
+	if err := a.localCache.Pin(id); err != nil {
+		a.logger.Error("Failed to pin cache entry", zap.Error(err))
+
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	a.logger.Info("Pinned cache entry", zap.String("id", c.Param("id")))
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (a *Admin) UnpinCacheEntry(c echo.Context) error {
+	id, err := decodeID(c)
+	if err != nil {
+		return err
+	}
+
+	if err := a.localCache.Unpin(id); err != nil {
+		a.logger.Error("Failed to unpin cache entry", zap.Error(err))
+
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	a.logger.Info("Unpinned cache entry", zap.String("id", c.Param("id")))
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (a *Admin) SetCacheEntryPriority(c echo.Context) error {
+	id, err := decodeID(c)
+	if err != nil {
+		return err
+	}
+
+	var req api.CachePriority
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid priority")
+	}
+
+	if err := a.localCache.SetPriority(id, req.Priority); err != nil {
+		a.logger.Error("Failed to set cache entry priority", zap.Error(err))
+
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	a.logger.Info("Set cache entry priority",
+		zap.String("id", c.Param("id")), zap.Int("priority", req.Priority))
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (a *Admin) StartPrefetch(c echo.Context) error {
+	var req api.PrefetchRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid prefetch request")
+	}
+
+	if len(req.IDs) == 0 && req.Selector == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "no ids or label selector specified")
+	}
+
+	seen := make(map[string]bool)
+	var ids [][]byte
+	addID := func(encodedID string) error {
+		if seen[encodedID] {
+			return nil
+		}
+		seen[encodedID] = true
+
+		id, err := blobid.ParseString(encodedID)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid id: "+encodedID)
+		}
+
+		ids = append(ids, id.Bytes())
+
+		return nil
+	}
+
+	for _, encodedID := range req.IDs {
+		if err := addID(encodedID); err != nil {
+			return err
+		}
+	}
+
+	if req.Selector != "" {
+		selector, err := meta.ParseSelector(req.Selector)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+
+		blobs, err := a.metadata.ListBlobs(c.Request().Context(), selector)
+		if err != nil {
+			a.logger.Error("Failed to list blobs", zap.Error(err))
+
+			return echo.NewHTTPError(http.StatusInternalServerError)
+		}
+
+		for _, blob := range blobs {
+			if err := addID(blob.ID); err != nil {
+				return err
+			}
+		}
+	}
+
+	job, err := a.prefetcher.Start(ids)
+	if err != nil {
+		a.logger.Error("Failed to start prefetch job", zap.Error(err))
+
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusAccepted, job.Status())
+}
+
+func (a *Admin) ListPrefetchJobs(c echo.Context) error {
+	jobs := a.prefetcher.Jobs()
+
+	resp := make([]api.PrefetchJob, 0, len(jobs))
+	for _, job := range jobs {
+		resp = append(resp, job.Status())
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
+
+func (a *Admin) GetPrefetchJob(c echo.Context) error {
+	job, ok := a.prefetcher.Job(c.Param("job"))
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound)
+	}
+
+	return c.JSON(http.StatusOK, job.Status())
+}
+
+func (a *Admin) StartScrub(c echo.Context) error {
+	if err := a.scrubber.Start(); err != nil {
+		if errors.Is(err, scrub.ErrRunning) {
+			return echo.NewHTTPError(http.StatusConflict, err.Error())
+		}
+
+		a.logger.Error("Failed to start scrub", zap.Error(err))
+
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	return a.scrubStatus(c, http.StatusAccepted)
+}
+
+func (a *Admin) ScrubStatus(c echo.Context) error {
+	return a.scrubStatus(c, http.StatusOK)
+}
+
+func (a *Admin) scrubStatus(c echo.Context, code int) error {
+	report, err := a.scrubber.Status(c.Request().Context())
+	if err != nil {
+		if errors.Is(err, meta.ErrNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound, "no scrub has been run")
+		}
+
+		a.logger.Error("Failed to get scrub status", zap.Error(err))
+
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	return c.JSON(code, report)
+}
+
+// decodeID decodes the id parameter, returning the digest the local cache is
+// keyed by.
+func decodeID(c echo.Context) ([]byte, error) {
+	id, err := blobid.ParseString(c.Param("id"))
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "invalid id")
+	}
+
+	return id.Digest, nil
+}
+
+func toAPICacheEntry(entry cache.Entry) api.CacheEntry {
+	return api.CacheEntry{
+		ID:         base58.Encode(entry.ID),
+		Size:       entry.Size,
+		LastAccess: entry.LastAccess,
+		Pinned:     entry.Pinned,
+		Priority:   entry.Priority,
+		Hits:       entry.Hits,
+	}
+}
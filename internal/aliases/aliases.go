@@ -0,0 +1,288 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package aliases implements mutable named aliases that point at immutable
+// blobs, so that stable URLs (eg. /dl/latest/tool-linux-amd64) can be
+// published. Every change to an alias is kept, so it can be rolled back.
+package aliases
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gpu-ninja/download-mirror/internal/auth"
+	"github.com/gpu-ninja/download-mirror/internal/blobid"
+	"github.com/gpu-ninja/download-mirror/internal/cas"
+	"github.com/gpu-ninja/download-mirror/internal/meta"
+	"github.com/gpu-ninja/download-mirror/pkg/api"
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+const maxPathLength = 512
+
+var segmentPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._+-]*$`)
+
+// Options configures aliases.
+type Options struct {
+	// ServeDirectly serves the blob an alias points at, rather than
+	// redirecting to its immutable URL.
+	ServeDirectly bool
+}
+
+// Aliases manages and serves aliases.
+type Aliases struct {
+	logger   *zap.Logger
+	storage  *cas.Storage
+	metadata *meta.Store
+	opts     Options
+}
+
+func NewAliases(logger *zap.Logger, storage *cas.Storage, metadata *meta.Store, opts Options) *Aliases {
+	return &Aliases{
+		logger:   logger,
+		storage:  storage,
+		metadata: metadata,
+		opts:     opts,
+	}
+}
+
+// Register registers the alias management routes.
+func (a *Aliases) Register(g *echo.Group) {
+	g.GET("/*", a.Get)
+	g.PUT("/*", a.Put)
+}
+
+// Get returns an alias and its history.
+func (a *Aliases) Get(c echo.Context) error {
+	aliasPath, err := parsePath(c.Param("*"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	alias, err := a.getAlias(c, aliasPath)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, a.toAPI(c, alias))
+}
+
+// Put points an alias at a blob, or rolls it back to an earlier revision.
+func (a *Aliases) Put(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	aliasPath, err := parsePath(c.Param("*"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	var update api.AliasUpdate
+	if err := c.Bind(&update); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid request body")
+	}
+
+	revision := meta.AliasRevision{
+		UpdatedBy: auth.TokenName(c),
+		CreatedAt: time.Now().UTC(),
+	}
+
+	if update.Revision != 0 {
+		if update.ID != "" {
+			return echo.NewHTTPError(http.StatusBadRequest, "either an id or a revision is required, not both")
+		}
+	} else {
+		if update.ID == "" {
+			return echo.NewHTTPError(http.StatusBadRequest, "an id or a revision is required")
+		}
+
+		id, err := blobid.ParseString(update.ID)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid id")
+		}
+
+		blob, err := a.metadata.GetBlob(ctx, id.Bytes())
+		if errors.Is(err, meta.ErrNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound, "unknown blob")
+		} else if err != nil {
+			a.logger.Error("Failed to get blob metadata", zap.String("id", update.ID), zap.Error(err))
+
+			return echo.NewHTTPError(http.StatusInternalServerError)
+		}
+
+		revision.ID, revision.Name = update.ID, update.Name
+		if revision.Name == "" {
+			revision.Name = blob.Name
+		}
+
+		if revision.Name == "" {
+			revision.Name = path.Base(aliasPath)
+		}
+	}
+
+	var changed bool
+	alias, err := a.metadata.UpdateAlias(ctx, aliasPath, func(alias *meta.Alias) (bool, error) {
+		revision := revision
+		revision.Revision = alias.Revision + 1
+
+		if update.Revision != 0 {
+			previous, ok := findRevision(alias, update.Revision)
+			if !ok {
+				return false, echo.NewHTTPError(http.StatusNotFound, "unknown revision")
+			}
+
+			revision.ID, revision.Name, revision.RollbackOf = previous.ID, previous.Name, previous.Revision
+		}
+
+		// Re-applying the current target (eg. a retried CI job) isn't a change.
+		changed = alias.Revision == 0 || alias.ID != revision.ID || alias.Name != revision.Name
+		if !changed {
+			return false, nil
+		}
+
+		alias.ID, alias.Name = revision.ID, revision.Name
+		alias.Revision = revision.Revision
+		alias.UpdatedAt = revision.CreatedAt
+		alias.History = append(alias.History, revision)
+
+		return true, nil
+	})
+	if err != nil {
+		var httpErr *echo.HTTPError
+		if errors.As(err, &httpErr) {
+			return httpErr
+		} else if errors.Is(err, meta.ErrConflict) {
+			return echo.NewHTTPError(http.StatusConflict, "alias is being updated concurrently, try again")
+		}
+
+		a.logger.Error("Failed to store alias", zap.String("path", aliasPath), zap.Error(err))
+
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	if !changed {
+		return c.JSON(http.StatusOK, a.toAPI(c, alias))
+	}
+
+	a.logger.Info("Updated alias", zap.String("path", aliasPath), zap.String("id", alias.ID),
+		zap.Int("revision", alias.Revision), zap.String("updatedBy", auth.TokenName(c)))
+
+	return c.JSON(http.StatusOK, a.toAPI(c, alias))
+}
+
+// Download redirects to (or serves) the blob an alias points at.
+func (a *Aliases) Download(c echo.Context) error {
+	aliasPath, err := parsePath(c.Param("*"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound)
+	}
+
+	alias, err := a.getAlias(c, aliasPath)
+	if err != nil {
+		return err
+	}
+
+	// Aliases are mutable, so responses must be revalidated.
+	c.Response().Header().Set(echo.HeaderCacheControl, "no-cache")
+
+	if !a.opts.ServeDirectly {
+		return c.Redirect(http.StatusFound, a.storage.BlobURL(c, alias.ID, alias.Name))
+	}
+
+	id, err := blobid.ParseString(alias.ID)
+	if err != nil {
+		a.logger.Error("Invalid blob id in alias", zap.String("path", aliasPath),
+			zap.String("id", alias.ID), zap.Error(err))
+
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	c.Response().Header().Set(echo.HeaderContentDisposition,
+		mime.FormatMediaType("attachment", map[string]string{"filename": alias.Name}))
+
+	return a.storage.Serve(c, id)
+}
+
+func (a *Aliases) getAlias(c echo.Context, aliasPath string) (*meta.Alias, error) {
+	alias, err := a.metadata.GetAlias(c.Request().Context(), aliasPath)
+	if errors.Is(err, meta.ErrNotFound) {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "unknown alias")
+	} else if err != nil {
+		a.logger.Error("Failed to get alias", zap.String("path", aliasPath), zap.Error(err))
+
+		return nil, echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	return alias, nil
+}
+
+func (a *Aliases) toAPI(c echo.Context, alias *meta.Alias) *api.Alias {
+	history := make([]api.AliasRevision, 0, len(alias.History))
+	for _, r := range alias.History {
+		history = append(history, api.AliasRevision{
+			Revision:   r.Revision,
+			ID:         r.ID,
+			Name:       r.Name,
+			UpdatedBy:  r.UpdatedBy,
+			RollbackOf: r.RollbackOf,
+			CreatedAt:  r.CreatedAt,
+		})
+	}
+
+	return &api.Alias{
+		Path:      alias.Path,
+		ID:        alias.ID,
+		Name:      alias.Name,
+		URL:       a.storage.BlobURL(c, alias.ID, alias.Name),
+		Revision:  alias.Revision,
+		UpdatedAt: alias.UpdatedAt,
+		History:   history,
+	}
+}
+
+// parsePath validates an alias path, each segment must start with an
+// alphanumeric character so that paths can't traverse directories.
+func parsePath(p string) (string, error) {
+	p = strings.Trim(p, "/")
+	if p == "" || len(p) > maxPathLength {
+		return "", fmt.Errorf("invalid alias path")
+	}
+
+	for _, segment := range strings.Split(p, "/") {
+		if !segmentPattern.MatchString(segment) {
+			return "", fmt.Errorf("invalid alias path segment %q", segment)
+		}
+	}
+
+	return p, nil
+}
+
+func findRevision(alias *meta.Alias, revision int) (meta.AliasRevision, bool) {
+	for _, r := range alias.History {
+		if r.Revision == revision {
+			return r, true
+		}
+	}
+
+	return meta.AliasRevision{}, false
+}
@@ -0,0 +1,240 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aliases_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/akamensky/base58"
+	"github.com/gpu-ninja/download-mirror/internal/aliases"
+	"github.com/gpu-ninja/download-mirror/internal/auth"
+	"github.com/gpu-ninja/download-mirror/internal/cas"
+	"github.com/gpu-ninja/download-mirror/internal/cas/castest"
+	"github.com/gpu-ninja/download-mirror/internal/meta"
+	"github.com/gpu-ninja/download-mirror/pkg/client"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestAliases(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+
+	fixture := castest.New(t, logger)
+
+	metadata := fixture.Metadata
+	storage := fixture.NewStorage(logger, cas.Options{})
+
+	tokens, err := auth.ParseTokens("ci:secret")
+	require.NoError(t, err)
+
+	newServer := func(opts aliases.Options) *httptest.Server {
+		blobAliases := aliases.NewAliases(logger, storage, metadata, opts)
+
+		e := echo.New()
+		e.GET("/blobs/:id/:name", storage.Get)
+		e.GET("/dl/*", blobAliases.Download)
+		blobAliases.Register(e.Group("/aliases", tokens.Middleware()))
+
+		srv := httptest.NewServer(e)
+		t.Cleanup(srv.Close)
+
+		return srv
+	}
+
+	srv := newServer(aliases.Options{})
+
+	ctx := context.Background()
+	store := func(name, content string) string {
+		f, err := os.Create(filepath.Join(t.TempDir(), name))
+		require.NoError(t, err)
+		defer f.Close()
+
+		_, err = f.WriteString(content)
+		require.NoError(t, err)
+
+		_, err = f.Seek(0, io.SeekStart)
+		require.NoError(t, err)
+
+		blob := &meta.Blob{Name: name}
+		require.NoError(t, storage.Store(ctx, f, blob))
+
+		return blob.ID
+	}
+
+	v1 := store("tool-v1", "version 1")
+	v2 := store("tool-v2", "version 2")
+
+	download := func(srv *httptest.Server, path string) (int, string) {
+		resp, err := http.Get(srv.URL + "/dl/" + path)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+
+		return resp.StatusCode, string(body)
+	}
+
+	c := client.New(srv.URL, client.WithToken("secret"))
+
+	t.Run("Unauthenticated", func(t *testing.T) {
+		_, err := client.New(srv.URL).SetAlias(ctx, "latest/tool", v1, "")
+
+		var apiErr *client.Error
+		require.True(t, errors.As(err, &apiErr))
+		assert.Equal(t, http.StatusUnauthorized, apiErr.StatusCode)
+	})
+
+	t.Run("Invalid Path", func(t *testing.T) {
+		_, err := c.SetAlias(ctx, "latest/../tool", v1, "")
+
+		var apiErr *client.Error
+		require.True(t, errors.As(err, &apiErr))
+		assert.Equal(t, http.StatusBadRequest, apiErr.StatusCode)
+	})
+
+	t.Run("Unknown Blob", func(t *testing.T) {
+		_, err := c.SetAlias(ctx, "latest/tool", "11111111111111111111111111111111", "")
+
+		var apiErr *client.Error
+		require.True(t, errors.As(err, &apiErr))
+		assert.Equal(t, http.StatusNotFound, apiErr.StatusCode)
+	})
+
+	alias, err := c.SetAlias(ctx, "latest/tool", v1, "tool-linux-amd64")
+	require.NoError(t, err)
+	assert.Equal(t, 1, alias.Revision)
+
+	status, body := download(srv, "latest/tool")
+	require.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "version 1", body)
+
+	alias, err = c.SetAlias(ctx, "latest/tool", v2, "")
+	require.NoError(t, err)
+	assert.Equal(t, 2, alias.Revision)
+	assert.Equal(t, "tool-v2", alias.Name)
+
+	// Setting the same target again isn't a new revision.
+	alias, err = c.SetAlias(ctx, "latest/tool", v2, "")
+	require.NoError(t, err)
+	assert.Equal(t, 2, alias.Revision)
+
+	_, body = download(srv, "latest/tool")
+	assert.Equal(t, "version 2", body)
+
+	t.Run("Rollback", func(t *testing.T) {
+		alias, err := c.RollbackAlias(ctx, "latest/tool", 1)
+		require.NoError(t, err)
+
+		assert.Equal(t, 3, alias.Revision)
+		assert.Equal(t, v1, alias.ID)
+		assert.Equal(t, "tool-linux-amd64", alias.Name)
+
+		alias, err = c.GetAlias(ctx, "latest/tool")
+		require.NoError(t, err)
+
+		require.Len(t, alias.History, 3)
+		assert.Equal(t, 1, alias.History[2].RollbackOf)
+		assert.Equal(t, "ci", alias.History[2].UpdatedBy)
+
+		_, body := download(srv, "latest/tool")
+		assert.Equal(t, "version 1", body)
+	})
+
+	t.Run("Serve Directly", func(t *testing.T) {
+		srv := newServer(aliases.Options{ServeDirectly: true})
+
+		resp, err := http.Get(srv.URL + "/dl/latest/tool")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "no-cache", resp.Header.Get("Cache-Control"))
+		assert.Contains(t, resp.Header.Get("Content-Disposition"), "tool-linux-amd64")
+	})
+
+	t.Run("Re-keyed Blob", func(t *testing.T) {
+		srv := newServer(aliases.Options{ServeDirectly: true})
+
+		// A blob addressed under a legacy key, that has since been re-keyed.
+		legacyID := sha256.Sum256([]byte("legacy"))
+		encodedLegacyID := base58.Encode(legacyID[:])
+
+		require.NoError(t, metadata.PutBlob(ctx, &meta.Blob{ID: encodedLegacyID, Name: "tool-v1"}))
+		require.NoError(t, metadata.PutRedirect(ctx, &meta.Redirect{ID: encodedLegacyID, Target: v1}))
+
+		_, err := c.SetAlias(ctx, "legacy/tool", encodedLegacyID, "")
+		require.NoError(t, err)
+
+		status, body := download(srv, "legacy/tool")
+		require.Equal(t, http.StatusOK, status)
+		assert.Equal(t, "version 1", body)
+	})
+
+	t.Run("Concurrent Updates", func(t *testing.T) {
+		// Each node has its own metadata store, as if they were separate
+		// processes sharing the upstream.
+		var clients []*client.Client
+		for i := 0; i < 2; i++ {
+			nodeAliases := aliases.NewAliases(logger, storage, meta.NewStore(fixture.Upstream), aliases.Options{})
+
+			e := echo.New()
+			nodeAliases.Register(e.Group("/aliases", tokens.Middleware()))
+
+			srv := httptest.NewServer(e)
+			t.Cleanup(srv.Close)
+
+			clients = append(clients, client.New(srv.URL, client.WithToken("secret")))
+		}
+
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			for _, c := range clients {
+				wg.Add(1)
+				go func(c *client.Client, name string) {
+					defer wg.Done()
+
+					_, err := c.SetAlias(ctx, "concurrent/tool", v1, name)
+					assert.NoError(t, err)
+				}(c, fmt.Sprintf("tool-%d-%p", i, c))
+			}
+		}
+		wg.Wait()
+
+		alias, err := c.GetAlias(ctx, "concurrent/tool")
+		require.NoError(t, err)
+
+		assert.Equal(t, 20, alias.Revision)
+		assert.Len(t, alias.History, 20)
+	})
+
+	status, _ = download(srv, "latest/missing")
+	assert.Equal(t, http.StatusNotFound, status)
+}
@@ -0,0 +1,167 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package auth
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// DefaultTokenName is the name given to tokens that are configured without
+// an explicit name.
+const DefaultTokenName = "default"
+
+const tokenNameKey = "auth.tokenName"
+
+// Token is a named bearer token.
+type Token struct {
+	Name  string
+	Value string
+}
+
+// Tokens is a set of bearer tokens that are allowed to access a route.
+type Tokens []Token
+
+// TokenFileHeader is the first line of a token file that lists named tokens.
+// Files without it hold a single token, which is used verbatim.
+const TokenFileHeader = "# download-mirror tokens v1"
+
+// ParseTokenFile parses the contents of a token file. Files starting with
+// TokenFileHeader are parsed with ParseTokens, otherwise the whole file is a
+// single token (as token files were before tokens were named).
+func ParseTokenFile(data string) (Tokens, error) {
+	data = strings.TrimPrefix(data, "\ufeff")
+
+	if first, _, _ := strings.Cut(data, "\n"); strings.TrimSpace(first) == TokenFileHeader {
+		return ParseTokens(data)
+	}
+
+	value := strings.TrimSpace(data)
+	if value == "" {
+		return nil, nil
+	}
+
+	return Tokens{{Name: DefaultTokenName, Value: value}}, nil
+}
+
+// ParseTokens parses a list of tokens, one per line. Each line is either a
+// bare token, or a named token in the form "<name>:<token>". Blank lines and
+// lines starting with '#' are ignored.
+func ParseTokens(data string) (Tokens, error) {
+	var tokens Tokens
+	for i, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		token := Token{Name: DefaultTokenName, Value: line}
+		if name, value, ok := strings.Cut(line, ":"); ok {
+			token = Token{Name: strings.TrimSpace(name), Value: strings.TrimSpace(value)}
+		}
+
+		if token.Name == "" || token.Value == "" {
+			return nil, fmt.Errorf("invalid token on line %d", i+1)
+		}
+
+		for _, existing := range tokens {
+			if existing.Name == token.Name {
+				return nil, fmt.Errorf("duplicate token name %q on line %d", token.Name, i+1)
+			}
+		}
+
+		tokens = append(tokens, token)
+	}
+
+	return tokens, nil
+}
+
+// Lookup returns the token matching the presented value.
+func (t Tokens) Lookup(value string) (Token, bool) {
+	var (
+		match Token
+		found bool
+	)
+
+	// Compare against every token so that timing doesn't leak which ones exist.
+	for _, token := range t {
+		if subtle.ConstantTimeCompare([]byte(token.Value), []byte(value)) == 1 {
+			match, found = token, true
+		}
+	}
+
+	return match, found
+}
+
+// Middleware returns an echo middleware that requires a valid bearer token.
+func (t Tokens) Middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			value, ok := strings.CutPrefix(c.Request().Header.Get(echo.HeaderAuthorization), "Bearer ")
+			if !ok {
+				return echo.NewHTTPError(http.StatusUnauthorized)
+			}
+
+			token, ok := t.Lookup(value)
+			if !ok {
+				return echo.NewHTTPError(http.StatusUnauthorized)
+			}
+
+			c.Set(tokenNameKey, token.Name)
+
+			return next(c)
+		}
+	}
+}
+
+// BasicMiddleware returns an echo middleware that requires a valid token,
+// presented either as a bearer token or as the password of HTTP basic
+// authentication (the username is ignored). This is what container registry
+// clients expect, unauthenticated requests are challenged for basic auth.
+func (t Tokens) BasicMiddleware(realm string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			value, ok := strings.CutPrefix(c.Request().Header.Get(echo.HeaderAuthorization), "Bearer ")
+			if !ok {
+				_, value, ok = c.Request().BasicAuth()
+			}
+
+			token, found := t.Lookup(value)
+			if !ok || !found {
+				c.Response().Header().Set(echo.HeaderWWWAuthenticate, fmt.Sprintf("Basic realm=%q", realm))
+
+				return echo.NewHTTPError(http.StatusUnauthorized)
+			}
+
+			c.Set(tokenNameKey, token.Name)
+
+			return next(c)
+		}
+	}
+}
+
+// TokenName returns the name of the token used to authenticate the request,
+// or an empty string if the request was not authenticated.
+func TokenName(c echo.Context) string {
+	name, _ := c.Get(tokenNameKey).(string)
+	return name
+}
@@ -0,0 +1,88 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package auth_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gpu-ninja/download-mirror/internal/auth"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokens(t *testing.T) {
+	tokens, err := auth.ParseTokens("# CI tokens\nci:secret1\n\nrelease: secret2\n")
+	require.NoError(t, err)
+	require.Len(t, tokens, 2)
+
+	e := echo.New()
+
+	var tokenName string
+	e.POST("/blob", func(c echo.Context) error {
+		tokenName = auth.TokenName(c)
+		return c.NoContent(http.StatusCreated)
+	}, tokens.Middleware())
+
+	req := httptest.NewRequest(http.MethodPost, "/blob", nil)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer secret2")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	assert.Equal(t, "release", tokenName)
+
+	req = httptest.NewRequest(http.MethodPost, "/blob", nil)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer wrong")
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	tokens, err = auth.ParseTokens("secret")
+	require.NoError(t, err)
+	assert.Equal(t, auth.Tokens{{Name: auth.DefaultTokenName, Value: "secret"}}, tokens)
+
+	_, err = auth.ParseTokens("ci:a\nci:b")
+	assert.Error(t, err)
+
+	t.Run("Token File", func(t *testing.T) {
+		tokens, err := auth.ParseTokenFile(auth.TokenFileHeader + "\nci:secret1\nrelease:secret2\n")
+		require.NoError(t, err)
+		assert.Equal(t, auth.Tokens{{Name: "ci", Value: "secret1"}, {Name: "release", Value: "secret2"}}, tokens)
+	})
+
+	t.Run("Legacy Token File", func(t *testing.T) {
+		tokens, err := auth.ParseTokenFile("legacy:secret\n")
+		require.NoError(t, err)
+
+		e := echo.New()
+		e.GET("/blob", func(c echo.Context) error {
+			return c.NoContent(http.StatusOK)
+		}, tokens.Middleware())
+
+		req := httptest.NewRequest(http.MethodGet, "/blob", nil)
+		req.Header.Set(echo.HeaderAuthorization, "Bearer legacy:secret")
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+	})
+}
@@ -0,0 +1,487 @@
+/* SPDX-License-Identifier: BSD-3-Clause
+ *
+ * Copyright (c) 2009 The Go Authors. All rights reserved.
+ * Copyright (c) 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *   * Redistributions of source code must retain the above copyright
+ * notice, this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above
+ * copyright notice, this list of conditions and the following disclaimer
+ * in the documentation and/or other materials provided with the
+ * distribution.
+ *   * Neither the name of Google Inc. nor the names of its
+ * contributors may be used to endorse or promote products derived from
+ * this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Package blobcache is a fork of Go's internal build cache, but for blobs
+// rather than actions. It was originally github.com/gpu-ninja/blobcache, it
+// is kept in tree so that the on-disk layout is owned (and tested) by the
+// mirror rather than relied upon as an implementation detail.
+//
+// Each blob is stored as two files in the subdirectory named after the first
+// byte of its id: "<hex id>-a", an index entry recording its size, and
+// "<hex id>-d", its contents.
+package blobcache
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// How often to update the file mtime on a cache entry.
+	mtimeInterval = 1 * time.Hour
+	// Suffixes of the index and data files of a cache entry.
+	indexSuffix = "-a"
+	dataSuffix  = "-d"
+)
+
+type ID []byte
+
+type Entry struct {
+	Size int64
+	Time time.Time
+}
+
+// Info describes a cache entry on disk.
+type Info struct {
+	Size int64
+	// LastAccess is the most recent (approximate) time the entry was used.
+	LastAccess time.Time
+}
+
+// Cache is a cache that stores blobs by a hash of their contents.
+type Cache struct {
+	logger   *zap.Logger
+	dir      string
+	newHash  func() hash.Hash
+	hashSize int64
+	now      func() time.Time // For testing.
+}
+
+// NewCache opens and returns the cache in the given directory.
+//
+// It is safe for multiple processes on a single machine to use the
+// same cache directory in a local file system simultaneously.
+// They will coordinate using operating system file locks and may
+// duplicate effort but will not corrupt the cache.
+//
+// However, it is NOT safe for multiple processes on different machines
+// to share a cache directory (for example, if the directory were stored
+// in a network file system). File locking is notoriously unreliable in
+// network file systems and may not suffice to protect the cache.
+func NewCache(logger *zap.Logger, dir string, newHash func() hash.Hash, hashSize int64, now func() time.Time) (*Cache, error) {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if !fi.IsDir() {
+		return nil, &os.PathError{Op: "open", Path: dir, Err: fmt.Errorf("not a directory")}
+	}
+
+	for i := 0; i < 256; i++ {
+		name := filepath.Join(dir, fmt.Sprintf("%02x", i))
+		if err := os.MkdirAll(name, 0o777); err != nil {
+			return nil, err
+		}
+	}
+
+	if now == nil {
+		now = time.Now
+	}
+
+	return &Cache{
+		logger:   logger,
+		dir:      dir,
+		newHash:  newHash,
+		hashSize: hashSize,
+		now:      now,
+	}, nil
+}
+
+// Get looks up the ID in the cache and returns a reader if found.
+func (c *Cache) Get(id ID) (file io.ReadSeekCloser, entry Entry, err error) {
+	entry, err = c.getIndexEntry(id)
+	if err != nil {
+		return nil, Entry{}, err
+	}
+
+	if err := c.used(c.fileName(id, indexSuffix)); err != nil {
+		return nil, Entry{}, err
+	}
+
+	path, err := c.dataFile(id)
+	if err != nil {
+		return nil, Entry{}, err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, Entry{}, err
+	}
+
+	if info.Size() != entry.Size {
+		return nil, Entry{}, &os.PathError{Op: "stat", Path: path, Err: errors.New("file incomplete")}
+	}
+
+	file, err = os.Open(path)
+	if err != nil {
+		return nil, Entry{}, err
+	}
+
+	return file, entry, nil
+}
+
+func (c *Cache) getIndexEntry(id ID) (Entry, error) {
+	// entry file is "v1 <hex id> <decimal size space-padded to 20 bytes> <unixnano space-padded to 20 bytes>\n"
+	hexSize := int(c.hashSize * 2)
+	entrySize := 2 + 1 + hexSize + 1 + 20 + 1 + 20 + 1
+
+	missing := func(reason error) (Entry, error) {
+		return Entry{}, &os.PathError{Op: "get", Path: hex.EncodeToString(id),
+			Err: fmt.Errorf("%v: %w", reason, os.ErrNotExist)}
+	}
+	f, err := os.Open(c.fileName(id, indexSuffix))
+	if err != nil {
+		return missing(err)
+	}
+	defer f.Close()
+	entry := make([]byte, entrySize+1) // +1 to detect whether f is too long
+	if n, err := io.ReadFull(f, entry); n > entrySize {
+		return missing(errors.New("too long"))
+	} else if err != io.ErrUnexpectedEOF {
+		if err == io.EOF {
+			return missing(errors.New("file is empty"))
+		}
+		return missing(err)
+	} else if n < entrySize {
+		return missing(errors.New("entry file incomplete"))
+	}
+	if entry[0] != 'v' || entry[1] != '1' || entry[2] != ' ' || entry[3+hexSize] != ' ' || entry[3+hexSize+1+20] != ' ' || entry[entrySize-1] != '\n' {
+		return missing(errors.New("invalid header"))
+	}
+	eid, entry := entry[3:3+hexSize], entry[3+hexSize:]
+	esize, entry := entry[1:1+20], entry[1+20:]
+	etime, _ := entry[1:1+20], entry[1+20:]
+	buf := make(ID, c.hashSize)
+	if _, err := hex.Decode(buf[:], eid); err != nil {
+		return missing(fmt.Errorf("decoding ID: %v", err))
+	} else if !bytes.Equal(buf, id) {
+		return missing(errors.New("mismatched ID"))
+	}
+	i := 0
+	for i < len(esize) && esize[i] == ' ' {
+		i++
+	}
+	size, err := strconv.ParseInt(string(esize[i:]), 10, 64)
+	if err != nil {
+		return missing(fmt.Errorf("parsing size: %v", err))
+	} else if size < 0 {
+		return missing(errors.New("negative size"))
+	}
+	i = 0
+	for i < len(etime) && etime[i] == ' ' {
+		i++
+	}
+	tm, err := strconv.ParseInt(string(etime[i:]), 10, 64)
+	if err != nil {
+		return missing(fmt.Errorf("parsing timestamp: %v", err))
+	} else if tm < 0 {
+		return missing(errors.New("negative timestamp"))
+	}
+
+	return Entry{
+		Size: size,
+		Time: time.Unix(0, tm),
+	}, nil
+}
+
+// Put stores the given file in the cache. It may read file twice.
+// The content of file must not change between the two passes.
+func (c *Cache) Put(file io.ReadSeeker) (ID, int64, error) {
+	id, size, _, err := c.PutHash(file, c.newHash)
+	return id, size, err
+}
+
+// PutHash is like Put, but stores the file under its digest using the given
+// hash rather than the hash the cache was opened with. The hash must produce
+// digests of the same size. It also reports whether a new entry was created,
+// rather than the file already being present in the cache.
+func (c *Cache) PutHash(file io.ReadSeeker, newHash func() hash.Hash) (ID, int64, bool, error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, 0, false, err
+	}
+
+	h := newHash()
+	size, err := io.Copy(h, file)
+	if err != nil {
+		return nil, 0, false, err
+	}
+
+	id := h.Sum(nil)
+	if int64(len(id)) != c.hashSize {
+		return nil, 0, false, fmt.Errorf("invalid id length: %d", len(id))
+	}
+
+	// Copy to cached output file (if not already present).
+	created, err := c.copyFile(file, id, size, newHash)
+	if err != nil {
+		return id, size, created, err
+	}
+
+	// Add to cache index.
+	return id, size, created, c.putIndexEntry(id, size)
+}
+
+// List returns the ids of all of the entries in the cache.
+func (c *Cache) List() ([]ID, error) {
+	var ids []ID
+	for i := 0; i < 256; i++ {
+		subdir := filepath.Join(c.dir, fmt.Sprintf("%02x", i))
+
+		f, err := os.Open(subdir)
+		if err != nil {
+			return nil, err
+		}
+
+		names, err := f.Readdirnames(-1)
+		_ = f.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, name := range names {
+			if !strings.HasSuffix(name, indexSuffix) {
+				continue
+			}
+
+			id, err := hex.DecodeString(strings.TrimSuffix(name, indexSuffix))
+			if err != nil || int64(len(id)) != c.hashSize {
+				continue
+			}
+
+			ids = append(ids, id)
+		}
+	}
+
+	return ids, nil
+}
+
+// Stat returns information about a cache entry without marking it as used.
+func (c *Cache) Stat(id ID) (Info, error) {
+	indexInfo, err := os.Stat(c.fileName(id, indexSuffix))
+	if err != nil {
+		return Info{}, err
+	}
+
+	dataInfo, err := os.Stat(c.fileName(id, dataSuffix))
+	if err != nil {
+		return Info{}, err
+	}
+
+	lastAccess := indexInfo.ModTime()
+	if dataInfo.ModTime().After(lastAccess) {
+		lastAccess = dataInfo.ModTime()
+	}
+
+	return Info{
+		Size:       dataInfo.Size(),
+		LastAccess: lastAccess,
+	}, nil
+}
+
+// Remove deletes an entry from the cache, it is not an error if the entry
+// does not exist.
+func (c *Cache) Remove(id ID) error {
+	// Remove the index file first so the entry is no longer visible.
+	if err := os.Remove(c.fileName(id, indexSuffix)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	if err := os.Remove(c.fileName(id, dataSuffix)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+// Move moves the contents of an entry to the given path and removes the
+// entry from the cache.
+func (c *Cache) Move(id ID, path string) error {
+	if err := os.Rename(c.fileName(id, dataSuffix), path); err != nil {
+		return err
+	}
+
+	return c.Remove(id)
+}
+
+// putIndexEntry adds an entry to the cache recording that executing the action
+// with the given id produces an output with the given output id (hash) and size.
+func (c *Cache) putIndexEntry(id ID, size int64) error {
+	entry := fmt.Sprintf("v1 %x %20d %20d\n", id, size, time.Now().UnixNano())
+	file := c.fileName(id, indexSuffix)
+
+	// Copy file to cache directory.
+	mode := os.O_WRONLY | os.O_CREATE
+	f, err := os.OpenFile(file, mode, 0666)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(entry)
+	if err == nil {
+		// Truncate the file only *after* writing it.
+		// (This should be a no-op, but truncate just in case of previous corruption.)
+		err = f.Truncate(int64(len(entry)))
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file)
+		return err
+	}
+
+	return os.Chtimes(file, c.now(), c.now()) // mainly for tests
+}
+
+// copyFile copies file into the cache, expecting it to have the given
+// output ID and size, if that file is not present already. It reports whether
+// the file was not present before.
+func (c *Cache) copyFile(file io.ReadSeeker, id ID, size int64, newHash func() hash.Hash) (bool, error) {
+	name := c.fileName(id, dataSuffix)
+	info, err := os.Stat(name)
+	created := err != nil
+	if err == nil && info.Size() == size {
+		// Check hash.
+		if f, err := os.Open(name); err == nil {
+			h := newHash()
+			if _, err := io.Copy(h, f); err != nil {
+				return false, err
+			}
+			if err := f.Close(); err != nil {
+				return false, err
+			}
+			id2 := h.Sum(nil)
+			if bytes.Equal(id, id2) {
+				return false, nil
+			}
+		}
+		// Hash did not match. Fall through and rewrite file.
+	}
+
+	// Copy file to cache directory.
+	mode := os.O_RDWR | os.O_CREATE
+	if err == nil && info.Size() > size { // shouldn't happen but fix in case
+		mode |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(name, mode, 0666)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	if size == 0 {
+		// File now exists with correct size.
+		// Only one possible zero-length file, so contents are OK too.
+		// Early return here makes sure there's a "last byte" for code below.
+		return created, nil
+	}
+
+	// From here on, if any of the I/O writing the file fails,
+	// we make a best-effort attempt to truncate the file f
+	// before returning, to avoid leaving bad bytes in the file.
+
+	// Copy file to f, but also into h to double-check hash.
+	if _, err := file.Seek(0, 0); err != nil {
+		_ = f.Truncate(0)
+		return false, err
+	}
+	h := newHash()
+	w := io.MultiWriter(f, h)
+	if _, err := io.CopyN(w, file, size-1); err != nil {
+		_ = f.Truncate(0)
+		return false, err
+	}
+	// Check last byte before writing it; writing it will make the size match
+	// what other processes expect to find and might cause them to start
+	// using the file.
+	buf := make([]byte, 1)
+	if _, err := file.Read(buf); err != nil {
+		_ = f.Truncate(0)
+		return false, err
+	}
+
+	_, _ = h.Write(buf)
+
+	sum := h.Sum(nil)
+
+	if !bytes.Equal(sum, id[:]) {
+		_ = f.Truncate(0)
+		return false, fmt.Errorf("file content changed underneath")
+	}
+
+	// Commit cache file entry.
+	if _, err := f.Write(buf); err != nil {
+		_ = f.Truncate(0)
+		return false, err
+	}
+	if err := f.Close(); err != nil {
+		// Data might not have been written,
+		// but file may look like it is the right size.
+		// To be extra careful, remove cached file.
+		os.Remove(name)
+		return false, err
+	}
+
+	return created, os.Chtimes(name, c.now(), c.now()) // mainly for tests
+}
+
+// dataFile returns the name of the cache file storing data with the given ID.
+func (c *Cache) dataFile(id ID) (string, error) {
+	file := c.fileName(id, dataSuffix)
+	return file, c.used(file)
+}
+
+// fileName returns the name of the file corresponding to the given id.
+func (c *Cache) fileName(id ID, suffix string) string {
+	return filepath.Join(c.dir, fmt.Sprintf("%02x", id[0]), fmt.Sprintf("%x", id)+suffix)
+}
+
+// used makes a best-effort attempt to update mtime on file,
+// so that mtime reflects cache access time.
+func (c *Cache) used(file string) error {
+	info, err := os.Stat(file)
+	if err == nil && c.now().Sub(info.ModTime()) < mtimeInterval {
+		return nil
+	}
+
+	return os.Chtimes(file, c.now(), c.now())
+}
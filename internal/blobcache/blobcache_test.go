@@ -0,0 +1,200 @@
+/* SPDX-License-Identifier: BSD-3-Clause
+ *
+ * Copyright (c) 2009 The Go Authors. All rights reserved.
+ * Copyright (c) 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *   * Redistributions of source code must retain the above copyright
+ * notice, this list of conditions and the following disclaimer.
+ *   * Redistributions in binary form must reproduce the above
+ * copyright notice, this list of conditions and the following disclaimer
+ * in the documentation and/or other materials provided with the
+ * distribution.
+ *   * Neither the name of Google Inc. nor the names of its
+ * contributors may be used to endorse or promote products derived from
+ * this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ * LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ * A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ * OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ * SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ * LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ * DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ * THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package blobcache_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gpu-ninja/download-mirror/internal/blobcache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+	"golang.org/x/crypto/sha3"
+)
+
+func TestCache(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+
+	blob := make([]byte, 1000000)
+	_, err := io.ReadFull(rand.Reader, blob)
+	require.NoError(t, err)
+
+	cacheDir := t.TempDir()
+
+	c, err := blobcache.NewCache(logger, cacheDir, sha256.New, sha256.Size, func() time.Time {
+		return time.Now().Add(-5 * time.Hour)
+	})
+	require.NoError(t, err)
+
+	id, size, err := c.Put(bytes.NewReader(blob))
+	require.NoError(t, err)
+
+	assert.Equal(t, len(id), sha256.Size)
+	assert.Equal(t, int64(len(blob)), size)
+
+	// Should be a no-op.
+	_, _, err = c.Put(bytes.NewReader(blob))
+	require.NoError(t, err)
+
+	file, e, err := c.Get(id)
+	require.NoError(t, err)
+
+	assert.NotEmpty(t, file)
+	assert.Equal(t, int64(len(blob)), e.Size)
+	assert.NotZero(t, e.Time)
+
+	readBlob, err := io.ReadAll(file)
+	require.NoError(t, err)
+
+	err = file.Close()
+	require.NoError(t, err)
+
+	assert.Equal(t, blob, readBlob)
+
+	t.Run("List", func(t *testing.T) {
+		ids, err := c.List()
+		require.NoError(t, err)
+
+		assert.Equal(t, []blobcache.ID{id}, ids)
+	})
+
+	t.Run("Stat", func(t *testing.T) {
+		info, err := c.Stat(id)
+		require.NoError(t, err)
+
+		assert.Equal(t, int64(len(blob)), info.Size)
+		assert.NotZero(t, info.LastAccess)
+	})
+
+	t.Run("Put With Hash", func(t *testing.T) {
+		otherID, _, created, err := c.PutHash(bytes.NewReader(blob), sha3.New256)
+		require.NoError(t, err)
+		assert.True(t, created)
+
+		expected := sha3.Sum256(blob)
+		assert.Equal(t, blobcache.ID(expected[:]), otherID)
+
+		_, _, created, err = c.PutHash(bytes.NewReader(blob), sha3.New256)
+		require.NoError(t, err)
+		assert.False(t, created)
+
+		file, _, err := c.Get(otherID)
+		require.NoError(t, err)
+		require.NoError(t, file.Close())
+
+		require.NoError(t, c.Remove(otherID))
+	})
+
+	t.Run("Move", func(t *testing.T) {
+		dst := filepath.Join(t.TempDir(), "moved")
+		require.NoError(t, c.Move(id, dst))
+
+		data, err := os.ReadFile(dst)
+		require.NoError(t, err)
+
+		assert.Equal(t, blob, data)
+
+		_, _, err = c.Get(id)
+		assert.ErrorIs(t, err, os.ErrNotExist)
+
+		// Removing a missing entry is not an error.
+		require.NoError(t, c.Remove(id))
+
+		ids, err := c.List()
+		require.NoError(t, err)
+
+		assert.Empty(t, ids)
+	})
+}
+
+// TestLayout guards the on-disk layout, caches written by earlier releases
+// must remain readable.
+func TestLayout(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+
+	cacheDir := t.TempDir()
+
+	c, err := blobcache.NewCache(logger, cacheDir, sha256.New, sha256.Size, nil)
+	require.NoError(t, err)
+
+	blob := []byte("hello world")
+	digest := sha256.Sum256(blob)
+	name := hex.EncodeToString(digest[:])
+
+	t.Run("Write", func(t *testing.T) {
+		id, _, err := c.Put(bytes.NewReader(blob))
+		require.NoError(t, err)
+
+		assert.Equal(t, blobcache.ID(digest[:]), id)
+
+		index, err := os.ReadFile(filepath.Join(cacheDir, name[:2], name+"-a"))
+		require.NoError(t, err)
+
+		assert.Regexp(t, fmt.Sprintf(`^v1 %s %20d [ 0-9]{20}\n$`, name, len(blob)), string(index))
+
+		data, err := os.ReadFile(filepath.Join(cacheDir, name[:2], name+"-d"))
+		require.NoError(t, err)
+
+		assert.Equal(t, blob, data)
+
+		require.NoError(t, c.Remove(id))
+	})
+
+	t.Run("Read", func(t *testing.T) {
+		index := fmt.Sprintf("v1 %s %20d %20d\n", name, len(blob), time.Now().UnixNano())
+		require.NoError(t, os.WriteFile(filepath.Join(cacheDir, name[:2], name+"-a"), []byte(index), 0o644))
+		require.NoError(t, os.WriteFile(filepath.Join(cacheDir, name[:2], name+"-d"), blob, 0o644))
+
+		file, entry, err := c.Get(digest[:])
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = file.Close()
+		})
+
+		assert.Equal(t, int64(len(blob)), entry.Size)
+
+		data, err := io.ReadAll(file)
+		require.NoError(t, err)
+
+		assert.Equal(t, blob, data)
+	})
+}
@@ -0,0 +1,254 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package blobid implements the versioned, self-describing blob id format.
+//
+// Legacy ids are the raw 32 byte HMAC-SHA256 digest of the content. Versioned
+// ids are multihash-like, and are encoded as:
+//
+//	<version> <algorithm (uvarint)> <key id length (uvarint)> <key id> <digest length (uvarint)> <digest>
+//
+// So that the hash algorithm or key can be changed without ambiguity. Both
+// forms are base58 encoded when used in URLs.
+package blobid
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/akamensky/base58"
+)
+
+// LegacySize is the size of a legacy (unversioned) id.
+const LegacySize = 32
+
+// Versions of the id format.
+const (
+	VersionLegacy = 0
+	Version1      = 1
+)
+
+// ErrInvalid is returned when an id cannot be parsed.
+var ErrInvalid = errors.New("invalid blob id")
+
+// Algorithm identifies the hash used to derive an id.
+type Algorithm uint64
+
+const (
+	// HMACSHA256 is HMAC-SHA256 keyed by a secure hash secret.
+	HMACSHA256 Algorithm = 0x01
+)
+
+func (a Algorithm) String() string {
+	switch a {
+	case HMACSHA256:
+		return "hmac-sha256"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint64(a))
+	}
+}
+
+// DigestSize returns the size of digests produced by the algorithm.
+func (a Algorithm) DigestSize() int {
+	switch a {
+	case HMACSHA256:
+		return 32
+	default:
+		return 0
+	}
+}
+
+// ParseAlgorithm parses the name of an algorithm.
+func ParseAlgorithm(name string) (Algorithm, error) {
+	switch name {
+	case HMACSHA256.String():
+		return HMACSHA256, nil
+	default:
+		return 0, fmt.Errorf("unknown algorithm %q: %w", name, ErrInvalid)
+	}
+}
+
+// ID is a parsed blob id.
+type ID struct {
+	Version   int
+	Algorithm Algorithm
+	// KeyID is the hex encoded id of the secure hash key, it is empty for
+	// legacy ids (where the key is not recorded).
+	KeyID  string
+	Digest []byte
+}
+
+// New returns a versioned id.
+func New(algorithm Algorithm, keyID string, digest []byte) ID {
+	return ID{
+		Version:   Version1,
+		Algorithm: algorithm,
+		KeyID:     keyID,
+		Digest:    digest,
+	}
+}
+
+// Legacy returns the legacy id for a HMAC-SHA256 digest.
+func Legacy(digest []byte) ID {
+	return ID{
+		Version:   VersionLegacy,
+		Algorithm: HMACSHA256,
+		Digest:    digest,
+	}
+}
+
+// Parse parses the binary form of an id, accepting both legacy and versioned
+// ids.
+func Parse(b []byte) (ID, error) {
+	if len(b) == LegacySize {
+		return Legacy(bytes.Clone(b)), nil
+	}
+
+	if len(b) == 0 || b[0] != Version1 {
+		return ID{}, fmt.Errorf("unsupported version: %w", ErrInvalid)
+	}
+
+	r := bytes.NewReader(b[1:])
+
+	algorithm, err := binary.ReadUvarint(r)
+	if err != nil {
+		return ID{}, fmt.Errorf("reading algorithm: %w", ErrInvalid)
+	}
+
+	keyID, err := readField(r)
+	if err != nil {
+		return ID{}, fmt.Errorf("reading key id: %w", ErrInvalid)
+	}
+
+	digest, err := readField(r)
+	if err != nil {
+		return ID{}, fmt.Errorf("reading digest: %w", ErrInvalid)
+	}
+
+	if r.Len() != 0 {
+		return ID{}, fmt.Errorf("trailing data: %w", ErrInvalid)
+	}
+
+	id := New(Algorithm(algorithm), hex.EncodeToString(keyID), digest)
+	if size := id.Algorithm.DigestSize(); size == 0 || len(digest) != size {
+		return ID{}, fmt.Errorf("unsupported algorithm or digest size: %w", ErrInvalid)
+	}
+
+	return id, nil
+}
+
+// ParseString parses the base58 encoded form of an id.
+func ParseString(s string) (ID, error) {
+	b, err := base58.Decode(s)
+	if err != nil {
+		return ID{}, fmt.Errorf("decoding: %w", ErrInvalid)
+	}
+
+	return Parse(b)
+}
+
+// Bytes returns the binary form of the id.
+func (id ID) Bytes() []byte {
+	if id.Version == VersionLegacy {
+		return id.Digest
+	}
+
+	keyID, _ := hex.DecodeString(id.KeyID)
+
+	b := []byte{Version1}
+	b = binary.AppendUvarint(b, uint64(id.Algorithm))
+	b = binary.AppendUvarint(b, uint64(len(keyID)))
+	b = append(b, keyID...)
+	b = binary.AppendUvarint(b, uint64(len(id.Digest)))
+	b = append(b, id.Digest...)
+
+	return b
+}
+
+// String returns the base58 encoded form of the id.
+func (id ID) String() string {
+	return base58.Encode(id.Bytes())
+}
+
+// Name returns the name of the upstream object storing the blob. Legacy
+// blobs are named by their base58 encoded id, versioned blobs as
+// <algorithm>.<key id>.<base58 digest>, so that both can be stored side by
+// side.
+func (id ID) Name() string {
+	if id.Version == VersionLegacy {
+		return base58.Encode(id.Digest)
+	}
+
+	return strings.Join([]string{id.Algorithm.String(), id.KeyID, base58.Encode(id.Digest)}, ".")
+}
+
+// ParseName parses the name of an upstream object.
+func ParseName(name string) (ID, error) {
+	parts := strings.Split(name, ".")
+	if len(parts) == 1 {
+		return ParseString(name)
+	} else if len(parts) != 3 {
+		return ID{}, fmt.Errorf("malformed name: %w", ErrInvalid)
+	}
+
+	algorithm, err := ParseAlgorithm(parts[0])
+	if err != nil {
+		return ID{}, err
+	}
+
+	if _, err := hex.DecodeString(parts[1]); err != nil {
+		return ID{}, fmt.Errorf("decoding key id: %w", ErrInvalid)
+	}
+
+	digest, err := base58.Decode(parts[2])
+	if err != nil || len(digest) != algorithm.DigestSize() {
+		return ID{}, fmt.Errorf("decoding digest: %w", ErrInvalid)
+	}
+
+	return New(algorithm, parts[1], digest), nil
+}
+
+// Digest returns the digest of an id in binary form, the local cache is keyed
+// by digest. Ids that cannot be parsed are returned unchanged.
+func Digest(b []byte) []byte {
+	id, err := Parse(b)
+	if err != nil {
+		return b
+	}
+
+	return id.Digest
+}
+
+func readField(r *bytes.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if n > uint64(r.Len()) {
+		return nil, errors.New("field too long")
+	}
+
+	field := make([]byte, n)
+	_, _ = r.Read(field)
+
+	return field, nil
+}
@@ -0,0 +1,78 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package blobid_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/gpu-ninja/download-mirror/internal/blobid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestID(t *testing.T) {
+	digest := bytes.Repeat([]byte{0xab}, 32)
+
+	t.Run("Legacy", func(t *testing.T) {
+		id, err := blobid.Parse(digest)
+		require.NoError(t, err)
+
+		assert.Equal(t, blobid.VersionLegacy, id.Version)
+		assert.Equal(t, blobid.HMACSHA256, id.Algorithm)
+		assert.Equal(t, digest, id.Bytes())
+
+		parsed, err := blobid.ParseName(id.Name())
+		require.NoError(t, err)
+		assert.Equal(t, id, parsed)
+	})
+
+	t.Run("Versioned", func(t *testing.T) {
+		id := blobid.New(blobid.HMACSHA256, "096b5474", digest)
+
+		parsed, err := blobid.ParseString(id.String())
+		require.NoError(t, err)
+		assert.Equal(t, id, parsed)
+
+		assert.Equal(t, digest, blobid.Digest(id.Bytes()))
+
+		assert.Regexp(t, `^hmac-sha256\.096b5474\.[1-9A-HJ-NP-Za-km-z]+$`, id.Name())
+
+		parsed, err = blobid.ParseName(id.Name())
+		require.NoError(t, err)
+		assert.Equal(t, id, parsed)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		id := blobid.New(blobid.HMACSHA256, "096b5474", digest).Bytes()
+
+		for _, b := range [][]byte{
+			nil,
+			digest[:31],
+			id[:len(id)-1],
+			append(bytes.Clone(id), 0),
+			append([]byte{2}, id[1:]...),
+		} {
+			_, err := blobid.Parse(b)
+			assert.ErrorIs(t, err, blobid.ErrInvalid)
+		}
+
+		_, err := blobid.ParseName("sha1.096b5474.abc")
+		assert.ErrorIs(t, err, blobid.ErrInvalid)
+	})
+}
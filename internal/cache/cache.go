@@ -0,0 +1,942 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gpu-ninja/download-mirror/internal/blobcache"
+	"github.com/gpu-ninja/download-mirror/internal/diskusage"
+	"github.com/gpu-ninja/download-mirror/internal/integrity"
+	"github.com/gpu-ninja/download-mirror/internal/metrics"
+	"github.com/gpu-ninja/download-mirror/internal/securehash"
+	"go.uber.org/zap"
+)
+
+// DefaultTrimInterval is how often the cache is trimmed by default.
+const DefaultTrimInterval = 5 * time.Minute
+
+const (
+	quarantineDir  = "quarantine"
+	pinsFile       = "pins"
+	prioritiesFile = "priorities"
+	hitsFile       = "hits"
+)
+
+// Options configures a local cache.
+type Options struct {
+	// Dir is the directory the cache is stored in.
+	Dir string
+	// MaxBytes is the maximum size of the cache, zero means unlimited.
+	MaxBytes int64
+	// TrimInterval is how often the cache is trimmed in the background.
+	TrimInterval time.Duration
+	// NewHash returns the hash used to address blobs.
+	NewHash func() hash.Hash
+	// HashSize is the size of the hash in bytes.
+	HashSize int
+	// Policy is the eviction policy, defaults to LRU.
+	Policy Policy
+	// HighWatermark is the fraction of MaxBytes that triggers a trim when
+	// exceeded, defaults to 1.
+	HighWatermark float64
+	// LowWatermark is the fraction of MaxBytes that a trim evicts down to,
+	// defaults to the high watermark.
+	LowWatermark float64
+	// MinFreeBytes is the amount of free space to maintain on the cache
+	// filesystem by evicting entries, zero disables the check.
+	MinFreeBytes int64
+	// MemoryMaxBytes is the byte budget of the in-memory hot tier, zero
+	// disables it.
+	MemoryMaxBytes int64
+	// MemoryMaxBlobSize is the size of the largest blob that will be kept in
+	// the in-memory hot tier.
+	MemoryMaxBlobSize int64
+}
+
+// Entry describes a cached blob.
+type Entry struct {
+	ID         []byte
+	Size       int64
+	LastAccess time.Time
+	Pinned     bool
+	// Priority is the eviction priority, lower priority entries are evicted
+	// first regardless of the eviction policy.
+	Priority int
+	// Hits is the number of times the entry has been read from the cache.
+	Hits int64
+}
+
+// Usage describes the current usage of the cache.
+type Usage struct {
+	SizeBytes   int64
+	MaxBytes    int64
+	Entries     int
+	PinnedBytes int64
+	Pinned      int
+	// Memory is the usage of the in-memory hot tier, if enabled.
+	Memory *MemoryStats
+}
+
+// TrimResult describes the outcome of a trim.
+type TrimResult struct {
+	Evicted      int
+	EvictedBytes int64
+	SizeBytes    int64
+}
+
+// Cache is a size limited local blob cache that supports pinning entries.
+type Cache struct {
+	logger *zap.Logger
+	opts   Options
+	blobs  *blobcache.Cache
+	// Serializes trims and evictions.
+	trimMu sync.Mutex
+	// Protects pins, priorities, hits and the GDSF state.
+	mu         sync.Mutex
+	pins       map[string]bool
+	priorities map[string]int
+	hits       map[string]int64
+	// GDSF keys of entries, computed when they are stored or accessed.
+	scores map[string]float64
+	// GDSF inflation value, the key of the last evicted entry.
+	inflation float64
+	// In-memory hot tier for small blobs, nil if disabled.
+	memory *memoryTier
+	// Approximate size of the cache, updated on writes and reset on trims.
+	size   atomic.Int64
+	trimCh chan struct{}
+	cancel context.CancelFunc
+	tasks  sync.WaitGroup
+}
+
+// New opens (or creates) a local cache and starts trimming it in the
+// background.
+func New(logger *zap.Logger, opts Options) (*Cache, error) {
+	if err := os.MkdirAll(opts.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create cache directory: %w", err)
+	}
+
+	if opts.Policy == "" {
+		opts.Policy = PolicyLRU
+	}
+
+	if opts.HighWatermark <= 0 {
+		opts.HighWatermark = 1
+	}
+
+	if opts.LowWatermark <= 0 || opts.LowWatermark > opts.HighWatermark {
+		opts.LowWatermark = opts.HighWatermark
+	}
+
+	blobs, err := blobcache.NewCache(logger, opts.Dir, opts.NewHash, int64(opts.HashSize), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open cache: %w", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	c := &Cache{
+		logger:     logger,
+		opts:       opts,
+		blobs:      blobs,
+		pins:       make(map[string]bool),
+		priorities: make(map[string]int),
+		hits:       make(map[string]int64),
+		scores:     make(map[string]float64),
+		trimCh:     make(chan struct{}, 1),
+		cancel:     cancel,
+	}
+
+	if opts.MemoryMaxBytes > 0 && opts.MemoryMaxBlobSize > 0 {
+		c.memory = newMemoryTier(opts.MemoryMaxBytes)
+	}
+
+	if err := c.loadPins(); err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to load pins: %w", err)
+	}
+
+	if err := loadCounts(filepath.Join(opts.Dir, prioritiesFile), func(key string, value int64) {
+		c.priorities[key] = int(value)
+	}); err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to load priorities: %w", err)
+	}
+
+	if err := loadCounts(filepath.Join(opts.Dir, hitsFile), func(key string, value int64) {
+		c.hits[key] = value
+	}); err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to load hits: %w", err)
+	}
+
+	metrics.CacheMaxBytes.Set(float64(opts.MaxBytes))
+
+	c.tasks.Add(1)
+	go func() {
+		defer c.tasks.Done()
+
+		if usage, err := c.Usage(); err == nil {
+			c.size.Store(usage.SizeBytes)
+			metrics.CacheSizeBytes.Set(float64(usage.SizeBytes))
+		}
+
+		// Catch up on anything written while the cache was closed.
+		c.maybeTrim()
+
+		var tick <-chan time.Time
+		if opts.TrimInterval > 0 {
+			ticker := time.NewTicker(opts.TrimInterval)
+			defer ticker.Stop()
+
+			tick = ticker.C
+		}
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-tick:
+			case <-c.trimCh:
+			}
+
+			if _, err := c.Trim(); err != nil {
+				logger.Error("Failed to trim cache", zap.Error(err))
+			}
+		}
+	}()
+
+	return c, nil
+}
+
+// Close stops trimming the cache in the background.
+func (c *Cache) Close() error {
+	c.cancel()
+	c.tasks.Wait()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.saveHits(); err != nil {
+		return fmt.Errorf("failed to save hits: %w", err)
+	}
+
+	return nil
+}
+
+// Get opens a cached blob. Small blobs are verified and promoted to the
+// in-memory hot tier (if enabled) so that subsequent requests can be served
+// with GetMemory, corrupt blobs are quarantined and integrity.ErrCorrupt is
+// returned.
+func (c *Cache) Get(id []byte) (io.ReadSeekCloser, blobcache.Entry, error) {
+	r, entry, err := c.blobs.Get(id)
+	if err != nil {
+		return nil, entry, err
+	}
+
+	key := hex.EncodeToString(id)
+
+	c.mu.Lock()
+	c.hits[key]++
+	c.touch(key, entry.Size)
+	c.mu.Unlock()
+
+	if c.memory == nil || entry.Size > c.opts.MemoryMaxBlobSize {
+		return r, entry, nil
+	}
+
+	defer r.Close()
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, entry, err
+	}
+
+	// Small blobs are cheap to verify, and the hot tier must never serve
+	// corrupt content.
+	h := c.NewHash()
+	_, _ = h.Write(data)
+	if !integrity.Matches(h, id) {
+		c.logger.Warn("Quarantining corrupt cache entry", zap.String("id", key))
+
+		if err := c.Quarantine(id); err != nil {
+			c.logger.Error("Failed to quarantine corrupt cache entry", zap.String("id", key), zap.Error(err))
+		}
+
+		return nil, entry, integrity.ErrCorrupt
+	}
+
+	c.memory.add(key, data)
+
+	return nopCloser{bytes.NewReader(data)}, entry, nil
+}
+
+// NewHash returns a new instance of the hash used to address blobs.
+func (c *Cache) NewHash() hash.Hash {
+	return c.opts.NewHash()
+}
+
+// GetMemory returns a blob from the in-memory hot tier, the returned slice
+// must not be modified.
+func (c *Cache) GetMemory(id []byte) ([]byte, bool) {
+	if c.memory == nil {
+		return nil, false
+	}
+
+	key := hex.EncodeToString(id)
+
+	data, ok := c.memory.get(key)
+	if !ok {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	c.hits[key]++
+	c.touch(key, int64(len(data)))
+	c.mu.Unlock()
+
+	return data, true
+}
+
+// touch updates the GDSF key of an entry as it's stored or accessed, c.mu
+// must be held.
+func (c *Cache) touch(key string, size int64) {
+	if c.opts.Policy == PolicyGDSF {
+		c.scores[key] = gdsfScore(c.inflation, c.hits[key], size)
+	}
+}
+
+// Put stores a blob in the cache, returning its id and size.
+func (c *Cache) Put(file io.ReadSeeker) ([]byte, int64, error) {
+	return c.put(file, c.NewHash)
+}
+
+// PutDigest stores a blob in the cache under the given digest, which may be
+// the digest of the blob under a legacy key of the keyring, so that it can be
+// found again by the id it was requested with. integrity.ErrCorrupt is
+// returned if the blob is not addressed by the digest under any key.
+func (c *Cache) PutDigest(file io.ReadSeeker, digest []byte) (int64, error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	h := c.NewHash()
+	if _, err := io.Copy(h, file); err != nil {
+		return 0, err
+	}
+
+	newHash := c.NewHash
+	if m, ok := h.(*securehash.MultiHash); ok {
+		key, ok := m.Match(digest)
+		if !ok {
+			return 0, integrity.ErrCorrupt
+		}
+
+		newHash = func() hash.Hash {
+			return securehash.New(key.Secret)
+		}
+	} else if !bytes.Equal(h.Sum(nil), digest) {
+		return 0, integrity.ErrCorrupt
+	}
+
+	_, size, err := c.put(file, newHash)
+	if err != nil {
+		return 0, err
+	}
+
+	return size, nil
+}
+
+// put stores a blob in the cache under its digest using newHash. Blobs that
+// were already in the cache don't add to its size.
+func (c *Cache) put(file io.ReadSeeker, newHash func() hash.Hash) ([]byte, int64, error) {
+	id, size, created, err := c.blobs.PutHash(file, newHash)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if !created {
+		return id, size, nil
+	}
+
+	c.mu.Lock()
+	c.touch(hex.EncodeToString(id), size)
+	c.mu.Unlock()
+
+	metrics.CacheSizeBytes.Add(float64(size))
+
+	c.size.Add(size)
+	c.maybeTrim()
+
+	return id, size, nil
+}
+
+// maybeTrim schedules a background trim if the cache has grown past its high
+// watermark, or the cache filesystem is running low on space.
+func (c *Cache) maybeTrim() {
+	if !c.overHighWatermark(c.size.Load()) && !c.belowFreeSpaceFloor() {
+		return
+	}
+
+	select {
+	case c.trimCh <- struct{}{}:
+	default:
+	}
+}
+
+func (c *Cache) overHighWatermark(size int64) bool {
+	return c.opts.MaxBytes > 0 && size > int64(float64(c.opts.MaxBytes)*c.opts.HighWatermark)
+}
+
+func (c *Cache) belowFreeSpaceFloor() bool {
+	if c.opts.MinFreeBytes <= 0 {
+		return false
+	}
+
+	free, err := diskusage.Free(c.opts.Dir)
+	if err != nil {
+		return false
+	}
+
+	return free < c.opts.MinFreeBytes
+}
+
+// List returns all of the entries in the cache, most recently used first.
+func (c *Cache) List() ([]Entry, error) {
+	ids, err := c.blobs.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []Entry
+	for _, id := range ids {
+		entry, err := c.stat(id)
+		if err != nil {
+			c.logger.Debug("Skipping incomplete cache entry",
+				zap.String("id", hex.EncodeToString(id)), zap.Error(err))
+			continue
+		}
+
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].LastAccess.After(entries[j].LastAccess)
+	})
+
+	return entries, nil
+}
+
+// Stat returns the cache entry for the given id.
+func (c *Cache) Stat(id []byte) (Entry, error) {
+	if len(id) != c.opts.HashSize {
+		return Entry{}, fmt.Errorf("invalid id length: %d", len(id))
+	}
+
+	return c.stat(id)
+}
+
+func (c *Cache) stat(id []byte) (Entry, error) {
+	info, err := c.blobs.Stat(id)
+	if err != nil {
+		return Entry{}, err
+	}
+
+	return Entry{
+		ID:         id,
+		Size:       info.Size,
+		LastAccess: info.LastAccess,
+		Pinned:     c.IsPinned(id),
+		Priority:   c.Priority(id),
+		Hits:       c.Hits(id),
+	}, nil
+}
+
+// Usage returns the current usage of the cache.
+func (c *Cache) Usage() (Usage, error) {
+	entries, err := c.List()
+	if err != nil {
+		return Usage{}, err
+	}
+
+	usage := Usage{
+		MaxBytes: c.opts.MaxBytes,
+		Entries:  len(entries),
+	}
+
+	if c.memory != nil {
+		memoryUsage := c.memory.usage()
+		usage.Memory = &memoryUsage
+	}
+
+	for _, entry := range entries {
+		usage.SizeBytes += entry.Size
+		if entry.Pinned {
+			usage.Pinned++
+			usage.PinnedBytes += entry.Size
+		}
+	}
+
+	return usage, nil
+}
+
+// Evict removes a blob from the cache (even if it is pinned).
+func (c *Cache) Evict(id []byte) error {
+	if len(id) != c.opts.HashSize {
+		return fmt.Errorf("invalid id length: %d", len(id))
+	}
+
+	c.trimMu.Lock()
+	defer c.trimMu.Unlock()
+
+	entry, err := c.stat(id)
+	if err != nil {
+		return err
+	}
+
+	if err := c.remove(id); err != nil {
+		return err
+	}
+
+	c.size.Add(-entry.Size)
+
+	c.forget(id)
+
+	metrics.CacheEvictedBytes.Add(float64(entry.Size))
+	metrics.CacheSizeBytes.Sub(float64(entry.Size))
+
+	return nil
+}
+
+// Quarantine moves a (corrupt) blob out of the cache into the quarantine
+// directory, so that it can be inspected later.
+func (c *Cache) Quarantine(id []byte) error {
+	if len(id) != c.opts.HashSize {
+		return fmt.Errorf("invalid id length: %d", len(id))
+	}
+
+	c.trimMu.Lock()
+	defer c.trimMu.Unlock()
+
+	entry, err := c.stat(id)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Join(c.opts.Dir, quarantineDir), 0o755); err != nil {
+		return err
+	}
+
+	if c.memory != nil {
+		c.memory.remove(hex.EncodeToString(id))
+	}
+
+	if err := c.blobs.Move(id, filepath.Join(c.opts.Dir, quarantineDir, hex.EncodeToString(id))); err != nil {
+		return err
+	}
+
+	c.size.Add(-entry.Size)
+
+	c.forget(id)
+
+	metrics.CacheSizeBytes.Sub(float64(entry.Size))
+
+	return nil
+}
+
+// forget clears the policy state (pin, priority, hits and GDSF key) of a blob
+// that has been removed from the cache, so that it isn't inherited if the
+// blob is cached again.
+func (c *Cache) forget(id []byte) {
+	key := hex.EncodeToString(id)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, pinned := c.pins[key]
+	_, prioritised := c.priorities[key]
+
+	delete(c.pins, key)
+	delete(c.priorities, key)
+	delete(c.hits, key)
+	delete(c.scores, key)
+
+	if pinned {
+		if err := c.savePins(); err != nil {
+			c.logger.Warn("Failed to save pins", zap.Error(err))
+		}
+	}
+
+	if prioritised {
+		if err := c.savePriorities(); err != nil {
+			c.logger.Warn("Failed to save priorities", zap.Error(err))
+		}
+	}
+}
+
+// Trim evicts unpinned entries, in the order determined by the eviction
+// policy, once the cache has grown past its high watermark (or free space has
+// fallen below the configured floor). Entries are evicted until the cache is
+// back under its low watermark and the free space floor is satisfied.
+func (c *Cache) Trim() (TrimResult, error) {
+	c.trimMu.Lock()
+	defer c.trimMu.Unlock()
+
+	c.logger.Info("Trimming cache")
+
+	result, err := c.trim()
+	if err != nil {
+		metrics.CacheTrims.WithLabelValues("error").Inc()
+		return result, err
+	}
+
+	metrics.CacheTrims.WithLabelValues("success").Inc()
+	metrics.CacheEvictedBytes.Add(float64(result.EvictedBytes))
+	metrics.CacheSizeBytes.Set(float64(result.SizeBytes))
+
+	c.size.Store(result.SizeBytes)
+
+	if result.Evicted > 0 {
+		c.logger.Info("Trimmed cache", zap.Int("evicted", result.Evicted),
+			zap.Int64("evictedBytes", result.EvictedBytes))
+	}
+
+	return result, nil
+}
+
+func (c *Cache) trim() (TrimResult, error) {
+	entries, err := c.List()
+	if err != nil {
+		return TrimResult{}, err
+	}
+
+	var result TrimResult
+	for _, entry := range entries {
+		result.SizeBytes += entry.Size
+	}
+
+	var toFree int64
+	if c.overHighWatermark(result.SizeBytes) {
+		toFree = result.SizeBytes - int64(float64(c.opts.MaxBytes)*c.opts.LowWatermark)
+	}
+
+	if c.opts.MinFreeBytes > 0 {
+		free, err := diskusage.Free(c.opts.Dir)
+		if err != nil && !errors.Is(err, diskusage.ErrUnsupported) {
+			return result, fmt.Errorf("failed to get free space: %w", err)
+		}
+
+		if err == nil && free < c.opts.MinFreeBytes && c.opts.MinFreeBytes-free > toFree {
+			toFree = c.opts.MinFreeBytes - free
+		}
+	}
+
+	if toFree <= 0 {
+		return result, nil
+	}
+
+	// Entries that haven't been accessed since the cache was opened are keyed
+	// as if they were accessed now.
+	c.mu.Lock()
+	scores := make(map[string]float64, len(entries))
+	if c.opts.Policy == PolicyGDSF {
+		for _, entry := range entries {
+			key := hex.EncodeToString(entry.ID)
+			if score, ok := c.scores[key]; ok {
+				scores[key] = score
+			} else {
+				scores[key] = gdsfScore(c.inflation, entry.Hits, entry.Size)
+			}
+		}
+	}
+	c.mu.Unlock()
+
+	order := evictionOrder(c.opts.Policy, entries, func(entry Entry) float64 {
+		return scores[hex.EncodeToString(entry.ID)]
+	})
+
+	for _, entry := range order {
+		if result.EvictedBytes >= toFree {
+			break
+		}
+
+		if err := c.remove(entry.ID); err != nil {
+			c.logger.Warn("Failed to evict cache entry",
+				zap.String("id", hex.EncodeToString(entry.ID)), zap.Error(err))
+			continue
+		}
+
+		key := hex.EncodeToString(entry.ID)
+
+		c.mu.Lock()
+		if score := scores[key]; score > c.inflation {
+			c.inflation = score
+		}
+		c.mu.Unlock()
+
+		c.forget(entry.ID)
+
+		result.Evicted++
+		result.EvictedBytes += entry.Size
+		result.SizeBytes -= entry.Size
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.saveHits(); err != nil {
+		c.logger.Warn("Failed to save hits", zap.Error(err))
+	}
+
+	return result, nil
+}
+
+func (c *Cache) remove(id []byte) error {
+	if c.memory != nil {
+		c.memory.remove(hex.EncodeToString(id))
+	}
+
+	return c.blobs.Remove(id)
+}
+
+// Pin prevents a blob from being evicted when the cache is trimmed.
+func (c *Cache) Pin(id []byte) error {
+	return c.setPinned(id, true)
+}
+
+// Unpin allows a previously pinned blob to be evicted.
+func (c *Cache) Unpin(id []byte) error {
+	return c.setPinned(id, false)
+}
+
+// IsPinned returns true if the blob is pinned.
+func (c *Cache) IsPinned(id []byte) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.pins[hex.EncodeToString(id)]
+}
+
+func (c *Cache) setPinned(id []byte, pinned bool) error {
+	if len(id) != c.opts.HashSize {
+		return fmt.Errorf("invalid id length: %d", len(id))
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := hex.EncodeToString(id)
+	if pinned {
+		c.pins[key] = true
+	} else {
+		delete(c.pins, key)
+	}
+
+	return c.savePins()
+}
+
+// Priority returns the eviction priority of the blob.
+func (c *Cache) Priority(id []byte) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.priorities[hex.EncodeToString(id)]
+}
+
+// SetPriority sets the eviction priority of the blob, entries with a lower
+// priority are evicted first.
+func (c *Cache) SetPriority(id []byte, priority int) error {
+	if len(id) != c.opts.HashSize {
+		return fmt.Errorf("invalid id length: %d", len(id))
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := hex.EncodeToString(id)
+	if priority != 0 {
+		c.priorities[key] = priority
+	} else {
+		delete(c.priorities, key)
+	}
+
+	return c.savePriorities()
+}
+
+// savePriorities persists the priorities, must be called with mu held.
+func (c *Cache) savePriorities() error {
+	counts := make(map[string]int64, len(c.priorities))
+	for key, priority := range c.priorities {
+		counts[key] = int64(priority)
+	}
+
+	return c.saveCounts(prioritiesFile, counts)
+}
+
+// Hits returns the number of times the blob has been read from the cache.
+func (c *Cache) Hits(id []byte) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.hits[hex.EncodeToString(id)]
+}
+
+// saveHits persists the hit counts, must be called with mu held.
+func (c *Cache) saveHits() error {
+	return c.saveCounts(hitsFile, c.hits)
+}
+
+func (c *Cache) loadPins() error {
+	f, err := os.Open(filepath.Join(c.opts.Dir, pinsFile))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			c.pins[line] = true
+		}
+	}
+
+	return scanner.Err()
+}
+
+// savePins atomically persists the set of pinned blobs, must be called with
+// mu held.
+func (c *Cache) savePins() error {
+	keys := make([]string, 0, len(c.pins))
+	for key := range c.pins {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	f, err := os.CreateTemp(c.opts.Dir, pinsFile+"-")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}()
+
+	for _, key := range keys {
+		if _, err := fmt.Fprintln(f, key); err != nil {
+			return err
+		}
+	}
+
+	if err := f.Sync(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), filepath.Join(c.opts.Dir, pinsFile))
+}
+
+// saveCounts atomically persists a set of "<key> <value>" lines.
+func (c *Cache) saveCounts(name string, counts map[string]int64) error {
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	f, err := os.CreateTemp(c.opts.Dir, name+"-")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}()
+
+	w := bufio.NewWriter(f)
+	for _, key := range keys {
+		if _, err := fmt.Fprintf(w, "%s %d\n", key, counts[key]); err != nil {
+			return err
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), filepath.Join(c.opts.Dir, name))
+}
+
+func loadCounts(path string, fn func(key string, value int64)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(strings.TrimSpace(scanner.Text()), " ")
+		if !ok {
+			continue
+		}
+
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			continue
+		}
+
+		fn(key, n)
+	}
+
+	return scanner.Err()
+}
+
+type nopCloser struct {
+	io.ReadSeeker
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
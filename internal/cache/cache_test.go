@@ -0,0 +1,362 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cache_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gpu-ninja/download-mirror/internal/cache"
+	"github.com/gpu-ninja/download-mirror/internal/integrity"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestCache(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+
+	dir := t.TempDir()
+
+	c, err := cache.New(logger, cache.Options{
+		Dir:      dir,
+		MaxBytes: 2000,
+		NewHash: func() hash.Hash {
+			return sha256.New()
+		},
+		HashSize: sha256.Size,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, c.Close())
+	})
+
+	var ids [][]byte
+	for i := 0; i < 3; i++ {
+		id, size, err := c.Put(bytes.NewReader(bytes.Repeat([]byte{byte(i)}, 1000)))
+		require.NoError(t, err)
+		assert.Equal(t, int64(1000), size)
+
+		if i == 0 {
+			require.NoError(t, c.Pin(id))
+		}
+
+		ids = append(ids, id)
+	}
+
+	// Exceeding the maximum size should trigger a trim in the background.
+	require.Eventually(t, func() bool {
+		usage, err := c.Usage()
+		return err == nil && usage.SizeBytes == 2000
+	}, 5*time.Second, 10*time.Millisecond)
+
+	usage, err := c.Usage()
+	require.NoError(t, err)
+
+	assert.Equal(t, 2, usage.Entries)
+	assert.Equal(t, 1, usage.Pinned)
+
+	result, err := c.Trim()
+	require.NoError(t, err)
+
+	assert.Equal(t, 0, result.Evicted)
+	assert.Equal(t, int64(2000), result.SizeBytes)
+
+	// The pinned entry should never be evicted.
+	_, err = c.Stat(ids[0])
+	require.NoError(t, err)
+
+	require.NoError(t, c.Evict(ids[0]))
+
+	_, _, err = c.Get(ids[0])
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	entries, err := c.List()
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestCacheEvictionPolicy(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+
+	c, err := cache.New(logger, cache.Options{
+		Dir:      t.TempDir(),
+		MaxBytes: 3000,
+		NewHash: func() hash.Hash {
+			return sha256.New()
+		},
+		HashSize:      sha256.Size,
+		Policy:        cache.PolicyLFU,
+		HighWatermark: 1,
+		LowWatermark:  0.75,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, c.Close())
+	})
+
+	put := func(b byte) []byte {
+		id, _, err := c.Put(bytes.NewReader(bytes.Repeat([]byte{b}, 1000)))
+		require.NoError(t, err)
+
+		return id
+	}
+
+	get := func(id []byte) {
+		r, _, err := c.Get(id)
+		require.NoError(t, err)
+		require.NoError(t, r.Close())
+	}
+
+	a, b, d := put(0), put(1), put(2)
+
+	get(a)
+	get(a)
+	get(d)
+
+	// A higher priority entry should be kept even though it has never been
+	// read.
+	require.NoError(t, c.SetPriority(b, 1))
+
+	_ = put(3)
+
+	// Trims down to the low watermark, evicting the least frequently used
+	// entries first.
+	require.Eventually(t, func() bool {
+		usage, err := c.Usage()
+		return err == nil && usage.SizeBytes == 2000
+	}, 5*time.Second, 10*time.Millisecond)
+
+	entries, err := c.List()
+	require.NoError(t, err)
+
+	var remaining [][]byte
+	for _, entry := range entries {
+		remaining = append(remaining, entry.ID)
+	}
+
+	assert.ElementsMatch(t, [][]byte{a, b}, remaining)
+
+	entry, err := c.Stat(a)
+	require.NoError(t, err)
+
+	assert.Equal(t, int64(2), entry.Hits)
+	assert.Equal(t, 0, entry.Priority)
+}
+
+func TestCacheEvictionPolicyGDSF(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+
+	c, err := cache.New(logger, cache.Options{
+		Dir:      t.TempDir(),
+		MaxBytes: 3000,
+		NewHash: func() hash.Hash {
+			return sha256.New()
+		},
+		HashSize:      sha256.Size,
+		Policy:        cache.PolicyGDSF,
+		HighWatermark: 1,
+		LowWatermark:  2.0 / 3,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, c.Close())
+	})
+
+	var next byte
+	put := func() []byte {
+		next++
+
+		id, _, err := c.Put(bytes.NewReader(bytes.Repeat([]byte{next}, 1000)))
+		require.NoError(t, err)
+
+		return id
+	}
+
+	get := func(id []byte) {
+		r, _, err := c.Get(id)
+		require.NoError(t, err)
+		require.NoError(t, r.Close())
+	}
+
+	popular := put()
+	for i := 0; i < 3; i++ {
+		get(popular)
+	}
+
+	_ = put()
+
+	// Each round stores a blob that is read once, and another that is never
+	// read, which pushes the cache over its high watermark.
+	round := func() {
+		get(put())
+		_ = put()
+
+		require.Eventually(t, func() bool {
+			usage, err := c.Usage()
+			return err == nil && usage.SizeBytes == 2000
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+
+	for i := 0; i < 2; i++ {
+		round()
+	}
+
+	// The popular blob is kept while it's more popular than new blobs.
+	_, err = c.Stat(popular)
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		round()
+	}
+
+	// But ages out once it hasn't been read for a while.
+	_, err = c.Stat(popular)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestCacheForgetsRemovedEntries(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+
+	dir := t.TempDir()
+
+	c, err := cache.New(logger, cache.Options{
+		Dir: dir,
+		NewHash: func() hash.Hash {
+			return sha256.New()
+		},
+		HashSize: sha256.Size,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, c.Close())
+	})
+
+	for name, remove := range map[string]func(id []byte) error{
+		"Evict":      c.Evict,
+		"Quarantine": c.Quarantine,
+	} {
+		t.Run(name, func(t *testing.T) {
+			data := []byte(name)
+
+			id, _, err := c.Put(bytes.NewReader(data))
+			require.NoError(t, err)
+
+			require.NoError(t, c.Pin(id))
+			require.NoError(t, c.SetPriority(id, 5))
+
+			r, _, err := c.Get(id)
+			require.NoError(t, err)
+			require.NoError(t, r.Close())
+
+			require.NoError(t, remove(id))
+
+			// Caching the blob again starts from a clean slate.
+			_, _, err = c.Put(bytes.NewReader(data))
+			require.NoError(t, err)
+
+			assert.False(t, c.IsPinned(id))
+			assert.Zero(t, c.Priority(id))
+			assert.Zero(t, c.Hits(id))
+		})
+	}
+}
+
+func TestCacheMemoryTier(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+
+	dir := t.TempDir()
+
+	c, err := cache.New(logger, cache.Options{
+		Dir: dir,
+		NewHash: func() hash.Hash {
+			return sha256.New()
+		},
+		HashSize:          sha256.Size,
+		MemoryMaxBytes:    2000,
+		MemoryMaxBlobSize: 1000,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, c.Close())
+	})
+
+	small := bytes.Repeat([]byte{1}, 1000)
+	smallID, _, err := c.Put(bytes.NewReader(small))
+	require.NoError(t, err)
+
+	largeID, _, err := c.Put(bytes.NewReader(bytes.Repeat([]byte{2}, 1001)))
+	require.NoError(t, err)
+
+	_, ok := c.GetMemory(smallID)
+	assert.False(t, ok)
+
+	// Reading from disk should promote small blobs.
+	for _, id := range [][]byte{smallID, largeID} {
+		r, _, err := c.Get(id)
+		require.NoError(t, err)
+		require.NoError(t, r.Close())
+	}
+
+	data, ok := c.GetMemory(smallID)
+	require.True(t, ok)
+	assert.Equal(t, small, data)
+
+	_, ok = c.GetMemory(largeID)
+	assert.False(t, ok)
+
+	usage, err := c.Usage()
+	require.NoError(t, err)
+	require.NotNil(t, usage.Memory)
+
+	assert.Equal(t, int64(1000), usage.Memory.SizeBytes)
+	assert.Equal(t, 1, usage.Memory.Entries)
+	assert.Equal(t, int64(1), usage.Memory.Hits)
+	assert.Equal(t, int64(2), usage.Memory.Misses)
+
+	// Evicting from the cache also removes the blob from memory.
+	require.NoError(t, c.Evict(smallID))
+
+	_, ok = c.GetMemory(smallID)
+	assert.False(t, ok)
+
+	t.Run("Corrupt Entries", func(t *testing.T) {
+		data := bytes.Repeat([]byte{3}, 1000)
+		id, _, err := c.Put(bytes.NewReader(data))
+		require.NoError(t, err)
+
+		corrupt := bytes.Repeat([]byte{4}, 1000)
+		require.NoError(t, os.WriteFile(filepath.Join(dir, fmt.Sprintf("%02x", id[0]), fmt.Sprintf("%x-d", id)), corrupt, 0o644))
+
+		_, _, err = c.Get(id)
+		require.ErrorIs(t, err, integrity.ErrCorrupt)
+
+		// The corrupt copy must never be promoted to memory.
+		_, ok := c.GetMemory(id)
+		assert.False(t, ok)
+
+		_, _, err = c.Get(id)
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+}
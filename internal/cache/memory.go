@@ -0,0 +1,135 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cache
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/gpu-ninja/download-mirror/internal/metrics"
+)
+
+// MemoryStats describes the usage of the in-memory hot tier.
+type MemoryStats struct {
+	SizeBytes int64
+	MaxBytes  int64
+	Entries   int
+	Hits      int64
+	Misses    int64
+	Evictions int64
+}
+
+// memoryTier is a byte budgeted, least recently used, in-memory cache of
+// small blobs.
+type memoryTier struct {
+	maxBytes int64
+	mu       sync.Mutex
+	lru      *list.List
+	entries  map[string]*list.Element
+	stats    MemoryStats
+}
+
+type memoryEntry struct {
+	key  string
+	data []byte
+}
+
+func newMemoryTier(maxBytes int64) *memoryTier {
+	return &memoryTier{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+		stats:    MemoryStats{MaxBytes: maxBytes},
+	}
+}
+
+// get returns the blob, the returned slice must not be modified.
+func (m *memoryTier) get(key string) ([]byte, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	elem, ok := m.entries[key]
+	if !ok {
+		m.stats.Misses++
+		metrics.MemoryCacheMisses.Inc()
+
+		return nil, false
+	}
+
+	m.lru.MoveToFront(elem)
+
+	m.stats.Hits++
+	metrics.MemoryCacheHits.Inc()
+
+	return elem.Value.(*memoryEntry).data, true
+}
+
+func (m *memoryTier) add(key string, data []byte) {
+	if int64(len(data)) > m.maxBytes {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if elem, ok := m.entries[key]; ok {
+		m.lru.MoveToFront(elem)
+		return
+	}
+
+	m.entries[key] = m.lru.PushFront(&memoryEntry{key: key, data: data})
+	m.stats.SizeBytes += int64(len(data))
+
+	for m.stats.SizeBytes > m.maxBytes {
+		m.removeElement(m.lru.Back())
+
+		m.stats.Evictions++
+		metrics.MemoryCacheEvictions.Inc()
+	}
+
+	metrics.MemoryCacheSizeBytes.Set(float64(m.stats.SizeBytes))
+}
+
+func (m *memoryTier) remove(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if elem, ok := m.entries[key]; ok {
+		m.removeElement(elem)
+
+		metrics.MemoryCacheSizeBytes.Set(float64(m.stats.SizeBytes))
+	}
+}
+
+// removeElement must be called with mu held.
+func (m *memoryTier) removeElement(elem *list.Element) {
+	entry := m.lru.Remove(elem).(*memoryEntry)
+	delete(m.entries, entry.key)
+
+	m.stats.SizeBytes -= int64(len(entry.data))
+}
+
+func (m *memoryTier) usage() MemoryStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stats := m.stats
+	stats.Entries = len(m.entries)
+
+	return stats
+}
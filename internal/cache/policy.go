@@ -0,0 +1,97 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cache
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Policy determines the order in which unpinned entries are evicted.
+type Policy string
+
+const (
+	// PolicyLRU evicts the least recently used entries first.
+	PolicyLRU Policy = "lru"
+	// PolicyLFU evicts the least frequently used entries first.
+	PolicyLFU Policy = "lfu"
+	// PolicyGDSF (Greedy-Dual-Size-Frequency) evicts large, infrequently used
+	// entries first, favouring keeping many small popular blobs.
+	PolicyGDSF Policy = "gdsf"
+)
+
+// ParsePolicy parses an eviction policy name.
+func ParsePolicy(s string) (Policy, error) {
+	switch p := Policy(strings.ToLower(strings.TrimSpace(s))); p {
+	case "":
+		return PolicyLRU, nil
+	case PolicyLRU, PolicyLFU, PolicyGDSF:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown eviction policy: %q", s)
+	}
+}
+
+// evictionOrder returns the unpinned entries in the order they should be
+// evicted. Lower priority entries are always evicted before higher priority
+// ones, the policy decides the order within a priority. For GDSF, score
+// returns the key of an entry.
+func evictionOrder(policy Policy, entries []Entry, score func(Entry) float64) []Entry {
+	var candidates []Entry
+	for _, entry := range entries {
+		if !entry.Pinned {
+			candidates = append(candidates, entry)
+		}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+
+		if a.Priority != b.Priority {
+			return a.Priority < b.Priority
+		}
+
+		switch policy {
+		case PolicyLFU:
+			if a.Hits != b.Hits {
+				return a.Hits < b.Hits
+			}
+		case PolicyGDSF:
+			if sa, sb := score(a), score(b); sa != sb {
+				return sa < sb
+			}
+		}
+
+		return a.LastAccess.Before(b.LastAccess)
+	})
+
+	return candidates
+}
+
+// gdsfScore is the GDSF key (H = L + F/S) of an entry as it's stored or
+// accessed, assuming a uniform fetch cost. The inflation value L is the key of
+// the last evicted entry, so entries that haven't been accessed for a while
+// age out even if they were once popular.
+func gdsfScore(inflation float64, hits, size int64) float64 {
+	if size < 1 {
+		size = 1
+	}
+
+	return inflation + float64(hits+1)/float64(size)
+}
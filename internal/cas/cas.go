@@ -18,71 +18,95 @@
 package cas
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
 	"errors"
 	"fmt"
-	"hash"
 	"io"
 	"net/http"
 	"net/url"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/akamensky/base58"
-	"github.com/gpu-ninja/blobcache"
-	"github.com/gpu-ninja/download-mirror/internal/securehash"
+	"github.com/gpu-ninja/download-mirror/internal/accesslog"
+	"github.com/gpu-ninja/download-mirror/internal/auth"
+	"github.com/gpu-ninja/download-mirror/internal/blobid"
+	"github.com/gpu-ninja/download-mirror/internal/cache"
+	"github.com/gpu-ninja/download-mirror/internal/integrity"
+	"github.com/gpu-ninja/download-mirror/internal/meta"
+	"github.com/gpu-ninja/download-mirror/internal/metrics"
+	"github.com/gpu-ninja/download-mirror/internal/quota"
+	"github.com/gpu-ninja/download-mirror/internal/ratelimit"
+	"github.com/gpu-ninja/download-mirror/internal/tracing"
 	"github.com/gpu-ninja/download-mirror/internal/upstream"
+	"github.com/gpu-ninja/download-mirror/pkg/api"
 	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 	"golang.org/x/sync/errgroup"
 )
 
-const (
-	cacheTrimInterval = 5 * time.Minute
-)
+var tracer = tracing.Tracer("cas")
+
+// maxFieldsSize is the maximum total size of the form fields (other than the
+// file) of an upload.
+const maxFieldsSize = 1 << 20
+
+// Options configures the content addressable storage handler.
+type Options struct {
+	// BaseURL is the base URL of blobs, if empty blob URLs will be derived
+	// from the incoming request.
+	BaseURL string
+	// VerifyOnServe re-hashes blobs served from the local disk cache, so that
+	// corrupt cache entries are never served. Blobs in the in-memory hot tier
+	// are always verified as they're promoted from disk, so they're trusted.
+	VerifyOnServe bool
+	// KeyID identifies the secure hash key new blobs are addressed under.
+	KeyID string
+	// LegacyIDs issues legacy (unversioned) ids for new blobs, for clients
+	// that can't handle versioned ids.
+	LegacyIDs bool
+	// SHA512 records the SHA-512 digest of uploaded blobs, in addition to
+	// their SHA-256 digest.
+	SHA512 bool
+	// Signer, if set, signs the content of newly stored blobs.
+	Signer Signer
+	// Quotas, if set, limits the size of uploaded blobs and charges them to
+	// the quota of their owner.
+	Quotas *quota.Quotas
+}
+
+// Signer signs the content of blobs as they are stored.
+type Signer interface {
+	SignBlob(ctx context.Context, r io.Reader, blob *meta.Blob) error
+}
 
 // Storage is a cached content addressable storage handler.
 type Storage struct {
 	logger     *zap.Logger
-	baseURL    string
-	localCache *blobcache.Cache
+	opts       Options
+	localCache *cache.Cache
 	ups        upstream.Upstream
+	metadata   *meta.Store
+	digests    *digestCache
 }
 
-func NewStorage(ctx context.Context, logger *zap.Logger, cacheDir string, cacheMaxBytes int64, secureHashSecret []byte, baseURL string, ups upstream.Upstream) (*Storage, error) {
-	if err := os.MkdirAll(cacheDir, 0o755); err != nil {
-		return nil, fmt.Errorf("failed to create cache directory: %w", err)
-	}
-
-	localCache, err := blobcache.NewCache(logger, cacheDir, func() hash.Hash {
-		return securehash.New(secureHashSecret)
-	}, securehash.Size, nil)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open cache: %w", err)
-	}
-
-	ticker := time.NewTicker(cacheTrimInterval)
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case <-ticker.C:
-				logger.Info("Trimming cache")
-
-				if err := localCache.Trim(cacheMaxBytes); err != nil {
-					logger.Error("Failed to trim cache", zap.Error(err))
-				}
-			}
-		}
-	}()
-
+// NewStorage creates a new content addressable storage handler.
+func NewStorage(logger *zap.Logger, localCache *cache.Cache, ups upstream.Upstream, metadata *meta.Store, opts Options) *Storage {
 	return &Storage{
 		logger:     logger,
-		baseURL:    baseURL,
+		opts:       opts,
 		localCache: localCache,
 		ups:        ups,
-	}, nil
+		metadata:   metadata,
+		digests:    newDigestCache(),
+	}
 }
 
 func (s *Storage) Get(c echo.Context) error {
@@ -90,32 +114,210 @@ func (s *Storage) Get(c echo.Context) error {
 
 	s.logger.Info("Received request for blob", zap.String("id", encodedID))
 
-	id, err := base58.Decode(encodedID)
-	if err != nil || len(id) != securehash.Size {
+	metrics.ActiveTransfers.WithLabelValues("download").Inc()
+	defer metrics.ActiveTransfers.WithLabelValues("download").Dec()
+
+	ctx, span := tracer.Start(c.Request().Context(), "cas.Get",
+		trace.WithAttributes(attribute.String("blob.id", encodedID)))
+	defer span.End()
+
+	parsedID, err := blobid.ParseString(encodedID)
+	if err != nil {
 		s.logger.Warn("Invalid id", zap.String("id", encodedID), zap.Error(err))
 
 		return echo.NewHTTPError(http.StatusBadRequest)
 	}
 
-	cacheReader, entry, err := s.localCache.Get(id)
-	if err != nil && !errors.Is(err, os.ErrNotExist) {
+	return s.serve(ctx, c, parsedID, true)
+}
+
+// Serve writes the blob with the given id to the client. Re-keyed blobs are
+// served in place, as the caller's route may not be a blob URL.
+func (s *Storage) Serve(c echo.Context, parsedID blobid.ID) error {
+	encodedID := parsedID.String()
+
+	metrics.ActiveTransfers.WithLabelValues("download").Inc()
+	defer metrics.ActiveTransfers.WithLabelValues("download").Dec()
+
+	ctx, span := tracer.Start(c.Request().Context(), "cas.Serve",
+		trace.WithAttributes(attribute.String("blob.id", encodedID)))
+	defer span.End()
+
+	return s.serve(ctx, c, parsedID, false)
+}
+
+// serve writes a blob to the client, if redirect is set re-keyed blobs are
+// redirected to their blob URL, otherwise they're served in place.
+func (s *Storage) serve(ctx context.Context, c echo.Context, parsedID blobid.ID, redirect bool) error {
+	span := trace.SpanFromContext(ctx)
+	encodedID := parsedID.String()
+
+	// The local cache is keyed by digest, the upstream by the full id.
+	id, digest := parsedID.Bytes(), parsedID.Digest
+
+	s.setDigestHeaders(ctx, c, id)
+
+	if data, ok := s.localCache.GetMemory(digest); ok {
+		s.logger.Info("Blob found in memory cache", zap.String("id", encodedID))
+
+		metrics.CacheHits.Inc()
+		span.SetAttributes(attribute.Bool("cache.hit", true), attribute.String("cache.tier", "memory"))
+		accesslog.SetCacheHit(c, true)
+
+		// Written directly from the cached slice, without copying.
+		serveContent(c, encodedID, bytes.NewReader(data))
+
+		metrics.ServedBytes.WithLabelValues("memory").Add(float64(c.Response().Size))
+
+		return nil
+	}
+
+	_, cacheSpan := tracer.Start(ctx, "blobcache.Get")
+	cacheReader, entry, err := s.localCache.Get(digest)
+	cacheSpan.End()
+	if errors.Is(err, integrity.ErrCorrupt) {
+		s.logger.Error("Corrupt blob in local cache", zap.String("id", encodedID))
+
+		metrics.IntegrityFailures.WithLabelValues("cache").Inc()
+	} else if err != nil && !errors.Is(err, os.ErrNotExist) {
 		s.logger.Error("Failed to get file from cache",
 			zap.String("id", encodedID), zap.Error(err))
 
+		tracing.RecordError(span, err)
 		return echo.NewHTTPError(http.StatusInternalServerError)
 	} else if err == nil {
 		defer cacheReader.Close()
 
 		s.logger.Info("Blob found in local cache", zap.String("id", encodedID))
 
-		c.Response().Header().Set(echo.HeaderContentLength, fmt.Sprintf("%d", entry.Size))
+		metrics.CacheHits.Inc()
+		span.SetAttributes(attribute.Bool("cache.hit", true))
+		accesslog.SetCacheHit(c, true)
 
-		return c.Stream(http.StatusOK, echo.MIMEOctetStream, cacheReader)
+		return s.serveFromCache(ctx, c, encodedID, digest, cacheReader, entry.Size)
 	}
 
 	s.logger.Info("Blob not found in local cache", zap.String("id", encodedID))
 
-	r, contentLength, err := s.ups.Get(id)
+	metrics.CacheMisses.Inc()
+	span.SetAttributes(attribute.Bool("cache.hit", false))
+	accesslog.SetCacheHit(c, false)
+
+	// Blobs addressed under a legacy key may have been re-keyed.
+	rekeyed, err := s.metadata.GetRedirect(ctx, id)
+	if err == nil {
+		if redirect {
+			s.logger.Info("Redirecting re-keyed blob", zap.String("id", encodedID),
+				zap.String("target", rekeyed.Target))
+
+			return c.Redirect(http.StatusMovedPermanently, s.BlobURL(c, rekeyed.Target, c.Param("name")))
+		}
+
+		target, err := blobid.ParseString(rekeyed.Target)
+		if err != nil {
+			s.logger.Error("Invalid re-keyed blob target", zap.String("id", encodedID),
+				zap.String("target", rekeyed.Target), zap.Error(err))
+
+			return echo.NewHTTPError(http.StatusInternalServerError)
+		}
+
+		s.logger.Info("Serving re-keyed blob", zap.String("id", encodedID),
+			zap.String("target", rekeyed.Target))
+
+		// Re-keyed blobs are addressed under the primary key, so they're
+		// never redirected again.
+		return s.serve(ctx, c, target, false)
+	} else if !errors.Is(err, meta.ErrNotFound) {
+		s.logger.Warn("Failed to get blob redirect", zap.String("id", encodedID), zap.Error(err))
+	}
+
+	if err := ratelimit.AllowCacheMiss(c); err != nil {
+		return err
+	}
+
+	err = s.serveFromUpstream(ctx, c, id)
+	if !errors.Is(err, integrity.ErrCorrupt) {
+		return err
+	}
+
+	s.logger.Error("Corrupt blob in upstream", zap.String("id", encodedID))
+
+	metrics.IntegrityFailures.WithLabelValues("upstream").Inc()
+	tracing.RecordError(span, err)
+
+	// The corrupt copy has been quarantined, so try to fill the cache from
+	// the next replica (so that the client can retry).
+	if _, fillErr := s.fill(ctx, id); fillErr != nil {
+		s.logger.Error("Failed to recover blob from replicas",
+			zap.String("id", encodedID), zap.Error(fillErr))
+	} else if !c.Response().Committed {
+		cacheReader, entry, err := s.localCache.Get(digest)
+		if err == nil {
+			defer cacheReader.Close()
+
+			return s.serveFromCache(ctx, c, encodedID, digest, cacheReader, entry.Size)
+		}
+	}
+
+	if c.Response().Committed {
+		// Abort the connection rather than completing a corrupt response.
+		panic(http.ErrAbortHandler)
+	}
+
+	return echo.NewHTTPError(http.StatusBadGateway)
+}
+
+func (s *Storage) serveFromCache(ctx context.Context, c echo.Context, encodedID string, digest []byte, cacheReader io.ReadSeeker, size int64) error {
+	_, writeSpan := tracer.Start(ctx, "client.Write")
+	defer writeSpan.End()
+
+	// Range requests (for parallel and resumed downloads) can only be served
+	// when the whole blob doesn't need to be verified as it is written.
+	if !s.opts.VerifyOnServe {
+		serveContent(c, encodedID, cacheReader)
+
+		metrics.ServedBytes.WithLabelValues("cache").Add(float64(c.Response().Size))
+
+		return nil
+	}
+
+	r := integrity.NewReader(cacheReader, s.localCache.NewHash(), digest, size)
+
+	c.Response().Header().Set(echo.HeaderContentLength, fmt.Sprintf("%d", size))
+
+	err := c.Stream(http.StatusOK, echo.MIMEOctetStream, readerFunc(func(p []byte) (int, error) {
+		n, err := r.Read(p)
+		metrics.ServedBytes.WithLabelValues("cache").Add(float64(n))
+
+		return n, err
+	}))
+	if errors.Is(err, integrity.ErrCorrupt) {
+		s.logger.Error("Corrupt blob in local cache", zap.String("digest", base58.Encode(digest)))
+
+		metrics.IntegrityFailures.WithLabelValues("cache").Inc()
+		tracing.RecordError(writeSpan, err)
+
+		if err := s.localCache.Quarantine(digest); err != nil {
+			s.logger.Error("Failed to quarantine corrupt cache entry", zap.Error(err))
+		}
+
+		// Abort the connection rather than completing a corrupt response.
+		panic(http.ErrAbortHandler)
+	}
+
+	return err
+}
+
+// serveFromUpstream streams a blob from the upstream to the client, while
+// simultaneously storing it in the local cache. The blob is verified before
+// it is committed to the cache, and if the upstream copy turns out to be
+// corrupt integrity.ErrCorrupt is returned.
+func (s *Storage) serveFromUpstream(ctx context.Context, c echo.Context, id []byte) error {
+	span := trace.SpanFromContext(ctx)
+
+	upstreamStart := time.Now()
+
+	r, contentLength, err := s.ups.Get(ctx, id)
 	if err != nil {
 		s.logger.Error("Failed to download blob from upstream", zap.Error(err))
 
@@ -123,6 +325,7 @@ func (s *Storage) Get(c echo.Context) error {
 			return echo.NewHTTPError(http.StatusNotFound)
 		}
 
+		tracing.RecordError(span, err)
 		return echo.NewHTTPError(http.StatusInternalServerError)
 	}
 	defer r.Close()
@@ -140,16 +343,23 @@ func (s *Storage) Get(c echo.Context) error {
 
 	dataAvailableCh := make(chan struct{}, 1)
 
-	g, ctx := errgroup.WithContext(c.Request().Context())
+	g, gCtx := errgroup.WithContext(ctx)
 
 	g.Go(func() error {
 		defer close(dataAvailableCh)
 
-		if _, err = copyContext(ctx, io.MultiWriter(f, writerFunc(func(p []byte) (int, error) {
+		_, readSpan := tracer.Start(ctx, "upstream.Read")
+		defer readSpan.End()
+
+		defer func() {
+			accesslog.SetUpstreamDuration(c, time.Since(upstreamStart))
+		}()
+
+		if _, err = copyContext(gCtx, io.MultiWriter(f, writerFunc(func(p []byte) (int, error) {
 			dataAvailableCh <- struct{}{}
 
 			return len(p), nil
-		})), r); err != nil {
+		})), ratelimit.LimitCacheMiss(c, r)); err != nil {
 			return fmt.Errorf("failed to read blob from upstream: %w", err)
 		}
 
@@ -157,6 +367,9 @@ func (s *Storage) Get(c echo.Context) error {
 	})
 
 	g.Go(func() error {
+		_, writeSpan := tracer.Start(ctx, "client.Write")
+		defer writeSpan.End()
+
 		var writtenBytes int64
 		buf := make([]byte, 32*1024)
 
@@ -188,14 +401,21 @@ func (s *Storage) Get(c echo.Context) error {
 			}
 
 			writtenBytes += int64(nw)
+
+			metrics.ServedBytes.WithLabelValues("upstream").Add(float64(nw))
 		}
 
 		return nil
 	})
 
 	if err := g.Wait(); err != nil {
+		if errors.Is(err, integrity.ErrCorrupt) {
+			return err
+		}
+
 		s.logger.Error("Encountered error transferring blob", zap.Error(err))
 
+		tracing.RecordError(span, err)
 		return echo.NewHTTPError(http.StatusInternalServerError)
 	}
 
@@ -205,34 +425,123 @@ func (s *Storage) Get(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError)
 	}
 
-	if _, _, err := s.localCache.Put(f); err != nil {
+	_, cacheSpan := tracer.Start(ctx, "blobcache.Put")
+	defer cacheSpan.End()
+
+	// Cached under the digest it was requested by, which for blobs addressed
+	// under a legacy key is not the digest under the primary key.
+	if _, err := s.localCache.PutDigest(f, blobid.Digest(id)); err != nil {
 		s.logger.Error("Failed to store blob in cache", zap.Error(err))
 
+		tracing.RecordError(cacheSpan, err)
 		return echo.NewHTTPError(http.StatusInternalServerError)
 	}
 
 	return nil
 }
 
-func (s *Storage) Put(c echo.Context) error {
-	body, err := c.FormFile("file")
-	if err != nil {
-		s.logger.Warn("Failed to get file from form", zap.Error(err))
+// serveContent serves a cached blob, with support for range and conditional
+// requests. Blobs are immutable, so their id is a strong ETag.
+func serveContent(c echo.Context, encodedID string, content io.ReadSeeker) {
+	c.Response().Header().Set(echo.HeaderContentType, echo.MIMEOctetStream)
+	c.Response().Header().Set("ETag", `"`+encodedID+`"`)
 
-		return echo.NewHTTPError(http.StatusBadRequest)
+	http.ServeContent(c.Response(), c.Request(), "", time.Time{}, content)
+}
+
+// Open opens the content of a blob, from the local cache if possible,
+// otherwise it's downloaded into the local cache first.
+func (s *Storage) Open(ctx context.Context, id []byte) (io.ReadCloser, error) {
+	digest := blobid.Digest(id)
+
+	r, _, err := s.localCache.Get(digest)
+	if errors.Is(err, os.ErrNotExist) || errors.Is(err, integrity.ErrCorrupt) {
+		if _, err := s.fill(ctx, id); err != nil {
+			return nil, err
+		}
+
+		r, _, err = s.localCache.Get(digest)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get blob from cache: %w", err)
 	}
 
-	s.logger.Info("Received request to store blob",
-		zap.String("name", body.Filename))
+	return r, nil
+}
+
+// Warm downloads a blob from the upstream into the local cache, unless it's
+// already cached. It returns whether the blob was downloaded, and its size.
+func (s *Storage) Warm(ctx context.Context, id []byte) (bool, int64, error) {
+	if entry, err := s.localCache.Stat(blobid.Digest(id)); err == nil {
+		return false, entry.Size, nil
+	}
 
-	r, err := body.Open()
+	size, err := s.fill(ctx, id)
 	if err != nil {
-		s.logger.Warn("Failed to open form file", zap.Error(err))
+		return false, 0, err
+	}
 
-		return echo.NewHTTPError(http.StatusInternalServerError)
+	return true, size, nil
+}
+
+// fill downloads a blob from the upstream into the local cache, returning its
+// size.
+func (s *Storage) fill(ctx context.Context, id []byte) (int64, error) {
+	r, _, err := s.ups.Get(ctx, id)
+	if err != nil {
+		return 0, fmt.Errorf("failed to download blob from upstream: %w", err)
 	}
 	defer r.Close()
 
+	f, err := os.CreateTemp("", "blob-")
+	if err != nil {
+		return 0, fmt.Errorf("failed to create temporary blob file: %w", err)
+	}
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}()
+
+	if _, err := copyContext(ctx, f, r); err != nil {
+		return 0, fmt.Errorf("failed to read blob from upstream: %w", err)
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, fmt.Errorf("failed to rewind temporary blob file: %w", err)
+	}
+
+	size, err := s.localCache.PutDigest(f, blobid.Digest(id))
+	if err != nil {
+		return 0, fmt.Errorf("failed to store blob in cache: %w", err)
+	}
+
+	return size, nil
+}
+
+func (s *Storage) Put(c echo.Context) error {
+	metrics.ActiveTransfers.WithLabelValues("upload").Inc()
+	defer metrics.ActiveTransfers.WithLabelValues("upload").Dec()
+
+	ctx, span := tracer.Start(c.Request().Context(), "cas.Put")
+	defer span.End()
+
+	owner := auth.TokenName(c)
+
+	// Reject uploads that are obviously too large before reading any of them.
+	if s.opts.Quotas != nil && s.opts.Quotas.MaxBlobSize() > 0 &&
+		c.Request().ContentLength > s.opts.Quotas.MaxBlobSize()+maxFieldsSize {
+		return quota.HTTPError(quota.ErrTooLarge)
+	}
+
+	// The form is streamed (rather than spooled by echo), so that limits are
+	// enforced as the blob is uploaded.
+	mr, err := c.Request().MultipartReader()
+	if err != nil {
+		s.logger.Warn("Failed to read multipart form", zap.Error(err))
+
+		return echo.NewHTTPError(http.StatusBadRequest)
+	}
+
 	f, err := os.CreateTemp("", "blob-")
 	if err != nil {
 		s.logger.Error("Failed to create temporary blob file", zap.Error(err))
@@ -244,10 +553,95 @@ func (s *Storage) Put(c echo.Context) error {
 		_ = os.Remove(f.Name())
 	}()
 
-	if _, err := copyContext(c.Request().Context(), f, r); err != nil {
-		s.logger.Warn("Failed to get blob from client", zap.Error(err))
+	// Public digests, so that downloads can be verified against published
+	// checksums.
+	sha256Hash, sha512Hash := sha256.New(), sha512.New()
+
+	var (
+		name        string
+		hasFile     bool
+		labelValues []string
+		fieldsSize  int64
+	)
+
+	for {
+		part, err := mr.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			s.logger.Warn("Failed to read multipart form", zap.Error(err))
+
+			return echo.NewHTTPError(http.StatusBadRequest)
+		}
 
-		return echo.NewHTTPError(http.StatusInternalServerError)
+		switch part.FormName() {
+		case "file":
+			if hasFile {
+				return echo.NewHTTPError(http.StatusBadRequest, "multiple files")
+			}
+			hasFile, name = true, part.FileName()
+
+			s.logger.Info("Received request to store blob", zap.String("name", name))
+
+			writers := []io.Writer{f, sha256Hash}
+			if s.opts.SHA512 {
+				writers = append(writers, sha512Hash)
+			}
+
+			limit, err := s.UploadWriter(ctx, owner)
+			if httpErr := quota.HTTPError(err); httpErr != nil {
+				return httpErr
+			} else if err != nil {
+				s.logger.Error("Failed to check quota", zap.Error(err))
+
+				return echo.NewHTTPError(http.StatusInternalServerError)
+			}
+			writers = append(writers, limit)
+
+			_, readSpan := tracer.Start(ctx, "client.Read")
+			_, err = copyContext(ctx, io.MultiWriter(writers...), part)
+			readSpan.End()
+			if httpErr := quota.HTTPError(err); httpErr != nil {
+				s.logger.Warn("Rejected blob upload", zap.String("name", name),
+					zap.String("token", owner), zap.Error(err))
+
+				return httpErr
+			} else if err != nil {
+				s.logger.Warn("Failed to get blob from client", zap.Error(err))
+
+				tracing.RecordError(span, err)
+				return echo.NewHTTPError(http.StatusInternalServerError)
+			}
+		default:
+			value, err := io.ReadAll(io.LimitReader(part, maxFieldsSize-fieldsSize+1))
+			if err != nil {
+				s.logger.Warn("Failed to read form field", zap.Error(err))
+
+				return echo.NewHTTPError(http.StatusBadRequest)
+			}
+
+			fieldsSize += int64(len(value))
+			if fieldsSize > maxFieldsSize {
+				return echo.NewHTTPError(http.StatusRequestEntityTooLarge, "form fields are too large")
+			}
+
+			if part.FormName() == "label" {
+				labelValues = append(labelValues, string(value))
+			}
+		}
+	}
+
+	if !hasFile {
+		s.logger.Warn("Missing file in form")
+
+		return echo.NewHTTPError(http.StatusBadRequest)
+	}
+
+	labels, err := meta.ParseLabels(labelValues)
+	if err != nil {
+		s.logger.Warn("Invalid labels", zap.Error(err))
+
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
 
 	if err := f.Sync(); err != nil {
@@ -262,33 +656,248 @@ func (s *Storage) Put(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError)
 	}
 
-	id, _, err := s.localCache.Put(f)
-	if err != nil {
-		s.logger.Error("Failed to store blob in cache", zap.Error(err))
+	blob := &meta.Blob{
+		Name:   name,
+		Labels: labels,
+		SHA256: hex.EncodeToString(sha256Hash.Sum(nil)),
+		Owner:  owner,
+	}
+
+	if s.opts.SHA512 {
+		blob.SHA512 = hex.EncodeToString(sha512Hash.Sum(nil))
+	}
+
+	if err := s.Store(ctx, f, blob); err != nil {
+		if httpErr := quota.HTTPError(err); httpErr != nil {
+			return httpErr
+		}
+
+		s.logger.Error("Failed to store blob", zap.Error(err))
 
+		tracing.RecordError(span, err)
 		return echo.NewHTTPError(http.StatusInternalServerError)
 	}
 
-	encodedID := base58.Encode(id[:])
+	encodedID := blob.ID
 
-	s.logger.Info("Received blob", zap.String("name", body.Filename),
+	s.logger.Info("Received blob", zap.String("name", name),
 		zap.String("id", encodedID))
 
-	cacheReader, _, err := s.localCache.Get(id)
+	span.SetAttributes(attribute.String("blob.id", encodedID))
+
+	digestsFromBlob(blob).setHeaders(c.Response().Header())
+
+	// Older clients expect just the URL of the blob.
+	if strings.Contains(c.Request().Header.Get(echo.HeaderAccept), echo.MIMEApplicationJSON) {
+		return c.JSON(http.StatusCreated, s.toAPI(c, blob))
+	}
+
+	return c.String(http.StatusCreated, s.BlobURL(c, encodedID, name))
+}
+
+// Stat returns the metadata of a blob.
+func (s *Storage) Stat(c echo.Context) error {
+	encodedID := c.Param("id")
+
+	parsedID, err := blobid.ParseString(encodedID)
 	if err != nil {
-		s.logger.Error("Failed to get blob from cache", zap.Error(err))
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid id")
+	}
+
+	blob, err := s.metadata.GetBlob(c.Request().Context(), parsedID.Bytes())
+	if errors.Is(err, meta.ErrNotFound) {
+		return echo.NewHTTPError(http.StatusNotFound, "unknown blob")
+	} else if err != nil {
+		s.logger.Error("Failed to get blob metadata", zap.String("id", encodedID), zap.Error(err))
 
 		return echo.NewHTTPError(http.StatusInternalServerError)
 	}
+
+	return c.JSON(http.StatusOK, s.toAPI(c, blob))
+}
+
+func (s *Storage) toAPI(c echo.Context, blob *meta.Blob) *api.Blob {
+	return &api.Blob{
+		ID:        blob.ID,
+		Name:      blob.Name,
+		URL:       s.BlobURL(c, blob.ID, blob.Name),
+		Size:      blob.Size,
+		Labels:    blob.Labels,
+		SHA256:    blob.SHA256,
+		SHA512:    blob.SHA512,
+		CreatedAt: blob.CreatedAt,
+	}
+}
+
+// StoreReader spools the content of r to a temporary file, recording its
+// public digests, and then stores it as a blob (see Store).
+func (s *Storage) StoreReader(ctx context.Context, r io.Reader, blob *meta.Blob) error {
+	f, err := os.CreateTemp("", "blob-")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary blob file: %w", err)
+	}
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}()
+
+	limit, err := s.UploadWriter(ctx, blob.Owner)
+	if err != nil {
+		return err
+	}
+
+	sha256Hash, sha512Hash := sha256.New(), sha512.New()
+	writers := []io.Writer{f, sha256Hash, limit}
+	if s.opts.SHA512 {
+		writers = append(writers, sha512Hash)
+	}
+
+	if _, err := copyContext(ctx, io.MultiWriter(writers...), r); err != nil {
+		return fmt.Errorf("failed to read blob: %w", err)
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to rewind temporary blob file: %w", err)
+	}
+
+	blob.SHA256 = hex.EncodeToString(sha256Hash.Sum(nil))
+	if s.opts.SHA512 {
+		blob.SHA512 = hex.EncodeToString(sha512Hash.Sum(nil))
+	}
+
+	return s.Store(ctx, f, blob)
+}
+
+// UploadWriter returns a writer that fails with quota.ErrTooLarge or
+// quota.ErrExceeded as soon as a blob grows larger than the maximum blob size
+// or the remaining quota of its owner, so that oversized blobs can be
+// rejected while they are streamed. Owner may be empty for blobs that aren't
+// uploaded by a token (eg. mirrored blobs).
+func (s *Storage) UploadWriter(ctx context.Context, owner string) (io.Writer, error) {
+	if s.opts.Quotas == nil {
+		return io.Discard, nil
+	}
+
+	return s.opts.Quotas.Writer(ctx, owner)
+}
+
+// Store stores the content of f as a blob, in the local cache and the
+// upstream, and records its metadata. The name, labels and public digests of
+// the blob are taken from blob, which is updated with its id and size.
+func (s *Storage) Store(ctx context.Context, f *os.File, blob *meta.Blob) error {
+	var reservation *quota.Reservation
+	if s.opts.Quotas != nil {
+		fi, err := f.Stat()
+		if err != nil {
+			return fmt.Errorf("failed to stat blob: %w", err)
+		}
+
+		if maxSize := s.opts.Quotas.MaxBlobSize(); maxSize > 0 && fi.Size() > maxSize {
+			return quota.ErrTooLarge
+		}
+
+		// Uploaded blobs are charged to the quota of their owner.
+		if blob.Owner != "" {
+			reservation, err = s.opts.Quotas.Reserve(ctx, blob.Owner, fi.Size())
+			if err != nil {
+				return err
+			}
+			defer reservation.Release()
+		}
+	}
+
+	_, cacheSpan := tracer.Start(ctx, "blobcache.Put")
+	digest, size, err := s.localCache.Put(f)
+	cacheSpan.End()
+	if err != nil {
+		return fmt.Errorf("failed to store blob in cache: %w", err)
+	}
+
+	parsedID := blobid.New(blobid.HMACSHA256, s.opts.KeyID, digest)
+	if s.opts.LegacyIDs {
+		parsedID = blobid.Legacy(digest)
+	}
+
+	id, encodedID := parsedID.Bytes(), parsedID.String()
+
+	cacheReader, _, err := s.localCache.Get(digest)
+	if err != nil {
+		return fmt.Errorf("failed to get blob from cache: %w", err)
+	}
 	defer cacheReader.Close()
 
-	if err := s.ups.Put(id, cacheReader); err != nil {
-		s.logger.Error("Failed to upload blob to upstream", zap.Error(err))
+	if err := s.ups.Put(ctx, id, cacheReader); err != nil {
+		return fmt.Errorf("failed to upload blob to upstream: %w", err)
+	}
+
+	blob.ID = encodedID
+	blob.Size = size
+	blob.KeyID = s.opts.KeyID
+	createdAt := time.Now().UTC()
+	blob.CreatedAt = createdAt
 
-		return echo.NewHTTPError(http.StatusInternalServerError)
+	if err := s.metadata.PutBlob(ctx, blob); err != nil {
+		return fmt.Errorf("failed to store blob metadata: %w", err)
+	}
+
+	// Existing blobs keep their original creation time (and owner), so
+	// re-uploading them isn't charged again.
+	if reservation != nil && blob.CreatedAt.Equal(createdAt) {
+		if err := reservation.Commit(ctx); err != nil {
+			s.logger.Error("Failed to charge blob to quota", zap.String("id", encodedID),
+				zap.String("token", blob.Owner), zap.Error(err))
+		}
+	}
+
+	for algorithm, digest := range map[string]string{
+		meta.DigestSHA256: blob.SHA256,
+		meta.DigestSHA512: blob.SHA512,
+	} {
+		if digest == "" {
+			continue
+		}
+
+		if err := s.metadata.PutDigest(ctx, &meta.Digest{
+			Algorithm: algorithm,
+			Digest:    digest,
+			ID:        encodedID,
+			Name:      blob.Name,
+			CreatedAt: blob.CreatedAt,
+		}); err != nil {
+			return fmt.Errorf("failed to store blob digest: %w", err)
+		}
+	}
+
+	s.digests.add(encodedID, digestsFromBlob(blob))
+
+	if s.opts.Signer != nil {
+		signReader, _, err := s.localCache.Get(digest)
+		if err != nil {
+			return fmt.Errorf("failed to get blob from cache: %w", err)
+		}
+		defer signReader.Close()
+
+		if err := s.opts.Signer.SignBlob(ctx, signReader, blob); err != nil {
+			return fmt.Errorf("failed to sign blob: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// BlobURL returns the immutable URL of a blob.
+func (s *Storage) BlobURL(c echo.Context, encodedID, name string) string {
+	return fmt.Sprintf("%s/%s/%s", s.blobBaseURL(c), encodedID, url.PathEscape(name))
+}
+
+// blobBaseURL returns the base URL for blobs, if no base URL was configured
+// it is derived from the request (honouring any trusted proxy headers).
+func (s *Storage) blobBaseURL(c echo.Context) string {
+	if s.opts.BaseURL != "" {
+		return s.opts.BaseURL
 	}
 
-	return c.String(http.StatusCreated, fmt.Sprintf("%s/%s/%s", s.baseURL, encodedID, url.PathEscape(body.Filename)))
+	return fmt.Sprintf("%s://%s/blobs", c.Scheme(), c.Request().Host)
 }
 
 func copyContext(ctx context.Context, dst io.Writer, src io.Reader) (int64, error) {
@@ -21,17 +21,25 @@ import (
 	"bytes"
 	"context"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
 	"io"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
-	"os"
-	"path/filepath"
 	"strings"
 	"testing"
 
 	"github.com/akamensky/base58"
+	"github.com/gpu-ninja/download-mirror/internal/auth"
+	"github.com/gpu-ninja/download-mirror/internal/cache"
 	"github.com/gpu-ninja/download-mirror/internal/cas"
+	"github.com/gpu-ninja/download-mirror/internal/meta"
+	"github.com/gpu-ninja/download-mirror/internal/quota"
+	"github.com/gpu-ninja/download-mirror/internal/securehash"
 	"github.com/gpu-ninja/download-mirror/internal/upstream"
 	"github.com/labstack/echo/v4"
 	"github.com/stretchr/testify/assert"
@@ -40,21 +48,26 @@ import (
 )
 
 func TestContentAddressableStorage(t *testing.T) {
-	ctx := context.Background()
-
 	logger := zaptest.NewLogger(t)
 
 	secureHashSecret := []byte("test")
 
-	ups := &fsUpstream{
-		dir: t.TempDir(),
-	}
-
-	cacheCtx, cancel := context.WithCancel(ctx)
+	ups, err := upstream.NewFilesystem(t.TempDir())
+	require.NoError(t, err)
 
-	s, err := cas.NewStorage(cacheCtx, logger, t.TempDir(), 0, secureHashSecret, "https://example.com/blobs", ups)
+	localCache, err := cache.New(logger, cache.Options{
+		Dir: t.TempDir(),
+		NewHash: func() hash.Hash {
+			return securehash.New(secureHashSecret)
+		},
+		HashSize: securehash.Size,
+	})
 	require.NoError(t, err)
 
+	s := cas.NewStorage(logger, localCache, ups, meta.NewStore(ups), cas.Options{
+		BaseURL: "https://example.com/blobs",
+	})
+
 	data := make([]byte, 1000000)
 	_, err = io.ReadFull(rand.Reader, data)
 	require.NoError(t, err)
@@ -95,13 +108,24 @@ func TestContentAddressableStorage(t *testing.T) {
 	assert.Equal(t, http.StatusOK, rec.Code)
 	assert.Equal(t, data, rec.Body.Bytes())
 
-	cancel()
-	cacheCtx, cancel = context.WithCancel(ctx)
-	defer cancel()
+	require.NoError(t, localCache.Close())
 
 	// New empty cache directory.
-	s, err = cas.NewStorage(cacheCtx, logger, t.TempDir(), 0, secureHashSecret, "https://example.com/blobs", ups)
+	localCache, err = cache.New(logger, cache.Options{
+		Dir: t.TempDir(),
+		NewHash: func() hash.Hash {
+			return securehash.New(secureHashSecret)
+		},
+		HashSize: securehash.Size,
+	})
 	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, localCache.Close())
+	})
+
+	s = cas.NewStorage(logger, localCache, ups, meta.NewStore(ups), cas.Options{
+		BaseURL: "https://example.com/blobs",
+	})
 
 	req = httptest.NewRequest(http.MethodGet, "/", nil)
 	rec = httptest.NewRecorder()
@@ -117,35 +141,253 @@ func TestContentAddressableStorage(t *testing.T) {
 	assert.Equal(t, data, rec.Body.Bytes())
 }
 
-type fsUpstream struct {
-	dir string
+func TestGetByDigest(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+
+	ups, err := upstream.NewFilesystem(t.TempDir())
+	require.NoError(t, err)
+
+	localCache, err := cache.New(logger, cache.Options{
+		Dir: t.TempDir(),
+		NewHash: func() hash.Hash {
+			return securehash.New([]byte("test"))
+		},
+		HashSize: securehash.Size,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, localCache.Close())
+	})
+
+	s := cas.NewStorage(logger, localCache, ups, meta.NewStore(ups), cas.Options{
+		BaseURL: "https://example.com/blobs",
+		SHA512:  true,
+	})
+
+	data := []byte("hello world")
+	digest := sha256.Sum256(data)
+
+	e := echo.New()
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	part, err := writer.CreateFormFile("file", "hello.txt")
+	require.NoError(t, err)
+
+	_, err = part.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+
+	req := httptest.NewRequest(http.MethodPost, "/", &body)
+	req.Header.Set(echo.HeaderContentType, writer.FormDataContentType())
+	rec := httptest.NewRecorder()
+
+	require.NoError(t, s.Put(e.NewContext(req, rec)))
+
+	blobURL := rec.Body.String()
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	rec = httptest.NewRecorder()
+
+	c := e.NewContext(req, rec)
+	c.SetPath("/sha256/:digest")
+	c.SetParamNames("digest")
+	c.SetParamValues(hex.EncodeToString(digest[:]))
+
+	require.NoError(t, s.GetByDigest(c))
+
+	assert.Equal(t, http.StatusFound, rec.Code)
+	assert.Equal(t, blobURL, rec.Header().Get(echo.HeaderLocation))
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	rec = httptest.NewRecorder()
+
+	c = e.NewContext(req, rec)
+	c.SetParamNames("id")
+	c.SetParamValues(strings.Split(blobURL, "/")[4])
+
+	require.NoError(t, s.Get(c))
+
+	assert.Equal(t, data, rec.Body.Bytes())
+	assert.Contains(t, rec.Header().Get("Repr-Digest"), "sha-256=:"+base64.StdEncoding.EncodeToString(digest[:])+":")
+	assert.Contains(t, rec.Header().Get("Repr-Digest"), "sha-512=:")
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	rec = httptest.NewRecorder()
+
+	c = e.NewContext(req, rec)
+	c.SetPath("/sha256/:digest")
+	c.SetParamNames("digest")
+	c.SetParamValues(hex.EncodeToString(make([]byte, 32)))
+
+	err = s.GetByDigest(c)
+	var httpErr *echo.HTTPError
+	require.ErrorAs(t, err, &httpErr)
+	assert.Equal(t, http.StatusNotFound, httpErr.Code)
 }
 
-func (ups *fsUpstream) Get(id []byte) (io.ReadCloser, int64, error) {
-	fi, err := os.Stat(filepath.Join(ups.dir, base58.Encode(id[:])))
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil, 0, upstream.ErrNotFound
-		}
+func TestUploadLimits(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+
+	ups, err := upstream.NewFilesystem(t.TempDir())
+	require.NoError(t, err)
+
+	localCache, err := cache.New(logger, cache.Options{
+		Dir: t.TempDir(),
+		NewHash: func() hash.Hash {
+			return securehash.New([]byte("test"))
+		},
+		HashSize: securehash.Size,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, localCache.Close())
+	})
+
+	tokens, err := auth.ParseTokens("ci:secret")
+	require.NoError(t, err)
+
+	metadata := meta.NewStore(ups)
+	quotas := quota.NewQuotas(logger, metadata, quota.Options{
+		MaxBlobSize: 1000,
+		Limits: map[string]quota.Limits{
+			"ci": {MaxBytes: 1500, MaxBlobs: 2},
+		},
+		Tokens: tokens,
+	})
 
-		return nil, 0, err
+	s := cas.NewStorage(logger, localCache, ups, metadata, cas.Options{
+		BaseURL: "https://example.com/blobs",
+		Quotas:  quotas,
+	})
+
+	e := echo.New()
+	e.POST("/blob", s.Put, tokens.Middleware())
+	e.GET("/quota", quotas.Get, tokens.Middleware())
+
+	upload := func(data []byte) int {
+		var body bytes.Buffer
+		writer := multipart.NewWriter(&body)
+		part, err := writer.CreateFormFile("file", "test.bin")
+		require.NoError(t, err)
+
+		_, err = part.Write(data)
+		require.NoError(t, err)
+		require.NoError(t, writer.Close())
+
+		req := httptest.NewRequest(http.MethodPost, "/blob", &body)
+		req.Header.Set(echo.HeaderContentType, writer.FormDataContentType())
+		req.Header.Set(echo.HeaderAuthorization, "Bearer secret")
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+
+		return rec.Code
 	}
 
-	f, err := os.Open(filepath.Join(ups.dir, base58.Encode(id[:])))
-	if err != nil {
-		return nil, 0, err
+	usage := func() (q struct{ Bytes, Blobs int64 }) {
+		req := httptest.NewRequest(http.MethodGet, "/quota", nil)
+		req.Header.Set(echo.HeaderAuthorization, "Bearer secret")
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &q))
+
+		return q
 	}
 
-	return f, fi.Size(), nil
+	t.Run("Max Blob Size", func(t *testing.T) {
+		assert.Equal(t, http.StatusRequestEntityTooLarge, upload(make([]byte, 1001)))
+		assert.Zero(t, usage().Blobs)
+	})
+
+	t.Run("Blobs Without Owner", func(t *testing.T) {
+		err := s.StoreReader(context.Background(), bytes.NewReader(make([]byte, 1001)), &meta.Blob{Name: "mirrored.bin"})
+		assert.ErrorIs(t, err, quota.ErrTooLarge)
+	})
+
+	t.Run("Quota", func(t *testing.T) {
+		first := bytes.Repeat([]byte("a"), 600)
+		assert.Equal(t, http.StatusCreated, upload(first))
+
+		// Re-uploading an existing blob isn't charged again.
+		assert.Equal(t, http.StatusCreated, upload(first))
+		assert.Equal(t, int64(600), usage().Bytes)
+
+		// Over the byte quota.
+		assert.Equal(t, http.StatusInsufficientStorage, upload(bytes.Repeat([]byte("b"), 1000)))
+
+		assert.Equal(t, http.StatusCreated, upload(bytes.Repeat([]byte("c"), 600)))
+
+		// Over the blob count quota.
+		assert.Equal(t, http.StatusInsufficientStorage, upload([]byte("d")))
+
+		u := usage()
+		assert.Equal(t, int64(1200), u.Bytes)
+		assert.Equal(t, int64(2), u.Blobs)
+
+		// Usage is persisted in the metadata store.
+		stored, err := metadata.GetUsage(context.Background(), "ci")
+		require.NoError(t, err)
+		assert.Equal(t, int64(2), stored.Blobs)
+	})
 }
 
-func (ups *fsUpstream) Put(id []byte, r io.Reader) error {
-	f, err := os.Create(filepath.Join(ups.dir, base58.Encode(id[:])))
-	if err != nil {
-		return err
+func TestGetLegacyKey(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+
+	ups, err := upstream.NewFilesystem(t.TempDir())
+	require.NoError(t, err)
+
+	keyring := securehash.NewKeyring([]byte("new"), []byte("old"))
+
+	localCache, err := cache.New(logger, cache.Options{
+		Dir:      t.TempDir(),
+		NewHash:  keyring.NewHash,
+		HashSize: securehash.Size,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, localCache.Close())
+	})
+
+	s := cas.NewStorage(logger, localCache, ups, meta.NewStore(ups), cas.Options{
+		BaseURL: "https://example.com/blobs",
+	})
+
+	data := []byte("hello world")
+
+	h := securehash.New([]byte("old"))
+	_, _ = h.Write(data)
+	legacyID := h.Sum(nil)
+
+	ctx := context.Background()
+	require.NoError(t, ups.Put(ctx, legacyID, bytes.NewReader(data)))
+
+	get := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		rec := httptest.NewRecorder()
+
+		c := echo.New().NewContext(req, rec)
+		c.SetParamNames("id", "name")
+		c.SetParamValues(base58.Encode(legacyID), "hello.txt")
+
+		require.NoError(t, s.Get(c))
+
+		return rec
 	}
-	defer f.Close()
 
-	_, err = io.Copy(f, r)
-	return err
+	rec := get()
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, data, rec.Body.Bytes())
+
+	_, err = localCache.Stat(legacyID)
+	require.NoError(t, err)
+
+	// The second request must be a cache hit.
+	require.NoError(t, ups.Quarantine(ctx, legacyID))
+
+	rec = get()
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, data, rec.Body.Bytes())
 }
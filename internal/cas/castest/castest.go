@@ -0,0 +1,70 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package castest provides the fixtures shared by tests of the services built
+// on the content addressable storage.
+package castest
+
+import (
+	"hash"
+	"testing"
+
+	"github.com/gpu-ninja/download-mirror/internal/cache"
+	"github.com/gpu-ninja/download-mirror/internal/cas"
+	"github.com/gpu-ninja/download-mirror/internal/meta"
+	"github.com/gpu-ninja/download-mirror/internal/securehash"
+	"github.com/gpu-ninja/download-mirror/internal/upstream"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// Fixture is a filesystem upstream, a local cache and a metadata store, all
+// in temporary directories that are removed when the test finishes.
+type Fixture struct {
+	Upstream *upstream.Filesystem
+	Cache    *cache.Cache
+	Metadata *meta.Store
+}
+
+// New returns a new fixture.
+func New(t testing.TB, logger *zap.Logger) *Fixture {
+	ups, err := upstream.NewFilesystem(t.TempDir())
+	require.NoError(t, err)
+
+	localCache, err := cache.New(logger, cache.Options{
+		Dir: t.TempDir(),
+		NewHash: func() hash.Hash {
+			return securehash.New([]byte("test"))
+		},
+		HashSize: securehash.Size,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, localCache.Close())
+	})
+
+	return &Fixture{
+		Upstream: ups,
+		Cache:    localCache,
+		Metadata: meta.NewStore(ups),
+	}
+}
+
+// NewStorage returns a content addressable storage backed by the fixture.
+func (f *Fixture) NewStorage(logger *zap.Logger, opts cas.Options) *cas.Storage {
+	return cas.NewStorage(logger, f.Cache, f.Upstream, f.Metadata, opts)
+}
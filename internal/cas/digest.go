@@ -0,0 +1,211 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cas
+
+import (
+	"container/list"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/akamensky/base58"
+	"github.com/gpu-ninja/download-mirror/internal/meta"
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+// digestCacheSize is the maximum number of blob digests kept in memory, so
+// that the metadata store isn't consulted on every download.
+const digestCacheSize = 10000
+
+// digests are the public digests of a blob's content.
+type digests struct {
+	sha256 []byte
+	sha512 []byte
+}
+
+// reprDigest formats the digests as a Repr-Digest header (RFC 9530).
+func (d *digests) reprDigest() string {
+	var fields []string
+	if d.sha256 != nil {
+		fields = append(fields, "sha-256=:"+base64.StdEncoding.EncodeToString(d.sha256)+":")
+	}
+
+	if d.sha512 != nil {
+		fields = append(fields, "sha-512=:"+base64.StdEncoding.EncodeToString(d.sha512)+":")
+	}
+
+	return strings.Join(fields, ", ")
+}
+
+// digest formats the digests as a legacy Digest header (RFC 3230).
+func (d *digests) digest() string {
+	var fields []string
+	if d.sha256 != nil {
+		fields = append(fields, "sha-256="+base64.StdEncoding.EncodeToString(d.sha256))
+	}
+
+	if d.sha512 != nil {
+		fields = append(fields, "sha-512="+base64.StdEncoding.EncodeToString(d.sha512))
+	}
+
+	return strings.Join(fields, ",")
+}
+
+func (d *digests) setHeaders(h http.Header) {
+	if d.sha256 == nil && d.sha512 == nil {
+		return
+	}
+
+	h.Set("Repr-Digest", d.reprDigest())
+	h.Set("Digest", d.digest())
+}
+
+func digestsFromBlob(blob *meta.Blob) *digests {
+	var d digests
+	d.sha256, _ = hex.DecodeString(blob.SHA256)
+	d.sha512, _ = hex.DecodeString(blob.SHA512)
+
+	return &d
+}
+
+// digestCache is a bounded LRU of blob digests, keyed by blob id.
+type digestCache struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+type digestCacheEntry struct {
+	key     string
+	digests *digests
+}
+
+func newDigestCache() *digestCache {
+	return &digestCache{
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+func (dc *digestCache) get(key string) (*digests, bool) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	e, ok := dc.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	dc.lru.MoveToFront(e)
+
+	return e.Value.(*digestCacheEntry).digests, true
+}
+
+func (dc *digestCache) add(key string, d *digests) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	if e, ok := dc.entries[key]; ok {
+		e.Value.(*digestCacheEntry).digests = d
+		dc.lru.MoveToFront(e)
+		return
+	}
+
+	dc.entries[key] = dc.lru.PushFront(&digestCacheEntry{key: key, digests: d})
+
+	for dc.lru.Len() > digestCacheSize {
+		oldest := dc.lru.Back()
+		dc.lru.Remove(oldest)
+		delete(dc.entries, oldest.Value.(*digestCacheEntry).key)
+	}
+}
+
+// setDigestHeaders sets the Repr-Digest and Digest headers for a blob, if
+// its public digests are known.
+func (s *Storage) setDigestHeaders(ctx context.Context, c echo.Context, id []byte) {
+	key := base58.Encode(id)
+
+	d, ok := s.digests.get(key)
+	if !ok {
+		blob, err := s.metadata.GetBlob(ctx, id)
+		if err != nil {
+			if !errors.Is(err, meta.ErrNotFound) {
+				s.logger.Warn("Failed to get blob metadata", zap.String("id", key), zap.Error(err))
+
+				return
+			}
+
+			// Blobs uploaded before digests were recorded.
+			blob = &meta.Blob{}
+		}
+
+		d = digestsFromBlob(blob)
+		s.digests.add(key, d)
+	}
+
+	d.setHeaders(c.Response().Header())
+}
+
+// GetByDigest resolves a public digest (eg. /sha256/:digest) to the blob
+// with that content, and redirects to it.
+func (s *Storage) GetByDigest(c echo.Context) error {
+	algorithm := strings.Trim(strings.TrimSuffix(c.Path(), "/:digest"), "/")
+	digest := strings.ToLower(c.Param("digest"))
+
+	var size int
+	switch algorithm {
+	case meta.DigestSHA256:
+		size = 32
+	case meta.DigestSHA512:
+		size = 64
+	default:
+		return echo.NewHTTPError(http.StatusNotFound)
+	}
+
+	if decoded, err := hex.DecodeString(digest); err != nil || len(decoded) != size {
+		s.logger.Warn("Invalid digest", zap.String("algorithm", algorithm), zap.String("digest", digest))
+
+		return echo.NewHTTPError(http.StatusBadRequest)
+	}
+
+	d, err := s.metadata.GetDigest(c.Request().Context(), algorithm, digest)
+	if err != nil {
+		if errors.Is(err, meta.ErrNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound)
+		}
+
+		s.logger.Error("Failed to get digest", zap.String("algorithm", algorithm),
+			zap.String("digest", digest), zap.Error(err))
+
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	name := d.Name
+	if name == "" {
+		name = digest
+	}
+
+	return c.Redirect(http.StatusFound, fmt.Sprintf("%s/%s/%s", s.blobBaseURL(c), d.ID, url.PathEscape(name)))
+}
@@ -0,0 +1,324 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package config parses the server's configuration file. The file is YAML
+// with nested sections, and each setting maps onto a command line flag, so
+// that flags and environment variables still take precedence over it.
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/go-units"
+	"gopkg.in/yaml.v3"
+)
+
+// Setting maps a path in the configuration file (eg. cache.size) onto a
+// flag.
+type Setting struct {
+	Path string
+	Flag string
+	// List settings are sequences, each element is applied to the flag in
+	// turn.
+	List bool
+	// Fields, if set, are the settings of List elements that are sections
+	// rather than values (eg. a replica with credentials).
+	Fields []string
+	// Check, if set, validates each value.
+	Check func(value string) error
+	// CheckFields, if set, validates each section element.
+	CheckFields func(fields map[string]string) error
+}
+
+// Value is a setting read from a configuration file.
+type Value struct {
+	Setting
+	Values []string
+	// Fields are the settings of the elements that are sections, indexed
+	// like Values (whose entry is empty for them). It's nil if there are no
+	// sections.
+	Fields []map[string]string
+	// Line is the line of the setting in the file.
+	Line int
+}
+
+// Error is a problem at a line of a configuration file.
+type Error struct {
+	Line    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Message)
+}
+
+// Errors are the problems found in a configuration file.
+type Errors []*Error
+
+func (e Errors) Error() string {
+	var messages []string
+	for _, err := range e {
+		messages = append(messages, err.Error())
+	}
+
+	return strings.Join(messages, "\n")
+}
+
+// Parse parses a configuration file against the known settings. Every problem
+// found is reported (as Errors), rather than just the first.
+func Parse(data []byte, settings []Setting) ([]Value, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+
+	// An empty file.
+	if len(doc.Content) == 0 {
+		return nil, nil
+	}
+
+	p := &parser{
+		settings: make(map[string]Setting),
+		sections: make(map[string]bool),
+	}
+
+	for _, s := range settings {
+		p.settings[s.Path] = s
+
+		parts := strings.Split(s.Path, ".")
+		for i := 1; i < len(parts); i++ {
+			p.sections[strings.Join(parts[:i], ".")] = true
+		}
+	}
+
+	p.parseSection("", doc.Content[0])
+
+	if len(p.errs) > 0 {
+		return nil, p.errs
+	}
+
+	return p.values, nil
+}
+
+type parser struct {
+	settings map[string]Setting
+	sections map[string]bool
+	values   []Value
+	errs     Errors
+}
+
+func (p *parser) errorf(node *yaml.Node, format string, args ...any) {
+	p.errs = append(p.errs, &Error{Line: node.Line, Message: fmt.Sprintf(format, args...)})
+}
+
+func (p *parser) parseSection(prefix string, node *yaml.Node) {
+	if node.Kind != yaml.MappingNode {
+		if prefix == "" {
+			p.errorf(node, "expected a mapping of settings")
+		} else {
+			p.errorf(node, "%s: expected a section", prefix)
+		}
+
+		return
+	}
+
+	seen := make(map[string]bool)
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+
+		path := key.Value
+		if prefix != "" {
+			path = prefix + "." + key.Value
+		}
+
+		if seen[key.Value] {
+			p.errorf(key, "%s: duplicate setting", path)
+			continue
+		}
+		seen[key.Value] = true
+
+		if s, ok := p.settings[path]; ok {
+			p.parseSetting(s, value)
+		} else if p.sections[path] {
+			p.parseSection(path, value)
+		} else {
+			p.errorf(key, "unknown setting %q", path)
+		}
+	}
+}
+
+func (p *parser) parseSetting(s Setting, node *yaml.Node) {
+	// Explicitly empty settings (eg. "token: ~") are left unset.
+	if node.Tag == "!!null" {
+		return
+	}
+
+	var scalars []*yaml.Node
+	switch {
+	case node.Kind == yaml.ScalarNode:
+		scalars = []*yaml.Node{node}
+	case node.Kind == yaml.SequenceNode && s.List:
+		scalars = node.Content
+	case s.List:
+		p.errorf(node, "%s: expected a value or a list of values", s.Path)
+		return
+	default:
+		p.errorf(node, "%s: expected a value", s.Path)
+		return
+	}
+
+	v := Value{Setting: s, Line: node.Line}
+	// Every invalid section is reported, rather than just the first.
+	valid := true
+	for i, scalar := range scalars {
+		if scalar.Kind == yaml.MappingNode && len(s.Fields) > 0 {
+			fields, ok := p.parseFields(s, scalar)
+			if !ok {
+				valid = false
+				continue
+			}
+
+			if v.Fields == nil {
+				v.Fields = make([]map[string]string, len(scalars))
+			}
+			v.Fields[i] = fields
+			v.Values = append(v.Values, "")
+			continue
+		}
+
+		if scalar.Kind != yaml.ScalarNode {
+			p.errorf(scalar, "%s: expected a value", s.Path)
+			return
+		}
+
+		if s.Check != nil {
+			if err := s.Check(scalar.Value); err != nil {
+				p.errorf(scalar, "%s: %v", s.Path, err)
+				return
+			}
+		}
+
+		v.Values = append(v.Values, scalar.Value)
+	}
+
+	if valid {
+		p.values = append(p.values, v)
+	}
+}
+
+func (p *parser) parseFields(s Setting, node *yaml.Node) (map[string]string, bool) {
+	known := make(map[string]bool)
+	for _, field := range s.Fields {
+		known[field] = true
+	}
+
+	ok := true
+	seen := make(map[string]bool)
+	fields := make(map[string]string)
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+
+		path := s.Path + "." + key.Value
+		duplicate := seen[key.Value]
+		seen[key.Value] = true
+
+		switch {
+		case !known[key.Value]:
+			p.errorf(key, "unknown setting %q", path)
+			ok = false
+		case duplicate:
+			p.errorf(key, "%s: duplicate setting", path)
+			ok = false
+		case value.Tag == "!!null":
+		case value.Kind != yaml.ScalarNode:
+			p.errorf(value, "%s: expected a value", path)
+			ok = false
+		default:
+			fields[key.Value] = value.Value
+		}
+	}
+
+	if ok && s.CheckFields != nil {
+		if err := s.CheckFields(fields); err != nil {
+			p.errorf(node, "%s: %v", s.Path, err)
+			ok = false
+		}
+	}
+
+	return fields, ok
+}
+
+// Bool checks that a value is a boolean.
+func Bool(value string) error {
+	if _, err := strconv.ParseBool(value); err != nil {
+		return fmt.Errorf("invalid boolean %q", value)
+	}
+
+	return nil
+}
+
+// Int checks that a value is an integer.
+func Int(value string) error {
+	if _, err := strconv.Atoi(value); err != nil {
+		return fmt.Errorf("invalid integer %q", value)
+	}
+
+	return nil
+}
+
+// Float checks that a value is a number.
+func Float(value string) error {
+	if _, err := strconv.ParseFloat(value, 64); err != nil {
+		return fmt.Errorf("invalid number %q", value)
+	}
+
+	return nil
+}
+
+// Duration checks that a value is a duration (eg. 30s).
+func Duration(value string) error {
+	if _, err := time.ParseDuration(value); err != nil {
+		return fmt.Errorf("invalid duration %q", value)
+	}
+
+	return nil
+}
+
+// Size checks that a value is a human readable size (eg. 10G).
+func Size(value string) error {
+	if _, err := units.FromHumanSize(value); err != nil {
+		return fmt.Errorf("invalid size %q", value)
+	}
+
+	return nil
+}
+
+// OneOf returns a check that a value is one of the given options.
+func OneOf(options ...string) func(string) error {
+	return func(value string) error {
+		for _, option := range options {
+			if value == option {
+				return nil
+			}
+		}
+
+		return fmt.Errorf("invalid value %q, expected one of %s", value, strings.Join(options, ", "))
+	}
+}
@@ -0,0 +1,143 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package config_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/gpu-ninja/download-mirror/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var settings = []config.Setting{
+	{Path: "server.listen", Flag: "listen"},
+	{Path: "cache.size", Flag: "cache-size", Check: config.Size},
+	{Path: "cache.memory.size", Flag: "memory-cache-size", Check: config.Size},
+	{Path: "upstreams.replicas", Flag: "replica-uri", List: true, Fields: []string{"uri", "user", "passwordFile"}, CheckFields: func(fields map[string]string) error {
+		if fields["uri"] == "" {
+			return errors.New("uri is required")
+		}
+
+		return nil
+	}},
+	{Path: "auth.token", Flag: "token"},
+}
+
+func TestParse(t *testing.T) {
+	t.Run("Valid", func(t *testing.T) {
+		values, err := config.Parse([]byte(`
+server:
+  listen: :8080
+cache:
+  size: 10G
+  memory:
+    size: 256M
+upstreams:
+  replicas:
+    - file:///srv/replica
+    - https://example.com/replica
+auth:
+  token: ~
+`), settings)
+		require.NoError(t, err)
+		require.Len(t, values, 4)
+
+		assert.Equal(t, "listen", values[0].Flag)
+		assert.Equal(t, []string{":8080"}, values[0].Values)
+		assert.Equal(t, 3, values[0].Line)
+
+		assert.Equal(t, "memory-cache-size", values[2].Flag)
+		assert.Equal(t, []string{"256M"}, values[2].Values)
+
+		assert.Equal(t, []string{"file:///srv/replica", "https://example.com/replica"}, values[3].Values)
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		_, err := config.Parse([]byte(`
+server:
+  listne: :8080
+cache:
+  size: lots
+  size: 10G
+auth: secret
+upstreams:
+  replicas:
+    uri: file:///srv/replica
+`), settings)
+		require.Error(t, err)
+
+		var errs config.Errors
+		require.ErrorAs(t, err, &errs)
+		require.Len(t, errs, 5)
+
+		assert.Equal(t, "line 3: unknown setting \"server.listne\"", errs[0].Error())
+		assert.Equal(t, 5, errs[1].Line)
+		assert.Contains(t, errs[1].Message, "invalid size")
+		assert.Equal(t, "line 6: cache.size: duplicate setting", errs[2].Error())
+		assert.Equal(t, "line 7: auth: expected a section", errs[3].Error())
+		assert.Equal(t, 10, errs[4].Line)
+	})
+
+	t.Run("Sections", func(t *testing.T) {
+		values, err := config.Parse([]byte(`
+upstreams:
+  replicas:
+    - file:///srv/replica
+    - uri: https://example.com/replica
+      user: replica
+      passwordFile: /etc/replica-password
+`), settings)
+		require.NoError(t, err)
+		require.Len(t, values, 1)
+
+		assert.Equal(t, []string{"file:///srv/replica", ""}, values[0].Values)
+		require.Len(t, values[0].Fields, 2)
+		assert.Nil(t, values[0].Fields[0])
+		assert.Equal(t, map[string]string{
+			"uri":          "https://example.com/replica",
+			"user":         "replica",
+			"passwordFile": "/etc/replica-password",
+		}, values[0].Fields[1])
+	})
+
+	t.Run("Section Errors", func(t *testing.T) {
+		_, err := config.Parse([]byte(`
+upstreams:
+  replicas:
+    - uri: https://example.com/replica
+      password: secret
+    - user: replica
+`), settings)
+		require.Error(t, err)
+
+		var errs config.Errors
+		require.ErrorAs(t, err, &errs)
+		require.Len(t, errs, 2)
+
+		assert.Equal(t, "line 5: unknown setting \"upstreams.replicas.password\"", errs[0].Error())
+		assert.Equal(t, "line 6: upstreams.replicas: uri is required", errs[1].Error())
+	})
+
+	t.Run("Syntax Error", func(t *testing.T) {
+		_, err := config.Parse([]byte("server:\n  listen: [\n"), settings)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "line")
+	})
+}
@@ -0,0 +1,463 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package goproxy implements the Go module proxy protocol (GOPROXY) over the
+// blob store. Module zips and go.mod files are stored as regular blobs, the
+// version index is stored as metadata records.
+package goproxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gpu-ninja/download-mirror/internal/auth"
+	"github.com/gpu-ninja/download-mirror/internal/blobid"
+	"github.com/gpu-ninja/download-mirror/internal/cas"
+	"github.com/gpu-ninja/download-mirror/internal/meta"
+	"github.com/gpu-ninja/download-mirror/internal/quota"
+	"github.com/gpu-ninja/download-mirror/pkg/api"
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+	modzip "golang.org/x/mod/zip"
+)
+
+// maxFieldSize is the largest (non-file) form field accepted when publishing.
+const maxFieldSize = 1024
+
+// Proxy serves the Go module proxy protocol.
+type Proxy struct {
+	logger   *zap.Logger
+	storage  *cas.Storage
+	metadata *meta.Store
+}
+
+func NewProxy(logger *zap.Logger, storage *cas.Storage, metadata *meta.Store) *Proxy {
+	return &Proxy{
+		logger:   logger,
+		storage:  storage,
+		metadata: metadata,
+	}
+}
+
+// Register registers the proxy routes, reads are public and publishing
+// requires the given (authentication) middleware.
+func (p *Proxy) Register(g *echo.Group, write echo.MiddlewareFunc) {
+	g.GET("/*", p.read)
+	g.PUT("/*", p.Publish, write)
+}
+
+func (p *Proxy) read(c echo.Context) error {
+	escapedPath, file, err := splitPath(c.Param("*"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+
+	modulePath, err := module.UnescapePath(escapedPath)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+
+	if file == "@latest" {
+		return p.latest(c, modulePath)
+	} else if file == "list" {
+		return p.list(c, modulePath)
+	}
+
+	for _, ext := range []string{".info", ".mod", ".zip"} {
+		if escapedVersion, ok := strings.CutSuffix(file, ext); ok {
+			version, err := module.UnescapeVersion(escapedVersion)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusNotFound, err.Error())
+			}
+
+			return p.serveFile(c, modulePath, version, ext)
+		}
+	}
+
+	return echo.NewHTTPError(http.StatusNotFound)
+}
+
+func (p *Proxy) list(c echo.Context, modulePath string) error {
+	versions, err := p.versions(c.Request().Context(), modulePath)
+	if err != nil {
+		return err
+	}
+
+	// Pseudo-versions are only resolved through @latest (or directly).
+	var sb strings.Builder
+	for _, version := range versions {
+		if !module.IsPseudoVersion(version) {
+			sb.WriteString(version)
+			sb.WriteString("\n")
+		}
+	}
+
+	return c.String(http.StatusOK, sb.String())
+}
+
+func (p *Proxy) latest(c echo.Context, modulePath string) error {
+	versions, err := p.versions(c.Request().Context(), modulePath)
+	if err != nil {
+		return err
+	}
+
+	// The go command prefers releases, then pre-releases and then finally
+	// pseudo-versions.
+	latest := versions[len(versions)-1]
+	for _, preferred := range []func(string) bool{
+		func(v string) bool { return semver.Prerelease(v) == "" },
+		func(v string) bool { return !module.IsPseudoVersion(v) },
+	} {
+		if v, ok := lastMatching(versions, preferred); ok {
+			latest = v
+			break
+		}
+	}
+
+	return p.serveFile(c, modulePath, latest, ".info")
+}
+
+// versions returns the published versions of a module in semver order, if
+// there are none a not found error is returned.
+func (p *Proxy) versions(ctx context.Context, modulePath string) ([]string, error) {
+	versions, err := p.metadata.ListGoModuleVersions(ctx, modulePath)
+	if err != nil {
+		p.logger.Error("Failed to list module versions",
+			zap.String("module", modulePath), zap.Error(err))
+
+		return nil, echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	if len(versions) == 0 {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "unknown module")
+	}
+
+	sort.Slice(versions, func(i, j int) bool {
+		return semver.Compare(versions[i], versions[j]) < 0
+	})
+
+	return versions, nil
+}
+
+func (p *Proxy) serveFile(c echo.Context, modulePath, version, ext string) error {
+	v, err := p.metadata.GetGoModuleVersion(c.Request().Context(), modulePath, version)
+	if err != nil {
+		if errors.Is(err, meta.ErrNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound, "unknown revision")
+		}
+
+		p.logger.Error("Failed to get module version", zap.String("module", modulePath),
+			zap.String("version", version), zap.Error(err))
+
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	var encodedID string
+	switch ext {
+	case ".info":
+		return c.JSON(http.StatusOK, api.GoModuleInfo{
+			Version: v.Version,
+			Time:    v.Time,
+		})
+	case ".mod":
+		encodedID = v.ModID
+	case ".zip":
+		encodedID = v.ZipID
+	}
+
+	id, err := blobid.ParseString(encodedID)
+	if err != nil {
+		p.logger.Error("Invalid blob id in module version", zap.String("module", modulePath),
+			zap.String("version", version), zap.String("id", encodedID), zap.Error(err))
+
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	return p.storage.Serve(c, id)
+}
+
+// Publish publishes a new version of a module. The go.mod file and module zip
+// are uploaded as the "mod" and "zip" form files, versions are immutable so
+// publishing an existing version fails.
+func (p *Proxy) Publish(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	escapedPath, escapedVersion, ok := strings.Cut(c.Param("*"), "/@v/")
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound)
+	}
+
+	modulePath, err := module.UnescapePath(escapedPath)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	version, err := module.UnescapeVersion(escapedVersion)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	if semver.Canonical(version) != version {
+		return echo.NewHTTPError(http.StatusBadRequest, "version must be a canonical semantic version")
+	}
+
+	mv := module.Version{Path: modulePath, Version: version}
+	if err := module.Check(modulePath, version); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	p.logger.Info("Received request to publish module", zap.Stringer("module", mv))
+
+	if _, err := p.metadata.GetGoModuleVersion(ctx, modulePath, version); err == nil {
+		return echo.NewHTTPError(http.StatusConflict, "version already published")
+	} else if !errors.Is(err, meta.ErrNotFound) {
+		p.logger.Error("Failed to get module version", zap.Stringer("module", mv), zap.Error(err))
+
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	fields, files, err := p.readForm(c)
+	defer func() {
+		for _, f := range files {
+			removeFile(f)
+		}
+	}()
+	if err != nil {
+		return err
+	}
+
+	publishedAt := time.Now().UTC()
+	if t := fields["time"]; t != "" {
+		publishedAt, err = time.Parse(time.RFC3339, t)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid time")
+		}
+	}
+
+	modFile, zipFile := files["mod"], files["zip"]
+	if modFile == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "missing mod file")
+	} else if zipFile == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "missing zip file")
+	}
+
+	modData, err := os.ReadFile(modFile.Name())
+	if err != nil {
+		p.logger.Error("Failed to read go.mod file", zap.Error(err))
+
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	if declaredPath := modfile.ModulePath(modData); declaredPath != modulePath {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			fmt.Sprintf("go.mod declares module %q", declaredPath))
+	}
+
+	if _, err := modzip.CheckZip(mv, zipFile.Name()); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid module zip: %v", err))
+	}
+
+	modBlob, err := p.store(ctx, modFile, version+".mod", auth.TokenName(c))
+	if httpErr := quota.HTTPError(err); httpErr != nil {
+		return httpErr
+	} else if err != nil {
+		p.logger.Error("Failed to store go.mod file", zap.Stringer("module", mv), zap.Error(err))
+
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	zipBlob, err := p.store(ctx, zipFile, version+".zip", auth.TokenName(c))
+	if httpErr := quota.HTTPError(err); httpErr != nil {
+		return httpErr
+	} else if err != nil {
+		p.logger.Error("Failed to store module zip", zap.Stringer("module", mv), zap.Error(err))
+
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	if err := p.metadata.PutGoModuleVersion(ctx, &meta.GoModuleVersion{
+		Path:      modulePath,
+		Version:   version,
+		Time:      publishedAt,
+		ModID:     modBlob.ID,
+		ZipID:     zipBlob.ID,
+		CreatedAt: time.Now().UTC(),
+	}); err != nil {
+		p.logger.Error("Failed to store module version", zap.Stringer("module", mv), zap.Error(err))
+
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	p.logger.Info("Published module", zap.Stringer("module", mv),
+		zap.String("modId", modBlob.ID), zap.String("zipId", zipBlob.ID))
+
+	return c.JSON(http.StatusCreated, api.GoModuleInfo{
+		Version: version,
+		Time:    publishedAt,
+	})
+}
+
+// readForm streams a publish request, spooling the "mod" and "zip" files to
+// temporary files. Files are checked against their maximum size and the
+// upload limits as they arrive, so that oversized uploads are rejected early.
+// The returned files must be removed, even if an error is returned.
+func (p *Proxy) readForm(c echo.Context) (map[string]string, map[string]*os.File, error) {
+	fields := make(map[string]string)
+	files := make(map[string]*os.File)
+
+	mr, err := c.Request().MultipartReader()
+	if err != nil {
+		return fields, files, echo.NewHTTPError(http.StatusBadRequest, "invalid multipart form")
+	}
+
+	for {
+		part, err := mr.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return fields, files, echo.NewHTTPError(http.StatusBadRequest, "invalid multipart form")
+		}
+
+		name := part.FormName()
+
+		var maxSize int64
+		switch name {
+		case "mod":
+			maxSize = modzip.MaxGoMod
+		case "zip":
+			maxSize = modzip.MaxZipFile
+		default:
+			value, err := io.ReadAll(io.LimitReader(part, maxFieldSize+1))
+			if err != nil {
+				return fields, files, echo.NewHTTPError(http.StatusBadRequest, "invalid multipart form")
+			} else if len(value) > maxFieldSize {
+				return fields, files, echo.NewHTTPError(http.StatusRequestEntityTooLarge,
+					fmt.Sprintf("%s field is too large", name))
+			}
+
+			fields[name] = string(value)
+			continue
+		}
+
+		if _, ok := files[name]; ok {
+			return fields, files, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("multiple %s files", name))
+		}
+
+		f, err := os.CreateTemp("", "goproxy-")
+		if err != nil {
+			p.logger.Error("Failed to create temporary file", zap.Error(err))
+
+			return fields, files, echo.NewHTTPError(http.StatusInternalServerError)
+		}
+		files[name] = f
+
+		limit, err := p.storage.UploadWriter(c.Request().Context(), auth.TokenName(c))
+		if httpErr := quota.HTTPError(err); httpErr != nil {
+			return fields, files, httpErr
+		} else if err != nil {
+			p.logger.Error("Failed to check quota", zap.Error(err))
+
+			return fields, files, echo.NewHTTPError(http.StatusInternalServerError)
+		}
+
+		n, err := io.Copy(io.MultiWriter(f, limit), io.LimitReader(part, maxSize+1))
+		if httpErr := quota.HTTPError(err); httpErr != nil {
+			return fields, files, httpErr
+		} else if err != nil {
+			p.logger.Warn("Failed to read form file", zap.Error(err))
+
+			return fields, files, echo.NewHTTPError(http.StatusBadRequest, "invalid multipart form")
+		}
+
+		if n > maxSize {
+			return fields, files, echo.NewHTTPError(http.StatusRequestEntityTooLarge,
+				fmt.Sprintf("%s file is too large", name))
+		}
+	}
+
+	return fields, files, nil
+}
+
+// store stores a spooled file as a blob, owned by the uploading token.
+func (p *Proxy) store(ctx context.Context, f *os.File, name, owner string) (*meta.Blob, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to rewind file: %w", err)
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, fmt.Errorf("failed to hash file: %w", err)
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to rewind file: %w", err)
+	}
+
+	blob := &meta.Blob{
+		Name:   name,
+		SHA256: hex.EncodeToString(h.Sum(nil)),
+		Owner:  owner,
+	}
+
+	if err := p.storage.Store(ctx, f, blob); err != nil {
+		return nil, err
+	}
+
+	return blob, nil
+}
+
+// splitPath splits a request path into the escaped module path and the
+// requested file (eg. "list", "v1.0.0.zip" or "@latest").
+func splitPath(p string) (string, string, error) {
+	if escapedPath, ok := strings.CutSuffix(p, "/@latest"); ok {
+		return escapedPath, "@latest", nil
+	}
+
+	i := strings.LastIndex(p, "/@v/")
+	if i < 0 {
+		return "", "", fmt.Errorf("invalid module proxy path")
+	}
+
+	return p[:i], p[i+len("/@v/"):], nil
+}
+
+func lastMatching(versions []string, match func(string) bool) (string, bool) {
+	for i := len(versions) - 1; i >= 0; i-- {
+		if match(versions[i]) {
+			return versions[i], true
+		}
+	}
+
+	return "", false
+}
+
+func removeFile(f *os.File) {
+	_ = f.Close()
+	_ = os.Remove(f.Name())
+}
@@ -0,0 +1,191 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package goproxy_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gpu-ninja/download-mirror/internal/auth"
+	"github.com/gpu-ninja/download-mirror/internal/cas"
+	"github.com/gpu-ninja/download-mirror/internal/cas/castest"
+	"github.com/gpu-ninja/download-mirror/internal/goproxy"
+	"github.com/gpu-ninja/download-mirror/pkg/api"
+	"github.com/gpu-ninja/download-mirror/pkg/client"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+	"golang.org/x/mod/module"
+	modzip "golang.org/x/mod/zip"
+)
+
+func TestProxy(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+
+	fixture := castest.New(t, logger)
+
+	storage := fixture.NewStorage(logger, cas.Options{})
+
+	tokens, err := auth.ParseTokens("secret")
+	require.NoError(t, err)
+
+	e := echo.New()
+	goproxy.NewProxy(logger, storage, fixture.Metadata).Register(e.Group("/goproxy"), tokens.Middleware())
+
+	srv := httptest.NewServer(e)
+	t.Cleanup(srv.Close)
+
+	get := func(path string) (int, []byte) {
+		resp, err := http.Get(srv.URL + "/goproxy/" + path)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+
+		return resp.StatusCode, body
+	}
+
+	ctx := context.Background()
+	c := client.New(srv.URL, client.WithToken("secret"))
+
+	modulePath := "example.com/Hello"
+	mod := []byte("module example.com/Hello\n\ngo 1.20\n")
+
+	publish := func(version string, publishedAt time.Time) error {
+		var zip bytes.Buffer
+		require.NoError(t, modzip.Create(&zip, module.Version{Path: modulePath, Version: version}, []modzip.File{
+			memFile{name: "go.mod", data: mod},
+			memFile{name: "hello.go", data: []byte("package hello\n")},
+		}))
+
+		_, err := c.PublishGoModule(ctx, modulePath, version, bytes.NewReader(mod), &zip, publishedAt)
+		return err
+	}
+
+	status, _ := get("example.com/!hello/@v/list")
+	assert.Equal(t, http.StatusNotFound, status)
+
+	publishedAt := time.Date(2023, 9, 1, 12, 0, 0, 0, time.UTC)
+	for _, version := range []string{"v1.0.0", "v1.1.0-rc.1", "v0.9.0", "v0.0.0-20230101000000-abcdefabcdef"} {
+		require.NoError(t, publish(version, publishedAt))
+	}
+
+	t.Run("Immutable", func(t *testing.T) {
+		var apiErr *client.Error
+		require.True(t, errors.As(publish("v1.0.0", publishedAt), &apiErr))
+		assert.Equal(t, http.StatusConflict, apiErr.StatusCode)
+	})
+
+	t.Run("Unauthenticated", func(t *testing.T) {
+		_, err := client.New(srv.URL).PublishGoModule(ctx, modulePath, "v2.0.0",
+			bytes.NewReader(mod), bytes.NewReader(nil), time.Time{})
+
+		var apiErr *client.Error
+		require.True(t, errors.As(err, &apiErr))
+		assert.Equal(t, http.StatusUnauthorized, apiErr.StatusCode)
+	})
+
+	t.Run("Module Path Mismatch", func(t *testing.T) {
+		_, err := c.PublishGoModule(ctx, "example.com/other", "v1.0.0",
+			bytes.NewReader(mod), bytes.NewReader(nil), time.Time{})
+
+		var apiErr *client.Error
+		require.True(t, errors.As(err, &apiErr))
+		assert.Equal(t, http.StatusBadRequest, apiErr.StatusCode)
+	})
+
+	t.Run("List", func(t *testing.T) {
+		status, body := get("example.com/!hello/@v/list")
+		require.Equal(t, http.StatusOK, status)
+
+		assert.Equal(t, "v0.9.0\nv1.0.0\nv1.1.0-rc.1\n", string(body))
+	})
+
+	t.Run("Latest", func(t *testing.T) {
+		status, body := get("example.com/!hello/@latest")
+		require.Equal(t, http.StatusOK, status)
+
+		var info api.GoModuleInfo
+		require.NoError(t, json.Unmarshal(body, &info))
+
+		assert.Equal(t, "v1.0.0", info.Version)
+		assert.True(t, publishedAt.Equal(info.Time))
+	})
+
+	t.Run("Files", func(t *testing.T) {
+		status, body := get("example.com/!hello/@v/v1.0.0.mod")
+		require.Equal(t, http.StatusOK, status)
+		assert.Equal(t, mod, body)
+
+		status, body = get("example.com/!hello/@v/v1.0.0.zip")
+		require.Equal(t, http.StatusOK, status)
+
+		_, err := modzip.CheckZip(module.Version{Path: modulePath, Version: "v1.0.0"}, writeTemp(t, body))
+		assert.NoError(t, err)
+
+		status, _ = get("example.com/!hello/@v/v2.0.0.info")
+		assert.Equal(t, http.StatusNotFound, status)
+	})
+}
+
+type memFile struct {
+	name string
+	data []byte
+}
+
+func (f memFile) Path() string {
+	return f.name
+}
+
+func (f memFile) Lstat() (fs.FileInfo, error) {
+	return memFileInfo{f}, nil
+}
+
+func (f memFile) Open() (io.ReadCloser, error) {
+	return io.NopCloser(bytes.NewReader(f.data)), nil
+}
+
+type memFileInfo struct {
+	f memFile
+}
+
+func (fi memFileInfo) Name() string       { return fi.f.name }
+func (fi memFileInfo) Size() int64        { return int64(len(fi.f.data)) }
+func (fi memFileInfo) Mode() fs.FileMode  { return 0o644 }
+func (fi memFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi memFileInfo) IsDir() bool        { return false }
+func (fi memFileInfo) Sys() any           { return nil }
+
+func writeTemp(t *testing.T, data []byte) string {
+	name := filepath.Join(t.TempDir(), "module.zip")
+	require.NoError(t, os.WriteFile(name, data, 0o644))
+
+	return name
+}
@@ -0,0 +1,135 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package health
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/docker/go-units"
+	"github.com/gpu-ninja/download-mirror/internal/diskusage"
+	"github.com/gpu-ninja/download-mirror/internal/upstream"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// DiskDetails describes the state of the cache directory.
+type DiskDetails struct {
+	Path      string `json:"path"`
+	FreeBytes int64  `json:"freeBytes,omitempty"`
+	Free      string `json:"free,omitempty"`
+}
+
+// DiskCheck verifies that the directory is writable and has at least
+// minFreeBytes of free space available.
+func DiskCheck(dir string, minFreeBytes int64) CheckFunc {
+	return func(ctx context.Context) (any, error) {
+		details := DiskDetails{Path: dir}
+
+		f, err := os.CreateTemp(dir, ".readyz-")
+		if err != nil {
+			return details, fmt.Errorf("directory is not writable: %w", err)
+		}
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+
+		free, err := diskusage.Free(dir)
+		if errors.Is(err, diskusage.ErrUnsupported) {
+			return details, nil
+		} else if err != nil {
+			return details, fmt.Errorf("failed to get free space: %w", err)
+		}
+
+		details.FreeBytes = free
+		details.Free = units.BytesSize(float64(free))
+
+		if free < minFreeBytes {
+			return details, fmt.Errorf("insufficient free space: %s available, %s required",
+				units.BytesSize(float64(free)), units.BytesSize(float64(minFreeBytes)))
+		}
+
+		return details, nil
+	}
+}
+
+// UpstreamCheck verifies that the upstream is reachable.
+func UpstreamCheck(ups upstream.Upstream) CheckFunc {
+	return func(ctx context.Context) (any, error) {
+		if err := ups.Check(ctx); err != nil {
+			return nil, fmt.Errorf("upstream is unavailable: %w", err)
+		}
+
+		return nil, nil
+	}
+}
+
+// CertificateDetails describes the ACME certificate for a domain.
+type CertificateDetails struct {
+	Domain   string    `json:"domain"`
+	NotAfter time.Time `json:"notAfter,omitempty"`
+	Issuer   string    `json:"issuer,omitempty"`
+}
+
+// CertificateCheck verifies that a valid certificate for the domain has been
+// obtained by the ACME client and that it does not expire within minValidity.
+func CertificateCheck(cache autocert.Cache, domain string, minValidity time.Duration) CheckFunc {
+	return func(ctx context.Context) (any, error) {
+		details := CertificateDetails{Domain: domain}
+
+		data, err := cache.Get(ctx, domain)
+		if err != nil {
+			if errors.Is(err, autocert.ErrCacheMiss) {
+				return details, fmt.Errorf("no certificate has been issued")
+			}
+
+			return details, fmt.Errorf("failed to read certificate: %w", err)
+		}
+
+		// The autocert cache stores the private key followed by the certificate chain.
+		var leaf *x509.Certificate
+		for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+			if block.Type != "CERTIFICATE" {
+				continue
+			}
+
+			leaf, err = x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return details, fmt.Errorf("failed to parse certificate: %w", err)
+			}
+
+			break
+		}
+
+		if leaf == nil {
+			return details, fmt.Errorf("no certificate found")
+		}
+
+		details.NotAfter = leaf.NotAfter
+		details.Issuer = leaf.Issuer.CommonName
+
+		if time.Until(leaf.NotAfter) < minValidity {
+			return details, fmt.Errorf("certificate expires at %s", leaf.NotAfter.Format(time.RFC3339))
+		}
+
+		return details, nil
+	}
+}
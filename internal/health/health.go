@@ -0,0 +1,149 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package health
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+const (
+	statusOK   = "ok"
+	statusFail = "fail"
+)
+
+// CheckFunc is a readiness check. It may return details that are useful to
+// operators, which will be included in the readiness response.
+type CheckFunc func(ctx context.Context) (any, error)
+
+// Checker serves liveness and readiness endpoints.
+type Checker struct {
+	logger  *zap.Logger
+	timeout time.Duration
+	mu      sync.Mutex
+	checks  map[string]CheckFunc
+}
+
+// Result is the result of a single readiness check.
+type Result struct {
+	Status  string `json:"status"`
+	Error   string `json:"error,omitempty"`
+	Details any    `json:"details,omitempty"`
+}
+
+// Response is the body of a readiness response.
+type Response struct {
+	Status string            `json:"status"`
+	Checks map[string]Result `json:"checks,omitempty"`
+}
+
+// NewChecker creates a new health checker, each readiness check will be
+// given at most the specified timeout to complete.
+func NewChecker(logger *zap.Logger, timeout time.Duration) *Checker {
+	return &Checker{
+		logger:  logger,
+		timeout: timeout,
+		checks:  make(map[string]CheckFunc),
+	}
+}
+
+// Add registers a named readiness check.
+func (h *Checker) Add(name string, check CheckFunc) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.checks[name] = check
+}
+
+// Liveness reports whether the process is alive and able to serve requests.
+func (h *Checker) Liveness(c echo.Context) error {
+	return c.JSON(http.StatusOK, Response{Status: statusOK})
+}
+
+// Readiness runs all of the registered readiness checks and reports whether
+// the mirror is ready to receive traffic.
+func (h *Checker) Readiness(c echo.Context) error {
+	resp := h.Check(c.Request().Context())
+
+	status := http.StatusOK
+	if resp.Status != statusOK {
+		status = http.StatusServiceUnavailable
+	}
+
+	return c.JSON(status, resp)
+}
+
+// Check runs all of the registered readiness checks concurrently.
+func (h *Checker) Check(ctx context.Context) Response {
+	h.mu.Lock()
+	names := make([]string, 0, len(h.checks))
+	for name := range h.checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	checks := make([]CheckFunc, len(names))
+	for i, name := range names {
+		checks[i] = h.checks[name]
+	}
+	h.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+
+	results := make([]Result, len(checks))
+
+	var wg sync.WaitGroup
+	for i := range checks {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			details, err := checks[i](ctx)
+			results[i] = Result{Status: statusOK, Details: details}
+			if err != nil {
+				h.logger.Warn("Readiness check failed",
+					zap.String("check", names[i]), zap.Error(err))
+
+				results[i].Status = statusFail
+				results[i].Error = err.Error()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	resp := Response{
+		Status: statusOK,
+		Checks: make(map[string]Result, len(checks)),
+	}
+
+	for i, name := range names {
+		resp.Checks[name] = results[i]
+		if results[i].Status != statusOK {
+			resp.Status = statusFail
+		}
+	}
+
+	return resp
+}
@@ -0,0 +1,100 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package integrity
+
+import (
+	"bytes"
+	"errors"
+	"hash"
+	"io"
+)
+
+// ErrCorrupt is returned when the content of a blob does not match its id.
+var ErrCorrupt = errors.New("blob content does not match id")
+
+// Matcher is implemented by hashes that can verify content addressed under
+// more than one key (eg. securehash.MultiHash).
+type Matcher interface {
+	Matches(id []byte) bool
+}
+
+// Matches reports whether the content written to h is addressed by id.
+func Matches(h hash.Hash, id []byte) bool {
+	if m, ok := h.(Matcher); ok {
+		return m.Matches(id)
+	}
+
+	return bytes.Equal(h.Sum(nil), id)
+}
+
+// Reader verifies the content read from the underlying reader against the
+// expected id (the keyed hash of the content).
+//
+// When the expected size is known, the final chunk is withheld until the
+// content has been verified, so that a consumer never receives a complete
+// (but corrupt) blob.
+type Reader struct {
+	r    io.Reader
+	h    hash.Hash
+	id   []byte
+	size int64
+	read int64
+	err  error
+}
+
+// NewReader returns a verifying reader, size may be negative if unknown.
+func NewReader(r io.Reader, h hash.Hash, id []byte, size int64) *Reader {
+	return &Reader{
+		r:    r,
+		h:    h,
+		id:   id,
+		size: size,
+	}
+}
+
+func (v *Reader) Read(p []byte) (int, error) {
+	if v.err != nil {
+		return 0, v.err
+	}
+
+	n, err := v.r.Read(p)
+	_, _ = v.h.Write(p[:n])
+	v.read += int64(n)
+
+	if v.size >= 0 && v.read > v.size {
+		v.err = ErrCorrupt
+		return 0, v.err
+	}
+
+	if errors.Is(err, io.EOF) || (v.size >= 0 && v.read == v.size) {
+		if (v.size >= 0 && v.read != v.size) || !Matches(v.h, v.id) {
+			v.err = ErrCorrupt
+			return 0, v.err
+		}
+
+		if err == nil && n == 0 {
+			err = io.EOF
+		}
+	}
+
+	if err != nil {
+		v.err = err
+	}
+
+	return n, err
+}
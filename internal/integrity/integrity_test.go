@@ -0,0 +1,70 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package integrity_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"testing"
+	"testing/iotest"
+
+	"github.com/gpu-ninja/download-mirror/internal/integrity"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReader(t *testing.T) {
+	data := bytes.Repeat([]byte("hello world "), 1000)
+	id := sha256.Sum256(data)
+
+	t.Run("Valid", func(t *testing.T) {
+		r := integrity.NewReader(bytes.NewReader(data), sha256.New(), id[:], int64(len(data)))
+
+		got, err := io.ReadAll(r)
+		require.NoError(t, err)
+		assert.Equal(t, data, got)
+	})
+
+	t.Run("Unknown Size", func(t *testing.T) {
+		r := integrity.NewReader(iotest.HalfReader(bytes.NewReader(data)), sha256.New(), id[:], -1)
+
+		got, err := io.ReadAll(r)
+		require.NoError(t, err)
+		assert.Equal(t, data, got)
+	})
+
+	t.Run("Corrupt", func(t *testing.T) {
+		corrupt := bytes.Clone(data)
+		corrupt[len(corrupt)-1] ^= 0xff
+
+		r := integrity.NewReader(bytes.NewReader(corrupt), sha256.New(), id[:], int64(len(corrupt)))
+
+		got, err := io.ReadAll(r)
+		assert.ErrorIs(t, err, integrity.ErrCorrupt)
+		// The final chunk should be withheld.
+		assert.Less(t, len(got), len(corrupt))
+	})
+
+	t.Run("Truncated", func(t *testing.T) {
+		r := integrity.NewReader(bytes.NewReader(data[:100]), sha256.New(), id[:], int64(len(data)))
+
+		_, err := io.ReadAll(r)
+		assert.ErrorIs(t, err, integrity.ErrCorrupt)
+	})
+}
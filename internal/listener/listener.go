@@ -0,0 +1,138 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package listener
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	unixPrefix    = "unix:"
+	systemdPrefix = "systemd"
+	// The first file descriptor passed by systemd socket activation.
+	listenFDsStart = 3
+)
+
+var (
+	activatedOnce      sync.Once
+	activatedListeners []net.Listener
+	activatedNames     []string
+	activatedErr       error
+)
+
+// Listen creates a listener for the given address. Supported forms are:
+//
+//	host:port          TCP address.
+//	unix:/path/to.sock Unix domain socket.
+//	systemd            First socket passed by systemd socket activation.
+//	systemd:<name>     Socket passed by systemd with the given FileDescriptorName.
+//	systemd:<index>    Socket passed by systemd at the given (zero based) index.
+func Listen(addr string) (net.Listener, error) {
+	switch {
+	case strings.HasPrefix(addr, unixPrefix):
+		path := strings.TrimPrefix(addr, unixPrefix)
+
+		// Remove any stale socket left behind by a previous run.
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("failed to remove stale socket: %w", err)
+		}
+
+		return net.Listen("unix", path)
+	case addr == systemdPrefix || strings.HasPrefix(addr, systemdPrefix+":"):
+		return activated(strings.TrimPrefix(strings.TrimPrefix(addr, systemdPrefix), ":"))
+	default:
+		return net.Listen("tcp", addr)
+	}
+}
+
+func activated(name string) (net.Listener, error) {
+	activatedOnce.Do(func() {
+		activatedListeners, activatedNames, activatedErr = listenFDs()
+	})
+	if activatedErr != nil {
+		return nil, activatedErr
+	}
+
+	if len(activatedListeners) == 0 {
+		return nil, fmt.Errorf("no sockets passed by systemd")
+	}
+
+	if name == "" {
+		return activatedListeners[0], nil
+	}
+
+	for i, n := range activatedNames {
+		if n == name {
+			return activatedListeners[i], nil
+		}
+	}
+
+	if i, err := strconv.Atoi(name); err == nil && i >= 0 && i < len(activatedListeners) {
+		return activatedListeners[i], nil
+	}
+
+	return nil, fmt.Errorf("no socket named %q passed by systemd", name)
+}
+
+// listenFDs implements the sd_listen_fds(3) protocol.
+func listenFDs() ([]net.Listener, []string, error) {
+	defer func() {
+		_ = os.Unsetenv("LISTEN_PID")
+		_ = os.Unsetenv("LISTEN_FDS")
+		_ = os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil, nil
+	}
+
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil, nil
+	}
+
+	var names []string
+	if fdNames := os.Getenv("LISTEN_FDNAMES"); fdNames != "" {
+		names = strings.Split(fdNames, ":")
+	}
+
+	listeners := make([]net.Listener, n)
+	for i := 0; i < n; i++ {
+		name := "LISTEN_FD_" + strconv.Itoa(listenFDsStart+i)
+		if i < len(names) {
+			name = names[i]
+		}
+
+		f := os.NewFile(uintptr(listenFDsStart+i), name)
+
+		listeners[i], err = net.FileListener(f)
+		_ = f.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to use socket passed by systemd: %w", err)
+		}
+	}
+
+	return listeners, names, nil
+}
@@ -0,0 +1,80 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"context"
+	"time"
+)
+
+const aliasesDir = "meta/aliases"
+
+// Alias is a mutable name that points at an immutable blob.
+type Alias struct {
+	// Path is the name of the alias (eg. latest/tool-linux-amd64).
+	Path string `json:"path"`
+	// ID is the base58 encoded id of the blob the alias points at.
+	ID string `json:"id"`
+	// Name is the filename the blob is served under.
+	Name string `json:"name"`
+	// Revision is incremented every time the alias changes.
+	Revision int `json:"revision"`
+	// UpdatedAt is when the alias last changed.
+	UpdatedAt time.Time `json:"updatedAt"`
+	// History is every revision of the alias, oldest first (including the
+	// current one).
+	History []AliasRevision `json:"history"`
+}
+
+// AliasRevision is a past (or the current) target of an alias.
+type AliasRevision struct {
+	Revision int    `json:"revision"`
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	// UpdatedBy is the name of the token that made the change.
+	UpdatedBy string `json:"updatedBy,omitempty"`
+	// RollbackOf is the revision that was restored, if the change was a
+	// rollback.
+	RollbackOf int       `json:"rollbackOf,omitempty"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+// GetAlias returns an alias.
+func (s *Store) GetAlias(ctx context.Context, path string) (*Alias, error) {
+	var a Alias
+	if err := s.get(ctx, recordName(aliasesDir, path), &a); err != nil {
+		return nil, err
+	}
+
+	return &a, nil
+}
+
+// UpdateAlias performs a read-modify-write update of an alias, modify is
+// called with the current alias (with a zero revision if it doesn't exist)
+// and reports whether it changed it. The updated alias is returned. Updates
+// that raced with another update are retried, so modify may be called more
+// than once.
+func (s *Store) UpdateAlias(ctx context.Context, path string, modify func(a *Alias) (bool, error)) (*Alias, error) {
+	return update(ctx, s, recordName(aliasesDir, path), func(a *Alias, exists bool) (bool, error) {
+		if !exists {
+			a.Path = path
+		}
+
+		return modify(a)
+	})
+}
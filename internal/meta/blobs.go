@@ -0,0 +1,132 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/akamensky/base58"
+)
+
+const blobsDir = "meta/blobs"
+
+// Blob is the metadata record for an uploaded blob.
+type Blob struct {
+	// ID is the base58 encoded blob id.
+	ID string `json:"id"`
+	// Name is the filename the blob was uploaded with.
+	Name string `json:"name,omitempty"`
+	// Size is the size of the blob in bytes.
+	Size int64 `json:"size"`
+	// Labels are arbitrary key/value pairs used to select blobs.
+	Labels map[string]string `json:"labels,omitempty"`
+	// SHA256 is the hex encoded SHA-256 digest of the content.
+	SHA256 string `json:"sha256,omitempty"`
+	// SHA512 is the hex encoded SHA-512 digest of the content.
+	SHA512 string `json:"sha512,omitempty"`
+	// KeyID identifies the secure hash key the blob is addressed under.
+	KeyID string `json:"keyId,omitempty"`
+	// Owner is the name of the token that first uploaded the blob, it is
+	// charged for the storage of the blob.
+	Owner string `json:"owner,omitempty"`
+	// CreatedAt is when the blob was first uploaded.
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// GetBlob returns the metadata record for a blob.
+func (s *Store) GetBlob(ctx context.Context, id []byte) (*Blob, error) {
+	var blob Blob
+	if err := s.get(ctx, recordName(blobsDir, base58.Encode(id)), &blob); err != nil {
+		return nil, err
+	}
+
+	return &blob, nil
+}
+
+// PutBlob creates or updates the metadata record for a blob. If a record
+// already exists, labels are merged and the original owner and creation time
+// are kept. The blob is updated to match the stored record.
+func (s *Store) PutBlob(ctx context.Context, blob *Blob) error {
+	if _, err := base58.Decode(blob.ID); err != nil {
+		return err
+	}
+
+	record, err := update(ctx, s, recordName(blobsDir, blob.ID), func(record *Blob, exists bool) (bool, error) {
+		existing := *record
+
+		*record = *blob
+		if exists {
+			record.CreatedAt = existing.CreatedAt
+			record.Owner = existing.Owner
+		}
+
+		if len(existing.Labels) > 0 {
+			record.Labels = make(map[string]string, len(existing.Labels)+len(blob.Labels))
+			for k, v := range existing.Labels {
+				record.Labels[k] = v
+			}
+
+			for k, v := range blob.Labels {
+				record.Labels[k] = v
+			}
+		}
+
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	*blob = *record
+
+	return nil
+}
+
+// ListBlobs returns the metadata records for all blobs matching the label
+// selector, ordered by creation time.
+func (s *Store) ListBlobs(ctx context.Context, selector Selector) ([]Blob, error) {
+	keys, err := s.list(ctx, blobsDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var blobs []Blob
+	for _, key := range keys {
+		var blob Blob
+		if err := s.get(ctx, recordName(blobsDir, key), &blob); err != nil {
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+
+			return nil, err
+		}
+
+		if selector.Matches(blob.Labels) {
+			blobs = append(blobs, blob)
+		}
+	}
+
+	sort.Slice(blobs, func(i, j int) bool {
+		return blobs[i].CreatedAt.Before(blobs[j].CreatedAt)
+	})
+
+	return blobs, nil
+}
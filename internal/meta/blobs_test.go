@@ -0,0 +1,115 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/akamensky/base58"
+	"github.com/gpu-ninja/download-mirror/internal/meta"
+	"github.com/gpu-ninja/download-mirror/internal/upstream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPutBlob(t *testing.T) {
+	ctx := context.Background()
+
+	ups, err := upstream.NewFilesystem(t.TempDir())
+	require.NoError(t, err)
+
+	metadata := meta.NewStore(ups)
+
+	id := sha256.Sum256([]byte("hello world"))
+	encodedID := base58.Encode(id[:])
+
+	require.NoError(t, metadata.PutBlob(ctx, &meta.Blob{
+		ID:        encodedID,
+		Owner:     "first",
+		CreatedAt: time.Now().UTC(),
+	}))
+
+	t.Run("Concurrent Labels", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+
+				assert.NoError(t, metadata.PutBlob(ctx, &meta.Blob{
+					ID:        encodedID,
+					Owner:     "second",
+					Labels:    map[string]string{fmt.Sprintf("label%d", i): "true"},
+					CreatedAt: time.Now().UTC(),
+				}))
+			}(i)
+		}
+		wg.Wait()
+
+		blob, err := metadata.GetBlob(ctx, id[:])
+		require.NoError(t, err)
+
+		assert.Len(t, blob.Labels, 50)
+		assert.Equal(t, "first", blob.Owner)
+	})
+	t.Run("Unversioned Upstream", func(t *testing.T) {
+		ups, err := upstream.NewFilesystem(t.TempDir())
+		require.NoError(t, err)
+
+		metadata := meta.NewStore(&unversionedUpstream{Filesystem: ups})
+
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+
+				assert.NoError(t, metadata.PutBlob(ctx, &meta.Blob{
+					ID:        encodedID,
+					Labels:    map[string]string{fmt.Sprintf("label%d", i): "true"},
+					CreatedAt: time.Now().UTC(),
+				}))
+			}(i)
+		}
+		wg.Wait()
+
+		blob, err := metadata.GetBlob(ctx, id[:])
+		require.NoError(t, err)
+
+		assert.Len(t, blob.Labels, 10)
+	})
+}
+
+// unversionedUpstream is an upstream that doesn't support conditional writes.
+type unversionedUpstream struct {
+	*upstream.Filesystem
+}
+
+func (u *unversionedUpstream) GetObjectVersion(_ context.Context, _ string) (io.ReadCloser, string, error) {
+	return nil, "", upstream.ErrUnversioned
+}
+
+func (u *unversionedUpstream) PutObjectIfVersion(_ context.Context, _ string, _ io.Reader, _ string) error {
+	return upstream.ErrUnversioned
+}
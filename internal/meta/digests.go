@@ -0,0 +1,61 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"context"
+	"path"
+	"time"
+)
+
+const digestsDir = "meta/digests"
+
+// Supported public digest algorithms.
+const (
+	DigestSHA256 = "sha256"
+	DigestSHA512 = "sha512"
+)
+
+// Digest maps a public digest of a blob's content to its id.
+type Digest struct {
+	// Algorithm is the digest algorithm (sha256 or sha512).
+	Algorithm string `json:"algorithm"`
+	// Digest is the hex encoded digest.
+	Digest string `json:"digest"`
+	// ID is the base58 encoded blob id.
+	ID string `json:"id"`
+	// Name is the filename the blob was uploaded with.
+	Name string `json:"name,omitempty"`
+	// CreatedAt is when the mapping was recorded.
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// GetDigest returns the mapping for a hex encoded digest.
+func (s *Store) GetDigest(ctx context.Context, algorithm, digest string) (*Digest, error) {
+	var d Digest
+	if err := s.get(ctx, recordName(path.Join(digestsDir, algorithm), digest), &d); err != nil {
+		return nil, err
+	}
+
+	return &d, nil
+}
+
+// PutDigest creates or replaces the mapping for a digest.
+func (s *Store) PutDigest(ctx context.Context, d *Digest) error {
+	return s.put(ctx, recordName(path.Join(digestsDir, d.Algorithm), d.Digest), d)
+}
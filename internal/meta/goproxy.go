@@ -0,0 +1,116 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"context"
+	"path"
+	"time"
+
+	"golang.org/x/mod/module"
+)
+
+const goproxyDir = "meta/goproxy"
+
+// GoModuleVersion is a published version of a Go module.
+type GoModuleVersion struct {
+	// Path is the module path.
+	Path string `json:"path"`
+	// Version is the canonical semantic version.
+	Version string `json:"version"`
+	// Time is the commit (or publication) time reported to the go command.
+	Time time.Time `json:"time"`
+	// ModID is the id of the blob holding the go.mod file.
+	ModID string `json:"modId"`
+	// ZipID is the id of the blob holding the module zip.
+	ZipID string `json:"zipId"`
+	// CreatedAt is when the version was published.
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Records are laid out like the module proxy protocol, using the same case
+// escaping, so that nested modules can't clash with their parents.
+func goModuleVersionsDir(modulePath string) (string, error) {
+	escapedPath, err := module.EscapePath(modulePath)
+	if err != nil {
+		return "", err
+	}
+
+	return path.Join(goproxyDir, escapedPath, "@v"), nil
+}
+
+// GetGoModuleVersion returns a published version of a Go module.
+func (s *Store) GetGoModuleVersion(ctx context.Context, modulePath, version string) (*GoModuleVersion, error) {
+	dir, err := goModuleVersionsDir(modulePath)
+	if err != nil {
+		return nil, err
+	}
+
+	escapedVersion, err := module.EscapeVersion(version)
+	if err != nil {
+		return nil, err
+	}
+
+	var v GoModuleVersion
+	if err := s.get(ctx, recordName(dir, escapedVersion), &v); err != nil {
+		return nil, err
+	}
+
+	return &v, nil
+}
+
+// PutGoModuleVersion records a published version of a Go module.
+func (s *Store) PutGoModuleVersion(ctx context.Context, v *GoModuleVersion) error {
+	dir, err := goModuleVersionsDir(v.Path)
+	if err != nil {
+		return err
+	}
+
+	escapedVersion, err := module.EscapeVersion(v.Version)
+	if err != nil {
+		return err
+	}
+
+	return s.put(ctx, recordName(dir, escapedVersion), v)
+}
+
+// ListGoModuleVersions returns the published versions of a Go module, in no
+// particular order.
+func (s *Store) ListGoModuleVersions(ctx context.Context, modulePath string) ([]string, error) {
+	dir, err := goModuleVersionsDir(modulePath)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := s.list(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var versions []string
+	for _, key := range keys {
+		version, err := module.UnescapeVersion(key)
+		if err != nil {
+			continue
+		}
+
+		versions = append(versions, version)
+	}
+
+	return versions, nil
+}
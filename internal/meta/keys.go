@@ -0,0 +1,89 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"context"
+	"time"
+
+	"github.com/akamensky/base58"
+)
+
+const (
+	redirectsDir = "meta/redirects"
+	keysRecord   = "meta/keys.json"
+)
+
+// Redirect maps a blob id addressed under a legacy key to the id of the same
+// content under the current primary key.
+type Redirect struct {
+	// ID is the base58 encoded legacy blob id.
+	ID string `json:"id"`
+	// Target is the base58 encoded blob id under the primary key.
+	Target string `json:"target"`
+	// KeyID identifies the legacy key.
+	KeyID string `json:"keyId,omitempty"`
+	// TargetKeyID identifies the key the target is addressed under.
+	TargetKeyID string `json:"targetKeyId,omitempty"`
+	// CreatedAt is when the blob was re-keyed.
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// GetRedirect returns the redirect for a legacy blob id.
+func (s *Store) GetRedirect(ctx context.Context, id []byte) (*Redirect, error) {
+	var redirect Redirect
+	if err := s.get(ctx, recordName(redirectsDir, base58.Encode(id)), &redirect); err != nil {
+		return nil, err
+	}
+
+	return &redirect, nil
+}
+
+// PutRedirect creates or replaces the redirect for a legacy blob id.
+func (s *Store) PutRedirect(ctx context.Context, redirect *Redirect) error {
+	return s.put(ctx, recordName(redirectsDir, redirect.ID), redirect)
+}
+
+// Keys records which secure hash keys blobs have been addressed under, so
+// that a misconfigured keyring can be detected.
+type Keys struct {
+	// Primary is the id of the key new blobs are addressed under.
+	Primary string `json:"primary"`
+	// KeyIDs are the ids of every key that blobs may be addressed under.
+	KeyIDs []string `json:"keyIds"`
+	// Migrated are the ids of legacy keys whose blobs have all been re-keyed
+	// to the primary key.
+	Migrated []string `json:"migrated,omitempty"`
+	// UpdatedAt is when the record was last updated.
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// GetKeys returns the keys record.
+func (s *Store) GetKeys(ctx context.Context) (*Keys, error) {
+	var keys Keys
+	if err := s.get(ctx, keysRecord, &keys); err != nil {
+		return nil, err
+	}
+
+	return &keys, nil
+}
+
+// PutKeys replaces the keys record.
+func (s *Store) PutKeys(ctx context.Context, keys *Keys) error {
+	return s.put(ctx, keysRecord, keys)
+}
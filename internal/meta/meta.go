@@ -0,0 +1,229 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/gpu-ninja/download-mirror/internal/upstream"
+)
+
+var (
+	// ErrNotFound is returned when a metadata record does not exist.
+	ErrNotFound = errors.New("metadata record not found")
+	// ErrConflict is returned when an update of a record kept conflicting
+	// with concurrent updates.
+	ErrConflict = errors.New("metadata record was modified concurrently")
+)
+
+// maxUpdateAttempts is how many times an update is attempted before giving
+// up with ErrConflict.
+const maxUpdateAttempts = 10
+
+// Store is a metadata store that persists JSON records as objects in the
+// upstream, so that every mirror node sees the same state.
+type Store struct {
+	ups upstream.Upstream
+	// Protects locks.
+	mu    sync.Mutex
+	locks map[string]*recordLock
+}
+
+// recordLock serialises read-modify-write updates of a record.
+type recordLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+func NewStore(ups upstream.Upstream) *Store {
+	return &Store{
+		ups:   ups,
+		locks: make(map[string]*recordLock),
+	}
+}
+
+// lock serialises read-modify-write updates of a record within this process,
+// it returns a function that unlocks the record.
+func (s *Store) lock(name string) func() {
+	s.mu.Lock()
+	l, ok := s.locks[name]
+	if !ok {
+		l = &recordLock{}
+		s.locks[name] = l
+	}
+	l.refs++
+	s.mu.Unlock()
+
+	l.mu.Lock()
+
+	return func() {
+		l.mu.Unlock()
+
+		s.mu.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(s.locks, name)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// get reads and decodes a record.
+func (s *Store) get(ctx context.Context, name string, v any) error {
+	r, err := s.ups.GetObject(ctx, name)
+	if err != nil {
+		if errors.Is(err, upstream.ErrNotFound) {
+			return ErrNotFound
+		}
+
+		return fmt.Errorf("failed to read metadata record %q: %w", name, err)
+	}
+	defer r.Close()
+
+	if err := json.NewDecoder(r).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode metadata record %q: %w", name, err)
+	}
+
+	return nil
+}
+
+// getVersion reads and decodes a record, returning its version.
+func (s *Store) getVersion(ctx context.Context, name string, v any) (string, error) {
+	r, version, err := s.ups.GetObjectVersion(ctx, name)
+	if err != nil {
+		if errors.Is(err, upstream.ErrNotFound) {
+			return "", ErrNotFound
+		}
+
+		return "", fmt.Errorf("failed to read metadata record %q: %w", name, err)
+	}
+	defer r.Close()
+
+	if err := json.NewDecoder(r).Decode(v); err != nil {
+		return "", fmt.Errorf("failed to decode metadata record %q: %w", name, err)
+	}
+
+	return version, nil
+}
+
+// put encodes and writes a record.
+func (s *Store) put(ctx context.Context, name string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode metadata record %q: %w", name, err)
+	}
+
+	if err := s.ups.PutObject(ctx, name, bytes.NewReader(data)); err != nil {
+		return fmt.Errorf("failed to write metadata record %q: %w", name, err)
+	}
+
+	return nil
+}
+
+// putIfVersion encodes and writes a record, if it is still at the given
+// version (or doesn't exist, if the version is empty).
+func (s *Store) putIfVersion(ctx context.Context, name string, v any, version string) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode metadata record %q: %w", name, err)
+	}
+
+	if err := s.ups.PutObjectIfVersion(ctx, name, bytes.NewReader(data), version); err != nil {
+		return fmt.Errorf("failed to write metadata record %q: %w", name, err)
+	}
+
+	return nil
+}
+
+// update performs a read-modify-write update of a record. modify is called
+// with the current record (the zero value if it doesn't exist), and reports
+// whether it changed it. Updates are serialised within this process, and
+// written conditionally so that an update that raced with another node is
+// retried rather than lost. If the upstream doesn't support conditional
+// writes, updates are only serialised within this process.
+func update[T any](ctx context.Context, s *Store, name string, modify func(v *T, exists bool) (bool, error)) (*T, error) {
+	unlock := s.lock(name)
+	defer unlock()
+
+	for attempt := 0; attempt < maxUpdateAttempts; attempt++ {
+		var v T
+		versioned := true
+		version, err := s.getVersion(ctx, name, &v)
+		if errors.Is(err, upstream.ErrUnversioned) {
+			versioned = false
+			err = s.get(ctx, name, &v)
+		}
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return nil, err
+		}
+
+		changed, err := modify(&v, err == nil)
+		if err != nil {
+			return nil, err
+		} else if !changed {
+			return &v, nil
+		}
+
+		if !versioned {
+			if err := s.put(ctx, name, &v); err != nil {
+				return nil, err
+			}
+
+			return &v, nil
+		}
+
+		err = s.putIfVersion(ctx, name, &v, version)
+		if errors.Is(err, upstream.ErrConflict) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		return &v, nil
+	}
+
+	return nil, fmt.Errorf("%w: %q", ErrConflict, name)
+}
+
+// list returns the names (without the extension) of the records in dir.
+func (s *Store) list(ctx context.Context, dir string) ([]string, error) {
+	names, err := s.ups.ListObjects(ctx, dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list metadata records in %q: %w", dir, err)
+	}
+
+	var keys []string
+	for _, name := range names {
+		if key, ok := strings.CutSuffix(name, ".json"); ok {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys, nil
+}
+
+func recordName(dir, key string) string {
+	return path.Join(dir, key+".json")
+}
@@ -0,0 +1,114 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"context"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+const ociDir = "meta/oci"
+
+// OCIManifest is an OCI image manifest (or index) pushed to a repository.
+type OCIManifest struct {
+	// Repository is the name of the repository.
+	Repository string `json:"repository"`
+	// Digest is the digest of the manifest (eg. sha256:<hex>).
+	Digest string `json:"digest"`
+	// MediaType is the media type of the manifest.
+	MediaType string `json:"mediaType"`
+	// Content is the manifest exactly as it was pushed.
+	Content []byte `json:"content"`
+	// CreatedAt is when the manifest was first pushed.
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// OCITag points a tag in a repository at a manifest.
+type OCITag struct {
+	// Repository is the name of the repository.
+	Repository string `json:"repository"`
+	// Tag is the name of the tag.
+	Tag string `json:"tag"`
+	// Digest is the digest of the tagged manifest.
+	Digest string `json:"digest"`
+	// UpdatedAt is when the tag was last pushed.
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// Repository names can contain slashes, but path components can't start
+// with an underscore, so these can't clash with nested repositories.
+func ociManifestsDir(repository string) string {
+	return path.Join(ociDir, repository, "_manifests")
+}
+
+func ociTagsDir(repository string) string {
+	return path.Join(ociDir, repository, "_tags")
+}
+
+// ociDigestKey avoids colons in object names, sha256:<hex> is stored as
+// sha256/<hex>.
+func ociDigestKey(digest string) string {
+	algorithm, encoded, _ := strings.Cut(digest, ":")
+	return path.Join(algorithm, encoded)
+}
+
+// GetOCIManifest returns a manifest by digest.
+func (s *Store) GetOCIManifest(ctx context.Context, repository, digest string) (*OCIManifest, error) {
+	var manifest OCIManifest
+	if err := s.get(ctx, recordName(ociManifestsDir(repository), ociDigestKey(digest)), &manifest); err != nil {
+		return nil, err
+	}
+
+	return &manifest, nil
+}
+
+// PutOCIManifest creates or replaces a manifest.
+func (s *Store) PutOCIManifest(ctx context.Context, manifest *OCIManifest) error {
+	return s.put(ctx, recordName(ociManifestsDir(manifest.Repository), ociDigestKey(manifest.Digest)), manifest)
+}
+
+// GetOCITag returns a tag.
+func (s *Store) GetOCITag(ctx context.Context, repository, tag string) (*OCITag, error) {
+	var t OCITag
+	if err := s.get(ctx, recordName(ociTagsDir(repository), tag), &t); err != nil {
+		return nil, err
+	}
+
+	return &t, nil
+}
+
+// PutOCITag creates or moves a tag.
+func (s *Store) PutOCITag(ctx context.Context, tag *OCITag) error {
+	return s.put(ctx, recordName(ociTagsDir(tag.Repository), tag.Tag), tag)
+}
+
+// ListOCITags returns the names of the tags in a repository, in lexical
+// order.
+func (s *Store) ListOCITags(ctx context.Context, repository string) ([]string, error) {
+	tags, err := s.list(ctx, ociTagsDir(repository))
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(tags)
+
+	return tags, nil
+}
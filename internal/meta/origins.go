@@ -0,0 +1,64 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+)
+
+const originsDir = "meta/origins"
+
+// Origin maps an origin URL that was mirrored on demand to the blob holding
+// its content.
+type Origin struct {
+	// URL is the origin URL.
+	URL string `json:"url"`
+	// ID is the base58 encoded blob id.
+	ID string `json:"id"`
+	// Size is the size of the content in bytes.
+	Size int64 `json:"size"`
+	// SHA256 is the hex encoded SHA-256 digest of the content.
+	SHA256 string `json:"sha256"`
+	// FetchedAt is when the content was fetched from the origin.
+	FetchedAt time.Time `json:"fetchedAt"`
+}
+
+// URLs can be arbitrarily long and contain characters that aren't valid in
+// object names, so records are keyed by the hash of the URL.
+func originKey(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return hex.EncodeToString(sum[:])
+}
+
+// GetOrigin returns the mapping for an origin URL.
+func (s *Store) GetOrigin(ctx context.Context, url string) (*Origin, error) {
+	var o Origin
+	if err := s.get(ctx, recordName(originsDir, originKey(url)), &o); err != nil {
+		return nil, err
+	}
+
+	return &o, nil
+}
+
+// PutOrigin creates or replaces the mapping for an origin URL.
+func (s *Store) PutOrigin(ctx context.Context, o *Origin) error {
+	return s.put(ctx, recordName(originsDir, originKey(o.URL)), o)
+}
@@ -0,0 +1,172 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"context"
+	"errors"
+	"path"
+	"sort"
+	"time"
+)
+
+const releasesDir = "meta/releases"
+
+// ErrReserved is returned when a version of a product is already reserved by
+// another creation of the release.
+var ErrReserved = errors.New("release version is reserved")
+
+// Release is the manifest of a release, a set of blobs (eg. one per
+// platform, plus checksums and signatures).
+type Release struct {
+	// Product is the name of the product.
+	Product string `json:"product"`
+	// Version is the version of the release.
+	Version string `json:"version"`
+	// Files are the files in the release.
+	Files []ReleaseFile `json:"files"`
+	// CreatedBy is the name of the token that created the release.
+	CreatedBy string `json:"createdBy,omitempty"`
+	// CreatedAt is when the release was created.
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// ReleaseFile is a file in a release.
+type ReleaseFile struct {
+	// Name is the filename of the file in the release.
+	Name string `json:"name"`
+	// Platform is the platform the file is for (eg. linux/amd64), if any.
+	Platform string `json:"platform,omitempty"`
+	// ID is the base58 encoded blob id.
+	ID string `json:"id"`
+	// Size is the size of the file in bytes.
+	Size int64 `json:"size"`
+	// SHA256 is the hex encoded SHA-256 digest of the file.
+	SHA256 string `json:"sha256"`
+}
+
+// ReleaseChannel points a channel of a product (eg. stable) at a release.
+type ReleaseChannel struct {
+	Product   string    `json:"product"`
+	Channel   string    `json:"channel"`
+	Version   string    `json:"version"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// ReleaseReservation claims a version of a product while its release is being
+// created, so that concurrent creations (on any node) can't both sign and
+// store it.
+type ReleaseReservation struct {
+	Product   string    `json:"product"`
+	Version   string    `json:"version"`
+	CreatedBy string    `json:"createdBy,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	// Released is set when the creation failed, so that the version can be
+	// reserved again.
+	Released bool `json:"released,omitempty"`
+}
+
+// Channel names must start with an alphanumeric character, so these can't
+// clash with versions.
+func releaseChannelsDir(product string) string {
+	return path.Join(releasesDir, product, "_channels")
+}
+
+func releaseReservationsDir(product string) string {
+	return path.Join(releasesDir, product, "_reservations")
+}
+
+// GetRelease returns the manifest of a release.
+func (s *Store) GetRelease(ctx context.Context, product, version string) (*Release, error) {
+	var r Release
+	if err := s.get(ctx, recordName(path.Join(releasesDir, product), version), &r); err != nil {
+		return nil, err
+	}
+
+	return &r, nil
+}
+
+// PutRelease creates or replaces the manifest of a release.
+func (s *Store) PutRelease(ctx context.Context, r *Release) error {
+	return s.put(ctx, recordName(path.Join(releasesDir, r.Product), r.Version), r)
+}
+
+// ReserveRelease reserves a version of a product, ErrReserved is returned if
+// it's already reserved. Reservations that were released, or are older than
+// maxAge (the creation was abandoned), are taken over.
+func (s *Store) ReserveRelease(ctx context.Context, res *ReleaseReservation, maxAge time.Duration) error {
+	name := recordName(releaseReservationsDir(res.Product), res.Version)
+
+	_, err := update(ctx, s, name, func(existing *ReleaseReservation, exists bool) (bool, error) {
+		if exists && !existing.Released && time.Since(existing.CreatedAt) < maxAge {
+			return false, ErrReserved
+		}
+
+		*existing = *res
+
+		return true, nil
+	})
+
+	return err
+}
+
+// ReleaseReservation releases a reservation made by ReserveRelease, unless
+// it has since been taken over.
+func (s *Store) ReleaseReservation(ctx context.Context, res *ReleaseReservation) error {
+	name := recordName(releaseReservationsDir(res.Product), res.Version)
+
+	_, err := update(ctx, s, name, func(existing *ReleaseReservation, exists bool) (bool, error) {
+		if !exists || existing.Released || !existing.CreatedAt.Equal(res.CreatedAt) {
+			return false, nil
+		}
+
+		existing.Released = true
+
+		return true, nil
+	})
+
+	return err
+}
+
+// ListReleases returns the versions of a product's releases, in lexical
+// order.
+func (s *Store) ListReleases(ctx context.Context, product string) ([]string, error) {
+	versions, err := s.list(ctx, path.Join(releasesDir, product))
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(versions)
+
+	return versions, nil
+}
+
+// GetReleaseChannel returns a release channel.
+func (s *Store) GetReleaseChannel(ctx context.Context, product, channel string) (*ReleaseChannel, error) {
+	var c ReleaseChannel
+	if err := s.get(ctx, recordName(releaseChannelsDir(product), channel), &c); err != nil {
+		return nil, err
+	}
+
+	return &c, nil
+}
+
+// PutReleaseChannel creates or moves a release channel.
+func (s *Store) PutReleaseChannel(ctx context.Context, c *ReleaseChannel) error {
+	return s.put(ctx, recordName(releaseChannelsDir(c.Product), c.Channel), c)
+}
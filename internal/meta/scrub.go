@@ -0,0 +1,48 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"context"
+
+	"github.com/gpu-ninja/download-mirror/pkg/api"
+)
+
+const (
+	scrubReportsDir   = "meta/scrub"
+	latestScrubReport = "latest"
+)
+
+// PutScrubReport stores a scrub report, and records it as the latest report.
+func (s *Store) PutScrubReport(ctx context.Context, report *api.ScrubReport) error {
+	if err := s.put(ctx, recordName(scrubReportsDir, report.StartedAt.UTC().Format("20060102T150405Z")), report); err != nil {
+		return err
+	}
+
+	return s.put(ctx, recordName(scrubReportsDir, latestScrubReport), report)
+}
+
+// LatestScrubReport returns the most recently stored scrub report.
+func (s *Store) LatestScrubReport(ctx context.Context) (*api.ScrubReport, error) {
+	var report api.ScrubReport
+	if err := s.get(ctx, recordName(scrubReportsDir, latestScrubReport), &report); err != nil {
+		return nil, err
+	}
+
+	return &report, nil
+}
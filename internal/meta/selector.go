@@ -0,0 +1,109 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Requirement is a single label selector requirement.
+type Requirement struct {
+	Key string
+	// Value is the required value, ignored if Exists is set.
+	Value  string
+	Negate bool
+	Exists bool
+}
+
+// Selector is a set of label requirements, all of which must match.
+type Selector []Requirement
+
+// ParseSelector parses a label selector in the form "key=value,key!=value,key".
+func ParseSelector(s string) (Selector, error) {
+	var selector Selector
+	for _, term := range strings.Split(s, ",") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+
+		var req Requirement
+		if key, value, ok := strings.Cut(term, "!="); ok {
+			req = Requirement{Key: key, Value: value, Negate: true}
+		} else if key, value, ok := strings.Cut(term, "="); ok {
+			req = Requirement{Key: key, Value: value}
+		} else {
+			req = Requirement{Key: term, Exists: true}
+		}
+
+		req.Key = strings.TrimSpace(req.Key)
+		req.Value = strings.TrimSpace(req.Value)
+
+		if req.Key == "" {
+			return nil, fmt.Errorf("invalid label selector term: %q", term)
+		}
+
+		selector = append(selector, req)
+	}
+
+	return selector, nil
+}
+
+// ParseLabels parses a list of "key=value" labels.
+func ParseLabels(labels []string) (map[string]string, error) {
+	if len(labels) == 0 {
+		return nil, nil
+	}
+
+	m := make(map[string]string, len(labels))
+	for _, label := range labels {
+		key, value, ok := strings.Cut(label, "=")
+		if !ok || strings.TrimSpace(key) == "" {
+			return nil, fmt.Errorf("invalid label: %q", label)
+		}
+
+		m[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+
+	return m, nil
+}
+
+// Matches returns true if the labels satisfy every requirement.
+func (s Selector) Matches(labels map[string]string) bool {
+	for _, req := range s {
+		value, ok := labels[req.Key]
+
+		switch {
+		case req.Exists:
+			if !ok {
+				return false
+			}
+		case req.Negate:
+			if ok && value == req.Value {
+				return false
+			}
+		default:
+			if !ok || value != req.Value {
+				return false
+			}
+		}
+	}
+
+	return true
+}
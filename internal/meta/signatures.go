@@ -0,0 +1,53 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"context"
+	"time"
+)
+
+const signaturesDir = "meta/signatures"
+
+// Signature is a minisign signature over a blob or a generated release file.
+type Signature struct {
+	// Subject is what was signed (eg. blobs/<id> or
+	// releases/<product>/<version>/SHA256SUMS).
+	Subject string `json:"subject"`
+	// KeyID is the id of the signing key, as minisign displays it.
+	KeyID string `json:"keyId"`
+	// Signature is the minisign signature file.
+	Signature string `json:"signature"`
+	// CreatedAt is when the signature was recorded.
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// GetSignature returns the signature of a subject.
+func (s *Store) GetSignature(ctx context.Context, subject string) (*Signature, error) {
+	var sig Signature
+	if err := s.get(ctx, recordName(signaturesDir, subject), &sig); err != nil {
+		return nil, err
+	}
+
+	return &sig, nil
+}
+
+// PutSignature creates or replaces the signature of a subject.
+func (s *Store) PutSignature(ctx context.Context, sig *Signature) error {
+	return s.put(ctx, recordName(signaturesDir, sig.Subject), sig)
+}
@@ -0,0 +1,114 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"path"
+	"time"
+)
+
+const usageDir = "meta/usage"
+
+// Usage is the storage charged to a token, for the blobs it uploaded.
+type Usage struct {
+	// Token is the name of the token.
+	Token string `json:"token"`
+	// Node is the name of the mirror the blobs were uploaded to. Each node
+	// only ever writes its own usage record, so that nodes don't overwrite
+	// each other's counts.
+	Node string `json:"node,omitempty"`
+	// Bytes is the total size of the blobs uploaded by the token.
+	Bytes int64 `json:"bytes"`
+	// Blobs is the number of blobs uploaded by the token.
+	Blobs int64 `json:"blobs"`
+	// UpdatedAt is when the usage last changed.
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// Token and node names can contain characters that aren't valid in object
+// names.
+func usageKey(name string) string {
+	return url.PathEscape(name)
+}
+
+// GetUsage returns the total storage charged to a token, across every node.
+func (s *Store) GetUsage(ctx context.Context, token string) (*Usage, error) {
+	records, err := s.ListUsage(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(records) == 0 {
+		return nil, ErrNotFound
+	}
+
+	total := Usage{Token: token}
+	for _, u := range records {
+		total.Bytes += u.Bytes
+		total.Blobs += u.Blobs
+		if u.UpdatedAt.After(total.UpdatedAt) {
+			total.UpdatedAt = u.UpdatedAt
+		}
+	}
+
+	return &total, nil
+}
+
+// ListUsage returns the storage charged to a token by each node.
+func (s *Store) ListUsage(ctx context.Context, token string) ([]*Usage, error) {
+	dir := path.Join(usageDir, usageKey(token))
+
+	keys, err := s.list(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []*Usage
+	for _, key := range keys {
+		var u Usage
+		if err := s.get(ctx, recordName(dir, key), &u); err != nil {
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+
+			return nil, err
+		}
+
+		records = append(records, &u)
+	}
+
+	return records, nil
+}
+
+// GetNodeUsage returns the storage charged to a token by a single node.
+func (s *Store) GetNodeUsage(ctx context.Context, token, node string) (*Usage, error) {
+	var u Usage
+	if err := s.get(ctx, recordName(path.Join(usageDir, usageKey(token)), usageKey(node)), &u); err != nil {
+		return nil, err
+	}
+
+	return &u, nil
+}
+
+// PutUsage creates or replaces the storage charged to a token by a node.
+func (s *Store) PutUsage(ctx context.Context, u *Usage) error {
+	return s.put(ctx, recordName(path.Join(usageDir, usageKey(u.Token)), usageKey(u.Node)), u)
+}
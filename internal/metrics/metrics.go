@@ -0,0 +1,217 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package metrics
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "download_mirror"
+
+var (
+	// CacheHits is the number of blob requests served from the local cache.
+	CacheHits = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "cache",
+		Name:      "hits_total",
+		Help:      "Number of blob requests served from the local cache.",
+	})
+	// CacheMisses is the number of blob requests that had to go to the upstream.
+	CacheMisses = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "cache",
+		Name:      "misses_total",
+		Help:      "Number of blob requests not found in the local cache.",
+	})
+	// CacheSizeBytes is the current size of the local cache.
+	CacheSizeBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "cache",
+		Name:      "size_bytes",
+		Help:      "Current size of the local cache.",
+	})
+	// CacheMaxBytes is the configured maximum size of the local cache.
+	CacheMaxBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "cache",
+		Name:      "max_bytes",
+		Help:      "Configured maximum size of the local cache.",
+	})
+	// CacheTrims is the number of cache trim runs.
+	CacheTrims = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "cache",
+		Name:      "trims_total",
+		Help:      "Number of cache trim runs.",
+	}, []string{"outcome"})
+	// CacheEvictedBytes is the number of bytes evicted from the local cache.
+	CacheEvictedBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "cache",
+		Name:      "evicted_bytes_total",
+		Help:      "Number of bytes evicted from the local cache.",
+	})
+	// MemoryCacheHits is the number of blob requests served from the in-memory
+	// hot tier.
+	MemoryCacheHits = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "memory_cache",
+		Name:      "hits_total",
+		Help:      "Number of blob requests served from the in-memory hot tier.",
+	})
+	// MemoryCacheMisses is the number of blob requests not found in the
+	// in-memory hot tier.
+	MemoryCacheMisses = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "memory_cache",
+		Name:      "misses_total",
+		Help:      "Number of blob requests not found in the in-memory hot tier.",
+	})
+	// MemoryCacheSizeBytes is the current size of the in-memory hot tier.
+	MemoryCacheSizeBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "memory_cache",
+		Name:      "size_bytes",
+		Help:      "Current size of the in-memory hot tier.",
+	})
+	// MemoryCacheEvictions is the number of blobs evicted from the in-memory
+	// hot tier.
+	MemoryCacheEvictions = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "memory_cache",
+		Name:      "evictions_total",
+		Help:      "Number of blobs evicted from the in-memory hot tier.",
+	})
+	// IntegrityFailures is the number of blobs found to not match their id.
+	IntegrityFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "integrity_failures_total",
+		Help:      "Number of corrupt blobs detected, by source (cache or upstream).",
+	}, []string{"source"})
+	// ScrubbedBlobs is the number of blob copies checked by the scrubber.
+	ScrubbedBlobs = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "scrub",
+		Name:      "blobs_total",
+		Help:      "Number of blob copies checked by the scrubber, by outcome (healthy, missing, corrupt or error).",
+	}, []string{"outcome"})
+	// ScrubRepairs is the number of blob copies repaired by the scrubber.
+	ScrubRepairs = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "scrub",
+		Name:      "repairs_total",
+		Help:      "Number of missing or corrupt blob copies repaired by the scrubber.",
+	})
+	// OriginFetches is the number of pull-through fetches from origins.
+	OriginFetches = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "origin",
+		Name:      "fetches_total",
+		Help:      "Number of pull-through fetches from origins, by outcome (success, not_found, mismatch or error).",
+	}, []string{"outcome"})
+	// OriginFetchedBytes is the number of bytes fetched from origins.
+	OriginFetchedBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "origin",
+		Name:      "fetched_bytes_total",
+		Help:      "Number of bytes fetched from origins.",
+	})
+	// ServedBytes is the number of blob bytes sent to clients, by source.
+	ServedBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "served_bytes_total",
+		Help:      "Number of blob bytes sent to clients, by source (memory, cache or upstream).",
+	}, []string{"source"})
+	// ActiveTransfers is the number of in-progress downloads and uploads.
+	ActiveTransfers = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "active_transfers",
+		Help:      "Number of in-progress transfers, by direction (download or upload).",
+	}, []string{"direction"})
+	// UpstreamRequestDuration is the latency of upstream requests.
+	UpstreamRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "upstream",
+		Name:      "request_duration_seconds",
+		Help:      "Latency of upstream requests, by operation and outcome.",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 2, 14),
+	}, []string{"operation", "outcome"})
+	// PrefetchedBlobs is the number of blobs processed by prefetch jobs.
+	PrefetchedBlobs = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "prefetch",
+		Name:      "blobs_total",
+		Help:      "Number of blobs processed by prefetch jobs, by outcome (fetched, cached or failed).",
+	}, []string{"outcome"})
+	// HTTPRequests is the number of HTTP requests handled, by route and status.
+	HTTPRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "requests_total",
+		Help:      "Number of HTTP requests handled, by route, method and status code.",
+	}, []string{"route", "method", "status"})
+	// RateLimitedRequests is the number of requests rejected by rate limits.
+	RateLimitedRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "rate_limited_requests_total",
+		Help:      "Number of requests rejected for exceeding a rate limit, by limit (request or cache_miss).",
+	}, []string{"limit"})
+)
+
+// Handler returns a HTTP handler that exposes the metrics in the Prometheus
+// text format.
+func Handler() echo.HandlerFunc {
+	return echo.WrapHandler(promhttp.Handler())
+}
+
+// Middleware returns an echo middleware that counts HTTP requests by route
+// and status code.
+func Middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			err := next(c)
+
+			status := c.Response().Status
+			if err != nil {
+				var httpErr *echo.HTTPError
+				if errors.As(err, &httpErr) {
+					status = httpErr.Code
+				} else if !c.Response().Committed {
+					status = http.StatusInternalServerError
+				}
+			}
+
+			route := c.Path()
+			if route == "" {
+				route = "unmatched"
+			}
+
+			HTTPRequests.WithLabelValues(route, c.Request().Method, strconv.Itoa(status)).Inc()
+
+			return err
+		}
+	}
+}
@@ -0,0 +1,132 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package metrics
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/gpu-ninja/download-mirror/internal/upstream"
+)
+
+// InstrumentUpstream wraps an upstream so that the latency of each request
+// is recorded.
+func InstrumentUpstream(ups upstream.Upstream) upstream.Upstream {
+	return &instrumentedUpstream{ups: ups}
+}
+
+type instrumentedUpstream struct {
+	ups upstream.Upstream
+}
+
+func (i *instrumentedUpstream) Get(ctx context.Context, id []byte) (io.ReadCloser, int64, error) {
+	start := time.Now()
+	r, size, err := i.ups.Get(ctx, id)
+	observeUpstream("get", start, err)
+
+	return r, size, err
+}
+
+func (i *instrumentedUpstream) Put(ctx context.Context, id []byte, r io.Reader) error {
+	start := time.Now()
+	err := i.ups.Put(ctx, id, r)
+	observeUpstream("put", start, err)
+
+	return err
+}
+
+func (i *instrumentedUpstream) List(ctx context.Context) ([][]byte, error) {
+	start := time.Now()
+	ids, err := i.ups.List(ctx)
+	observeUpstream("list", start, err)
+
+	return ids, err
+}
+
+func (i *instrumentedUpstream) Quarantine(ctx context.Context, id []byte) error {
+	start := time.Now()
+	err := i.ups.Quarantine(ctx, id)
+	observeUpstream("quarantine", start, err)
+
+	return err
+}
+
+func (i *instrumentedUpstream) Check(ctx context.Context) error {
+	start := time.Now()
+	err := i.ups.Check(ctx)
+	observeUpstream("check", start, err)
+
+	return err
+}
+
+func (i *instrumentedUpstream) GetObject(ctx context.Context, name string) (io.ReadCloser, error) {
+	start := time.Now()
+	r, err := i.ups.GetObject(ctx, name)
+	observeUpstream("get_object", start, err)
+
+	return r, err
+}
+
+func (i *instrumentedUpstream) PutObject(ctx context.Context, name string, r io.Reader) error {
+	start := time.Now()
+	err := i.ups.PutObject(ctx, name, r)
+	observeUpstream("put_object", start, err)
+
+	return err
+}
+
+func (i *instrumentedUpstream) GetObjectVersion(ctx context.Context, name string) (io.ReadCloser, string, error) {
+	start := time.Now()
+	r, version, err := i.ups.GetObjectVersion(ctx, name)
+	observeUpstream("get_object", start, err)
+
+	return r, version, err
+}
+
+func (i *instrumentedUpstream) PutObjectIfVersion(ctx context.Context, name string, r io.Reader, version string) error {
+	start := time.Now()
+	err := i.ups.PutObjectIfVersion(ctx, name, r, version)
+	observeUpstream("put_object", start, err)
+
+	return err
+}
+
+func (i *instrumentedUpstream) ListObjects(ctx context.Context, dir string) ([]string, error) {
+	start := time.Now()
+	names, err := i.ups.ListObjects(ctx, dir)
+	observeUpstream("list_objects", start, err)
+
+	return names, err
+}
+
+func observeUpstream(operation string, start time.Time, err error) {
+	outcome := "success"
+	if errors.Is(err, upstream.ErrNotFound) {
+		outcome = "not_found"
+	} else if errors.Is(err, upstream.ErrConflict) {
+		outcome = "conflict"
+	} else if errors.Is(err, upstream.ErrUnversioned) {
+		outcome = "unversioned"
+	} else if err != nil {
+		outcome = "error"
+	}
+
+	UpstreamRequestDuration.WithLabelValues(operation, outcome).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,492 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package oci implements the OCI distribution API (the docker registry v2
+// API) over the blob store. Blobs are stored as regular blobs and resolved by
+// their public digest, manifests and tags are stored as metadata records.
+package oci
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gpu-ninja/download-mirror/internal/blobid"
+	"github.com/gpu-ninja/download-mirror/internal/cas"
+	"github.com/gpu-ninja/download-mirror/internal/meta"
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+const (
+	// maxManifestSize is the largest manifest that can be pushed.
+	maxManifestSize = 4 << 20
+	// defaultManifestMediaType is assumed for manifests pushed without one.
+	defaultManifestMediaType = "application/vnd.oci.image.manifest.v1+json"
+)
+
+const (
+	headerAPIVersion    = "Docker-Distribution-API-Version"
+	headerContentDigest = "Docker-Content-Digest"
+	headerUploadUUID    = "Docker-Upload-UUID"
+	headerSubject       = "OCI-Subject"
+)
+
+const namePattern = `[a-z0-9]+(?:(?:\.|_|__|-+)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:\.|_|__|-+)[a-z0-9]+)*)*`
+
+var (
+	blobPath     = regexp.MustCompile(`^/v2/(` + namePattern + `)/blobs/([^/]+)$`)
+	uploadPath   = regexp.MustCompile(`^/v2/(` + namePattern + `)/blobs/uploads/([^/]*)$`)
+	manifestPath = regexp.MustCompile(`^/v2/(` + namePattern + `)/manifests/([^/]+)$`)
+	tagsPath     = regexp.MustCompile(`^/v2/(` + namePattern + `)/tags/list$`)
+	tagPattern   = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9._-]{0,127}$`)
+)
+
+// Registry serves the OCI distribution API.
+type Registry struct {
+	logger    *zap.Logger
+	storage   *cas.Storage
+	metadata  *meta.Store
+	uploadDir string
+	mu        sync.Mutex
+	uploads   map[string]*upload
+}
+
+func NewRegistry(logger *zap.Logger, storage *cas.Storage, metadata *meta.Store) (*Registry, error) {
+	uploadDir, err := os.MkdirTemp("", "oci-uploads-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create upload directory: %w", err)
+	}
+
+	return &Registry{
+		logger:    logger,
+		storage:   storage,
+		metadata:  metadata,
+		uploadDir: uploadDir,
+		uploads:   make(map[string]*upload),
+	}, nil
+}
+
+// Close discards any in progress uploads.
+func (r *Registry) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for uuid, u := range r.uploads {
+		_ = u.f.Close()
+		delete(r.uploads, uuid)
+	}
+
+	return os.RemoveAll(r.uploadDir)
+}
+
+// Register registers the registry routes, reads are public and writes
+// require the given (authentication) middleware.
+func (r *Registry) Register(g *echo.Group, write echo.MiddlewareFunc) {
+	g.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			c.Response().Header().Set(headerAPIVersion, "registry/2.0")
+
+			return next(c)
+		}
+	})
+
+	g.GET("", r.Base)
+	g.GET("/", r.Base)
+	g.GET("/*", r.read)
+	g.HEAD("/*", r.read)
+
+	for _, method := range []string{http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete} {
+		g.Add(method, "/*", r.write, write)
+	}
+}
+
+// Base is the API version check.
+func (r *Registry) Base(c echo.Context) error {
+	return c.JSON(http.StatusOK, struct{}{})
+}
+
+func (r *Registry) read(c echo.Context) error {
+	path := c.Request().URL.Path
+
+	if m := uploadPath.FindStringSubmatch(path); m != nil && c.Request().Method == http.MethodGet {
+		return r.uploadStatus(c, m[1], m[2])
+	} else if m := tagsPath.FindStringSubmatch(path); m != nil {
+		return r.listTags(c, m[1])
+	} else if m := manifestPath.FindStringSubmatch(path); m != nil {
+		return r.getManifest(c, m[1], m[2])
+	} else if m := blobPath.FindStringSubmatch(path); m != nil {
+		return r.getBlob(c, m[1], m[2])
+	}
+
+	return newError(http.StatusNotFound, codeNameInvalid, "invalid repository name or path")
+}
+
+func (r *Registry) write(c echo.Context) error {
+	path := c.Request().URL.Path
+	method := c.Request().Method
+
+	if m := uploadPath.FindStringSubmatch(path); m != nil {
+		switch {
+		case method == http.MethodPost && m[2] == "":
+			return r.startUpload(c, m[1])
+		case method == http.MethodPatch && m[2] != "":
+			return r.patchUpload(c, m[1], m[2])
+		case method == http.MethodPut && m[2] != "":
+			return r.finishUpload(c, m[1], m[2])
+		case method == http.MethodDelete && m[2] != "":
+			return r.cancelUpload(c, m[2])
+		}
+	} else if m := manifestPath.FindStringSubmatch(path); m != nil && method == http.MethodPut {
+		return r.putManifest(c, m[1], m[2])
+	} else if manifestPath.MatchString(path) || blobPath.MatchString(path) {
+		return newError(http.StatusMethodNotAllowed, codeUnsupported, "deletion is not supported")
+	}
+
+	return newError(http.StatusNotFound, codeNameInvalid, "invalid repository name or path")
+}
+
+func (r *Registry) getBlob(c echo.Context, name, digest string) error {
+	ctx := c.Request().Context()
+
+	algorithm, encoded, err := parseDigest(digest)
+	if err != nil {
+		return newError(http.StatusBadRequest, codeDigestInvalid, err.Error())
+	}
+
+	id, err := r.resolveBlob(ctx, algorithm, encoded)
+	if err != nil {
+		return err
+	}
+
+	c.Response().Header().Set(headerContentDigest, digest)
+
+	if c.Request().Method == http.MethodHead {
+		blob, err := r.metadata.GetBlob(ctx, id.Bytes())
+		if err != nil {
+			r.logger.Error("Failed to get blob metadata", zap.String("repository", name),
+				zap.String("digest", digest), zap.Error(err))
+
+			return echo.NewHTTPError(http.StatusInternalServerError)
+		}
+
+		c.Response().Header().Set(echo.HeaderContentType, echo.MIMEOctetStream)
+		c.Response().Header().Set(echo.HeaderContentLength, strconv.FormatInt(blob.Size, 10))
+
+		return c.NoContent(http.StatusOK)
+	}
+
+	r.logger.Info("Received request for OCI blob", zap.String("repository", name),
+		zap.String("digest", digest))
+
+	return r.storage.Serve(c, id)
+}
+
+// resolveBlob returns the id of the blob with the given public digest.
+func (r *Registry) resolveBlob(ctx context.Context, algorithm, encoded string) (blobid.ID, error) {
+	d, err := r.metadata.GetDigest(ctx, algorithm, encoded)
+	if err != nil {
+		if errors.Is(err, meta.ErrNotFound) {
+			return blobid.ID{}, newError(http.StatusNotFound, codeBlobUnknown, "blob unknown to registry")
+		}
+
+		r.logger.Error("Failed to get digest", zap.String("digest", algorithm+":"+encoded), zap.Error(err))
+
+		return blobid.ID{}, echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	id, err := blobid.ParseString(d.ID)
+	if err != nil {
+		r.logger.Error("Invalid blob id in digest record", zap.String("id", d.ID), zap.Error(err))
+
+		return blobid.ID{}, echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	return id, nil
+}
+
+func (r *Registry) getManifest(c echo.Context, name, reference string) error {
+	ctx := c.Request().Context()
+
+	digest := reference
+	if _, _, err := parseDigest(reference); err != nil {
+		if !tagPattern.MatchString(reference) {
+			return newError(http.StatusBadRequest, codeManifestInvalid, "invalid tag or digest")
+		}
+
+		tag, err := r.metadata.GetOCITag(ctx, name, reference)
+		if err != nil {
+			return r.manifestError(err, name, reference)
+		}
+
+		digest = tag.Digest
+	}
+
+	manifest, err := r.metadata.GetOCIManifest(ctx, name, digest)
+	if err != nil {
+		return r.manifestError(err, name, reference)
+	}
+
+	c.Response().Header().Set(headerContentDigest, manifest.Digest)
+	c.Response().Header().Set(echo.HeaderContentLength, strconv.Itoa(len(manifest.Content)))
+
+	if c.Request().Method == http.MethodHead {
+		c.Response().Header().Set(echo.HeaderContentType, manifest.MediaType)
+
+		return c.NoContent(http.StatusOK)
+	}
+
+	return c.Blob(http.StatusOK, manifest.MediaType, manifest.Content)
+}
+
+func (r *Registry) manifestError(err error, name, reference string) error {
+	if errors.Is(err, meta.ErrNotFound) {
+		return newError(http.StatusNotFound, codeManifestUnknown, "manifest unknown to registry")
+	}
+
+	r.logger.Error("Failed to get manifest", zap.String("repository", name),
+		zap.String("reference", reference), zap.Error(err))
+
+	return echo.NewHTTPError(http.StatusInternalServerError)
+}
+
+// descriptor references content from a manifest.
+type descriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+}
+
+// manifest is the subset of an image manifest or index needed to validate
+// it.
+type manifest struct {
+	MediaType string       `json:"mediaType"`
+	Config    *descriptor  `json:"config"`
+	Layers    []descriptor `json:"layers"`
+	Manifests []descriptor `json:"manifests"`
+	Subject   *descriptor  `json:"subject"`
+}
+
+func (r *Registry) putManifest(c echo.Context, name, reference string) error {
+	ctx := c.Request().Context()
+
+	content, err := io.ReadAll(io.LimitReader(c.Request().Body, maxManifestSize+1))
+	if err != nil {
+		r.logger.Warn("Failed to read manifest", zap.Error(err))
+
+		return echo.NewHTTPError(http.StatusBadRequest)
+	}
+
+	if len(content) > maxManifestSize {
+		return newError(http.StatusRequestEntityTooLarge, codeSizeInvalid, "manifest too large")
+	}
+
+	var parsed manifest
+	if err := json.Unmarshal(content, &parsed); err != nil {
+		return newError(http.StatusBadRequest, codeManifestInvalid, "manifest is not valid JSON")
+	}
+
+	mediaType := c.Request().Header.Get(echo.HeaderContentType)
+	if mediaType == "" {
+		mediaType = parsed.MediaType
+	}
+
+	if mediaType == "" {
+		mediaType = defaultManifestMediaType
+	}
+
+	var tag string
+	algorithm := meta.DigestSHA256
+	if refAlgorithm, _, err := parseDigest(reference); err == nil {
+		algorithm = refAlgorithm
+	} else if tagPattern.MatchString(reference) {
+		tag = reference
+	} else {
+		return newError(http.StatusBadRequest, codeManifestInvalid, "invalid tag or digest")
+	}
+
+	digest := computeDigest(algorithm, content)
+	if tag == "" && digest != reference {
+		return newError(http.StatusBadRequest, codeDigestInvalid, "manifest digest does not match")
+	}
+
+	// Everything a manifest references must have been pushed first.
+	var blobs []descriptor
+	if parsed.Config != nil {
+		blobs = append(blobs, *parsed.Config)
+	}
+	blobs = append(blobs, parsed.Layers...)
+
+	for _, d := range blobs {
+		refAlgorithm, encoded, err := parseDigest(d.Digest)
+		if err != nil {
+			return newError(http.StatusBadRequest, codeManifestInvalid, "invalid digest: "+d.Digest)
+		}
+
+		if _, err := r.resolveBlob(ctx, refAlgorithm, encoded); err != nil {
+			return newError(http.StatusBadRequest, codeManifestBlobUnknown, "blob unknown to registry: "+d.Digest)
+		}
+	}
+
+	for _, d := range parsed.Manifests {
+		if _, _, err := parseDigest(d.Digest); err != nil {
+			return newError(http.StatusBadRequest, codeManifestInvalid, "invalid digest: "+d.Digest)
+		}
+
+		if _, err := r.metadata.GetOCIManifest(ctx, name, d.Digest); err != nil {
+			return newError(http.StatusBadRequest, codeManifestBlobUnknown, "manifest unknown to registry: "+d.Digest)
+		}
+	}
+
+	r.logger.Info("Received OCI manifest", zap.String("repository", name),
+		zap.String("reference", reference), zap.String("digest", digest))
+
+	now := time.Now().UTC()
+
+	if err := r.metadata.PutOCIManifest(ctx, &meta.OCIManifest{
+		Repository: name,
+		Digest:     digest,
+		MediaType:  mediaType,
+		Content:    content,
+		CreatedAt:  now,
+	}); err != nil {
+		r.logger.Error("Failed to store manifest", zap.Error(err))
+
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	if tag != "" {
+		if err := r.metadata.PutOCITag(ctx, &meta.OCITag{
+			Repository: name,
+			Tag:        tag,
+			Digest:     digest,
+			UpdatedAt:  now,
+		}); err != nil {
+			r.logger.Error("Failed to store tag", zap.Error(err))
+
+			return echo.NewHTTPError(http.StatusInternalServerError)
+		}
+	}
+
+	if parsed.Subject != nil {
+		c.Response().Header().Set(headerSubject, parsed.Subject.Digest)
+	}
+
+	c.Response().Header().Set(echo.HeaderLocation, fmt.Sprintf("/v2/%s/manifests/%s", name, digest))
+	c.Response().Header().Set(headerContentDigest, digest)
+
+	return c.NoContent(http.StatusCreated)
+}
+
+func (r *Registry) listTags(c echo.Context, name string) error {
+	tags, err := r.metadata.ListOCITags(c.Request().Context(), name)
+	if err != nil {
+		r.logger.Error("Failed to list tags", zap.String("repository", name), zap.Error(err))
+
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	if last := c.QueryParam("last"); last != "" {
+		i := 0
+		for i < len(tags) && tags[i] <= last {
+			i++
+		}
+
+		tags = tags[i:]
+	}
+
+	if n := c.QueryParam("n"); n != "" {
+		limit, err := strconv.Atoi(n)
+		if err != nil || limit < 0 {
+			return newError(http.StatusBadRequest, codeUnsupported, "invalid page size")
+		}
+
+		if limit < len(tags) {
+			tags = tags[:limit]
+
+			if limit > 0 {
+				c.Response().Header().Set("Link", fmt.Sprintf(`</v2/%s/tags/list?n=%d&last=%s>; rel="next"`,
+					name, limit, tags[len(tags)-1]))
+			}
+		}
+	}
+
+	if tags == nil {
+		tags = []string{}
+	}
+
+	return c.JSON(http.StatusOK, struct {
+		Name string   `json:"name"`
+		Tags []string `json:"tags"`
+	}{
+		Name: name,
+		Tags: tags,
+	})
+}
+
+// parseDigest parses and validates a digest, returning its algorithm and hex
+// encoded value.
+func parseDigest(digest string) (string, string, error) {
+	algorithm, encoded, ok := strings.Cut(digest, ":")
+	if !ok {
+		return "", "", fmt.Errorf("invalid digest %q", digest)
+	}
+
+	var size int
+	switch algorithm {
+	case meta.DigestSHA256:
+		size = sha256.Size
+	case meta.DigestSHA512:
+		size = sha512.Size
+	default:
+		return "", "", fmt.Errorf("unsupported digest algorithm %q", algorithm)
+	}
+
+	if decoded, err := hex.DecodeString(encoded); err != nil || len(decoded) != size || strings.ToLower(encoded) != encoded {
+		return "", "", fmt.Errorf("invalid digest %q", digest)
+	}
+
+	return algorithm, encoded, nil
+}
+
+func newDigestHash(algorithm string) hash.Hash {
+	if algorithm == meta.DigestSHA512 {
+		return sha512.New()
+	}
+
+	return sha256.New()
+}
+
+func computeDigest(algorithm string, content []byte) string {
+	h := newDigestHash(algorithm)
+	_, _ = h.Write(content)
+
+	return algorithm + ":" + hex.EncodeToString(h.Sum(nil))
+}
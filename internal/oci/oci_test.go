@@ -0,0 +1,226 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package oci_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gpu-ninja/download-mirror/internal/auth"
+	"github.com/gpu-ninja/download-mirror/internal/cas"
+	"github.com/gpu-ninja/download-mirror/internal/cas/castest"
+	"github.com/gpu-ninja/download-mirror/internal/oci"
+	"github.com/gpu-ninja/download-mirror/internal/quota"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestRegistry(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+
+	fixture := castest.New(t, logger)
+
+	metadata := fixture.Metadata
+	storage := fixture.NewStorage(logger, cas.Options{
+		Quotas: quota.NewQuotas(logger, metadata, quota.Options{MaxBlobSize: 100000}),
+	})
+
+	registry, err := oci.NewRegistry(logger, storage, metadata)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, registry.Close())
+	})
+
+	tokens, err := auth.ParseTokens("secret")
+	require.NoError(t, err)
+
+	e := echo.New()
+	e.GET("/blobs/:id/:name", storage.Get)
+	registry.Register(e.Group("/v2"), tokens.BasicMiddleware("test"))
+
+	srv := httptest.NewServer(e)
+	t.Cleanup(srv.Close)
+
+	do := func(method, path string, body []byte, headers ...string) *http.Response {
+		req, err := http.NewRequest(method, srv.URL+path, bytes.NewReader(body))
+		require.NoError(t, err)
+
+		req.SetBasicAuth("user", "secret")
+		for i := 0; i < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = resp.Body.Close()
+		})
+
+		return resp
+	}
+
+	digestOf := func(data []byte) string {
+		sum := sha256.Sum256(data)
+		return "sha256:" + hex.EncodeToString(sum[:])
+	}
+
+	resp := do(http.MethodGet, "/v2/", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "registry/2.0", resp.Header.Get("Docker-Distribution-API-Version"))
+
+	t.Run("Unauthenticated", func(t *testing.T) {
+		resp, err := http.Post(srv.URL+"/v2/test/repo/blobs/uploads/", "", nil)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+		assert.Contains(t, resp.Header.Get("WWW-Authenticate"), "Basic")
+	})
+
+	layer := bytes.Repeat([]byte("layer "), 10000)
+	config := []byte(`{"architecture":"amd64","os":"linux"}`)
+
+	t.Run("Chunked Upload", func(t *testing.T) {
+		resp := do(http.MethodPost, "/v2/test/repo/blobs/uploads/", nil)
+		require.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+		location := resp.Header.Get("Location")
+		require.NotEmpty(t, location)
+
+		resp = do(http.MethodPatch, location, layer[:1000],
+			"Content-Type", "application/octet-stream", "Content-Range", "0-999")
+		require.Equal(t, http.StatusAccepted, resp.StatusCode)
+		assert.Equal(t, "0-999", resp.Header.Get("Range"))
+
+		// Out of order.
+		resp = do(http.MethodPatch, location, layer[2000:3000], "Content-Range", "2000-2999")
+		assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, resp.StatusCode)
+
+		resp = do(http.MethodPatch, location, layer[1000:], "Content-Range", fmt.Sprintf("1000-%d", len(layer)-1))
+		require.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+		resp = do(http.MethodPut, location+"?digest="+digestOf(layer), nil)
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+		assert.Equal(t, digestOf(layer), resp.Header.Get("Docker-Content-Digest"))
+	})
+
+	t.Run("Too Large", func(t *testing.T) {
+		resp := do(http.MethodPost, "/v2/test/repo/blobs/uploads/", nil)
+		require.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+		location := resp.Header.Get("Location")
+
+		resp = do(http.MethodPatch, location, make([]byte, 60000), "Content-Range", "0-59999")
+		require.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+		// The limit applies to the whole blob, not each chunk.
+		resp = do(http.MethodPatch, location, make([]byte, 60000), "Content-Range", "60000-119999")
+		assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+
+		resp = do(http.MethodGet, location, nil)
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+
+	t.Run("Monolithic Upload", func(t *testing.T) {
+		resp := do(http.MethodPost, "/v2/test/repo/blobs/uploads/?digest="+digestOf(config), config)
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+		resp = do(http.MethodPost, "/v2/test/repo/blobs/uploads/?digest="+digestOf([]byte("other")), config)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+
+	t.Run("Cross Mount", func(t *testing.T) {
+		resp := do(http.MethodPost, "/v2/other/blobs/uploads/?mount="+digestOf(layer)+"&from=test/repo", nil)
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	})
+
+	t.Run("Pull Blob", func(t *testing.T) {
+		resp := do(http.MethodHead, "/v2/test/repo/blobs/"+digestOf(layer), nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, fmt.Sprintf("%d", len(layer)), resp.Header.Get("Content-Length"))
+
+		resp = do(http.MethodGet, "/v2/test/repo/blobs/"+digestOf(layer), nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		got, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, layer, got)
+
+		resp = do(http.MethodGet, "/v2/test/repo/blobs/"+digestOf([]byte("missing")), nil)
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+
+	manifest, err := json.Marshal(map[string]any{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.oci.image.manifest.v1+json",
+		"config": map[string]any{
+			"mediaType": "application/vnd.oci.image.config.v1+json",
+			"digest":    digestOf(config),
+			"size":      len(config),
+		},
+		"layers": []map[string]any{{
+			"mediaType": "application/vnd.oci.image.layer.v1.tar",
+			"digest":    digestOf(layer),
+			"size":      len(layer),
+		}},
+	})
+	require.NoError(t, err)
+
+	t.Run("Manifests", func(t *testing.T) {
+		resp := do(http.MethodPut, "/v2/test/repo/manifests/latest", manifest,
+			"Content-Type", "application/vnd.oci.image.manifest.v1+json")
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+		assert.Equal(t, digestOf(manifest), resp.Header.Get("Docker-Content-Digest"))
+
+		for _, reference := range []string{"latest", digestOf(manifest)} {
+			resp = do(http.MethodGet, "/v2/test/repo/manifests/"+reference, nil)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, "application/vnd.oci.image.manifest.v1+json", resp.Header.Get("Content-Type"))
+
+			got, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, manifest, got)
+		}
+
+		resp = do(http.MethodGet, "/v2/test/repo/manifests/missing", nil)
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+		invalid := bytes.Replace(manifest, []byte(digestOf(config)), []byte(digestOf([]byte("missing"))), 1)
+		resp = do(http.MethodPut, "/v2/test/repo/manifests/invalid", invalid)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+		resp = do(http.MethodGet, "/v2/test/repo/tags/list", nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var tags struct {
+			Name string   `json:"name"`
+			Tags []string `json:"tags"`
+		}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&tags))
+		assert.Equal(t, []string{"latest"}, tags.Tags)
+	})
+}
@@ -0,0 +1,362 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package oci
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gpu-ninja/download-mirror/internal/auth"
+	"github.com/gpu-ninja/download-mirror/internal/meta"
+	"github.com/gpu-ninja/download-mirror/internal/quota"
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+// uploadExpiry is how long an idle upload session is kept around.
+const uploadExpiry = 24 * time.Hour
+
+// upload is an in progress blob upload session, the content is spooled to a
+// temporary file, hashed and checked against the upload limits as it arrives.
+type upload struct {
+	mu        sync.Mutex
+	uuid      string
+	f         *os.File
+	size      int64
+	sha256    hash.Hash
+	sha512    hash.Hash
+	limit     io.Writer
+	updatedAt time.Time
+}
+
+func (u *upload) write(ctx context.Context, r io.Reader) error {
+	n, err := io.Copy(io.MultiWriter(u.f, u.sha256, u.sha512, u.limit), readerFunc(func(p []byte) (int, error) {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+
+		return r.Read(p)
+	}))
+	u.size += n
+	u.updatedAt = time.Now()
+
+	return err
+}
+
+func (r *Registry) startUpload(c echo.Context, name string) error {
+	ctx := c.Request().Context()
+
+	// Blobs are shared between repositories, so cross repository mounts of
+	// existing blobs are free.
+	if mount := c.QueryParam("mount"); mount != "" {
+		if algorithm, encoded, err := parseDigest(mount); err == nil {
+			if _, err := r.resolveBlob(ctx, algorithm, encoded); err == nil {
+				c.Response().Header().Set(echo.HeaderLocation, fmt.Sprintf("/v2/%s/blobs/%s", name, mount))
+				c.Response().Header().Set(headerContentDigest, mount)
+
+				return c.NoContent(http.StatusCreated)
+			}
+		}
+	}
+
+	u, err := r.newUpload(ctx, auth.TokenName(c))
+	if httpErr := quota.HTTPError(err); httpErr != nil {
+		return httpErr
+	} else if err != nil {
+		r.logger.Error("Failed to create upload", zap.Error(err))
+
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	// Monolithic upload.
+	if digest := c.QueryParam("digest"); digest != "" {
+		u.mu.Lock()
+		defer u.mu.Unlock()
+		defer r.removeUpload(u)
+
+		return r.commit(c, u, name, digest)
+	}
+
+	r.logger.Info("Started OCI blob upload", zap.String("repository", name), zap.String("uuid", u.uuid))
+
+	setUploadHeaders(c, name, u)
+
+	return c.NoContent(http.StatusAccepted)
+}
+
+func (r *Registry) patchUpload(c echo.Context, name, uuid string) error {
+	u, err := r.getUpload(uuid)
+	if err != nil {
+		return err
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if contentRange := c.Request().Header.Get("Content-Range"); contentRange != "" {
+		start, ok := parseContentRange(contentRange)
+		if !ok || start != u.size {
+			setUploadHeaders(c, name, u)
+
+			return newError(http.StatusRequestedRangeNotSatisfiable, codeBlobUploadInvalid, "chunk is out of order")
+		}
+	}
+
+	if err := u.write(c.Request().Context(), c.Request().Body); err != nil {
+		if httpErr := quota.HTTPError(err); httpErr != nil {
+			r.removeUpload(u)
+
+			return httpErr
+		}
+
+		r.logger.Warn("Failed to read blob chunk", zap.String("uuid", uuid), zap.Error(err))
+
+		return newError(http.StatusBadRequest, codeBlobUploadInvalid, "failed to read chunk")
+	}
+
+	setUploadHeaders(c, name, u)
+
+	return c.NoContent(http.StatusAccepted)
+}
+
+func (r *Registry) finishUpload(c echo.Context, name, uuid string) error {
+	u, err := r.getUpload(uuid)
+	if err != nil {
+		return err
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	defer r.removeUpload(u)
+
+	return r.commit(c, u, name, c.QueryParam("digest"))
+}
+
+// commit writes the remainder of the blob from the request body, verifies it
+// against the expected digest, and stores it.
+func (r *Registry) commit(c echo.Context, u *upload, name, digest string) error {
+	ctx := c.Request().Context()
+
+	algorithm, encoded, err := parseDigest(digest)
+	if err != nil {
+		return newError(http.StatusBadRequest, codeDigestInvalid, err.Error())
+	}
+
+	if err := u.write(ctx, c.Request().Body); err != nil {
+		if httpErr := quota.HTTPError(err); httpErr != nil {
+			return httpErr
+		}
+
+		r.logger.Warn("Failed to read blob", zap.String("uuid", u.uuid), zap.Error(err))
+
+		return newError(http.StatusBadRequest, codeBlobUploadInvalid, "failed to read blob")
+	}
+
+	sha256Digest, sha512Digest := hex.EncodeToString(u.sha256.Sum(nil)), hex.EncodeToString(u.sha512.Sum(nil))
+
+	actual := sha256Digest
+	if algorithm == meta.DigestSHA512 {
+		actual = sha512Digest
+	}
+
+	if actual != encoded {
+		return newError(http.StatusBadRequest, codeDigestInvalid, "blob digest does not match")
+	}
+
+	// Layers are often shared between images, so the blob may already exist.
+	if _, err := r.resolveBlob(ctx, algorithm, encoded); err != nil {
+		blob := &meta.Blob{
+			SHA256: sha256Digest,
+			Owner:  auth.TokenName(c),
+		}
+
+		if algorithm == meta.DigestSHA512 {
+			blob.SHA512 = sha512Digest
+		}
+
+		if err := r.storage.Store(ctx, u.f, blob); err != nil {
+			if httpErr := quota.HTTPError(err); httpErr != nil {
+				return httpErr
+			}
+
+			r.logger.Error("Failed to store blob", zap.String("digest", digest), zap.Error(err))
+
+			return echo.NewHTTPError(http.StatusInternalServerError)
+		}
+
+		r.logger.Info("Received OCI blob", zap.String("repository", name),
+			zap.String("digest", digest), zap.String("id", blob.ID))
+	}
+
+	c.Response().Header().Set(echo.HeaderLocation, fmt.Sprintf("/v2/%s/blobs/%s", name, digest))
+	c.Response().Header().Set(headerContentDigest, digest)
+
+	return c.NoContent(http.StatusCreated)
+}
+
+func (r *Registry) uploadStatus(c echo.Context, name, uuid string) error {
+	u, err := r.getUpload(uuid)
+	if err != nil {
+		return err
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	setUploadHeaders(c, name, u)
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (r *Registry) cancelUpload(c echo.Context, uuid string) error {
+	u, err := r.getUpload(uuid)
+	if err != nil {
+		return err
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	r.removeUpload(u)
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (r *Registry) newUpload(ctx context.Context, owner string) (*upload, error) {
+	r.purgeUploads()
+
+	limit, err := r.storage.UploadWriter(ctx, owner)
+	if err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+
+	f, err := os.CreateTemp(r.uploadDir, "upload-")
+	if err != nil {
+		return nil, err
+	}
+
+	u := &upload{
+		uuid:      hex.EncodeToString(b),
+		f:         f,
+		sha256:    sha256.New(),
+		sha512:    sha512.New(),
+		limit:     limit,
+		updatedAt: time.Now(),
+	}
+
+	r.mu.Lock()
+	r.uploads[u.uuid] = u
+	r.mu.Unlock()
+
+	return u, nil
+}
+
+func (r *Registry) getUpload(uuid string) (*upload, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	u, ok := r.uploads[uuid]
+	if !ok {
+		return nil, newError(http.StatusNotFound, codeBlobUploadUnknown, "blob upload unknown to registry")
+	}
+
+	return u, nil
+}
+
+// removeUpload discards an upload, the caller must hold the upload's lock.
+func (r *Registry) removeUpload(u *upload) {
+	r.mu.Lock()
+	delete(r.uploads, u.uuid)
+	r.mu.Unlock()
+
+	_ = u.f.Close()
+	_ = os.Remove(u.f.Name())
+}
+
+// purgeUploads discards abandoned uploads.
+func (r *Registry) purgeUploads() {
+	r.mu.Lock()
+	var expired []*upload
+	for _, u := range r.uploads {
+		if u.mu.TryLock() {
+			if time.Since(u.updatedAt) > uploadExpiry {
+				expired = append(expired, u)
+			} else {
+				u.mu.Unlock()
+			}
+		}
+	}
+	r.mu.Unlock()
+
+	for _, u := range expired {
+		r.logger.Info("Discarding abandoned OCI blob upload", zap.String("uuid", u.uuid))
+
+		r.removeUpload(u)
+		u.mu.Unlock()
+	}
+}
+
+func setUploadHeaders(c echo.Context, name string, u *upload) {
+	end := u.size - 1
+	if end < 0 {
+		end = 0
+	}
+
+	c.Response().Header().Set(echo.HeaderLocation, fmt.Sprintf("/v2/%s/blobs/uploads/%s", name, u.uuid))
+	c.Response().Header().Set("Range", fmt.Sprintf("0-%d", end))
+	c.Response().Header().Set(headerUploadUUID, u.uuid)
+}
+
+// parseContentRange parses the start offset of a chunk, from a Content-Range
+// header of the form <start>-<end>.
+func parseContentRange(contentRange string) (int64, bool) {
+	startStr, _, ok := strings.Cut(strings.TrimPrefix(contentRange, "bytes "), "-")
+	if !ok {
+		return 0, false
+	}
+
+	start, err := strconv.ParseInt(startStr, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return start, true
+}
+
+type readerFunc func(p []byte) (n int, err error)
+
+func (f readerFunc) Read(p []byte) (n int, err error) {
+	return f(p)
+}
@@ -0,0 +1,235 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package prefetch
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/akamensky/base58"
+	"github.com/gpu-ninja/download-mirror/internal/cas"
+	"github.com/gpu-ninja/download-mirror/internal/metrics"
+	"github.com/gpu-ninja/download-mirror/pkg/api"
+	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+)
+
+// maxRetainedJobs is the number of finished jobs to keep around for status
+// reporting.
+const maxRetainedJobs = 100
+
+// Prefetcher pulls blobs from the upstream into the local cache in the
+// background, through the content addressable storage so that they're
+// verified and cached the same way as blobs fetched on demand.
+type Prefetcher struct {
+	logger      *zap.Logger
+	storage     *cas.Storage
+	concurrency int
+	ctx         context.Context
+	cancel      context.CancelFunc
+	tasks       sync.WaitGroup
+	mu          sync.Mutex
+	jobs        map[string]*Job
+}
+
+// Job is a prefetch job.
+type Job struct {
+	mu     sync.Mutex
+	status api.PrefetchJob
+}
+
+// Status returns a snapshot of the job's progress.
+func (j *Job) Status() api.PrefetchJob {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	status := j.status
+	status.Failures = append([]api.PrefetchFailure(nil), j.status.Failures...)
+
+	return status
+}
+
+func NewPrefetcher(logger *zap.Logger, storage *cas.Storage, concurrency int) *Prefetcher {
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Prefetcher{
+		logger:      logger,
+		storage:     storage,
+		concurrency: concurrency,
+		ctx:         ctx,
+		cancel:      cancel,
+		jobs:        make(map[string]*Job),
+	}
+}
+
+// Close cancels any running jobs and waits for them to stop.
+func (p *Prefetcher) Close() error {
+	p.cancel()
+	p.tasks.Wait()
+
+	return nil
+}
+
+// Start starts a new prefetch job for the given blob ids.
+func (p *Prefetcher) Start(ids [][]byte) (*Job, error) {
+	jobID := make([]byte, 8)
+	if _, err := rand.Read(jobID); err != nil {
+		return nil, err
+	}
+
+	job := &Job{
+		status: api.PrefetchJob{
+			ID:        hex.EncodeToString(jobID),
+			State:     api.PrefetchStateRunning,
+			Total:     len(ids),
+			StartedAt: time.Now().UTC(),
+		},
+	}
+
+	p.mu.Lock()
+	p.jobs[job.status.ID] = job
+	p.pruneJobs()
+	p.mu.Unlock()
+
+	logger := p.logger.With(zap.String("job", job.status.ID))
+
+	logger.Info("Starting prefetch job", zap.Int("blobs", len(ids)))
+
+	p.tasks.Add(1)
+	go func() {
+		defer p.tasks.Done()
+
+		g := errgroup.Group{}
+		g.SetLimit(p.concurrency)
+
+		for _, id := range ids {
+			id := id
+
+			if p.ctx.Err() != nil {
+				break
+			}
+
+			g.Go(func() error {
+				fetched, size, err := p.storage.Warm(p.ctx, id)
+
+				job.mu.Lock()
+				defer job.mu.Unlock()
+
+				switch {
+				case err != nil:
+					logger.Warn("Failed to prefetch blob",
+						zap.String("id", base58.Encode(id)), zap.Error(err))
+
+					metrics.PrefetchedBlobs.WithLabelValues("failed").Inc()
+
+					job.status.Failed++
+					job.status.Failures = append(job.status.Failures, api.PrefetchFailure{
+						ID:    base58.Encode(id),
+						Error: err.Error(),
+					})
+				case fetched:
+					metrics.PrefetchedBlobs.WithLabelValues("fetched").Inc()
+
+					job.status.Fetched++
+					job.status.Bytes += size
+				default:
+					metrics.PrefetchedBlobs.WithLabelValues("cached").Inc()
+
+					job.status.Cached++
+				}
+
+				return nil
+			})
+		}
+
+		_ = g.Wait()
+
+		job.mu.Lock()
+		defer job.mu.Unlock()
+
+		now := time.Now().UTC()
+		job.status.FinishedAt = &now
+		job.status.State = api.PrefetchStateCompleted
+		if p.ctx.Err() != nil {
+			job.status.State = api.PrefetchStateCancelled
+		}
+
+		logger.Info("Prefetch job finished", zap.String("state", job.status.State),
+			zap.Int("fetched", job.status.Fetched), zap.Int("cached", job.status.Cached),
+			zap.Int("failed", job.status.Failed))
+	}()
+
+	return job, nil
+}
+
+// Job returns the job with the given id.
+func (p *Prefetcher) Job(id string) (*Job, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	job, ok := p.jobs[id]
+	return job, ok
+}
+
+// Jobs returns all of the retained jobs, most recent first.
+func (p *Prefetcher) Jobs() []*Job {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	jobs := make([]*Job, 0, len(p.jobs))
+	for _, job := range p.jobs {
+		jobs = append(jobs, job)
+	}
+
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].Status().StartedAt.After(jobs[j].Status().StartedAt)
+	})
+
+	return jobs
+}
+
+// pruneJobs removes the oldest finished jobs, must be called with mu held.
+func (p *Prefetcher) pruneJobs() {
+	for len(p.jobs) > maxRetainedJobs {
+		var oldest *Job
+		for _, job := range p.jobs {
+			status := job.Status()
+			if status.State == api.PrefetchStateRunning {
+				continue
+			}
+
+			if oldest == nil || status.StartedAt.Before(oldest.Status().StartedAt) {
+				oldest = job
+			}
+		}
+
+		if oldest == nil {
+			return
+		}
+
+		delete(p.jobs, oldest.Status().ID)
+	}
+}
@@ -0,0 +1,98 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package prefetch_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/gpu-ninja/download-mirror/internal/cas"
+	"github.com/gpu-ninja/download-mirror/internal/cas/castest"
+	"github.com/gpu-ninja/download-mirror/internal/prefetch"
+	"github.com/gpu-ninja/download-mirror/internal/securehash"
+	"github.com/gpu-ninja/download-mirror/pkg/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestPrefetcher(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	ctx := context.Background()
+
+	fixture := castest.New(t, logger)
+	ups, localCache := fixture.Upstream, fixture.Cache
+
+	var ids [][]byte
+	var blobs [][]byte
+	for i := 0; i < 3; i++ {
+		data := make([]byte, 10000)
+		_, err := io.ReadFull(rand.Reader, data)
+		require.NoError(t, err)
+
+		h := securehash.New([]byte("test"))
+		_, _ = h.Write(data)
+		id := h.Sum(nil)
+
+		require.NoError(t, ups.Put(ctx, id, bytes.NewReader(data)))
+
+		ids = append(ids, id)
+		blobs = append(blobs, data)
+	}
+
+	// Already cached blobs should be skipped.
+	_, _, err := localCache.Put(bytes.NewReader(blobs[0]))
+	require.NoError(t, err)
+
+	// A blob that doesn't exist in the upstream.
+	missing := make([]byte, securehash.Size)
+
+	p := prefetch.NewPrefetcher(logger, fixture.NewStorage(logger, cas.Options{}), 2)
+	t.Cleanup(func() {
+		require.NoError(t, p.Close())
+	})
+
+	job, err := p.Start(append(ids, missing))
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return job.Status().State != api.PrefetchStateRunning
+	}, 10*time.Second, 10*time.Millisecond)
+
+	status := job.Status()
+	assert.Equal(t, api.PrefetchStateCompleted, status.State)
+	assert.Equal(t, 4, status.Total)
+	assert.Equal(t, 2, status.Fetched)
+	assert.Equal(t, 1, status.Cached)
+	assert.Equal(t, 1, status.Failed)
+	assert.Len(t, status.Failures, 1)
+	assert.Equal(t, int64(20000), status.Bytes)
+
+	for _, id := range ids {
+		_, err := localCache.Stat(id)
+		assert.NoError(t, err)
+	}
+
+	got, ok := p.Job(status.ID)
+	require.True(t, ok)
+	assert.Equal(t, job, got)
+}
@@ -0,0 +1,302 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package pullthrough mirrors files from allow-listed origins on demand. The
+// first request for a URL fetches it from the origin and stores it as a
+// regular blob, later requests are served from the blob store.
+package pullthrough
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gpu-ninja/download-mirror/internal/blobid"
+	"github.com/gpu-ninja/download-mirror/internal/cas"
+	"github.com/gpu-ninja/download-mirror/internal/meta"
+	"github.com/gpu-ninja/download-mirror/internal/metrics"
+	"github.com/gpu-ninja/download-mirror/internal/quota"
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+	"golang.org/x/sync/singleflight"
+)
+
+// DefaultFetchTimeout is the default maximum duration of a fetch from an
+// origin.
+const DefaultFetchTimeout = 30 * time.Minute
+
+var (
+	errOriginNotFound   = errors.New("not found at origin")
+	errChecksumMismatch = errors.New("content does not match the expected checksum")
+)
+
+// Options configures pull-through mirroring.
+type Options struct {
+	// Origins are the allow-listed origin URL prefixes (eg.
+	// https://github.com/).
+	Origins []string
+	// Client is the HTTP client used to fetch from origins.
+	Client *http.Client
+	// FetchTimeout is the maximum duration of a fetch from an origin.
+	FetchTimeout time.Duration
+}
+
+// Mirror is a pull-through mirror of allow-listed origins.
+type Mirror struct {
+	logger   *zap.Logger
+	storage  *cas.Storage
+	metadata *meta.Store
+	opts     Options
+	origins  []*url.URL
+	fetches  singleflight.Group
+}
+
+func NewMirror(logger *zap.Logger, storage *cas.Storage, metadata *meta.Store, opts Options) (*Mirror, error) {
+	var origins []*url.URL
+	for _, origin := range opts.Origins {
+		u, err := url.Parse(origin)
+		if err != nil {
+			return nil, fmt.Errorf("invalid origin %q: %w", origin, err)
+		}
+
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid origin %q: expected an http(s) URL", origin)
+		}
+
+		// Prefixes match whole path segments only.
+		if !strings.HasSuffix(u.Path, "/") {
+			u.Path += "/"
+		}
+
+		origins = append(origins, u)
+	}
+
+	if opts.Client == nil {
+		opts.Client = http.DefaultClient
+	}
+
+	if opts.FetchTimeout == 0 {
+		opts.FetchTimeout = DefaultFetchTimeout
+	}
+
+	return &Mirror{
+		logger:   logger,
+		storage:  storage,
+		metadata: metadata,
+		opts:     opts,
+		origins:  origins,
+	}, nil
+}
+
+// Get serves a file from an origin, the request path is the origin URL
+// without the scheme (eg. /mirror/github.com/org/repo/releases/download/...).
+// The content can be checked against an expected SHA-256 digest with the
+// sha256 query parameter.
+func (m *Mirror) Get(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	originURL, ok := m.resolve(c.Param("*"))
+	if !ok {
+		m.logger.Warn("Origin not allowed", zap.String("path", c.Param("*")))
+
+		return echo.NewHTTPError(http.StatusForbidden, "origin not allowed")
+	}
+
+	expected := strings.ToLower(c.QueryParam("sha256"))
+	if expected != "" {
+		if decoded, err := hex.DecodeString(expected); err != nil || len(decoded) != sha256.Size {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid sha256 digest")
+		}
+	}
+
+	m.logger.Info("Received request for origin URL", zap.String("url", originURL))
+
+	o, err := m.metadata.GetOrigin(ctx, originURL)
+	if errors.Is(err, meta.ErrNotFound) {
+		// Concurrent requests for the same URL share a single fetch.
+		var v any
+		v, err, _ = m.fetches.Do(originURL+"#"+expected, func() (any, error) {
+			return m.fetch(originURL, expected)
+		})
+		if err == nil {
+			o = v.(*meta.Origin)
+		}
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, errOriginNotFound):
+			return echo.NewHTTPError(http.StatusNotFound)
+		case errors.Is(err, errChecksumMismatch), errors.Is(err, quota.ErrTooLarge):
+			return echo.NewHTTPError(http.StatusBadGateway, err.Error())
+		}
+
+		m.logger.Error("Failed to mirror origin URL", zap.String("url", originURL), zap.Error(err))
+
+		return echo.NewHTTPError(http.StatusBadGateway)
+	}
+
+	if expected != "" && o.SHA256 != expected {
+		m.logger.Warn("Mirrored content does not match the expected checksum",
+			zap.String("url", originURL), zap.String("sha256", o.SHA256), zap.String("expected", expected))
+
+		return echo.NewHTTPError(http.StatusConflict, "mirrored content does not match the expected checksum")
+	}
+
+	id, err := blobid.ParseString(o.ID)
+	if err != nil {
+		m.logger.Error("Invalid blob id in origin mapping", zap.String("url", originURL),
+			zap.String("id", o.ID), zap.Error(err))
+
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	return m.storage.Serve(c, id)
+}
+
+// resolve maps a request path to an allow-listed origin URL.
+func (m *Mirror) resolve(p string) (string, bool) {
+	host, rest, _ := strings.Cut(p, "/")
+
+	// Don't let dot segments escape an allow-listed prefix.
+	cleaned := path.Clean("/" + rest)
+
+	for _, origin := range m.origins {
+		if origin.Host == host && strings.HasPrefix(cleaned, origin.Path) {
+			u := url.URL{Scheme: origin.Scheme, Host: host, Path: cleaned}
+			return u.String(), true
+		}
+	}
+
+	return "", false
+}
+
+// fetch downloads a URL from its origin, stores it as a blob and records the
+// mapping from the URL to the blob. The fetch is detached from the request,
+// as other requests may be waiting on it.
+func (m *Mirror) fetch(originURL, expected string) (*meta.Origin, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), m.opts.FetchTimeout)
+	defer cancel()
+
+	m.logger.Info("Fetching from origin", zap.String("url", originURL))
+
+	o, err := m.doFetch(ctx, originURL, expected)
+	if err != nil {
+		outcome := "error"
+		if errors.Is(err, errOriginNotFound) {
+			outcome = "not_found"
+		} else if errors.Is(err, errChecksumMismatch) {
+			outcome = "mismatch"
+		}
+
+		metrics.OriginFetches.WithLabelValues(outcome).Inc()
+
+		return nil, err
+	}
+
+	metrics.OriginFetches.WithLabelValues("success").Inc()
+
+	m.logger.Info("Mirrored origin URL", zap.String("url", originURL),
+		zap.String("id", o.ID), zap.Int64("size", o.Size))
+
+	return o, nil
+}
+
+func (m *Mirror) doFetch(ctx context.Context, originURL, expected string) (*meta.Origin, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, originURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := m.opts.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch from origin: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone {
+		return nil, errOriginNotFound
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("origin returned unexpected status: %s", resp.Status)
+	}
+
+	f, err := os.CreateTemp("", "origin-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}()
+
+	// Mirrored blobs aren't charged to a quota, but are still subject to the
+	// maximum blob size.
+	limit, err := m.storage.UploadWriter(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h, limit), resp.Body)
+	metrics.OriginFetchedBytes.Add(float64(n))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from origin: %w", err)
+	}
+
+	sha256Digest := hex.EncodeToString(h.Sum(nil))
+	if expected != "" && sha256Digest != expected {
+		m.logger.Warn("Origin content does not match the expected checksum",
+			zap.String("url", originURL), zap.String("sha256", sha256Digest), zap.String("expected", expected))
+
+		return nil, errChecksumMismatch
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to rewind temporary file: %w", err)
+	}
+
+	blob := &meta.Blob{
+		Name:   path.Base(req.URL.Path),
+		SHA256: sha256Digest,
+	}
+
+	if err := m.storage.Store(ctx, f, blob); err != nil {
+		return nil, fmt.Errorf("failed to store blob: %w", err)
+	}
+
+	o := &meta.Origin{
+		URL:       originURL,
+		ID:        blob.ID,
+		Size:      blob.Size,
+		SHA256:    sha256Digest,
+		FetchedAt: time.Now().UTC(),
+	}
+
+	if err := m.metadata.PutOrigin(ctx, o); err != nil {
+		return nil, fmt.Errorf("failed to store origin mapping: %w", err)
+	}
+
+	return o, nil
+}
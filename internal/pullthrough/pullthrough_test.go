@@ -0,0 +1,130 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pullthrough_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gpu-ninja/download-mirror/internal/cas"
+	"github.com/gpu-ninja/download-mirror/internal/cas/castest"
+	"github.com/gpu-ninja/download-mirror/internal/meta"
+	"github.com/gpu-ninja/download-mirror/internal/pullthrough"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestMirror(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+
+	content := strings.Repeat("release asset ", 1000)
+	sum := sha256.Sum256([]byte(content))
+	digest := hex.EncodeToString(sum[:])
+
+	var originRequests atomic.Int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		originRequests.Add(1)
+
+		if r.URL.Path != "/releases/download/v1.0.0/tool-linux-amd64" {
+			http.NotFound(w, r)
+			return
+		}
+
+		_, _ = io.WriteString(w, content)
+	}))
+	t.Cleanup(origin.Close)
+
+	fixture := castest.New(t, logger)
+
+	metadata := fixture.Metadata
+	storage := fixture.NewStorage(logger, cas.Options{})
+
+	mirror, err := pullthrough.NewMirror(logger, storage, metadata, pullthrough.Options{
+		Origins: []string{origin.URL + "/releases"},
+	})
+	require.NoError(t, err)
+
+	e := echo.New()
+	e.GET("/mirror/*", mirror.Get)
+
+	srv := httptest.NewServer(e)
+	t.Cleanup(srv.Close)
+
+	originHost := strings.TrimPrefix(origin.URL, "http://")
+
+	get := func(path string) (int, string) {
+		resp, err := http.Get(srv.URL + "/mirror/" + originHost + path)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+
+		return resp.StatusCode, string(body)
+	}
+
+	t.Run("Not Allowed", func(t *testing.T) {
+		status, _ := get("/other/file")
+		assert.Equal(t, http.StatusForbidden, status)
+
+		status, _ = get("/releases/../other/file")
+		assert.Equal(t, http.StatusForbidden, status)
+
+		assert.Zero(t, originRequests.Load())
+	})
+
+	t.Run("Checksum Mismatch", func(t *testing.T) {
+		status, _ := get("/releases/download/v1.0.0/tool-linux-amd64?sha256=" + strings.Repeat("0", 64))
+		assert.Equal(t, http.StatusBadGateway, status)
+
+		_, err := metadata.GetOrigin(context.Background(), origin.URL+"/releases/download/v1.0.0/tool-linux-amd64")
+		assert.ErrorIs(t, err, meta.ErrNotFound)
+	})
+
+	originRequests.Store(0)
+
+	t.Run("Pull Through", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			status, body := get("/releases/download/v1.0.0/tool-linux-amd64?sha256=" + digest)
+			require.Equal(t, http.StatusOK, status)
+			assert.Equal(t, content, body)
+		}
+
+		assert.Equal(t, int32(1), originRequests.Load())
+
+		o, err := metadata.GetOrigin(context.Background(), origin.URL+"/releases/download/v1.0.0/tool-linux-amd64")
+		require.NoError(t, err)
+
+		assert.Equal(t, digest, o.SHA256)
+		assert.Equal(t, int64(len(content)), o.Size)
+	})
+
+	t.Run("Not Found", func(t *testing.T) {
+		status, _ := get("/releases/download/v1.0.0/missing")
+		assert.Equal(t, http.StatusNotFound, status)
+	})
+}
@@ -0,0 +1,433 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package quota limits the storage that each token can use, and the size of
+// uploaded blobs.
+package quota
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/go-units"
+	"github.com/gpu-ninja/download-mirror/internal/auth"
+	"github.com/gpu-ninja/download-mirror/internal/meta"
+	"github.com/gpu-ninja/download-mirror/pkg/api"
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+// DefaultToken is the name that sets the limits of tokens without their own.
+const DefaultToken = "*"
+
+var (
+	// ErrTooLarge is returned when a blob is larger than the maximum blob size.
+	ErrTooLarge = errors.New("blob exceeds the maximum blob size")
+	// ErrExceeded is returned when storing a blob would exceed the quota of
+	// the token that uploaded it.
+	ErrExceeded = errors.New("storage quota exceeded")
+)
+
+// Limits are the storage quota of a token. Zero values are unlimited.
+type Limits struct {
+	// MaxBytes is the total size of the blobs the token can upload.
+	MaxBytes int64
+	// MaxBlobs is the number of blobs the token can upload.
+	MaxBlobs int64
+}
+
+// ParseLimits parses token quotas, each in the form
+// "<token>:<max bytes>[:<max blobs>]" (eg. "ci:100G:10000"). The token "*"
+// sets the quota of tokens without their own. Either limit can be left empty
+// (or 0) for unlimited.
+func ParseLimits(specs []string) (map[string]Limits, error) {
+	limits := make(map[string]Limits)
+	for _, spec := range specs {
+		parts := strings.Split(spec, ":")
+		if len(parts) < 2 || len(parts) > 3 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid quota %q, expected <token>:<max bytes>[:<max blobs>]", spec)
+		}
+
+		if _, ok := limits[parts[0]]; ok {
+			return nil, fmt.Errorf("duplicate quota for token %q", parts[0])
+		}
+
+		var l Limits
+		if parts[1] != "" {
+			maxBytes, err := units.FromHumanSize(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid quota %q: %w", spec, err)
+			}
+
+			l.MaxBytes = maxBytes
+		}
+
+		if len(parts) == 3 && parts[2] != "" {
+			maxBlobs, err := strconv.ParseInt(parts[2], 10, 64)
+			if err != nil || maxBlobs < 0 {
+				return nil, fmt.Errorf("invalid quota %q: invalid blob count", spec)
+			}
+
+			l.MaxBlobs = maxBlobs
+		}
+
+		limits[parts[0]] = l
+	}
+
+	return limits, nil
+}
+
+// Options configures the quotas.
+type Options struct {
+	// MaxBlobSize is the largest blob that can be uploaded, unlimited if zero.
+	MaxBlobSize int64
+	// Limits are the quotas of each token (or DefaultToken).
+	Limits map[string]Limits
+	// Tokens are the tokens whose usage is reported by List.
+	Tokens auth.Tokens
+	// Node is the name this mirror records its usage under, it must be unique
+	// among the mirrors sharing an upstream. Defaults to the hostname.
+	Node string
+}
+
+// Quotas tracks the storage used by each token in the metadata store, and
+// enforces their quotas.
+//
+// Each node keeps its own usage record per token, and the usage of a token is
+// the sum of the records of every node. The usage of other nodes is re-read
+// whenever a quota is checked, but it is not locked, so concurrent uploads to
+// different nodes can briefly exceed a quota.
+type Quotas struct {
+	logger   *zap.Logger
+	metadata *meta.Store
+	opts     Options
+	// Protects tokens and the usage within.
+	mu     sync.Mutex
+	tokens map[string]*tokenUsage
+}
+
+// tokenUsage is the usage of a token on this node.
+type tokenUsage struct {
+	// Serializes loading and storing the usage record of this node, so that
+	// Quotas.mu is never held during network I/O.
+	recordMu sync.Mutex
+	loaded   bool
+	// committed is the storage charged to the token by this node.
+	committed meta.Usage
+	// pending is the storage reserved by in-flight uploads.
+	pending meta.Usage
+}
+
+// NewQuotas creates a new quota tracker.
+func NewQuotas(logger *zap.Logger, metadata *meta.Store, opts Options) *Quotas {
+	if opts.Node == "" {
+		opts.Node, _ = os.Hostname()
+	}
+
+	return &Quotas{
+		logger:   logger,
+		metadata: metadata,
+		opts:     opts,
+		tokens:   make(map[string]*tokenUsage),
+	}
+}
+
+// MaxBlobSize returns the largest blob that can be uploaded, or zero if
+// unlimited.
+func (q *Quotas) MaxBlobSize() int64 {
+	return q.opts.MaxBlobSize
+}
+
+// Limits returns the quota of a token.
+func (q *Quotas) Limits(token string) Limits {
+	if l, ok := q.opts.Limits[token]; ok {
+		return l
+	}
+
+	return q.opts.Limits[DefaultToken]
+}
+
+// Reservation is storage reserved for a blob while it's being stored.
+type Reservation struct {
+	q     *Quotas
+	token string
+	usage *tokenUsage
+	size  int64
+	done  bool
+}
+
+// Reserve reserves storage for a blob uploaded by a token. The reservation
+// must be either committed or released.
+func (q *Quotas) Reserve(ctx context.Context, token string, size int64) (*Reservation, error) {
+	if q.opts.MaxBlobSize > 0 && size > q.opts.MaxBlobSize {
+		return nil, ErrTooLarge
+	}
+
+	others, usage, err := q.load(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	l := q.Limits(token)
+	if (l.MaxBytes > 0 && others.Bytes+usage.committed.Bytes+usage.pending.Bytes+size > l.MaxBytes) ||
+		(l.MaxBlobs > 0 && others.Blobs+usage.committed.Blobs+usage.pending.Blobs+1 > l.MaxBlobs) {
+		return nil, ErrExceeded
+	}
+
+	usage.pending.Bytes += size
+	usage.pending.Blobs++
+
+	return &Reservation{q: q, token: token, usage: usage, size: size}, nil
+}
+
+// Commit charges the blob to the token.
+func (r *Reservation) Commit(ctx context.Context) error {
+	r.q.mu.Lock()
+	if r.done {
+		r.q.mu.Unlock()
+		return nil
+	}
+	r.release()
+
+	r.usage.committed.Bytes += r.size
+	r.usage.committed.Blobs++
+	r.usage.committed.UpdatedAt = time.Now().UTC()
+	r.q.mu.Unlock()
+
+	return r.q.store(ctx, r.usage)
+}
+
+// Release releases the reservation without charging the token, eg. because
+// storing the blob failed or it already existed. It does nothing if the
+// reservation was committed.
+func (r *Reservation) Release() {
+	r.q.mu.Lock()
+	defer r.q.mu.Unlock()
+
+	if !r.done {
+		r.release()
+	}
+}
+
+func (r *Reservation) release() {
+	r.usage.pending.Bytes -= r.size
+	r.usage.pending.Blobs--
+	r.done = true
+}
+
+// Writer returns a writer that counts the bytes of a blob as it's uploaded
+// by a token, failing as soon as the blob is larger than the maximum blob
+// size or the remaining quota of the token. So that oversized uploads can be
+// rejected before they are stored. If token is empty, only the maximum blob
+// size is enforced.
+func (q *Quotas) Writer(ctx context.Context, token string) (*Writer, error) {
+	w := &Writer{maxSize: math.MaxInt64, err: ErrTooLarge}
+	if q.opts.MaxBlobSize > 0 {
+		w.maxSize = q.opts.MaxBlobSize
+	}
+
+	if token == "" {
+		return w, nil
+	}
+
+	others, usage, err := q.load(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	l := q.Limits(token)
+	if l.MaxBlobs > 0 && others.Blobs+usage.committed.Blobs+usage.pending.Blobs >= l.MaxBlobs {
+		return nil, ErrExceeded
+	}
+
+	if l.MaxBytes > 0 {
+		remaining := l.MaxBytes - others.Bytes - usage.committed.Bytes - usage.pending.Bytes
+		if remaining <= 0 {
+			return nil, ErrExceeded
+		}
+
+		if remaining < w.maxSize {
+			w.maxSize, w.err = remaining, ErrExceeded
+		}
+	}
+
+	return w, nil
+}
+
+// Writer counts the bytes of an upload, see Quotas.Writer.
+type Writer struct {
+	maxSize int64
+	err     error
+	written int64
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	w.written += int64(len(p))
+	if w.written > w.maxSize {
+		return 0, w.err
+	}
+
+	return len(p), nil
+}
+
+// HTTPError returns the HTTP error for a blob that is too large or exceeds
+// the quota of its token, or nil for other errors.
+func HTTPError(err error) *echo.HTTPError {
+	switch {
+	case errors.Is(err, ErrTooLarge):
+		return echo.NewHTTPError(http.StatusRequestEntityTooLarge, ErrTooLarge.Error())
+	case errors.Is(err, ErrExceeded):
+		return echo.NewHTTPError(http.StatusInsufficientStorage, ErrExceeded.Error())
+	default:
+		return nil
+	}
+}
+
+// Get returns the usage and quota of the token used to authenticate.
+func (q *Quotas) Get(c echo.Context) error {
+	quota, err := q.toAPI(c.Request().Context(), auth.TokenName(c))
+	if err != nil {
+		q.logger.Error("Failed to get usage", zap.Error(err))
+
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusOK, quota)
+}
+
+// List returns the usage and quota of every token.
+func (q *Quotas) List(c echo.Context) error {
+	quotas := []api.Quota{}
+	for _, token := range q.opts.Tokens {
+		quota, err := q.toAPI(c.Request().Context(), token.Name)
+		if err != nil {
+			q.logger.Error("Failed to get usage", zap.String("token", token.Name), zap.Error(err))
+
+			return echo.NewHTTPError(http.StatusInternalServerError)
+		}
+
+		quotas = append(quotas, *quota)
+	}
+
+	return c.JSON(http.StatusOK, quotas)
+}
+
+func (q *Quotas) toAPI(ctx context.Context, token string) (*api.Quota, error) {
+	others, usage, err := q.load(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	q.mu.Lock()
+	bytes := others.Bytes + usage.committed.Bytes
+	blobs := others.Blobs + usage.committed.Blobs
+	q.mu.Unlock()
+
+	l := q.Limits(token)
+
+	return &api.Quota{
+		Token:       token,
+		Bytes:       bytes,
+		Blobs:       blobs,
+		MaxBytes:    l.MaxBytes,
+		MaxBlobs:    l.MaxBlobs,
+		MaxBlobSize: q.opts.MaxBlobSize,
+	}, nil
+}
+
+// load returns the storage charged to a token by other nodes, which is
+// re-read every time, along with the usage of the token on this node, which
+// is only read from the metadata store the first time (as no other node
+// writes it).
+func (q *Quotas) load(ctx context.Context, token string) (meta.Usage, *tokenUsage, error) {
+	q.mu.Lock()
+	usage, ok := q.tokens[token]
+	if !ok {
+		usage = &tokenUsage{
+			committed: meta.Usage{Token: token, Node: q.opts.Node},
+		}
+		q.tokens[token] = usage
+	}
+	q.mu.Unlock()
+
+	usage.recordMu.Lock()
+	if !usage.loaded {
+		stored, err := q.metadata.GetNodeUsage(ctx, token, q.opts.Node)
+		if err != nil && !errors.Is(err, meta.ErrNotFound) {
+			usage.recordMu.Unlock()
+			return meta.Usage{}, nil, fmt.Errorf("failed to get usage: %w", err)
+		}
+
+		if err == nil {
+			q.mu.Lock()
+			usage.committed.Bytes = stored.Bytes
+			usage.committed.Blobs = stored.Blobs
+			usage.committed.UpdatedAt = stored.UpdatedAt
+			q.mu.Unlock()
+		}
+
+		usage.loaded = true
+	}
+	usage.recordMu.Unlock()
+
+	records, err := q.metadata.ListUsage(ctx, token)
+	if err != nil {
+		return meta.Usage{}, nil, fmt.Errorf("failed to get usage: %w", err)
+	}
+
+	others := meta.Usage{Token: token}
+	for _, record := range records {
+		if record.Node != q.opts.Node {
+			others.Bytes += record.Bytes
+			others.Blobs += record.Blobs
+		}
+	}
+
+	return others, usage, nil
+}
+
+// store writes the usage record of this node. Records are written one at a
+// time, with the latest usage, so an earlier commit can never overwrite a
+// later one.
+func (q *Quotas) store(ctx context.Context, usage *tokenUsage) error {
+	usage.recordMu.Lock()
+	defer usage.recordMu.Unlock()
+
+	q.mu.Lock()
+	record := usage.committed
+	q.mu.Unlock()
+
+	if err := q.metadata.PutUsage(ctx, &record); err != nil {
+		return fmt.Errorf("failed to store usage: %w", err)
+	}
+
+	return nil
+}
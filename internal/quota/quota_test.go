@@ -0,0 +1,118 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package quota_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/gpu-ninja/download-mirror/internal/meta"
+	"github.com/gpu-ninja/download-mirror/internal/quota"
+	"github.com/gpu-ninja/download-mirror/internal/upstream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestParseLimits(t *testing.T) {
+	limits, err := quota.ParseLimits([]string{"ci:100G:10000", "release::50", "*:1G"})
+	require.NoError(t, err)
+
+	assert.Equal(t, quota.Limits{MaxBytes: 100 * 1000 * 1000 * 1000, MaxBlobs: 10000}, limits["ci"])
+	assert.Equal(t, quota.Limits{MaxBlobs: 50}, limits["release"])
+	assert.Equal(t, quota.Limits{MaxBytes: 1000 * 1000 * 1000}, limits[quota.DefaultToken])
+
+	for _, spec := range []string{"ci", "ci:lots", "ci:1G:many", ":1G", "ci:1G:1:1"} {
+		_, err := quota.ParseLimits([]string{spec})
+		assert.Error(t, err, spec)
+	}
+
+	_, err = quota.ParseLimits([]string{"ci:1G", "ci:2G"})
+	assert.Error(t, err)
+}
+
+func TestQuotas(t *testing.T) {
+	ctx := context.Background()
+	logger := zaptest.NewLogger(t)
+
+	ups, err := upstream.NewFilesystem(t.TempDir())
+	require.NoError(t, err)
+
+	metadata := meta.NewStore(ups)
+
+	newQuotas := func(node string) *quota.Quotas {
+		return quota.NewQuotas(logger, metadata, quota.Options{
+			Limits: map[string]quota.Limits{
+				"ci": {MaxBytes: 1500, MaxBlobs: 100},
+			},
+			Node: node,
+		})
+	}
+
+	store := func(q *quota.Quotas, size int64) error {
+		r, err := q.Reserve(ctx, "ci", size)
+		if err != nil {
+			return err
+		}
+
+		return r.Commit(ctx)
+	}
+
+	a, b := newQuotas("a"), newQuotas("b")
+
+	t.Run("Multiple Nodes", func(t *testing.T) {
+		require.NoError(t, store(a, 600))
+		require.NoError(t, store(b, 600))
+
+		// The usage of the other node is taken into account.
+		assert.ErrorIs(t, store(a, 600), quota.ErrExceeded)
+
+		usage, err := metadata.GetUsage(ctx, "ci")
+		require.NoError(t, err)
+
+		assert.Equal(t, int64(1200), usage.Bytes)
+		assert.Equal(t, int64(2), usage.Blobs)
+	})
+
+	t.Run("Concurrent Commits", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				assert.NoError(t, store(a, 1))
+			}()
+		}
+		wg.Wait()
+
+		usage, err := metadata.GetNodeUsage(ctx, "ci", "a")
+		require.NoError(t, err)
+
+		assert.Equal(t, int64(620), usage.Bytes)
+		assert.Equal(t, int64(21), usage.Blobs)
+
+		// A restarted node picks up where it left off.
+		usage, err = metadata.GetUsage(ctx, "ci")
+		require.NoError(t, err)
+
+		_, err = newQuotas("a").Reserve(ctx, "ci", 1500-usage.Bytes+1)
+		assert.ErrorIs(t, err, quota.ErrExceeded)
+	})
+}
@@ -0,0 +1,375 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package ratelimit limits the request and byte rates of clients, so that a
+// single misbehaving client can't saturate the uplink (or the upstream).
+package ratelimit
+
+import (
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gpu-ninja/download-mirror/internal/auth"
+	"github.com/gpu-ninja/download-mirror/internal/metrics"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"golang.org/x/time/rate"
+)
+
+const (
+	clientKey = "ratelimit.client"
+	// chunkSize is the most data that is accounted for in one go, so that
+	// concurrent transfers sharing a limiter take turns.
+	chunkSize = 32 * 1024
+	// idleTimeout is how long the state of a client is kept after its last
+	// request completes.
+	idleTimeout = 10 * time.Minute
+)
+
+// Limits are the rate limits applied to a client. Zero values are unlimited.
+type Limits struct {
+	// RequestsPerSecond is the sustained request rate.
+	RequestsPerSecond float64
+	// Burst is the number of requests allowed in excess of the sustained
+	// rate, defaults to the request rate.
+	Burst int
+	// BytesPerSecond is the rate at which data is transferred.
+	BytesPerSecond int64
+}
+
+// Options configures the rate limits.
+type Options struct {
+	// Client limits apply to each client IP address (or subnet).
+	Client Limits
+	// Token limits apply to each token, requests presenting a valid token
+	// are subject to these rather than the client limits.
+	Token Limits
+	// CacheMiss limits apply to requests (per client or token) that miss the
+	// cache and are served from the upstream, in addition to the other limits.
+	// The byte rate limits reading from the upstream.
+	CacheMiss Limits
+	// Tokens are used to identify requests presenting a token.
+	Tokens auth.Tokens
+	// IPv4Prefix is the prefix length IPv4 clients are grouped by, defaults
+	// to 32 (each address).
+	IPv4Prefix int
+	// IPv6Prefix is the prefix length IPv6 clients are grouped by, defaults
+	// to 64.
+	IPv6Prefix int
+	// EgressBytesPerSecond caps the total rate at which responses are sent.
+	// The bandwidth is shared fairly between active downloads.
+	EgressBytesPerSecond int64
+	// Skipper skips rate limiting of some requests, eg. health checks.
+	Skipper middleware.Skipper
+}
+
+// Limiter applies rate limits to requests.
+type Limiter struct {
+	opts      Options
+	egress    *rate.Limiter
+	mu        sync.Mutex
+	clients   map[string]*client
+	lastSweep time.Time
+}
+
+type client struct {
+	requests     *rate.Limiter
+	bytes        *rate.Limiter
+	missRequests *rate.Limiter
+	missBytes    *rate.Limiter
+	// active is the number of in-flight requests.
+	active   atomic.Int64
+	lastSeen atomic.Int64
+}
+
+// NewLimiter creates a new rate limiter.
+func NewLimiter(opts Options) *Limiter {
+	if opts.IPv4Prefix == 0 {
+		opts.IPv4Prefix = 32
+	}
+
+	if opts.IPv6Prefix == 0 {
+		opts.IPv6Prefix = 64
+	}
+
+	if opts.Skipper == nil {
+		opts.Skipper = middleware.DefaultSkipper
+	}
+
+	return &Limiter{
+		opts:      opts,
+		egress:    newByteLimiter(opts.EgressBytesPerSecond),
+		clients:   make(map[string]*client),
+		lastSweep: time.Now(),
+	}
+}
+
+// Middleware returns an echo middleware that enforces the request rate
+// limits, and shapes responses to the byte rate limits. Requests over their
+// limit are rejected with 429 Too Many Requests, and a Retry-After header.
+func (l *Limiter) Middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if l.opts.Skipper(c) {
+				return next(c)
+			}
+
+			cl := l.client(c)
+			defer func() {
+				cl.lastSeen.Store(time.Now().UnixNano())
+				cl.active.Add(-1)
+			}()
+
+			if err := allow(c, cl.requests, "request"); err != nil {
+				return err
+			}
+
+			c.Set(clientKey, cl)
+
+			var limiters []*rate.Limiter
+			for _, lim := range []*rate.Limiter{cl.bytes, l.egress} {
+				if lim != nil {
+					limiters = append(limiters, lim)
+				}
+			}
+
+			if len(limiters) > 0 {
+				res := c.Response()
+				res.Writer = &writer{
+					ResponseWriter: res.Writer,
+					ctx:            c.Request().Context(),
+					limiters:       limiters,
+				}
+			}
+
+			return next(c)
+		}
+	}
+}
+
+// AllowCacheMiss enforces the cache-miss request rate limit, it's called
+// before a request is served from the upstream.
+func AllowCacheMiss(c echo.Context) error {
+	cl, ok := c.Get(clientKey).(*client)
+	if !ok {
+		return nil
+	}
+
+	return allow(c, cl.missRequests, "cache_miss")
+}
+
+// LimitCacheMiss limits reading of upstream data, for a request that missed
+// the cache, to the cache-miss byte rate.
+func LimitCacheMiss(c echo.Context, r io.Reader) io.Reader {
+	cl, ok := c.Get(clientKey).(*client)
+	if !ok || cl.missBytes == nil {
+		return r
+	}
+
+	return &reader{
+		Reader:  r,
+		ctx:     c.Request().Context(),
+		limiter: cl.missBytes,
+	}
+}
+
+// client returns the state of the client making the request, clients are
+// identified by their token or otherwise their IP address (or subnet).
+func (l *Limiter) client(c echo.Context) *client {
+	limits := l.opts.Client
+
+	var key string
+	if token, ok := l.opts.Tokens.Lookup(presentedToken(c.Request())); ok {
+		key = "token:" + token.Name
+		limits = l.opts.Token
+	} else if addr, err := netip.ParseAddr(c.RealIP()); err == nil {
+		addr = addr.Unmap()
+
+		bits := l.opts.IPv6Prefix
+		if addr.Is4() {
+			bits = l.opts.IPv4Prefix
+		}
+
+		prefix, _ := addr.Prefix(bits)
+		key = "ip:" + prefix.String()
+	} else {
+		key = "ip:" + c.RealIP()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastSweep) > idleTimeout {
+		l.lastSweep = now
+
+		for key, cl := range l.clients {
+			if cl.active.Load() == 0 && now.Sub(time.Unix(0, cl.lastSeen.Load())) > idleTimeout {
+				delete(l.clients, key)
+			}
+		}
+	}
+
+	cl, ok := l.clients[key]
+	if !ok {
+		cl = &client{
+			requests:     newRequestLimiter(limits),
+			bytes:        newByteLimiter(limits.BytesPerSecond),
+			missRequests: newRequestLimiter(l.opts.CacheMiss),
+			missBytes:    newByteLimiter(l.opts.CacheMiss.BytesPerSecond),
+		}
+		l.clients[key] = cl
+	}
+
+	cl.active.Add(1)
+	cl.lastSeen.Store(now.UnixNano())
+
+	return cl
+}
+
+// presentedToken returns the token presented by a request, either as a
+// bearer token or as the password of HTTP basic authentication.
+func presentedToken(req *http.Request) string {
+	if value, ok := strings.CutPrefix(req.Header.Get(echo.HeaderAuthorization), "Bearer "); ok {
+		return value
+	}
+
+	_, value, _ := req.BasicAuth()
+
+	return value
+}
+
+func allow(c echo.Context, limiter *rate.Limiter, limit string) error {
+	if limiter == nil {
+		return nil
+	}
+
+	r := limiter.Reserve()
+	delay := r.Delay()
+	if delay == 0 {
+		return nil
+	}
+
+	// Don't count rejected requests against the client.
+	r.Cancel()
+
+	metrics.RateLimitedRequests.WithLabelValues(limit).Inc()
+
+	c.Response().Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+
+	return echo.NewHTTPError(http.StatusTooManyRequests)
+}
+
+func newRequestLimiter(limits Limits) *rate.Limiter {
+	if limits.RequestsPerSecond <= 0 {
+		return nil
+	}
+
+	burst := limits.Burst
+	if burst <= 0 {
+		burst = int(math.Ceil(limits.RequestsPerSecond))
+	}
+
+	return rate.NewLimiter(rate.Limit(limits.RequestsPerSecond), burst)
+}
+
+func newByteLimiter(bytesPerSecond int64) *rate.Limiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+
+	burst := int(bytesPerSecond)
+	if burst < chunkSize {
+		burst = chunkSize
+	}
+
+	return rate.NewLimiter(rate.Limit(bytesPerSecond), burst)
+}
+
+// writer shapes a response to the byte rate limits. Each chunk waits its turn
+// with every limiter, reservations are handed out in order so concurrent
+// downloads sharing a limiter get an equal share of its bandwidth.
+type writer struct {
+	http.ResponseWriter
+	ctx      context.Context
+	limiters []*rate.Limiter
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > chunkSize {
+			chunk = chunk[:chunkSize]
+		}
+
+		for _, limiter := range w.limiters {
+			if err := limiter.WaitN(w.ctx, len(chunk)); err != nil {
+				return written, err
+			}
+		}
+
+		n, err := w.ResponseWriter.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+
+		p = p[n:]
+	}
+
+	return written, nil
+}
+
+func (w *writer) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *writer) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+type reader struct {
+	io.Reader
+	ctx     context.Context
+	limiter *rate.Limiter
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if len(p) > chunkSize {
+		p = p[:chunkSize]
+	}
+
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		if waitErr := r.limiter.WaitN(r.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+
+	return n, err
+}
@@ -0,0 +1,160 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ratelimit_test
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gpu-ninja/download-mirror/internal/auth"
+	"github.com/gpu-ninja/download-mirror/internal/ratelimit"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimiter(t *testing.T) {
+	tokens, err := auth.ParseTokens("ci:secret")
+	require.NoError(t, err)
+
+	limiter := ratelimit.NewLimiter(ratelimit.Options{
+		Client:     ratelimit.Limits{RequestsPerSecond: 0.1, Burst: 2, BytesPerSecond: 64 * 1024},
+		Token:      ratelimit.Limits{RequestsPerSecond: 0.1, Burst: 3},
+		CacheMiss:  ratelimit.Limits{RequestsPerSecond: 0.1, Burst: 1},
+		Tokens:     tokens,
+		IPv6Prefix: 64,
+	})
+
+	e := echo.New()
+	e.IPExtractor = echo.ExtractIPDirect()
+	e.Use(limiter.Middleware())
+
+	data := bytes.Repeat([]byte("x"), 96*1024)
+	e.GET("/data", func(c echo.Context) error {
+		return c.Blob(http.StatusOK, echo.MIMEOctetStream, data)
+	})
+	e.GET("/ping", func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	})
+	e.GET("/miss", func(c echo.Context) error {
+		if err := ratelimit.AllowCacheMiss(c); err != nil {
+			return err
+		}
+
+		return c.NoContent(http.StatusOK)
+	})
+
+	get := func(path, remoteAddr, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = remoteAddr
+		if token != "" {
+			req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+		}
+
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+
+		return rec
+	}
+
+	t.Run("Request Rate", func(t *testing.T) {
+		start := time.Now()
+		rec := get("/data", "198.51.100.1:1234", "")
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.Len(t, rec.Body.Bytes(), len(data))
+
+		// The first 64KiB are sent immediately, the remainder at 64KiB/s.
+		assert.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+
+		assert.Equal(t, http.StatusOK, get("/miss", "198.51.100.1:1234", "").Code)
+
+		rec = get("/data", "198.51.100.1:1234", "")
+		assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+		assert.Equal(t, "10", rec.Header().Get("Retry-After"))
+
+		// Other clients have their own limits.
+		assert.Equal(t, http.StatusOK, get("/ping", "198.51.100.2:1234", "").Code)
+	})
+
+	t.Run("Subnets", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, get("/ping", "[2001:db8::1]:1234", "").Code)
+		assert.Equal(t, http.StatusOK, get("/ping", "[2001:db8::2]:1234", "").Code)
+		assert.Equal(t, http.StatusTooManyRequests, get("/ping", "[2001:db8::3]:1234", "").Code)
+	})
+
+	t.Run("Tokens", func(t *testing.T) {
+		// Token requests aren't subject to the limits of the client.
+		for i := 0; i < 3; i++ {
+			assert.Equal(t, http.StatusOK, get("/data", "198.51.100.1:1234", "secret").Code)
+		}
+
+		assert.Equal(t, http.StatusTooManyRequests, get("/data", "198.51.100.3:1234", "secret").Code)
+	})
+
+	t.Run("Cache Miss", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, get("/miss", "198.51.100.4:1234", "").Code)
+
+		rec := get("/miss", "198.51.100.4:1234", "")
+		assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+		assert.NotEmpty(t, rec.Header().Get("Retry-After"))
+	})
+}
+
+func TestEgress(t *testing.T) {
+	limiter := ratelimit.NewLimiter(ratelimit.Options{
+		EgressBytesPerSecond: 64 * 1024,
+	})
+
+	e := echo.New()
+	e.Use(limiter.Middleware())
+
+	data := bytes.Repeat([]byte("x"), 64*1024)
+	e.GET("/data", func(c echo.Context) error {
+		return c.Blob(http.StatusOK, echo.MIMEOctetStream, data)
+	})
+
+	srv := httptest.NewServer(e)
+	t.Cleanup(srv.Close)
+
+	// Two concurrent downloads share the egress limit, after the initial burst.
+	start := time.Now()
+	done := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			resp, err := http.Get(srv.URL + "/data")
+			if err != nil {
+				done <- err
+				return
+			}
+			defer resp.Body.Close()
+
+			_, err = io.Copy(io.Discard, resp.Body)
+			done <- err
+		}()
+	}
+
+	for i := 0; i < 2; i++ {
+		require.NoError(t, <-done)
+	}
+
+	assert.GreaterOrEqual(t, time.Since(start), 900*time.Millisecond)
+}
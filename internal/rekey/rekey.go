@@ -0,0 +1,306 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package rekey migrates blobs addressed under legacy secure hash keys to the
+// primary key.
+package rekey
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/akamensky/base58"
+	"github.com/gpu-ninja/download-mirror/internal/blobid"
+	"github.com/gpu-ninja/download-mirror/internal/meta"
+	"github.com/gpu-ninja/download-mirror/internal/securehash"
+	"github.com/gpu-ninja/download-mirror/internal/upstream"
+	"go.uber.org/zap"
+)
+
+// Options configures a migration.
+type Options struct {
+	// DryRun reports which blobs would be re-keyed, without changing anything.
+	DryRun bool
+}
+
+// Report summarises a migration.
+type Report struct {
+	// Scanned is the number of blobs in the upstream.
+	Scanned int
+	// Current is the number of blobs already addressed under the primary key.
+	Current int
+	// Redirected is the number of legacy blobs that had already been re-keyed.
+	Redirected int
+	// Rekeyed is the number of blobs re-keyed (or that would be, in a dry run).
+	Rekeyed int
+	// Unknown are the ids of blobs not addressed under any key in the keyring.
+	Unknown []string
+	// Failed are the ids of blobs that could not be re-keyed.
+	Failed []string
+}
+
+type outcome int
+
+const (
+	outcomeCurrent outcome = iota
+	outcomeRekeyed
+	outcomeUnknown
+)
+
+// Migrate re-keys every blob in the upstream that is addressed under a legacy
+// key. The content is stored under its id for the primary key, the metadata
+// record is copied, and a redirect is recorded so that old URLs keep working.
+// Legacy copies are left in place.
+func Migrate(ctx context.Context, logger *zap.Logger, ups upstream.Upstream, metadata *meta.Store,
+	keyring *securehash.Keyring, opts Options) (*Report, error) {
+	ids, err := ups.List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list blobs: %w", err)
+	}
+
+	var report Report
+	for _, id := range ids {
+		if err := ctx.Err(); err != nil {
+			return &report, err
+		}
+
+		encodedID := base58.Encode(id)
+		report.Scanned++
+
+		if _, err := metadata.GetRedirect(ctx, id); err == nil {
+			report.Redirected++
+			continue
+		} else if !errors.Is(err, meta.ErrNotFound) {
+			logger.Error("Failed to get redirect", zap.String("id", encodedID), zap.Error(err))
+
+			report.Failed = append(report.Failed, encodedID)
+			continue
+		}
+
+		result, err := rekeyBlob(ctx, logger, ups, metadata, keyring, id, opts)
+		if err != nil {
+			logger.Error("Failed to re-key blob", zap.String("id", encodedID), zap.Error(err))
+
+			report.Failed = append(report.Failed, encodedID)
+			continue
+		}
+
+		switch result {
+		case outcomeCurrent:
+			report.Current++
+		case outcomeRekeyed:
+			report.Rekeyed++
+		case outcomeUnknown:
+			logger.Warn("Blob is not addressed under any key in the keyring", zap.String("id", encodedID))
+
+			report.Unknown = append(report.Unknown, encodedID)
+		}
+	}
+
+	// Once every blob is addressed under the primary key, the legacy keys are
+	// no longer needed. They're kept in the record (as migrated), so that
+	// blobs addressed under them are still accounted for.
+	if !opts.DryRun && len(report.Failed) == 0 && len(report.Unknown) == 0 {
+		keys, err := metadata.GetKeys(ctx)
+		if errors.Is(err, meta.ErrNotFound) {
+			keys = &meta.Keys{}
+		} else if err != nil {
+			return &report, err
+		}
+
+		keys.Primary = keyring.Primary().ID
+		keys.KeyIDs = appendMissing(keys.KeyIDs, keys.Primary)
+		for _, key := range keyring.Keys()[1:] {
+			keys.KeyIDs = appendMissing(keys.KeyIDs, key.ID)
+			keys.Migrated = appendMissing(keys.Migrated, key.ID)
+		}
+		keys.UpdatedAt = time.Now().UTC()
+
+		if err := metadata.PutKeys(ctx, keys); err != nil {
+			return &report, err
+		}
+	}
+
+	return &report, nil
+}
+
+func rekeyBlob(ctx context.Context, logger *zap.Logger, ups upstream.Upstream, metadata *meta.Store,
+	keyring *securehash.Keyring, id []byte, opts Options) (outcome, error) {
+	r, _, err := ups.Get(ctx, id)
+	if err != nil {
+		return 0, fmt.Errorf("failed to download blob: %w", err)
+	}
+	defer r.Close()
+
+	f, err := os.CreateTemp("", "rekey-")
+	if err != nil {
+		return 0, fmt.Errorf("failed to create temporary blob file: %w", err)
+	}
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}()
+
+	h := keyring.NewMultiHash()
+	if _, err := io.Copy(io.MultiWriter(f, h), r); err != nil {
+		return 0, fmt.Errorf("failed to download blob: %w", err)
+	}
+
+	key, ok := h.Match(blobid.Digest(id))
+	if !ok {
+		return outcomeUnknown, nil
+	} else if key.ID == keyring.Primary().ID {
+		return outcomeCurrent, nil
+	}
+
+	target := blobid.New(blobid.HMACSHA256, keyring.Primary().ID, h.Sum(nil)).Bytes()
+	encodedID, encodedTarget := base58.Encode(id), base58.Encode(target)
+
+	logger.Info("Re-keying blob", zap.String("id", encodedID), zap.String("keyId", key.ID),
+		zap.String("target", encodedTarget), zap.Bool("dryRun", opts.DryRun))
+
+	if opts.DryRun {
+		return outcomeRekeyed, nil
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, fmt.Errorf("failed to rewind temporary blob file: %w", err)
+	}
+
+	if err := ups.Put(ctx, target, f); err != nil {
+		return 0, fmt.Errorf("failed to upload blob: %w", err)
+	}
+
+	blob, err := metadata.GetBlob(ctx, id)
+	if err != nil && !errors.Is(err, meta.ErrNotFound) {
+		return 0, err
+	} else if err == nil {
+		blob.ID = encodedTarget
+		blob.KeyID = keyring.Primary().ID
+
+		if err := metadata.PutBlob(ctx, blob); err != nil {
+			return 0, err
+		}
+
+		for algorithm, digest := range map[string]string{
+			meta.DigestSHA256: blob.SHA256,
+			meta.DigestSHA512: blob.SHA512,
+		} {
+			if digest == "" {
+				continue
+			}
+
+			if err := metadata.PutDigest(ctx, &meta.Digest{
+				Algorithm: algorithm,
+				Digest:    digest,
+				ID:        encodedTarget,
+				Name:      blob.Name,
+				CreatedAt: time.Now().UTC(),
+			}); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	// Written last, so that an interrupted migration is retried.
+	if err := metadata.PutRedirect(ctx, &meta.Redirect{
+		ID:          encodedID,
+		Target:      encodedTarget,
+		KeyID:       key.ID,
+		TargetKeyID: keyring.Primary().ID,
+		CreatedAt:   time.Now().UTC(),
+	}); err != nil {
+		return 0, err
+	}
+
+	return outcomeRekeyed, nil
+}
+
+// ErrUnknownPrimaryKey is returned by CheckKeyring when the primary key of
+// the keyring has never been used to address blobs.
+var ErrUnknownPrimaryKey = errors.New("primary secure hash key has not been used before")
+
+// CheckKeyring checks the keyring against the keys that blobs have previously
+// been addressed under, as with a misconfigured secret every lookup would
+// silently miss. It warns about keys missing from the keyring, and returns
+// ErrUnknownPrimaryKey if the primary key is new, unless allowNewPrimary is
+// set (or this is the first use of the keyring), in which case it's recorded.
+func CheckKeyring(ctx context.Context, logger *zap.Logger, metadata *meta.Store, keyring *securehash.Keyring, allowNewPrimary bool) error {
+	primary := keyring.Primary().ID
+
+	keys, err := metadata.GetKeys(ctx)
+	if errors.Is(err, meta.ErrNotFound) {
+		return metadata.PutKeys(ctx, &meta.Keys{
+			Primary:   primary,
+			KeyIDs:    []string{primary},
+			UpdatedAt: time.Now().UTC(),
+		})
+	} else if err != nil {
+		return err
+	}
+
+	var missing []string
+	for _, keyID := range keys.KeyIDs {
+		if _, ok := keyring.Key(keyID); !ok && !contains(keys.Migrated, keyID) {
+			missing = append(missing, keyID)
+		}
+	}
+
+	if len(missing) > 0 {
+		logger.Warn("Blobs are addressed under keys missing from the keyring, they will not be found",
+			zap.Strings("keyIds", missing), zap.String("primaryKeyId", primary))
+	}
+
+	if !contains(keys.KeyIDs, primary) {
+		if !allowNewPrimary {
+			return fmt.Errorf("%w: %s", ErrUnknownPrimaryKey, primary)
+		}
+
+		logger.Info("Recording new primary secure hash key", zap.String("primaryKeyId", primary))
+
+		keys.KeyIDs = append(keys.KeyIDs, primary)
+	} else if keys.Primary == primary {
+		return nil
+	}
+
+	keys.Primary = primary
+	keys.UpdatedAt = time.Now().UTC()
+
+	return metadata.PutKeys(ctx, keys)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+func appendMissing(values []string, value string) []string {
+	if contains(values, value) {
+		return values
+	}
+
+	return append(values, value)
+}
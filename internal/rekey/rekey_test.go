@@ -0,0 +1,150 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rekey_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/akamensky/base58"
+	"github.com/gpu-ninja/download-mirror/internal/blobid"
+	"github.com/gpu-ninja/download-mirror/internal/meta"
+	"github.com/gpu-ninja/download-mirror/internal/rekey"
+	"github.com/gpu-ninja/download-mirror/internal/securehash"
+	"github.com/gpu-ninja/download-mirror/internal/upstream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+	logger := zaptest.NewLogger(t)
+
+	ups, err := upstream.NewFilesystem(t.TempDir())
+	require.NoError(t, err)
+
+	metadata := meta.NewStore(ups)
+
+	keyring := securehash.NewKeyring([]byte("new"), []byte("old"))
+
+	data := []byte("hello world")
+
+	h := securehash.New([]byte("old"))
+	_, _ = h.Write(data)
+	legacyID := h.Sum(nil)
+
+	// Re-keyed blobs are given versioned ids.
+	h = securehash.New([]byte("new"))
+	_, _ = h.Write(data)
+	primaryID := blobid.New(blobid.HMACSHA256, keyring.Primary().ID, h.Sum(nil)).Bytes()
+
+	require.NoError(t, ups.Put(ctx, legacyID, bytes.NewReader(data)))
+	require.NoError(t, metadata.PutBlob(ctx, &meta.Blob{
+		ID:        base58.Encode(legacyID),
+		Name:      "hello.txt",
+		Size:      int64(len(data)),
+		Labels:    map[string]string{"app": "hello"},
+		CreatedAt: time.Now().UTC(),
+	}))
+
+	report, err := rekey.Migrate(ctx, logger, ups, metadata, keyring, rekey.Options{DryRun: true})
+	require.NoError(t, err)
+
+	assert.Equal(t, 1, report.Rekeyed)
+
+	_, err = metadata.GetRedirect(ctx, legacyID)
+	require.ErrorIs(t, err, meta.ErrNotFound)
+
+	report, err = rekey.Migrate(ctx, logger, ups, metadata, keyring, rekey.Options{})
+	require.NoError(t, err)
+
+	assert.Equal(t, 1, report.Scanned)
+	assert.Equal(t, 1, report.Rekeyed)
+
+	redirect, err := metadata.GetRedirect(ctx, legacyID)
+	require.NoError(t, err)
+
+	assert.Equal(t, base58.Encode(primaryID), redirect.Target)
+	assert.Equal(t, securehash.KeyID([]byte("old")), redirect.KeyID)
+
+	r, _, err := ups.Get(ctx, primaryID)
+	require.NoError(t, err)
+
+	got, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+
+	assert.Equal(t, data, got)
+
+	blob, err := metadata.GetBlob(ctx, primaryID)
+	require.NoError(t, err)
+
+	assert.Equal(t, "hello.txt", blob.Name)
+	assert.Equal(t, "hello", blob.Labels["app"])
+	assert.Equal(t, keyring.Primary().ID, blob.KeyID)
+
+	keys, err := metadata.GetKeys(ctx)
+	require.NoError(t, err)
+
+	assert.ElementsMatch(t, []string{securehash.KeyID([]byte("old")), keyring.Primary().ID}, keys.KeyIDs)
+	assert.Equal(t, []string{securehash.KeyID([]byte("old"))}, keys.Migrated)
+
+	// The legacy secret can now be dropped.
+	require.NoError(t, rekey.CheckKeyring(ctx, logger, metadata, securehash.NewKeyring([]byte("new")), false))
+
+	// Migrating again should be a no-op.
+	report, err = rekey.Migrate(ctx, logger, ups, metadata, keyring, rekey.Options{})
+	require.NoError(t, err)
+
+	assert.Equal(t, 2, report.Scanned)
+	assert.Equal(t, 1, report.Current)
+	assert.Equal(t, 1, report.Redirected)
+	assert.Zero(t, report.Rekeyed)
+}
+
+func TestCheckKeyring(t *testing.T) {
+	ctx := context.Background()
+
+	ups, err := upstream.NewFilesystem(t.TempDir())
+	require.NoError(t, err)
+
+	metadata := meta.NewStore(ups)
+
+	require.NoError(t, rekey.CheckKeyring(ctx, zaptest.NewLogger(t), metadata, securehash.NewKeyring([]byte("old")), false))
+
+	// A mistyped secret mustn't be recorded as a valid key.
+	err = rekey.CheckKeyring(ctx, zaptest.NewLogger(t), metadata, securehash.NewKeyring([]byte("0ld")), false)
+	require.ErrorIs(t, err, rekey.ErrUnknownPrimaryKey)
+
+	keys, err := metadata.GetKeys(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{securehash.KeyID([]byte("old"))}, keys.KeyIDs)
+
+	keyring := securehash.NewKeyring([]byte("new"), []byte("old"))
+	require.NoError(t, rekey.CheckKeyring(ctx, zaptest.NewLogger(t), metadata, keyring, true))
+
+	keys, err = metadata.GetKeys(ctx)
+	require.NoError(t, err)
+
+	assert.Equal(t, keyring.Primary().ID, keys.Primary)
+	assert.ElementsMatch(t, []string{securehash.KeyID([]byte("old")), keyring.Primary().ID}, keys.KeyIDs)
+}
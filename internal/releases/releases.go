@@ -0,0 +1,746 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package releases implements release manifests, sets of blobs (eg. one per
+// platform, plus checksums and signatures) that are published together under
+// /releases/:product/:version, and channels that point at a release. Each
+// release has a generated manifest.json and SHA256SUMS, which are signed by
+// the server (or offline) and served next to the files as <name>.minisig.
+package releases
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gpu-ninja/download-mirror/internal/auth"
+	"github.com/gpu-ninja/download-mirror/internal/blobid"
+	"github.com/gpu-ninja/download-mirror/internal/cas"
+	"github.com/gpu-ninja/download-mirror/internal/meta"
+	"github.com/gpu-ninja/download-mirror/internal/quota"
+	"github.com/gpu-ninja/download-mirror/internal/signatures"
+	"github.com/gpu-ninja/download-mirror/pkg/api"
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+const (
+	// ChecksumsFile is the name of the generated checksums file of a release.
+	ChecksumsFile = "SHA256SUMS"
+	// ManifestFile is the name of the generated manifest of a release.
+	ManifestFile = "manifest.json"
+	// channelsSegment is reserved for the channel routes.
+	channelsSegment = "channels"
+	// maxRequestSize is the largest JSON release request accepted in a
+	// multipart form.
+	maxRequestSize = 1 << 20
+	// reservationTimeout is how long a version stays reserved by a creation
+	// that never finished (eg. the node crashed).
+	reservationTimeout = 24 * time.Hour
+)
+
+var namePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._+-]{0,254}$`)
+
+// Releases manages and serves releases.
+type Releases struct {
+	logger   *zap.Logger
+	storage  *cas.Storage
+	metadata *meta.Store
+	signer   *signatures.Signer
+}
+
+func NewReleases(logger *zap.Logger, storage *cas.Storage, metadata *meta.Store, signer *signatures.Signer) *Releases {
+	return &Releases{
+		logger:   logger,
+		storage:  storage,
+		metadata: metadata,
+		signer:   signer,
+	}
+}
+
+// Register registers the release routes, reads are public and writes require
+// the given (authentication) middleware.
+func (r *Releases) Register(g *echo.Group, write echo.MiddlewareFunc) {
+	g.GET("/:product", r.List)
+	g.GET("/:product/channels/:channel", r.GetChannel)
+	g.PUT("/:product/channels/:channel", r.PutChannel, write)
+	g.GET("/:product/:version", r.Get)
+	g.POST("/:product/:version", r.Create, write)
+	g.GET("/:product/:version/:file", r.GetFile)
+	g.PUT("/:product/:version/:file", r.PutSignature, write)
+}
+
+// List returns the versions of a product's releases.
+func (r *Releases) List(c echo.Context) error {
+	product := c.Param("product")
+	if !namePattern.MatchString(product) {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid product")
+	}
+
+	versions, err := r.metadata.ListReleases(c.Request().Context(), product)
+	if err != nil {
+		r.logger.Error("Failed to list releases", zap.String("product", product), zap.Error(err))
+
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	if versions == nil {
+		versions = []string{}
+	}
+
+	return c.JSON(http.StatusOK, versions)
+}
+
+// Create atomically creates a release, the manifest is only recorded once
+// every file has been stored. The request is either a multipart form with a
+// "release" field holding the JSON request and "file" parts, or just the JSON
+// request when every file refers to an existing blob.
+func (r *Releases) Create(c echo.Context) error {
+	ctx := c.Request().Context()
+	product, version := c.Param("product"), c.Param("version")
+
+	if !namePattern.MatchString(product) {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid product")
+	} else if !namePattern.MatchString(version) || version == channelsSegment {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid version")
+	}
+
+	// Reserve the version before anything is stored or signed, so that
+	// concurrent creations of the release can't both succeed.
+	reservation := &meta.ReleaseReservation{
+		Product:   product,
+		Version:   version,
+		CreatedBy: auth.TokenName(c),
+		CreatedAt: time.Now().UTC(),
+	}
+
+	if err := r.metadata.ReserveRelease(ctx, reservation, reservationTimeout); errors.Is(err, meta.ErrReserved) {
+		return echo.NewHTTPError(http.StatusConflict, "release is already being created")
+	} else if err != nil {
+		r.logger.Error("Failed to reserve release", zap.String("product", product),
+			zap.String("version", version), zap.Error(err))
+
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	var created bool
+	defer func() {
+		if created {
+			return
+		}
+
+		// The request context may have been cancelled.
+		if err := r.metadata.ReleaseReservation(context.Background(), reservation); err != nil {
+			r.logger.Warn("Failed to release reservation", zap.String("product", product),
+				zap.String("version", version), zap.Error(err))
+		}
+	}()
+
+	if _, err := r.metadata.GetRelease(ctx, product, version); err == nil {
+		return echo.NewHTTPError(http.StatusConflict, "release already exists")
+	} else if !errors.Is(err, meta.ErrNotFound) {
+		r.logger.Error("Failed to get release", zap.String("product", product),
+			zap.String("version", version), zap.Error(err))
+
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	var req api.ReleaseRequest
+	uploads := make(map[string]*os.File)
+	defer func() {
+		for _, f := range uploads {
+			_ = f.Close()
+			_ = os.Remove(f.Name())
+		}
+	}()
+
+	release := &meta.Release{
+		Product:   product,
+		Version:   version,
+		CreatedBy: auth.TokenName(c),
+		CreatedAt: time.Now().UTC(),
+	}
+
+	if strings.HasPrefix(c.Request().Header.Get(echo.HeaderContentType), echo.MIMEMultipartForm) {
+		if err := r.readForm(c, &req, uploads); err != nil {
+			return err
+		}
+	} else if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid release request")
+	}
+
+	if err := validateRequest(&req, uploads); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	r.logger.Info("Received request to create release", zap.String("product", product),
+		zap.String("version", version), zap.Int("files", len(req.Files)))
+
+	// Check the existing blobs before storing anything.
+	existing := make(map[string]*meta.ReleaseFile)
+	for _, f := range req.Files {
+		if f.ID != "" {
+			file, err := r.existingFile(c, f)
+			if err != nil {
+				return err
+			}
+
+			existing[f.Name] = file
+		}
+	}
+
+	for _, f := range req.Files {
+		if file, ok := existing[f.Name]; ok {
+			release.Files = append(release.Files, *file)
+			continue
+		}
+
+		file, err := r.storeUpload(c, release, f.Name, uploads[f.Name])
+		if httpErr := quota.HTTPError(err); httpErr != nil {
+			return httpErr
+		} else if err != nil {
+			r.logger.Error("Failed to store release file", zap.String("product", product),
+				zap.String("version", version), zap.String("name", f.Name), zap.Error(err))
+
+			return echo.NewHTTPError(http.StatusInternalServerError)
+		}
+
+		file.Platform = f.Platform
+		release.Files = append(release.Files, *file)
+	}
+
+	// Sign the generated files before the release becomes visible.
+	for _, name := range []string{ManifestFile, ChecksumsFile} {
+		content, _ := generate(release, name)
+		if err := r.signer.Sign(ctx, signatures.ReleaseSubject(product, version, name),
+			product+"/"+version+"/"+name, bytes.NewReader(content)); err != nil {
+			r.logger.Error("Failed to sign release", zap.String("product", product),
+				zap.String("version", version), zap.String("name", name), zap.Error(err))
+
+			return echo.NewHTTPError(http.StatusInternalServerError)
+		}
+	}
+
+	if err := r.metadata.PutRelease(ctx, release); err != nil {
+		r.logger.Error("Failed to store release", zap.String("product", product),
+			zap.String("version", version), zap.Error(err))
+
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	created = true
+
+	for _, channel := range req.Channels {
+		if err := r.metadata.PutReleaseChannel(ctx, &meta.ReleaseChannel{
+			Product:   product,
+			Channel:   channel,
+			Version:   version,
+			UpdatedAt: release.CreatedAt,
+		}); err != nil {
+			r.logger.Error("Failed to store release channel", zap.String("product", product),
+				zap.String("channel", channel), zap.Error(err))
+
+			return echo.NewHTTPError(http.StatusInternalServerError)
+		}
+	}
+
+	r.logger.Info("Created release", zap.String("product", product),
+		zap.String("version", version), zap.Strings("channels", req.Channels))
+
+	return c.JSON(http.StatusCreated, r.toAPI(c, release))
+}
+
+// readForm streams a multipart release request, spooling each uploaded file
+// to a temporary file. Files are checked against the upload limits as they
+// arrive, so that oversized uploads are rejected early.
+func (r *Releases) readForm(c echo.Context, req *api.ReleaseRequest, uploads map[string]*os.File) error {
+	mr, err := c.Request().MultipartReader()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid multipart form")
+	}
+
+	var names []string
+	for {
+		part, err := mr.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid multipart form")
+		}
+
+		switch part.FormName() {
+		case "release":
+			data, err := io.ReadAll(io.LimitReader(part, maxRequestSize+1))
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, "invalid multipart form")
+			} else if len(data) > maxRequestSize {
+				return echo.NewHTTPError(http.StatusRequestEntityTooLarge, "release request is too large")
+			}
+
+			if err := json.Unmarshal(data, req); err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, "invalid release request")
+			}
+		case "file":
+			name := part.FileName()
+			if _, ok := uploads[name]; ok {
+				return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("duplicate file %q", name))
+			}
+
+			f, err := r.spool(c, part)
+			if httpErr := quota.HTTPError(err); httpErr != nil {
+				return httpErr
+			} else if err != nil {
+				r.logger.Warn("Failed to read release file", zap.String("name", name), zap.Error(err))
+
+				return echo.NewHTTPError(http.StatusBadRequest, "invalid multipart form")
+			}
+
+			uploads[name] = f
+			names = append(names, name)
+		}
+	}
+
+	described := make(map[string]bool)
+	for _, f := range req.Files {
+		described[f.Name] = true
+	}
+
+	// Files that aren't described in the request have no platform.
+	for _, name := range names {
+		if !described[name] {
+			req.Files = append(req.Files, api.ReleaseFileRequest{Name: name})
+		}
+	}
+
+	return nil
+}
+
+// spool copies an uploaded file to a temporary file.
+func (r *Releases) spool(c echo.Context, part io.Reader) (*os.File, error) {
+	limit, err := r.storage.UploadWriter(c.Request().Context(), auth.TokenName(c))
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.CreateTemp("", "release-")
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := io.Copy(io.MultiWriter(f, limit), part); err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// storeUpload stores an uploaded release file as a blob.
+func (r *Releases) storeUpload(c echo.Context, release *meta.Release, name string, f *os.File) (*meta.ReleaseFile, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	blob := &meta.Blob{
+		Name: name,
+		Labels: map[string]string{
+			"release.product": release.Product,
+			"release.version": release.Version,
+		},
+		Owner: auth.TokenName(c),
+	}
+
+	if err := r.storage.StoreReader(c.Request().Context(), f, blob); err != nil {
+		return nil, err
+	}
+
+	return &meta.ReleaseFile{
+		Name:   name,
+		ID:     blob.ID,
+		Size:   blob.Size,
+		SHA256: blob.SHA256,
+	}, nil
+}
+
+// existingFile describes a release file that refers to an existing blob.
+func (r *Releases) existingFile(c echo.Context, f api.ReleaseFileRequest) (*meta.ReleaseFile, error) {
+	id, err := blobid.ParseString(f.ID)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid id for file %q", f.Name))
+	}
+
+	blob, err := r.metadata.GetBlob(c.Request().Context(), id.Bytes())
+	if errors.Is(err, meta.ErrNotFound) {
+		return nil, echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("unknown blob for file %q", f.Name))
+	} else if err != nil {
+		r.logger.Error("Failed to get blob metadata", zap.String("id", f.ID), zap.Error(err))
+
+		return nil, echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	// The checksums file is generated from the recorded digests.
+	if blob.SHA256 == "" {
+		return nil, echo.NewHTTPError(http.StatusBadRequest,
+			fmt.Sprintf("blob for file %q has no recorded sha256 digest", f.Name))
+	}
+
+	return &meta.ReleaseFile{
+		Name:     f.Name,
+		Platform: f.Platform,
+		ID:       f.ID,
+		Size:     blob.Size,
+		SHA256:   blob.SHA256,
+	}, nil
+}
+
+// Get returns the manifest of a release, the version can also be the name of
+// a channel.
+func (r *Releases) Get(c echo.Context) error {
+	release, err := r.resolve(c)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, r.toAPI(c, release))
+}
+
+// GetFile serves a file of a release, one of its generated files, or the
+// signature of either (as <name>.minisig).
+func (r *Releases) GetFile(c echo.Context) error {
+	release, err := r.resolve(c)
+	if err != nil {
+		return err
+	}
+
+	name := c.Param("file")
+	if content, ok := generate(release, name); ok {
+		contentType := echo.MIMETextPlainCharsetUTF8
+		if name == ManifestFile {
+			contentType = echo.MIMEApplicationJSONCharsetUTF8
+		}
+
+		return c.Blob(http.StatusOK, contentType, content)
+	}
+
+	if f := findFile(release, name); f != nil {
+		id, err := blobid.ParseString(f.ID)
+		if err != nil {
+			r.logger.Error("Invalid blob id in release", zap.String("product", release.Product),
+				zap.String("version", release.Version), zap.String("id", f.ID), zap.Error(err))
+
+			return echo.NewHTTPError(http.StatusInternalServerError)
+		}
+
+		return r.storage.Serve(c, id)
+	}
+
+	subject, _, err := signatureSubject(release, name)
+	if err != nil {
+		return err
+	}
+
+	return r.signer.ServeSignature(c, subject)
+}
+
+// PutSignature records an offline signature of a release file, or of one of
+// its generated files (which is verified against the generated content).
+func (r *Releases) PutSignature(c echo.Context) error {
+	ctx := c.Request().Context()
+	product, version := c.Param("product"), c.Param("version")
+
+	if !namePattern.MatchString(product) || !namePattern.MatchString(version) {
+		return echo.NewHTTPError(http.StatusNotFound)
+	}
+
+	// Channels move, so signatures are only accepted for exact versions.
+	release, err := r.metadata.GetRelease(ctx, product, version)
+	if errors.Is(err, meta.ErrNotFound) {
+		return echo.NewHTTPError(http.StatusNotFound, "unknown release")
+	} else if err != nil {
+		r.logger.Error("Failed to get release", zap.String("product", product),
+			zap.String("version", version), zap.Error(err))
+
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	subject, content, err := signatureSubject(release, c.Param("file"))
+	if err != nil {
+		return err
+	}
+
+	if content != nil {
+		return r.signer.AcceptUpload(c, subject, bytes.NewReader(content))
+	}
+
+	// Release files are blobs, the signature is verified against the blob.
+	f := findFile(release, strings.TrimSuffix(c.Param("file"), signatures.Extension))
+
+	id, err := blobid.ParseString(f.ID)
+	if err != nil {
+		r.logger.Error("Invalid blob id in release", zap.String("product", release.Product),
+			zap.String("version", release.Version), zap.String("id", f.ID), zap.Error(err))
+
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	blob, err := r.storage.Open(ctx, id.Bytes())
+	if err != nil {
+		r.logger.Error("Failed to open release file", zap.String("product", release.Product),
+			zap.String("version", release.Version), zap.String("name", f.Name), zap.Error(err))
+
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	defer blob.Close()
+
+	return r.signer.AcceptUpload(c, subject, blob)
+}
+
+// GetChannel returns a release channel.
+func (r *Releases) GetChannel(c echo.Context) error {
+	channel, err := r.metadata.GetReleaseChannel(c.Request().Context(), c.Param("product"), c.Param("channel"))
+	if errors.Is(err, meta.ErrNotFound) {
+		return echo.NewHTTPError(http.StatusNotFound, "unknown channel")
+	} else if err != nil {
+		r.logger.Error("Failed to get release channel", zap.Error(err))
+
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusOK, toAPIChannel(channel))
+}
+
+// PutChannel points a release channel at a release.
+func (r *Releases) PutChannel(c echo.Context) error {
+	ctx := c.Request().Context()
+	product, name := c.Param("product"), c.Param("channel")
+
+	if !namePattern.MatchString(product) {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid product")
+	} else if !namePattern.MatchString(name) {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid channel")
+	}
+
+	var req api.ReleaseChannel
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid request body")
+	}
+
+	if _, err := r.metadata.GetRelease(ctx, product, req.Version); errors.Is(err, meta.ErrNotFound) {
+		return echo.NewHTTPError(http.StatusNotFound, "unknown release")
+	} else if err != nil {
+		r.logger.Error("Failed to get release", zap.Error(err))
+
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	channel := &meta.ReleaseChannel{
+		Product:   product,
+		Channel:   name,
+		Version:   req.Version,
+		UpdatedAt: time.Now().UTC(),
+	}
+
+	if err := r.metadata.PutReleaseChannel(ctx, channel); err != nil {
+		r.logger.Error("Failed to store release channel", zap.Error(err))
+
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	r.logger.Info("Updated release channel", zap.String("product", product),
+		zap.String("channel", name), zap.String("version", req.Version))
+
+	return c.JSON(http.StatusOK, toAPIChannel(channel))
+}
+
+// resolve returns the release named by the request, if there's no release
+// with the requested version it is looked up as a channel instead.
+func (r *Releases) resolve(c echo.Context) (*meta.Release, error) {
+	ctx := c.Request().Context()
+	product, version := c.Param("product"), c.Param("version")
+
+	if !namePattern.MatchString(product) || !namePattern.MatchString(version) {
+		return nil, echo.NewHTTPError(http.StatusNotFound)
+	}
+
+	release, err := r.metadata.GetRelease(ctx, product, version)
+	if errors.Is(err, meta.ErrNotFound) {
+		var channel *meta.ReleaseChannel
+		channel, err = r.metadata.GetReleaseChannel(ctx, product, version)
+		if err == nil {
+			// Channels move, so responses must be revalidated.
+			c.Response().Header().Set(echo.HeaderCacheControl, "no-cache")
+
+			release, err = r.metadata.GetRelease(ctx, product, channel.Version)
+		}
+	}
+	if errors.Is(err, meta.ErrNotFound) {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "unknown release")
+	} else if err != nil {
+		r.logger.Error("Failed to get release", zap.String("product", product),
+			zap.String("version", version), zap.Error(err))
+
+		return nil, echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	return release, nil
+}
+
+func (r *Releases) toAPI(c echo.Context, release *meta.Release) *api.Release {
+	files := make([]api.ReleaseFile, 0, len(release.Files))
+	for _, f := range release.Files {
+		files = append(files, api.ReleaseFile{
+			Name:     f.Name,
+			Platform: f.Platform,
+			ID:       f.ID,
+			URL:      r.storage.BlobURL(c, f.ID, f.Name),
+			Size:     f.Size,
+			SHA256:   f.SHA256,
+		})
+	}
+
+	return &api.Release{
+		Product:   release.Product,
+		Version:   release.Version,
+		Files:     files,
+		CreatedBy: release.CreatedBy,
+		CreatedAt: release.CreatedAt,
+	}
+}
+
+func toAPIChannel(channel *meta.ReleaseChannel) *api.ReleaseChannel {
+	return &api.ReleaseChannel{
+		Product:   channel.Product,
+		Channel:   channel.Channel,
+		Version:   channel.Version,
+		UpdatedAt: channel.UpdatedAt,
+	}
+}
+
+func validateRequest(req *api.ReleaseRequest, uploads map[string]*os.File) error {
+	if len(req.Files) == 0 {
+		return fmt.Errorf("a release requires at least one file")
+	}
+
+	names := make(map[string]bool)
+	for _, f := range req.Files {
+		if !namePattern.MatchString(f.Name) || isReserved(f.Name) {
+			return fmt.Errorf("invalid file name %q", f.Name)
+		} else if names[f.Name] {
+			return fmt.Errorf("duplicate file %q", f.Name)
+		}
+
+		names[f.Name] = true
+
+		_, uploaded := uploads[f.Name]
+		if f.ID == "" && !uploaded {
+			return fmt.Errorf("file %q was not uploaded", f.Name)
+		} else if f.ID != "" && uploaded {
+			return fmt.Errorf("file %q was both uploaded and refers to a blob", f.Name)
+		}
+	}
+
+	for _, channel := range req.Channels {
+		if !namePattern.MatchString(channel) {
+			return fmt.Errorf("invalid channel %q", channel)
+		}
+	}
+
+	return nil
+}
+
+// generate returns the content of a generated release file.
+func generate(release *meta.Release, name string) ([]byte, bool) {
+	switch name {
+	case ChecksumsFile:
+		return []byte(checksums(release)), true
+	case ManifestFile:
+		return manifest(release), true
+	default:
+		return nil, false
+	}
+}
+
+// isReserved returns true if a file name would collide with a generated file,
+// or with the signature of one.
+func isReserved(name string) bool {
+	name = strings.TrimSuffix(name, signatures.Extension)
+
+	return name == ChecksumsFile || name == ManifestFile
+}
+
+func findFile(release *meta.Release, name string) *meta.ReleaseFile {
+	for i := range release.Files {
+		if release.Files[i].Name == name {
+			return &release.Files[i]
+		}
+	}
+
+	return nil
+}
+
+// signatureSubject returns the subject of a release signature file, and for
+// generated files the signed content.
+func signatureSubject(release *meta.Release, name string) (string, []byte, error) {
+	signed, ok := strings.CutSuffix(name, signatures.Extension)
+	if !ok {
+		return "", nil, echo.NewHTTPError(http.StatusNotFound, "unknown file")
+	}
+
+	if content, ok := generate(release, signed); ok {
+		return signatures.ReleaseSubject(release.Product, release.Version, signed), content, nil
+	}
+
+	if f := findFile(release, signed); f != nil {
+		return signatures.BlobSubject(f.ID), nil, nil
+	}
+
+	return "", nil, echo.NewHTTPError(http.StatusNotFound, "unknown file")
+}
+
+// manifest generates the canonical manifest of a release, it is what release
+// signatures are made over.
+func manifest(release *meta.Release) []byte {
+	data, _ := json.MarshalIndent(release, "", "  ")
+
+	return append(data, '\n')
+}
+
+// checksums generates a checksums file in the format of sha256sum.
+func checksums(release *meta.Release) string {
+	files := append([]meta.ReleaseFile(nil), release.Files...)
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name < files[j].Name
+	})
+
+	var sb strings.Builder
+	for _, f := range files {
+		fmt.Fprintf(&sb, "%s  %s\n", f.SHA256, f.Name)
+	}
+
+	return sb.String()
+}
@@ -0,0 +1,289 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package releases_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"aead.dev/minisign"
+	"github.com/gpu-ninja/download-mirror/internal/auth"
+	"github.com/gpu-ninja/download-mirror/internal/cas"
+	"github.com/gpu-ninja/download-mirror/internal/cas/castest"
+	"github.com/gpu-ninja/download-mirror/internal/quota"
+	"github.com/gpu-ninja/download-mirror/internal/releases"
+	"github.com/gpu-ninja/download-mirror/internal/signatures"
+	"github.com/gpu-ninja/download-mirror/pkg/api"
+	"github.com/gpu-ninja/download-mirror/pkg/client"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestReleases(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+
+	fixture := castest.New(t, logger)
+
+	serverPublicKey, serverKey, err := minisign.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	offlinePublicKey, offlineKey, err := minisign.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	metadata := fixture.Metadata
+	signer := signatures.NewSigner(logger, metadata, &serverKey, []minisign.PublicKey{offlinePublicKey})
+	storage := fixture.NewStorage(logger, cas.Options{
+		Signer: signer,
+		Quotas: quota.NewQuotas(logger, metadata, quota.Options{MaxBlobSize: 1000}),
+	})
+
+	tokens, err := auth.ParseTokens("secret")
+	require.NoError(t, err)
+
+	e := echo.New()
+	releases.NewReleases(logger, storage, metadata, signer).Register(e.Group("/releases"), tokens.Middleware())
+
+	srv := httptest.NewServer(e)
+	t.Cleanup(srv.Close)
+
+	get := func(path string) (int, string) {
+		resp, err := http.Get(srv.URL + "/releases/" + path)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+
+		return resp.StatusCode, string(body)
+	}
+
+	ctx := context.Background()
+	c := client.New(srv.URL, client.WithToken("secret"))
+
+	files := map[string]string{
+		"tool-linux-amd64":  "linux binary",
+		"tool-darwin-arm64": "darwin binary",
+	}
+
+	create := func(version string, channels ...string) (*api.Release, error) {
+		req := api.ReleaseRequest{Channels: channels}
+		var uploads []client.ReleaseUpload
+		for _, name := range []string{"tool-linux-amd64", "tool-darwin-arm64"} {
+			req.Files = append(req.Files, api.ReleaseFileRequest{
+				Name:     name,
+				Platform: strings.ReplaceAll(strings.TrimPrefix(name, "tool-"), "-", "/"),
+			})
+			uploads = append(uploads, client.ReleaseUpload{Name: name, Reader: strings.NewReader(files[name] + " " + version)})
+		}
+
+		return c.CreateRelease(ctx, "tool", version, req, uploads)
+	}
+
+	release, err := create("v1.0.0", "stable")
+	require.NoError(t, err)
+
+	require.Len(t, release.Files, 2)
+	assert.Equal(t, "linux/amd64", release.Files[0].Platform)
+
+	t.Run("Immutable", func(t *testing.T) {
+		_, err := create("v1.0.0")
+
+		var apiErr *client.Error
+		require.True(t, errors.As(err, &apiErr))
+		assert.Equal(t, http.StatusConflict, apiErr.StatusCode)
+	})
+
+	t.Run("Atomic", func(t *testing.T) {
+		// The second file refers to a blob that doesn't exist, so the
+		// release must not be created.
+		_, err := c.CreateRelease(ctx, "tool", "v1.0.1", api.ReleaseRequest{
+			Files: []api.ReleaseFileRequest{
+				{Name: "tool-linux-amd64"},
+				{Name: "tool-darwin-arm64", ID: "11111111111111111111111111111111"},
+			},
+		}, []client.ReleaseUpload{{Name: "tool-linux-amd64", Reader: strings.NewReader("linux binary")}})
+		require.Error(t, err)
+
+		status, _ := get("tool/v1.0.1")
+		assert.Equal(t, http.StatusNotFound, status)
+
+		// The failed creation released its reservation.
+		_, err = create("v1.0.1")
+		require.NoError(t, err)
+	})
+
+	t.Run("Concurrent Creates", func(t *testing.T) {
+		const n = 5
+
+		var wg sync.WaitGroup
+		errs := make([]error, n)
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				_, errs[i] = create("v1.0.3")
+			}(i)
+		}
+		wg.Wait()
+
+		var created int
+		for _, err := range errs {
+			if err == nil {
+				created++
+				continue
+			}
+
+			var apiErr *client.Error
+			require.True(t, errors.As(err, &apiErr))
+			assert.Equal(t, http.StatusConflict, apiErr.StatusCode)
+		}
+		assert.Equal(t, 1, created)
+	})
+
+	t.Run("Too Large", func(t *testing.T) {
+		_, err := c.CreateRelease(ctx, "tool", "v1.0.2", api.ReleaseRequest{
+			Files: []api.ReleaseFileRequest{{Name: "tool-linux-amd64"}},
+		}, []client.ReleaseUpload{{Name: "tool-linux-amd64", Reader: bytes.NewReader(make([]byte, 2000))}})
+
+		var apiErr *client.Error
+		require.True(t, errors.As(err, &apiErr))
+		assert.Equal(t, http.StatusRequestEntityTooLarge, apiErr.StatusCode)
+
+		status, _ := get("tool/v1.0.2")
+		assert.Equal(t, http.StatusNotFound, status)
+	})
+
+	t.Run("Existing Blobs", func(t *testing.T) {
+		release, err := c.CreateRelease(ctx, "tool", "v1.0.0-repack", api.ReleaseRequest{
+			Files: []api.ReleaseFileRequest{{Name: "tool", ID: release.Files[0].ID}},
+		}, nil)
+		require.NoError(t, err)
+
+		assert.Equal(t, int64(len("linux binary v1.0.0")), release.Files[0].Size)
+	})
+
+	t.Run("Files", func(t *testing.T) {
+		status, body := get("tool/v1.0.0/tool-darwin-arm64")
+		require.Equal(t, http.StatusOK, status)
+		assert.Equal(t, "darwin binary v1.0.0", body)
+
+		status, _ = get("tool/v1.0.0/tool-windows-amd64.exe")
+		assert.Equal(t, http.StatusNotFound, status)
+	})
+
+	t.Run("Checksums", func(t *testing.T) {
+		status, body := get("tool/v1.0.0/SHA256SUMS")
+		require.Equal(t, http.StatusOK, status)
+
+		var expected strings.Builder
+		for _, name := range []string{"tool-darwin-arm64", "tool-linux-amd64"} {
+			sum := sha256.Sum256([]byte(files[name] + " v1.0.0"))
+			fmt.Fprintf(&expected, "%s  %s\n", hex.EncodeToString(sum[:]), name)
+		}
+
+		assert.Equal(t, expected.String(), body)
+	})
+
+	t.Run("Signatures", func(t *testing.T) {
+		verify := func(key minisign.PublicKey, name string) error {
+			data, err := c.GetReleaseSignature(ctx, "tool", "v1.0.0", name)
+			require.NoError(t, err)
+
+			status, body := get("tool/v1.0.0/" + name)
+			require.Equal(t, http.StatusOK, status)
+
+			_, err = signatures.Verify(key, strings.NewReader(body), data)
+
+			return err
+		}
+
+		// Signed by the server as the release was created.
+		for _, name := range []string{"manifest.json", "SHA256SUMS", "tool-linux-amd64"} {
+			assert.NoError(t, verify(serverPublicKey, name), name)
+		}
+
+		_, manifest := get("tool/v1.0.0/manifest.json")
+		assert.Contains(t, manifest, `"tool-darwin-arm64"`)
+
+		_, checksums := get("tool/v1.0.0/SHA256SUMS")
+
+		sign := func(key minisign.PrivateKey, content string) []byte {
+			data, err := signatures.SignReader(key, strings.NewReader(content), "SHA256SUMS")
+			require.NoError(t, err)
+
+			return data
+		}
+
+		require.NoError(t, c.PutReleaseSignature(ctx, "tool", "v1.0.0", "SHA256SUMS", sign(offlineKey, checksums)))
+		assert.NoError(t, verify(offlinePublicKey, "SHA256SUMS"))
+
+		var apiErr *client.Error
+		err = c.PutReleaseSignature(ctx, "tool", "v1.0.0", "SHA256SUMS", sign(offlineKey, "tampered"))
+		require.True(t, errors.As(err, &apiErr))
+		assert.Equal(t, http.StatusBadRequest, apiErr.StatusCode)
+
+		_, untrustedKey, err := minisign.GenerateKey(rand.Reader)
+		require.NoError(t, err)
+
+		err = c.PutReleaseSignature(ctx, "tool", "v1.0.0", "SHA256SUMS", sign(untrustedKey, checksums))
+		require.True(t, errors.As(err, &apiErr))
+		assert.Equal(t, http.StatusForbidden, apiErr.StatusCode)
+
+		require.NoError(t, c.PutReleaseSignature(ctx, "tool", "v1.0.0", "tool-linux-amd64",
+			sign(offlineKey, "linux binary v1.0.0")))
+		assert.NoError(t, verify(offlinePublicKey, "tool-linux-amd64"))
+
+		err = c.PutReleaseSignature(ctx, "tool", "v1.0.0", "tool-linux-amd64", sign(offlineKey, "tampered"))
+		require.True(t, errors.As(err, &apiErr))
+		assert.Equal(t, http.StatusBadRequest, apiErr.StatusCode)
+	})
+
+	t.Run("Channels", func(t *testing.T) {
+		_, err := create("v1.1.0")
+		require.NoError(t, err)
+
+		_, body := get("tool/stable/tool-linux-amd64")
+		assert.Equal(t, "linux binary v1.0.0", body)
+
+		_, err = c.SetReleaseChannel(ctx, "tool", "stable", "v1.1.0")
+		require.NoError(t, err)
+
+		release, err := c.GetRelease(ctx, "tool", "stable")
+		require.NoError(t, err)
+		assert.Equal(t, "v1.1.0", release.Version)
+
+		_, body = get("tool/stable/tool-linux-amd64")
+		assert.Equal(t, "linux binary v1.1.0", body)
+
+		_, err = c.SetReleaseChannel(ctx, "tool", "stable", "v9.9.9")
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,520 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package scrub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/akamensky/base58"
+	"github.com/gpu-ninja/download-mirror/internal/blobid"
+	"github.com/gpu-ninja/download-mirror/internal/cache"
+	"github.com/gpu-ninja/download-mirror/internal/integrity"
+	"github.com/gpu-ninja/download-mirror/internal/meta"
+	"github.com/gpu-ninja/download-mirror/internal/metrics"
+	"github.com/gpu-ninja/download-mirror/internal/upstream"
+	"github.com/gpu-ninja/download-mirror/pkg/api"
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+)
+
+// ErrRunning is returned when a scrub is already in progress.
+var ErrRunning = errors.New("scrub already running")
+
+// Options configures a scrubber.
+type Options struct {
+	// Interval is how often to scrub the upstream, zero disables scheduled
+	// scrubs.
+	Interval time.Duration
+	// BytesPerSecond limits the rate at which blobs are read, so that
+	// scrubbing doesn't starve live traffic. Zero means unlimited.
+	BytesPerSecond int64
+}
+
+// Scrubber audits every copy of every blob in the upstream replicas,
+// repairing missing or corrupt copies where an intact copy is available.
+type Scrubber struct {
+	logger     *zap.Logger
+	replicas   []upstream.Upstream
+	localCache *cache.Cache
+	metadata   *meta.Store
+	newHash    func() hash.Hash
+	opts       Options
+	limiter    *rate.Limiter
+	ctx        context.Context
+	cancel     context.CancelFunc
+	tasks      sync.WaitGroup
+	mu         sync.Mutex
+	current    *api.ScrubReport
+	last       *api.ScrubReport
+}
+
+func NewScrubber(logger *zap.Logger, replicas []upstream.Upstream, localCache *cache.Cache,
+	metadata *meta.Store, newHash func() hash.Hash, opts Options) *Scrubber {
+	limiter := rate.NewLimiter(rate.Inf, 0)
+	if opts.BytesPerSecond > 0 {
+		limiter = rate.NewLimiter(rate.Limit(opts.BytesPerSecond), int(opts.BytesPerSecond))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	s := &Scrubber{
+		logger:     logger,
+		replicas:   replicas,
+		localCache: localCache,
+		metadata:   metadata,
+		newHash:    newHash,
+		opts:       opts,
+		limiter:    limiter,
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+
+	if opts.Interval > 0 {
+		s.tasks.Add(1)
+		go func() {
+			defer s.tasks.Done()
+
+			ticker := time.NewTicker(opts.Interval)
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					if err := s.Start(); err != nil && !errors.Is(err, ErrRunning) {
+						logger.Error("Failed to start scheduled scrub", zap.Error(err))
+					}
+				}
+			}
+		}()
+	}
+
+	return s
+}
+
+// Close cancels any running scrub and waits for it to stop.
+func (s *Scrubber) Close() error {
+	s.cancel()
+	s.tasks.Wait()
+
+	return nil
+}
+
+// Start starts a scrub in the background.
+func (s *Scrubber) Start() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.current != nil {
+		return ErrRunning
+	}
+
+	if s.ctx.Err() != nil {
+		return s.ctx.Err()
+	}
+
+	s.current = &api.ScrubReport{
+		State:     api.ScrubStateRunning,
+		StartedAt: time.Now().UTC(),
+	}
+
+	s.tasks.Add(1)
+	go func() {
+		defer s.tasks.Done()
+
+		s.run(s.ctx)
+	}()
+
+	return nil
+}
+
+// Status returns a snapshot of the running scrub, or otherwise the most
+// recently completed scrub (if any).
+func (s *Scrubber) Status(ctx context.Context) (*api.ScrubReport, error) {
+	s.mu.Lock()
+	report := s.current
+	if report == nil {
+		report = s.last
+	}
+
+	if report != nil {
+		snapshot := *report
+		snapshot.Problems = append([]api.ScrubProblem(nil), report.Problems...)
+		s.mu.Unlock()
+
+		return &snapshot, nil
+	}
+	s.mu.Unlock()
+
+	// Fall back to the last report written by any mirror node.
+	return s.metadata.LatestScrubReport(ctx)
+}
+
+func (s *Scrubber) run(ctx context.Context) {
+	s.logger.Info("Starting scrub", zap.Int("replicas", len(s.replicas)))
+
+	err := s.scrub(ctx)
+
+	s.mu.Lock()
+	report := s.current
+	now := time.Now().UTC()
+	report.FinishedAt = &now
+
+	switch {
+	case err == nil:
+		report.State = api.ScrubStateCompleted
+	case ctx.Err() != nil:
+		report.State = api.ScrubStateCancelled
+	default:
+		report.State = api.ScrubStateFailed
+		report.Error = err.Error()
+	}
+
+	s.current = nil
+	s.last = report
+	s.mu.Unlock()
+
+	if err != nil && ctx.Err() == nil {
+		s.logger.Error("Scrub failed", zap.Error(err))
+	}
+
+	s.logger.Info("Scrub finished", zap.String("state", report.State),
+		zap.Int("scanned", report.Scanned), zap.Int("missing", report.Missing),
+		zap.Int("corrupt", report.Corrupt), zap.Int("repaired", report.Repaired))
+
+	// Use a fresh context, so that the report of a cancelled scrub is still
+	// written.
+	writeCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if err := s.metadata.PutScrubReport(writeCtx, report); err != nil {
+		s.logger.Error("Failed to write scrub report", zap.Error(err))
+	}
+}
+
+func (s *Scrubber) scrub(ctx context.Context) error {
+	// List the blobs in every replica, so that blobs only present in some
+	// of them are detected as missing in the others.
+	seen := make(map[string]bool)
+	var ids [][]byte
+	for i, ups := range s.replicas {
+		replicaIDs, err := ups.List(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to list blobs on replica %d: %w", i, err)
+		}
+
+		for _, id := range replicaIDs {
+			if !seen[string(id)] {
+				seen[string(id)] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+
+	s.mu.Lock()
+	s.current.Total = len(ids)
+	s.mu.Unlock()
+
+	for _, id := range ids {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		// Re-keyed blobs are only kept under their legacy ids until the
+		// legacy copies are cleaned up, once the legacy key is dropped they
+		// can no longer be verified and mustn't be quarantined as corrupt.
+		if redirected, err := s.redirected(ctx, id); err != nil || redirected {
+			s.mu.Lock()
+			s.current.Scanned++
+			if err != nil {
+				s.current.Errors++
+				s.current.Problems = append(s.current.Problems, api.ScrubProblem{
+					ID: base58.Encode(id), Problem: api.ScrubProblemError, Error: err.Error(),
+				})
+			} else {
+				s.current.Skipped++
+			}
+			s.mu.Unlock()
+
+			continue
+		}
+
+		problems, n := s.scrubBlob(ctx, id)
+
+		s.mu.Lock()
+		s.current.Scanned++
+		s.current.Bytes += n
+		if len(problems) == 0 {
+			s.current.Healthy++
+		}
+
+		for _, problem := range problems {
+			switch problem.Problem {
+			case api.ScrubProblemMissing:
+				s.current.Missing++
+			case api.ScrubProblemCorrupt:
+				s.current.Corrupt++
+			default:
+				s.current.Errors++
+			}
+
+			if problem.Repaired {
+				s.current.Repaired++
+			}
+		}
+
+		s.current.Problems = append(s.current.Problems, problems...)
+		s.mu.Unlock()
+	}
+
+	return nil
+}
+
+// redirected returns whether a blob has been re-keyed, and is addressed by a
+// legacy id.
+func (s *Scrubber) redirected(ctx context.Context, id []byte) (bool, error) {
+	if _, err := s.metadata.GetRedirect(ctx, id); err == nil {
+		return true, nil
+	} else if !errors.Is(err, meta.ErrNotFound) {
+		return false, fmt.Errorf("failed to get redirect: %w", err)
+	}
+
+	return false, nil
+}
+
+// scrubBlob checks every copy of a blob, repairing any that are missing or
+// corrupt. It returns any problems found and the number of bytes read.
+func (s *Scrubber) scrubBlob(ctx context.Context, id []byte) ([]api.ScrubProblem, int64) {
+	encodedID := base58.Encode(id)
+
+	expectedSize := int64(-1)
+	if blob, err := s.metadata.GetBlob(ctx, id); err == nil {
+		expectedSize = blob.Size
+	}
+
+	var problems []api.ScrubProblem
+	var bytesRead int64
+	var source *os.File
+	var sourceName string
+
+	defer func() {
+		if source != nil {
+			_ = source.Close()
+			_ = os.Remove(source.Name())
+		}
+	}()
+
+	for i, ups := range s.replicas {
+		// Keep the first intact copy around, so that it can be used to repair
+		// any other replicas.
+		var f *os.File
+		if source == nil {
+			var err error
+			f, err = os.CreateTemp("", "scrub-")
+			if err != nil {
+				problems = append(problems, api.ScrubProblem{
+					ID: encodedID, Replica: i, Problem: api.ScrubProblemError, Error: err.Error(),
+				})
+				continue
+			}
+		}
+
+		w := io.Discard
+		if f != nil {
+			w = f
+		}
+
+		n, err := s.verify(ctx, ups, id, expectedSize, w)
+		bytesRead += n
+
+		if err == nil {
+			metrics.ScrubbedBlobs.WithLabelValues("healthy").Inc()
+
+			if f != nil {
+				source = f
+				sourceName = fmt.Sprintf("replica %d", i)
+			}
+
+			continue
+		}
+
+		if f != nil {
+			_ = f.Close()
+			_ = os.Remove(f.Name())
+		}
+
+		problem := api.ScrubProblem{ID: encodedID, Replica: i, Problem: api.ScrubProblemError, Error: err.Error()}
+		switch {
+		case errors.Is(err, upstream.ErrNotFound):
+			problem.Problem = api.ScrubProblemMissing
+			problem.Error = ""
+		case errors.Is(err, integrity.ErrCorrupt):
+			problem.Problem = api.ScrubProblemCorrupt
+			problem.Error = ""
+		}
+
+		metrics.ScrubbedBlobs.WithLabelValues(problem.Problem).Inc()
+
+		s.logger.Warn("Found problem with blob", zap.String("id", encodedID),
+			zap.Int("replica", i), zap.String("problem", problem.Problem), zap.Error(err))
+
+		problems = append(problems, problem)
+	}
+
+	if len(problems) == 0 {
+		return nil, bytesRead
+	}
+
+	// Fall back to the local cache as a source of an intact copy.
+	if source == nil {
+		f, err := s.fromCache(id)
+		if err == nil {
+			source = f
+			sourceName = "cache"
+		} else if !errors.Is(err, os.ErrNotExist) {
+			s.logger.Warn("Failed to read blob from local cache",
+				zap.String("id", encodedID), zap.Error(err))
+		}
+	}
+
+	for i := range problems {
+		problem := &problems[i]
+		if problem.Problem == api.ScrubProblemError {
+			continue
+		}
+
+		ups := s.replicas[problem.Replica]
+
+		if problem.Problem == api.ScrubProblemCorrupt {
+			if err := ups.Quarantine(ctx, id); err != nil && !errors.Is(err, upstream.ErrNotFound) {
+				s.logger.Error("Failed to quarantine corrupt blob", zap.String("id", encodedID),
+					zap.Int("replica", problem.Replica), zap.Error(err))
+				continue
+			}
+		}
+
+		if source == nil {
+			continue
+		}
+
+		if _, err := source.Seek(0, io.SeekStart); err != nil {
+			s.logger.Error("Failed to rewind blob", zap.Error(err))
+			continue
+		}
+
+		if err := ups.Put(ctx, id, s.limitReader(ctx, source)); err != nil {
+			s.logger.Error("Failed to repair blob", zap.String("id", encodedID),
+				zap.Int("replica", problem.Replica), zap.Error(err))
+			continue
+		}
+
+		s.logger.Info("Repaired blob", zap.String("id", encodedID),
+			zap.Int("replica", problem.Replica), zap.String("source", sourceName))
+
+		metrics.ScrubRepairs.Inc()
+
+		problem.Repaired = true
+		problem.RepairedFrom = sourceName
+	}
+
+	return problems, bytesRead
+}
+
+// verify reads a copy of a blob, checking it against its id (and expected
+// size if known), writing the content to w.
+func (s *Scrubber) verify(ctx context.Context, ups upstream.Upstream, id []byte, expectedSize int64, w io.Writer) (int64, error) {
+	r, size, err := ups.Get(ctx, id)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	if expectedSize >= 0 && size >= 0 && size != expectedSize {
+		return 0, fmt.Errorf("unexpected size %d, expected %d: %w", size, expectedSize, integrity.ErrCorrupt)
+	}
+
+	return io.Copy(w, integrity.NewReader(s.limitReader(ctx, r), s.newHash(), blobid.Digest(id), expectedSize))
+}
+
+// fromCache copies an intact copy of the blob from the local cache into a
+// temporary file.
+func (s *Scrubber) fromCache(id []byte) (*os.File, error) {
+	digest := blobid.Digest(id)
+
+	r, _, err := s.localCache.Get(digest)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	f, err := os.CreateTemp("", "scrub-")
+	if err != nil {
+		return nil, err
+	}
+
+	h := s.newHash()
+	if _, err := io.Copy(io.MultiWriter(f, h), r); err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return nil, err
+	}
+
+	if !integrity.Matches(h, digest) {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return nil, integrity.ErrCorrupt
+	}
+
+	return f, nil
+}
+
+// limitReader limits the rate at which r can be read.
+func (s *Scrubber) limitReader(ctx context.Context, r io.Reader) io.Reader {
+	if s.limiter.Limit() == rate.Inf {
+		return r
+	}
+
+	return readerFunc(func(p []byte) (int, error) {
+		if burst := s.limiter.Burst(); len(p) > burst {
+			p = p[:burst]
+		}
+
+		n, err := r.Read(p)
+		if n > 0 {
+			if waitErr := s.limiter.WaitN(ctx, n); waitErr != nil {
+				return n, waitErr
+			}
+		}
+
+		return n, err
+	})
+}
+
+type readerFunc func(p []byte) (n int, err error)
+
+func (f readerFunc) Read(p []byte) (n int, err error) {
+	return f(p)
+}
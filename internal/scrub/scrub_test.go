@@ -0,0 +1,156 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package scrub_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/akamensky/base58"
+	"github.com/gpu-ninja/download-mirror/internal/cache"
+	"github.com/gpu-ninja/download-mirror/internal/meta"
+	"github.com/gpu-ninja/download-mirror/internal/scrub"
+	"github.com/gpu-ninja/download-mirror/internal/upstream"
+	"github.com/gpu-ninja/download-mirror/pkg/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestScrubber(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	ctx := context.Background()
+
+	newHash := func() hash.Hash {
+		return sha256.New()
+	}
+
+	primaryDir, replicaDir := t.TempDir(), t.TempDir()
+
+	primary, err := upstream.NewFilesystem(primaryDir)
+	require.NoError(t, err)
+
+	replica, err := upstream.NewFilesystem(replicaDir)
+	require.NoError(t, err)
+
+	localCache, err := cache.New(logger, cache.Options{
+		Dir:      t.TempDir(),
+		NewHash:  newHash,
+		HashSize: sha256.Size,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, localCache.Close())
+	})
+
+	put := func(b byte) ([]byte, []byte) {
+		data := bytes.Repeat([]byte{b}, 1000)
+		sum := sha256.Sum256(data)
+
+		require.NoError(t, primary.Put(ctx, sum[:], bytes.NewReader(data)))
+		require.NoError(t, replica.Put(ctx, sum[:], bytes.NewReader(data)))
+
+		return sum[:], data
+	}
+
+	corrupt := func(dir string, id []byte) {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, base58.Encode(id)), bytes.Repeat([]byte{0xff}, 1000), 0o644))
+	}
+
+	healthyID, _ := put(0)
+
+	missingID, _ := put(1)
+	require.NoError(t, os.Remove(filepath.Join(replicaDir, base58.Encode(missingID))))
+
+	corruptID, _ := put(2)
+	corrupt(primaryDir, corruptID)
+
+	// Corrupt in every replica, but intact in the local cache.
+	cachedID, cachedData := put(3)
+	corrupt(primaryDir, cachedID)
+	corrupt(replicaDir, cachedID)
+
+	_, _, err = localCache.Put(bytes.NewReader(cachedData))
+	require.NoError(t, err)
+
+	metadata := meta.NewStore(primary)
+
+	// A legacy copy of a re-keyed blob, which can't be verified with the
+	// current key.
+	legacyID := bytes.Repeat([]byte{0x42}, sha256.Size)
+	legacyData := bytes.Repeat([]byte{4}, 1000)
+	require.NoError(t, primary.Put(ctx, legacyID, bytes.NewReader(legacyData)))
+	require.NoError(t, metadata.PutRedirect(ctx, &meta.Redirect{
+		ID:     base58.Encode(legacyID),
+		Target: base58.Encode(healthyID),
+	}))
+
+	s := scrub.NewScrubber(logger, []upstream.Upstream{primary, replica}, localCache,
+		metadata, newHash, scrub.Options{BytesPerSecond: 1 << 20})
+	t.Cleanup(func() {
+		require.NoError(t, s.Close())
+	})
+
+	require.NoError(t, s.Start())
+
+	var report *api.ScrubReport
+	require.Eventually(t, func() bool {
+		report, err = s.Status(ctx)
+		return err == nil && report.State != api.ScrubStateRunning
+	}, 10*time.Second, 10*time.Millisecond)
+
+	assert.Equal(t, api.ScrubStateCompleted, report.State)
+	assert.Equal(t, 5, report.Scanned)
+	assert.Equal(t, 1, report.Healthy)
+	assert.Equal(t, 1, report.Skipped)
+	assert.Equal(t, 1, report.Missing)
+	assert.Equal(t, 3, report.Corrupt)
+	assert.Equal(t, 4, report.Repaired)
+
+	// Every copy should now be intact.
+	for _, ups := range []upstream.Upstream{primary, replica} {
+		for _, id := range [][]byte{healthyID, missingID, corruptID, cachedID} {
+			r, _, err := ups.Get(ctx, id)
+			require.NoError(t, err)
+
+			data, err := io.ReadAll(r)
+			require.NoError(t, err)
+			require.NoError(t, r.Close())
+
+			sum := sha256.Sum256(data)
+			assert.Equal(t, id, sum[:])
+		}
+	}
+
+	// The legacy copy should have been left alone.
+	r, _, err := primary.Get(ctx, legacyID)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+
+	// And the report should have been persisted.
+	stored, err := meta.NewStore(primary).LatestScrubReport(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, report.Repaired, stored.Repaired)
+}
@@ -1,6 +1,6 @@
 /* SPDX-License-Identifier: Apache-2.0
  *
- * Copyright 2023 Damian Peckett <damian@peckett>.
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
  *
  * Licensed under the Apache License, Version 2.0 (the "License");
  * you may not use this file except in compliance with the License.
@@ -18,13 +18,160 @@
 package securehash
 
 import (
+	"bytes"
 	"crypto/hmac"
 	"crypto/sha256"
+	"encoding/hex"
 	"hash"
 )
 
 const Size = sha256.Size
 
+// KeyIDSize is the size in bytes of a key id.
+const KeyIDSize = 4
+
 func New(secureHashSecret []byte) hash.Hash {
 	return hmac.New(sha256.New, secureHashSecret)
 }
+
+// Key is a secure hash secret.
+type Key struct {
+	// ID is a short hex encoded identifier for the key, derived from the
+	// secret (without revealing it).
+	ID     string
+	Secret []byte
+}
+
+// NewKey returns the key for a secret.
+func NewKey(secret []byte) Key {
+	return Key{
+		ID:     KeyID(secret),
+		Secret: secret,
+	}
+}
+
+// KeyID derives the short identifier of a secret.
+func KeyID(secret []byte) string {
+	h := New(secret)
+	_, _ = h.Write([]byte("download-mirror key id"))
+
+	return hex.EncodeToString(h.Sum(nil)[:KeyIDSize])
+}
+
+// Keyring is a primary key, used to address new blobs, along with any legacy
+// keys that existing blobs may still be addressed with.
+type Keyring struct {
+	keys []Key
+}
+
+// NewKeyring creates a keyring, duplicate legacy secrets are ignored.
+func NewKeyring(primary []byte, legacy ...[]byte) *Keyring {
+	k := &Keyring{
+		keys: []Key{NewKey(primary)},
+	}
+
+	for _, secret := range legacy {
+		if _, ok := k.Key(KeyID(secret)); !ok {
+			k.keys = append(k.keys, NewKey(secret))
+		}
+	}
+
+	return k
+}
+
+// Primary returns the primary key.
+func (k *Keyring) Primary() Key {
+	return k.keys[0]
+}
+
+// Keys returns every key in the keyring, primary first.
+func (k *Keyring) Keys() []Key {
+	return k.keys
+}
+
+// Key returns the key with the given id.
+func (k *Keyring) Key(id string) (Key, bool) {
+	for _, key := range k.keys {
+		if key.ID == id {
+			return key, true
+		}
+	}
+
+	return Key{}, false
+}
+
+// NewHash returns a hash that addresses content under the primary key. If
+// the keyring has legacy keys, the hash is a *MultiHash so that content
+// addressed under any of the keys can be verified.
+func (k *Keyring) NewHash() hash.Hash {
+	if len(k.keys) == 1 {
+		return New(k.keys[0].Secret)
+	}
+
+	return k.NewMultiHash()
+}
+
+// NewMultiHash returns a hash that computes the hash of content under every
+// key in the keyring at once.
+func (k *Keyring) NewMultiHash() *MultiHash {
+	m := &MultiHash{
+		keys: k.keys,
+	}
+
+	for _, key := range k.keys {
+		m.hashes = append(m.hashes, New(key.Secret))
+	}
+
+	return m
+}
+
+// MultiHash is a hash of content under every key in a keyring. Sum returns
+// the hash under the primary key.
+type MultiHash struct {
+	keys   []Key
+	hashes []hash.Hash
+}
+
+func (m *MultiHash) Write(p []byte) (int, error) {
+	for _, h := range m.hashes {
+		_, _ = h.Write(p)
+	}
+
+	return len(p), nil
+}
+
+func (m *MultiHash) Sum(b []byte) []byte {
+	return m.hashes[0].Sum(b)
+}
+
+func (m *MultiHash) Reset() {
+	for _, h := range m.hashes {
+		h.Reset()
+	}
+}
+
+func (m *MultiHash) Size() int {
+	return Size
+}
+
+func (m *MultiHash) BlockSize() int {
+	return m.hashes[0].BlockSize()
+}
+
+// Match returns the key the content written so far is addressed by id under.
+func (m *MultiHash) Match(id []byte) (Key, bool) {
+	for i, h := range m.hashes {
+		if bytes.Equal(h.Sum(nil), id) {
+			return m.keys[i], true
+		}
+	}
+
+	return Key{}, false
+}
+
+// Matches reports whether the content written so far is addressed by id
+// under any key.
+func (m *MultiHash) Matches(id []byte) bool {
+	_, ok := m.Match(id)
+	return ok
+}
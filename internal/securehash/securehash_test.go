@@ -0,0 +1,58 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package securehash_test
+
+import (
+	"testing"
+
+	"github.com/gpu-ninja/download-mirror/internal/securehash"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyring(t *testing.T) {
+	keyring := securehash.NewKeyring([]byte("new"), []byte("old"), []byte("old"))
+
+	require.Len(t, keyring.Keys(), 2)
+	assert.Equal(t, securehash.KeyID([]byte("new")), keyring.Primary().ID)
+	assert.Len(t, keyring.Primary().ID, 2*securehash.KeyIDSize)
+	assert.NotEqual(t, keyring.Keys()[0].ID, keyring.Keys()[1].ID)
+
+	data := []byte("hello world")
+
+	legacy := securehash.New([]byte("old"))
+	_, _ = legacy.Write(data)
+	legacyID := legacy.Sum(nil)
+
+	primary := securehash.New([]byte("new"))
+	_, _ = primary.Write(data)
+	primaryID := primary.Sum(nil)
+
+	h := keyring.NewMultiHash()
+	_, _ = h.Write(data)
+
+	// Content is addressed under the primary key.
+	assert.Equal(t, primaryID, h.Sum(nil))
+
+	key, ok := h.Match(legacyID)
+	require.True(t, ok)
+	assert.Equal(t, securehash.KeyID([]byte("old")), key.ID)
+
+	assert.True(t, h.Matches(primaryID))
+	assert.False(t, h.Matches(make([]byte, securehash.Size)))
+}
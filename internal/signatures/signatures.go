@@ -0,0 +1,302 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package signatures keeps minisign signatures of blobs and release files.
+// Signatures are either made by the server as content is stored (if it has a
+// signing key), or made offline and uploaded, in which case they must be made
+// by a trusted key.
+package signatures
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"aead.dev/minisign"
+	"github.com/gpu-ninja/download-mirror/internal/auth"
+	"github.com/gpu-ninja/download-mirror/internal/blobid"
+	"github.com/gpu-ninja/download-mirror/internal/meta"
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+// Extension is appended to the URL of a blob or file to get its signature.
+const Extension = ".minisig"
+
+// maxSignatureSize is the largest signature that can be uploaded, minisign
+// signatures are a few hundred bytes (plus comments).
+const maxSignatureSize = 4 << 10
+
+var (
+	// ErrUntrustedKey is returned when an uploaded signature wasn't made by a
+	// trusted key.
+	ErrUntrustedKey = errors.New("signature was not made by a trusted key")
+	// ErrInvalidSignature is returned when an uploaded signature doesn't
+	// verify against the content it's for.
+	ErrInvalidSignature = errors.New("invalid signature")
+	// ErrNotSigned is returned when there is no signature for a subject.
+	ErrNotSigned = errors.New("not signed")
+)
+
+// Signer signs content with the server's key, and keeps signatures.
+type Signer struct {
+	logger   *zap.Logger
+	metadata *meta.Store
+	key      *minisign.PrivateKey
+	trusted  map[uint64]minisign.PublicKey
+}
+
+// NewSigner creates a new signer, the key is optional. Uploaded signatures
+// must be made by one of the trusted keys (or the signer's own key).
+func NewSigner(logger *zap.Logger, metadata *meta.Store, key *minisign.PrivateKey, trusted []minisign.PublicKey) *Signer {
+	s := &Signer{
+		logger:   logger,
+		metadata: metadata,
+		key:      key,
+		trusted:  make(map[uint64]minisign.PublicKey),
+	}
+
+	for _, k := range trusted {
+		s.trusted[k.ID()] = k
+	}
+
+	if key != nil {
+		s.trusted[key.ID()] = key.Public().(minisign.PublicKey)
+	}
+
+	return s
+}
+
+// KeyID formats a minisign key id as minisign displays it.
+func KeyID(id uint64) string {
+	return fmt.Sprintf("%016X", id)
+}
+
+// BlobSubject is the subject of a blob's signature.
+func BlobSubject(encodedID string) string {
+	return path.Join("blobs", encodedID)
+}
+
+// ReleaseSubject is the subject of the signature of a generated release file.
+func ReleaseSubject(product, version, name string) string {
+	return path.Join("releases", product, version, name)
+}
+
+// Sign signs the content of r with the server's key, if it has one. The
+// name is recorded in the trusted comment.
+func (s *Signer) Sign(ctx context.Context, subject, name string, r io.Reader) error {
+	if s.key == nil {
+		return nil
+	}
+
+	data, err := SignReader(*s.key, r, name)
+	if err != nil {
+		return fmt.Errorf("failed to sign: %w", err)
+	}
+
+	return s.put(ctx, subject, s.key.ID(), data)
+}
+
+// SignReader signs the content of r, recording the name in the trusted
+// comment (like minisign does).
+func SignReader(key minisign.PrivateKey, r io.Reader, name string) ([]byte, error) {
+	reader := minisign.NewReader(r)
+	if _, err := io.Copy(io.Discard, reader); err != nil {
+		return nil, err
+	}
+
+	return reader.SignWithComments(key,
+		fmt.Sprintf("timestamp:%d\tfile:%s", time.Now().Unix(), name),
+		"signature from minisign secret key "+KeyID(key.ID())), nil
+}
+
+// Verify checks that data is a signature made by key over the content of r,
+// and returns the parsed signature.
+func Verify(key minisign.PublicKey, r io.Reader, data []byte) (*minisign.Signature, error) {
+	var sig minisign.Signature
+	if err := sig.UnmarshalText(data); err != nil {
+		return nil, err
+	}
+
+	if sig.KeyID != key.ID() {
+		return nil, fmt.Errorf("signature was made by key %s, not %s", KeyID(sig.KeyID), KeyID(key.ID()))
+	}
+
+	reader := minisign.NewReader(r)
+	if _, err := io.Copy(io.Discard, reader); err != nil {
+		return nil, err
+	}
+
+	if !reader.Verify(key, data) {
+		return nil, ErrInvalidSignature
+	}
+
+	return &sig, nil
+}
+
+// SignBlob signs the content of a newly stored blob.
+func (s *Signer) SignBlob(ctx context.Context, r io.Reader, blob *meta.Blob) error {
+	return s.Sign(ctx, BlobSubject(blob.ID), blob.Name, r)
+}
+
+// Get returns the signature file of a subject.
+func (s *Signer) Get(ctx context.Context, subject string) ([]byte, error) {
+	sig, err := s.metadata.GetSignature(ctx, subject)
+	if errors.Is(err, meta.ErrNotFound) {
+		return nil, ErrNotSigned
+	} else if err != nil {
+		return nil, err
+	}
+
+	return []byte(sig.Signature), nil
+}
+
+// Accept records an uploaded signature of content, it must be made by a
+// trusted key.
+func (s *Signer) Accept(ctx context.Context, subject string, data []byte, content io.Reader) error {
+	var parsed minisign.Signature
+	if err := parsed.UnmarshalText(data); err != nil {
+		return err
+	}
+
+	key, ok := s.trusted[parsed.KeyID]
+	if !ok {
+		return ErrUntrustedKey
+	}
+
+	sig, err := Verify(key, content, data)
+	if err != nil {
+		return err
+	}
+
+	// Store the signature as parsed, rather than whatever was uploaded.
+	data, err = sig.MarshalText()
+	if err != nil {
+		return err
+	}
+
+	return s.put(ctx, subject, sig.KeyID, data)
+}
+
+func (s *Signer) put(ctx context.Context, subject string, keyID uint64, data []byte) error {
+	return s.metadata.PutSignature(ctx, &meta.Signature{
+		Subject:   subject,
+		KeyID:     KeyID(keyID),
+		Signature: string(data),
+		CreatedAt: time.Now().UTC(),
+	})
+}
+
+// GetBlobSignature serves the signature of a blob, at /blobs/<id>.minisig.
+func (s *Signer) GetBlobSignature(c echo.Context) error {
+	encodedID, ok := strings.CutSuffix(c.Param("file"), Extension)
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound)
+	}
+
+	if _, err := blobid.ParseString(encodedID); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid id")
+	}
+
+	return s.ServeSignature(c, BlobSubject(encodedID))
+}
+
+// Blobs opens the content of blobs, so that uploaded signatures can be
+// verified against it.
+type Blobs interface {
+	Open(ctx context.Context, id []byte) (io.ReadCloser, error)
+}
+
+// PutBlobSignature returns a handler that records an uploaded signature of a
+// blob, after verifying it against the content of the blob.
+func (s *Signer) PutBlobSignature(blobs Blobs) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		encodedID, ok := strings.CutSuffix(c.Param("file"), Extension)
+		if !ok {
+			return echo.NewHTTPError(http.StatusNotFound)
+		}
+
+		id, err := blobid.ParseString(encodedID)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid id")
+		}
+
+		if _, err := s.metadata.GetBlob(ctx, id.Bytes()); errors.Is(err, meta.ErrNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound, "unknown blob")
+		} else if err != nil {
+			s.logger.Error("Failed to get blob metadata", zap.String("id", encodedID), zap.Error(err))
+
+			return echo.NewHTTPError(http.StatusInternalServerError)
+		}
+
+		content, err := blobs.Open(ctx, id.Bytes())
+		if err != nil {
+			s.logger.Error("Failed to open blob", zap.String("id", encodedID), zap.Error(err))
+
+			return echo.NewHTTPError(http.StatusInternalServerError)
+		}
+		defer content.Close()
+
+		return s.AcceptUpload(c, BlobSubject(encodedID), content)
+	}
+}
+
+// ServeSignature serves the signature file of a subject.
+func (s *Signer) ServeSignature(c echo.Context, subject string) error {
+	data, err := s.Get(c.Request().Context(), subject)
+	if errors.Is(err, ErrNotSigned) {
+		return echo.NewHTTPError(http.StatusNotFound, "not signed")
+	} else if err != nil {
+		s.logger.Error("Failed to get signature", zap.String("subject", subject), zap.Error(err))
+
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	return c.Blob(http.StatusOK, echo.MIMETextPlainCharsetUTF8, data)
+}
+
+// AcceptUpload records a signature uploaded in the request body (see Accept).
+func (s *Signer) AcceptUpload(c echo.Context, subject string, content io.Reader) error {
+	data, err := io.ReadAll(io.LimitReader(c.Request().Body, maxSignatureSize+1))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to read signature")
+	} else if len(data) > maxSignatureSize {
+		return echo.NewHTTPError(http.StatusRequestEntityTooLarge, "signature is too large")
+	}
+
+	if err := s.Accept(c.Request().Context(), subject, data, content); err != nil {
+		if errors.Is(err, ErrUntrustedKey) {
+			return echo.NewHTTPError(http.StatusForbidden, err.Error())
+		}
+
+		s.logger.Warn("Rejected signature", zap.String("subject", subject), zap.Error(err))
+
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid signature: %v", err))
+	}
+
+	s.logger.Info("Recorded signature", zap.String("subject", subject),
+		zap.String("tokenName", auth.TokenName(c)))
+
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,171 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package signatures_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"aead.dev/minisign"
+	"github.com/gpu-ninja/download-mirror/internal/blobid"
+	"github.com/gpu-ninja/download-mirror/internal/meta"
+	"github.com/gpu-ninja/download-mirror/internal/signatures"
+	"github.com/gpu-ninja/download-mirror/internal/upstream"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestSignatures(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	ctx := context.Background()
+
+	ups, err := upstream.NewFilesystem(t.TempDir())
+	require.NoError(t, err)
+
+	metadata := meta.NewStore(ups)
+
+	serverPublicKey, serverKey, err := minisign.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	offlinePublicKey, offlineKey, err := minisign.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	signer := signatures.NewSigner(logger, metadata, &serverKey, []minisign.PublicKey{offlinePublicKey})
+
+	content := []byte("hello world")
+
+	sign := func(t *testing.T, key minisign.PrivateKey, content []byte) []byte {
+		data, err := signatures.SignReader(key, bytes.NewReader(content), "hello.txt")
+		require.NoError(t, err)
+
+		return data
+	}
+
+	t.Run("Sign", func(t *testing.T) {
+		err := signer.Sign(ctx, "test/sign", "hello.txt", bytes.NewReader(content))
+		require.NoError(t, err)
+
+		data, err := signer.Get(ctx, "test/sign")
+		require.NoError(t, err)
+
+		sig, err := signatures.Verify(serverPublicKey, bytes.NewReader(content), data)
+		require.NoError(t, err)
+
+		assert.Contains(t, sig.TrustedComment, "file:hello.txt")
+	})
+
+	t.Run("Accept", func(t *testing.T) {
+		err := signer.Accept(ctx, "test/accept", sign(t, offlineKey, content), bytes.NewReader(content))
+		require.NoError(t, err)
+
+		_, err = signer.Get(ctx, "test/accept")
+		require.NoError(t, err)
+	})
+
+	t.Run("Different Content", func(t *testing.T) {
+		err := signer.Accept(ctx, "test/different", sign(t, offlineKey, []byte("something else")), bytes.NewReader(content))
+		assert.ErrorIs(t, err, signatures.ErrInvalidSignature)
+
+		_, err = signer.Get(ctx, "test/different")
+		assert.ErrorIs(t, err, signatures.ErrNotSigned)
+	})
+
+	t.Run("Untrusted Key", func(t *testing.T) {
+		_, untrustedKey, err := minisign.GenerateKey(rand.Reader)
+		require.NoError(t, err)
+
+		err = signer.Accept(ctx, "test/untrusted", sign(t, untrustedKey, content), bytes.NewReader(content))
+		assert.ErrorIs(t, err, signatures.ErrUntrustedKey)
+	})
+
+	t.Run("Blob Signature", func(t *testing.T) {
+		digest := sha256.Sum256(content)
+		encodedID := blobid.New(blobid.HMACSHA256, "", digest[:]).String()
+
+		require.NoError(t, metadata.PutBlob(ctx, &meta.Blob{
+			ID:        encodedID,
+			Name:      "hello.txt",
+			Size:      int64(len(content)),
+			CreatedAt: time.Now(),
+		}))
+
+		blobs := blobContents{encodedID: content}
+
+		e := echo.New()
+		e.GET("/blobs/:file", signer.GetBlobSignature)
+		e.PUT("/blobs/:file", signer.PutBlobSignature(blobs))
+
+		upload := func(t *testing.T, sig []byte) int {
+			req := httptest.NewRequest(http.MethodPut, "/blobs/"+encodedID+signatures.Extension, bytes.NewReader(sig))
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+
+			return rec.Code
+		}
+
+		t.Run("Different Content", func(t *testing.T) {
+			assert.Equal(t, http.StatusBadRequest, upload(t, sign(t, offlineKey, []byte("something else"))))
+		})
+
+		t.Run("Upload", func(t *testing.T) {
+			assert.Equal(t, http.StatusNoContent, upload(t, sign(t, offlineKey, content)))
+
+			req := httptest.NewRequest(http.MethodGet, "/blobs/"+encodedID+signatures.Extension, nil)
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+
+			require.Equal(t, http.StatusOK, rec.Code)
+
+			_, err := signatures.Verify(offlinePublicKey, bytes.NewReader(content), rec.Body.Bytes())
+			require.NoError(t, err)
+		})
+
+		t.Run("Unknown Blob", func(t *testing.T) {
+			digest := sha256.Sum256([]byte("unknown"))
+			unknownID := blobid.New(blobid.HMACSHA256, "", digest[:]).String()
+
+			req := httptest.NewRequest(http.MethodPut, "/blobs/"+unknownID+signatures.Extension,
+				bytes.NewReader(sign(t, offlineKey, content)))
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+
+			assert.Equal(t, http.StatusNotFound, rec.Code)
+		})
+	})
+}
+
+type blobContents map[string][]byte
+
+func (b blobContents) Open(_ context.Context, id []byte) (io.ReadCloser, error) {
+	parsed, err := blobid.Parse(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return io.NopCloser(strings.NewReader(string(b[parsed.String()]))), nil
+}
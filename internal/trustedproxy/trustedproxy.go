@@ -0,0 +1,191 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package trustedproxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// forwardedHeaders are only honoured when the request was received from a
+// trusted proxy.
+var forwardedHeaders = []string{
+	echo.HeaderXForwardedFor,
+	echo.HeaderXForwardedProto,
+	echo.HeaderXForwardedProtocol,
+	echo.HeaderXForwardedSsl,
+	echo.HeaderXUrlScheme,
+	echo.HeaderXRealIP,
+	"Forwarded",
+}
+
+// UnixSocket is the entry that trusts peers connected over a unix socket (eg.
+// a reverse proxy on the same host), whose addresses aren't IPs.
+const UnixSocket = "unix"
+
+// Proxies is a set of trusted reverse proxies.
+type Proxies struct {
+	networks []*net.IPNet
+	// unix is whether peers connected over a unix socket are trusted.
+	unix bool
+}
+
+// Parse parses a list of CIDRs (or bare IP addresses, or UnixSocket) into a
+// set of trusted proxies.
+func Parse(cidrs []string) (Proxies, error) {
+	var proxies Proxies
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+
+		if cidr == UnixSocket {
+			proxies.unix = true
+			continue
+		}
+
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return Proxies{}, fmt.Errorf("invalid trusted proxy address: %q", cidr)
+			}
+
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				bits = 8 * net.IPv4len
+			}
+
+			cidr = fmt.Sprintf("%s/%d", cidr, bits)
+		}
+
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return Proxies{}, fmt.Errorf("invalid trusted proxy CIDR: %w", err)
+		}
+
+		proxies.networks = append(proxies.networks, ipNet)
+	}
+
+	return proxies, nil
+}
+
+// Trusted returns true if the request was received directly from a trusted
+// proxy.
+func (p Proxies) Trusted(r *http.Request) bool {
+	if p.unix && fromUnixSocket(r) {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	return p.contains(ip)
+}
+
+func (p Proxies) contains(ip net.IP) bool {
+	for _, ipNet := range p.networks {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IPExtractor returns an echo IP extractor that honours X-Forwarded-For only
+// for hops added by trusted proxies.
+func (p Proxies) IPExtractor() echo.IPExtractor {
+	if len(p.networks) == 0 && !p.unix {
+		return echo.ExtractIPDirect()
+	}
+
+	opts := []echo.TrustOption{
+		echo.TrustLoopback(false),
+		echo.TrustLinkLocal(false),
+		echo.TrustPrivateNet(false),
+	}
+	for _, ipNet := range p.networks {
+		opts = append(opts, echo.TrustIPRange(ipNet))
+	}
+
+	extractXFF := echo.ExtractIPFromXFFHeader(opts...)
+
+	return func(r *http.Request) string {
+		if !p.unix || !fromUnixSocket(r) {
+			return extractXFF(r)
+		}
+
+		// The peer isn't an IP, so start from the hop it added, and walk back
+		// through any other trusted proxies.
+		var hops []string
+		for _, value := range r.Header.Values(echo.HeaderXForwardedFor) {
+			for _, hop := range strings.Split(value, ",") {
+				hops = append(hops, strings.TrimSpace(hop))
+			}
+		}
+
+		for i := len(hops) - 1; i >= 0; i-- {
+			ip := net.ParseIP(hops[i])
+			if ip == nil {
+				break
+			}
+
+			if i == 0 || !p.contains(ip) {
+				return ip.String()
+			}
+		}
+
+		return r.RemoteAddr
+	}
+}
+
+// fromUnixSocket returns true if the request was received over a unix socket.
+func fromUnixSocket(r *http.Request) bool {
+	addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+
+	return ok && (addr.Network() == "unix" || addr.Network() == "unixpacket")
+}
+
+// Middleware stripsforwarding headers from requests that were not received
+// from a trusted proxy, so that they can't be used to spoof the scheme or
+// client address.
+func (p Proxies) Middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if !p.Trusted(c.Request()) {
+				for _, h := range forwardedHeaders {
+					c.Request().Header.Del(h)
+				}
+			}
+
+			return next(c)
+		}
+	}
+}
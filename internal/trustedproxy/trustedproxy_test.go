@@ -0,0 +1,135 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package trustedproxy_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/gpu-ninja/download-mirror/internal/trustedproxy"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrustedProxies(t *testing.T) {
+	proxies, err := trustedproxy.Parse([]string{"10.0.0.0/8", "192.168.1.1"})
+	require.NoError(t, err)
+
+	e := echo.New()
+	e.IPExtractor = proxies.IPExtractor()
+	e.Pre(proxies.Middleware())
+
+	var realIP, scheme string
+	e.GET("/", func(c echo.Context) error {
+		realIP = c.RealIP()
+		scheme = c.Scheme()
+
+		return c.NoContent(http.StatusOK)
+	})
+
+	t.Run("Trusted", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "10.1.2.3:1234"
+		req.Header.Set(echo.HeaderXForwardedFor, "203.0.113.7")
+		req.Header.Set(echo.HeaderXForwardedProto, "https")
+
+		e.ServeHTTP(httptest.NewRecorder(), req)
+
+		assert.Equal(t, "203.0.113.7", realIP)
+		assert.Equal(t, "https", scheme)
+	})
+
+	t.Run("Untrusted", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "198.51.100.1:1234"
+		req.Header.Set(echo.HeaderXForwardedFor, "203.0.113.7")
+		req.Header.Set(echo.HeaderXForwardedProto, "https")
+
+		e.ServeHTTP(httptest.NewRecorder(), req)
+
+		assert.Equal(t, "198.51.100.1", realIP)
+		assert.Equal(t, "http", scheme)
+	})
+
+	_, err = trustedproxy.Parse([]string{"not-an-ip"})
+	assert.Error(t, err)
+}
+
+func TestTrustedUnixSocketProxies(t *testing.T) {
+	serve := func(t *testing.T, cidrs ...string) *http.Client {
+		proxies, err := trustedproxy.Parse(cidrs)
+		require.NoError(t, err)
+
+		e := echo.New()
+		e.IPExtractor = proxies.IPExtractor()
+		e.Pre(proxies.Middleware())
+		e.GET("/", func(c echo.Context) error {
+			return c.String(http.StatusOK, c.RealIP()+" "+c.Scheme())
+		})
+
+		path := filepath.Join(t.TempDir(), "proxy.sock")
+		lis, err := net.Listen("unix", path)
+		require.NoError(t, err)
+
+		srv := &http.Server{Handler: e}
+		go func() {
+			_ = srv.Serve(lis)
+		}()
+		t.Cleanup(func() {
+			_ = srv.Close()
+		})
+
+		return &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return (&net.Dialer{}).DialContext(ctx, "unix", path)
+				},
+			},
+		}
+	}
+
+	get := func(t *testing.T, client *http.Client) string {
+		req, err := http.NewRequest(http.MethodGet, "http://proxy/", nil)
+		require.NoError(t, err)
+		req.Header.Set(echo.HeaderXForwardedFor, "203.0.113.7, 10.1.2.3")
+		req.Header.Set(echo.HeaderXForwardedProto, "https")
+
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+
+		return string(body)
+	}
+
+	t.Run("Trusted", func(t *testing.T) {
+		assert.Equal(t, "203.0.113.7 https", get(t, serve(t, trustedproxy.UnixSocket, "10.0.0.0/8")))
+	})
+
+	t.Run("Untrusted", func(t *testing.T) {
+		assert.NotContains(t, get(t, serve(t, "10.0.0.0/8")), "https")
+	})
+}
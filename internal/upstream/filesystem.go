@@ -0,0 +1,258 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package upstream
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Filesystem is an upstream backed by a local directory, it's mostly useful
+// for development and testing.
+type Filesystem struct {
+	dir string
+	// Serializes conditional writes, the directory is assumed to only be
+	// used by this process.
+	mu sync.Mutex
+}
+
+func NewFilesystem(dir string) (*Filesystem, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	return &Filesystem{
+		dir: filepath.Clean(dir),
+	}, nil
+}
+
+func (fs *Filesystem) Get(_ context.Context, id []byte) (io.ReadCloser, int64, error) {
+	f, err := os.Open(filepath.Join(fs.dir, blobName(id)))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, 0, ErrNotFound
+		}
+
+		return nil, 0, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, 0, err
+	}
+
+	return f, fi.Size(), nil
+}
+
+func (fs *Filesystem) Put(_ context.Context, id []byte, r io.Reader) error {
+	return fs.write(blobName(id), r)
+}
+
+func (fs *Filesystem) List(_ context.Context) ([][]byte, error) {
+	entries, err := os.ReadDir(fs.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids [][]byte
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		if id, ok := decodeBlobName(entry.Name()); ok {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids, nil
+}
+
+func (fs *Filesystem) Quarantine(_ context.Context, id []byte) error {
+	name := blobName(id)
+
+	if err := os.MkdirAll(filepath.Join(fs.dir, QuarantineDir), 0o755); err != nil {
+		return err
+	}
+
+	if err := os.Rename(filepath.Join(fs.dir, name), filepath.Join(fs.dir, QuarantineDir, name)); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return ErrNotFound
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+func (fs *Filesystem) Check(_ context.Context) error {
+	_, err := os.Stat(fs.dir)
+	return err
+}
+
+func (fs *Filesystem) GetObject(_ context.Context, name string) (io.ReadCloser, error) {
+	path, err := fs.path(name)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, ErrNotFound
+		}
+
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (fs *Filesystem) PutObject(_ context.Context, name string, r io.Reader) error {
+	return fs.write(name, r)
+}
+
+func (fs *Filesystem) GetObjectVersion(_ context.Context, name string) (io.ReadCloser, string, error) {
+	data, err := fs.readObject(name)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return io.NopCloser(bytes.NewReader(data)), objectVersion(data), nil
+}
+
+func (fs *Filesystem) PutObjectIfVersion(_ context.Context, name string, r io.Reader, version string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	data, err := fs.readObject(name)
+	if errors.Is(err, ErrNotFound) {
+		if version != "" {
+			return ErrConflict
+		}
+	} else if err != nil {
+		return err
+	} else if objectVersion(data) != version {
+		return ErrConflict
+	}
+
+	return fs.write(name, r)
+}
+
+func (fs *Filesystem) readObject(name string) ([]byte, error) {
+	path, err := fs.path(name)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, ErrNotFound
+		}
+
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// objectVersion is the version of an object, the digest of its content.
+func objectVersion(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func (fs *Filesystem) ListObjects(_ context.Context, dir string) ([]string, error) {
+	path, err := fs.path(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
+		names = append(names, entry.Name())
+	}
+
+	return names, nil
+}
+
+// write atomically writes a file.
+func (fs *Filesystem) write(name string, r io.Reader) error {
+	path, err := fs.path(name)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}()
+
+	if _, err := io.Copy(f, r); err != nil {
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// path resolves an object name, ensuring it can't escape the directory.
+func (fs *Filesystem) path(name string) (string, error) {
+	path := filepath.Join(fs.dir, filepath.FromSlash(name))
+	if path != fs.dir && !strings.HasPrefix(path, fs.dir+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid object name: %q", name)
+	}
+
+	return path, nil
+}
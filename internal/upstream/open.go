@@ -0,0 +1,47 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package upstream
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// Open creates an upstream from a URI, supported forms are:
+//
+//	file:///path/to/dir                    Local directory.
+//	https://[user[:password]@]host/path    WebDAV server.
+func Open(uri string) (Upstream, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream URI: %w", err)
+	}
+
+	switch u.Scheme {
+	case "file":
+		return NewFilesystem(u.Path)
+	case "http", "https":
+		user := u.User.Username()
+		password, _ := u.User.Password()
+		u.User = nil
+
+		return NewWebDAV(u.String(), user, password)
+	default:
+		return nil, fmt.Errorf("unsupported upstream scheme: %q", u.Scheme)
+	}
+}
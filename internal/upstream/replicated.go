@@ -0,0 +1,276 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package upstream
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+
+	"github.com/akamensky/base58"
+	"github.com/gpu-ninja/download-mirror/internal/blobid"
+	"github.com/gpu-ninja/download-mirror/internal/integrity"
+	"go.uber.org/zap"
+)
+
+// Replicated is an upstream that writes blobs to a primary upstream and any
+// number of replicas. Reads are served from the first replica that has the
+// blob, and are verified against the blob id while streaming. Corrupt copies
+// are quarantined, so that subsequent reads fall through to the next replica.
+type Replicated struct {
+	logger   *zap.Logger
+	newHash  func() hash.Hash
+	replicas []Upstream
+}
+
+// NewReplicated creates a replicated upstream, the first upstream is the
+// primary.
+func NewReplicated(logger *zap.Logger, newHash func() hash.Hash, primary Upstream, replicas ...Upstream) *Replicated {
+	return &Replicated{
+		logger:   logger,
+		newHash:  newHash,
+		replicas: append([]Upstream{primary}, replicas...),
+	}
+}
+
+// Replicas returns the primary upstream followed by the replicas.
+func (r *Replicated) Replicas() []Upstream {
+	return r.replicas
+}
+
+func (r *Replicated) Get(ctx context.Context, id []byte) (io.ReadCloser, int64, error) {
+	lastErr := error(ErrNotFound)
+	for i, ups := range r.replicas {
+		rc, size, err := ups.Get(ctx, id)
+		if err != nil {
+			if !errors.Is(err, ErrNotFound) {
+				r.logger.Warn("Failed to get blob from replica",
+					zap.Int("replica", i), zap.String("id", base58.Encode(id)), zap.Error(err))
+
+				lastErr = err
+			}
+
+			continue
+		}
+
+		return &verifiedReadCloser{
+			Reader: integrity.NewReader(rc, r.newHash(), blobid.Digest(id), size),
+			rc:     rc,
+			onCorrupt: func() {
+				r.logger.Warn("Quarantining corrupt blob",
+					zap.Int("replica", i), zap.String("id", base58.Encode(id)))
+
+				if err := ups.Quarantine(context.Background(), id); err != nil && !errors.Is(err, ErrNotFound) {
+					r.logger.Error("Failed to quarantine corrupt blob",
+						zap.Int("replica", i), zap.String("id", base58.Encode(id)), zap.Error(err))
+				}
+			},
+		}, size, nil
+	}
+
+	return nil, 0, lastErr
+}
+
+func (r *Replicated) Put(ctx context.Context, id []byte, body io.Reader) error {
+	seeker, ok := body.(io.ReadSeeker)
+	if !ok && len(r.replicas) > 1 {
+		f, err := os.CreateTemp("", "blob-")
+		if err != nil {
+			return fmt.Errorf("failed to create temporary blob file: %w", err)
+		}
+		defer func() {
+			_ = f.Close()
+			_ = os.Remove(f.Name())
+		}()
+
+		if _, err := io.Copy(f, body); err != nil {
+			return fmt.Errorf("failed to buffer blob: %w", err)
+		}
+
+		seeker = f
+	}
+
+	return r.forEach(func(i int, ups Upstream) error {
+		if seeker != nil {
+			if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+
+			// Hide any Close method, as some upstreams close the body after
+			// writing it.
+			return ups.Put(ctx, id, struct{ io.Reader }{seeker})
+		}
+
+		return ups.Put(ctx, id, body)
+	})
+}
+
+// List returns the ids of the blobs stored in any of the replicas.
+func (r *Replicated) List(ctx context.Context) ([][]byte, error) {
+	seen := make(map[string]bool)
+
+	var ids [][]byte
+	for i, ups := range r.replicas {
+		replicaIDs, err := ups.List(ctx)
+		if err != nil {
+			if i == 0 {
+				return nil, err
+			}
+
+			r.logger.Warn("Failed to list blobs on replica", zap.Int("replica", i), zap.Error(err))
+			continue
+		}
+
+		for _, id := range replicaIDs {
+			if !seen[string(id)] {
+				seen[string(id)] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+
+	return ids, nil
+}
+
+func (r *Replicated) Quarantine(ctx context.Context, id []byte) error {
+	var errs []error
+	for _, ups := range r.replicas {
+		if err := ups.Quarantine(ctx, id); err != nil && !errors.Is(err, ErrNotFound) {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Check checks the primary upstream, as it is required for writes.
+func (r *Replicated) Check(ctx context.Context) error {
+	return r.replicas[0].Check(ctx)
+}
+
+func (r *Replicated) GetObject(ctx context.Context, name string) (io.ReadCloser, error) {
+	lastErr := error(ErrNotFound)
+	for i, ups := range r.replicas {
+		rc, err := ups.GetObject(ctx, name)
+		if err != nil {
+			if !errors.Is(err, ErrNotFound) {
+				r.logger.Warn("Failed to get object from replica",
+					zap.Int("replica", i), zap.String("name", name), zap.Error(err))
+
+				lastErr = err
+			}
+
+			continue
+		}
+
+		return rc, nil
+	}
+
+	return nil, lastErr
+}
+
+func (r *Replicated) PutObject(ctx context.Context, name string, body io.Reader) error {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+
+	return r.forEach(func(_ int, ups Upstream) error {
+		return ups.PutObject(ctx, name, bytes.NewReader(data))
+	})
+}
+
+// GetObjectVersion reads an object from the primary, as only the primary
+// takes part in conditional writes.
+func (r *Replicated) GetObjectVersion(ctx context.Context, name string) (io.ReadCloser, string, error) {
+	return r.replicas[0].GetObjectVersion(ctx, name)
+}
+
+// PutObjectIfVersion writes an object conditionally to the primary, and then
+// unconditionally to the replicas.
+func (r *Replicated) PutObjectIfVersion(ctx context.Context, name string, body io.Reader, version string) error {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+
+	return r.forEach(func(i int, ups Upstream) error {
+		if i == 0 {
+			return ups.PutObjectIfVersion(ctx, name, bytes.NewReader(data), version)
+		}
+
+		return ups.PutObject(ctx, name, bytes.NewReader(data))
+	})
+}
+
+func (r *Replicated) ListObjects(ctx context.Context, dir string) ([]string, error) {
+	var err error
+	for i, ups := range r.replicas {
+		var names []string
+		names, err = ups.ListObjects(ctx, dir)
+		if err == nil {
+			return names, nil
+		}
+
+		r.logger.Warn("Failed to list objects on replica",
+			zap.Int("replica", i), zap.String("dir", dir), zap.Error(err))
+	}
+
+	return nil, err
+}
+
+// forEach performs a write against every replica. Writes must succeed on the
+// primary, failed writes to the other replicas are logged (and can later be
+// repaired by a scrub).
+func (r *Replicated) forEach(fn func(i int, ups Upstream) error) error {
+	for i, ups := range r.replicas {
+		if err := fn(i, ups); err != nil {
+			if i == 0 {
+				return err
+			}
+
+			r.logger.Warn("Failed to write to replica", zap.Int("replica", i), zap.Error(err))
+		}
+	}
+
+	return nil
+}
+
+type verifiedReadCloser struct {
+	io.Reader
+	rc        io.Closer
+	onCorrupt func()
+}
+
+func (v *verifiedReadCloser) Read(p []byte) (int, error) {
+	n, err := v.Reader.Read(p)
+	if errors.Is(err, integrity.ErrCorrupt) && v.onCorrupt != nil {
+		v.onCorrupt()
+		v.onCorrupt = nil
+	}
+
+	return n, err
+}
+
+func (v *verifiedReadCloser) Close() error {
+	return v.rc.Close()
+}
@@ -0,0 +1,84 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package upstream_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/akamensky/base58"
+	"github.com/gpu-ninja/download-mirror/internal/integrity"
+	"github.com/gpu-ninja/download-mirror/internal/upstream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestReplicated(t *testing.T) {
+	ctx := context.Background()
+
+	primaryDir := t.TempDir()
+	primary, err := upstream.NewFilesystem(primaryDir)
+	require.NoError(t, err)
+
+	replica, err := upstream.NewFilesystem(t.TempDir())
+	require.NoError(t, err)
+
+	ups := upstream.NewReplicated(zaptest.NewLogger(t), func() hash.Hash {
+		return sha256.New()
+	}, primary, replica)
+
+	data := bytes.Repeat([]byte("hello world "), 1000)
+	sum := sha256.Sum256(data)
+	id := sum[:]
+
+	require.NoError(t, ups.Put(ctx, id, bytes.NewReader(data)))
+
+	// Corrupt the primary copy.
+	corrupt := bytes.Clone(data)
+	corrupt[0] ^= 0xff
+	require.NoError(t, os.WriteFile(filepath.Join(primaryDir, base58.Encode(id)), corrupt, 0o644))
+
+	r, _, err := ups.Get(ctx, id)
+	require.NoError(t, err)
+
+	_, err = io.ReadAll(r)
+	require.ErrorIs(t, err, integrity.ErrCorrupt)
+	require.NoError(t, r.Close())
+
+	// The corrupt copy should have been quarantined.
+	_, err = os.Stat(filepath.Join(primaryDir, upstream.QuarantineDir, base58.Encode(id)))
+	require.NoError(t, err)
+
+	// And subsequent reads served by the replica.
+	r, _, err = ups.Get(ctx, id)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, r.Close())
+	})
+
+	got, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+}
@@ -18,11 +18,19 @@
 package upstream
 
 import (
+	"context"
 	"errors"
 	"io"
 	"os"
+	"strings"
+
+	"github.com/akamensky/base58"
+	"github.com/gpu-ninja/download-mirror/internal/blobid"
 )
 
+// QuarantineDir is the directory corrupt blobs are moved to.
+const QuarantineDir = "quarantine"
+
 // ErrNotFound is returned when a file is not found.
 var ErrNotFound = &os.PathError{
 	Op:   "Get",
@@ -30,8 +38,62 @@ var ErrNotFound = &os.PathError{
 	Err:  errors.New("not found"),
 }
 
+// ErrConflict is returned by a conditional write when the object has been
+// changed (or created) since it was read.
+var ErrConflict = errors.New("object was modified concurrently")
+
+// ErrUnversioned is returned by GetObjectVersion and PutObjectIfVersion when
+// the upstream doesn't support conditional writes.
+var ErrUnversioned = errors.New("upstream doesn't support conditional writes")
+
+// decodeBlobName decodes the id of a blob from its object name, skipping
+// temporary and other non blob objects.
+func decodeBlobName(name string) ([]byte, bool) {
+	if strings.HasPrefix(name, ".") {
+		return nil, false
+	}
+
+	id, err := blobid.ParseName(name)
+	if err != nil {
+		return nil, false
+	}
+
+	return id.Bytes(), true
+}
+
+// blobName returns the object name of a blob, legacy and versioned blobs are
+// named differently so that they can be stored side by side.
+func blobName(id []byte) string {
+	parsed, err := blobid.Parse(id)
+	if err != nil {
+		return base58.Encode(id)
+	}
+
+	return parsed.Name()
+}
+
 // Upstream is an interface for upstream storage providers.
 type Upstream interface {
-	Get(id []byte) (io.ReadCloser, int64, error)
-	Put(id []byte, r io.Reader) error
+	Get(ctx context.Context, id []byte) (io.ReadCloser, int64, error)
+	Put(ctx context.Context, id []byte, r io.Reader) error
+	// List returns the ids of all of the blobs stored in the upstream.
+	List(ctx context.Context) ([][]byte, error)
+	// Quarantine moves a (corrupt) blob out of the way, into QuarantineDir.
+	Quarantine(ctx context.Context, id []byte) error
+	// Check performs a cheap health check against the upstream.
+	Check(ctx context.Context) error
+	// GetObject retrieves a named metadata object (eg. "meta/blobs/<id>.json").
+	GetObject(ctx context.Context, name string) (io.ReadCloser, error)
+	// PutObject stores a named metadata object, replacing any existing object.
+	PutObject(ctx context.Context, name string, r io.Reader) error
+	// GetObjectVersion is like GetObject, but also returns an opaque version
+	// of the object (eg. its ETag) for use with PutObjectIfVersion.
+	GetObjectVersion(ctx context.Context, name string) (io.ReadCloser, string, error)
+	// PutObjectIfVersion stores a named metadata object only if it is still
+	// at the given version, or doesn't exist if the version is empty.
+	// ErrConflict is returned otherwise, and ErrUnversioned if the upstream doesn't
+	// support conditional writes.
+	PutObjectIfVersion(ctx context.Context, name string, r io.Reader, version string) error
+	// ListObjects returns the names of the objects directly within dir.
+	ListObjects(ctx context.Context, dir string) ([]string, error)
 }
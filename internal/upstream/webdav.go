@@ -18,15 +18,35 @@
 package upstream
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
 
-	"github.com/akamensky/base58"
+	"github.com/gpu-ninja/download-mirror/internal/tracing"
 	"github.com/studio-b12/gowebdav"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+var tracer = tracing.Tracer("upstream")
+
 type WebDAV struct {
 	client *gowebdav.Client
+	// Conditional requests are made directly, as the WebDAV client doesn't
+	// support per-request headers.
+	httpClient *http.Client
+	uri        string
+	user       string
+	password   string
+	// conditional is whether the server supports conditional writes.
+	conditional bool
 }
 
 func NewWebDAV(uri, user, password string) (*WebDAV, error) {
@@ -35,33 +55,361 @@ func NewWebDAV(uri, user, password string) (*WebDAV, error) {
 		return nil, fmt.Errorf("failed to connect: %w", err)
 	}
 
-	return &WebDAV{
-		client: c,
-	}, nil
-}
+	w := &WebDAV{
+		client:     c,
+		httpClient: &http.Client{},
+		uri:        strings.TrimSuffix(uri, "/"),
+		user:       user,
+		password:   password,
+	}
 
-func (w *WebDAV) Get(id []byte) (io.ReadCloser, int64, error) {
-	fi, err := w.client.Stat(base58.Encode(id))
+	conditional, err := w.probeConditionalWrites(context.Background())
 	if err != nil {
-		if gowebdav.IsErrNotFound(err) {
-			return nil, 0, ErrNotFound
+		return nil, fmt.Errorf("failed to probe for conditional write support: %w", err)
+	}
+	w.conditional = conditional
+
+	return w, nil
+}
+
+// probeConditionalWrites checks whether the server returns ETags and honours
+// If-None-Match, by creating a temporary object twice.
+func (w *WebDAV) probeConditionalWrites(ctx context.Context) (bool, error) {
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return false, err
+	}
+
+	name := ".conditional-probe-" + hex.EncodeToString(suffix)
+	defer func() {
+		_ = w.client.Remove(name)
+	}()
+
+	put := func() (int, error) {
+		resp, err := w.do(ctx, http.MethodPut, name, http.Header{"If-None-Match": []string{"*"}}, strings.NewReader("probe"))
+		if err != nil {
+			return 0, err
 		}
+		_ = resp.Body.Close()
+
+		return resp.StatusCode, nil
+	}
+
+	if status, err := put(); err != nil {
+		return false, err
+	} else if status < 200 || status > 299 {
+		return false, nil
+	}
+
+	// The object now exists, so the second write must be rejected.
+	if status, err := put(); err != nil {
+		return false, err
+	} else if status != http.StatusPreconditionFailed {
+		return false, nil
+	}
 
+	resp, err := w.do(ctx, http.MethodHead, name, nil, nil)
+	if err != nil {
+		return false, err
+	}
+	_ = resp.Body.Close()
+
+	return resp.Header.Get("ETag") != "", nil
+}
+
+func (w *WebDAV) Get(ctx context.Context, id []byte) (io.ReadCloser, int64, error) {
+	name := blobName(id)
+
+	fi, err := w.stat(ctx, name)
+	if err != nil {
 		return nil, 0, err
 	}
 
-	r, err := w.client.ReadStream(base58.Encode(id))
+	_, span := tracer.Start(ctx, "webdav.ReadStream", trace.WithAttributes(attribute.String("blob.id", name)))
+	defer span.End()
+
+	r, err := w.client.ReadStream(name)
 	if err != nil {
 		if gowebdav.IsErrNotFound(err) {
 			return nil, 0, ErrNotFound
 		}
 
+		tracing.RecordError(span, err)
 		return nil, 0, err
 	}
 
 	return r, fi.Size(), nil
 }
 
-func (w *WebDAV) Put(id []byte, r io.Reader) error {
-	return w.client.WriteStream(base58.Encode(id), r, 0o644)
+func (w *WebDAV) Put(ctx context.Context, id []byte, r io.Reader) error {
+	name := blobName(id)
+
+	_, span := tracer.Start(ctx, "webdav.WriteStream", trace.WithAttributes(attribute.String("blob.id", name)))
+	defer span.End()
+
+	if err := w.client.WriteStream(name, r, 0o644); err != nil {
+		tracing.RecordError(span, err)
+		return err
+	}
+
+	return nil
+}
+
+func (w *WebDAV) List(ctx context.Context) ([][]byte, error) {
+	_, span := tracer.Start(ctx, "webdav.List")
+	defer span.End()
+
+	infos, err := w.client.ReadDir("/")
+	if err != nil {
+		tracing.RecordError(span, err)
+		return nil, err
+	}
+
+	var ids [][]byte
+	for _, fi := range infos {
+		if fi.IsDir() {
+			continue
+		}
+
+		if id, ok := decodeBlobName(fi.Name()); ok {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids, nil
+}
+
+func (w *WebDAV) Quarantine(ctx context.Context, id []byte) error {
+	name := blobName(id)
+
+	_, span := tracer.Start(ctx, "webdav.Quarantine", trace.WithAttributes(attribute.String("blob.id", name)))
+	defer span.End()
+
+	if err := w.client.MkdirAll(QuarantineDir, 0o755); err != nil {
+		tracing.RecordError(span, err)
+		return err
+	}
+
+	if err := w.client.Rename(name, path.Join(QuarantineDir, name), true); err != nil {
+		if gowebdav.IsErrNotFound(err) {
+			return ErrNotFound
+		}
+
+		tracing.RecordError(span, err)
+		return err
+	}
+
+	return nil
+}
+
+func (w *WebDAV) stat(ctx context.Context, name string) (os.FileInfo, error) {
+	_, span := tracer.Start(ctx, "webdav.Stat", trace.WithAttributes(attribute.String("blob.id", name)))
+	defer span.End()
+
+	fi, err := w.client.Stat(name)
+	if err != nil {
+		if gowebdav.IsErrNotFound(err) {
+			return nil, ErrNotFound
+		}
+
+		tracing.RecordError(span, err)
+		return nil, err
+	}
+
+	return fi, nil
+}
+
+func (w *WebDAV) Check(ctx context.Context) error {
+	_, span := tracer.Start(ctx, "webdav.Check")
+	defer span.End()
+
+	// The WebDAV client doesn't take a context, so the request is made
+	// directly, so that it's cancelled with ctx.
+	resp, err := w.do(ctx, "PROPFIND", "/", http.Header{"Depth": []string{"0"}}, nil)
+	if err != nil {
+		tracing.RecordError(span, err)
+		return err
+	}
+	defer resp.Body.Close()
+
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode != http.StatusMultiStatus && resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("unexpected status: %s", resp.Status)
+		tracing.RecordError(span, err)
+		return err
+	}
+
+	return nil
+}
+
+func (w *WebDAV) GetObject(ctx context.Context, name string) (io.ReadCloser, error) {
+	_, span := tracer.Start(ctx, "webdav.GetObject", trace.WithAttributes(attribute.String("object.name", name)))
+	defer span.End()
+
+	r, err := w.client.ReadStream(name)
+	if err != nil {
+		if gowebdav.IsErrNotFound(err) {
+			return nil, ErrNotFound
+		}
+
+		tracing.RecordError(span, err)
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (w *WebDAV) PutObject(ctx context.Context, name string, r io.Reader) error {
+	_, span := tracer.Start(ctx, "webdav.PutObject", trace.WithAttributes(attribute.String("object.name", name)))
+	defer span.End()
+
+	// Write to a temporary object first, so that readers never see a partial
+	// object. The name is unique so that concurrent writers (possibly on other
+	// nodes) don't write over each other's temporary objects.
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		tracing.RecordError(span, err)
+		return err
+	}
+
+	tmpName := path.Join(path.Dir(name), "."+path.Base(name)+"-"+hex.EncodeToString(suffix)+".tmp")
+	if err := w.client.WriteStream(tmpName, r, 0o644); err != nil {
+		_ = w.client.Remove(tmpName)
+
+		tracing.RecordError(span, err)
+		return err
+	}
+
+	if err := w.client.Rename(tmpName, name, true); err != nil {
+		_ = w.client.Remove(tmpName)
+
+		tracing.RecordError(span, err)
+		return err
+	}
+
+	return nil
+}
+
+func (w *WebDAV) GetObjectVersion(ctx context.Context, name string) (io.ReadCloser, string, error) {
+	if !w.conditional {
+		return nil, "", ErrUnversioned
+	}
+
+	ctx, span := tracer.Start(ctx, "webdav.GetObjectVersion", trace.WithAttributes(attribute.String("object.name", name)))
+	defer span.End()
+
+	resp, err := w.do(ctx, http.MethodGet, name, nil, nil)
+	if err != nil {
+		tracing.RecordError(span, err)
+		return nil, "", err
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		_ = resp.Body.Close()
+		return nil, "", ErrNotFound
+	case resp.StatusCode != http.StatusOK:
+		_ = resp.Body.Close()
+
+		err := fmt.Errorf("unexpected status reading %q: %s", name, resp.Status)
+		tracing.RecordError(span, err)
+		return nil, "", err
+	}
+
+	version := resp.Header.Get("ETag")
+	if version == "" {
+		_ = resp.Body.Close()
+
+		err := fmt.Errorf("no ETag returned for %q", name)
+		tracing.RecordError(span, err)
+		return nil, "", err
+	}
+
+	return resp.Body, version, nil
+}
+
+func (w *WebDAV) PutObjectIfVersion(ctx context.Context, name string, r io.Reader, version string) error {
+	if !w.conditional {
+		return ErrUnversioned
+	}
+
+	ctx, span := tracer.Start(ctx, "webdav.PutObjectIfVersion", trace.WithAttributes(attribute.String("object.name", name)))
+	defer span.End()
+
+	header := http.Header{}
+	if version != "" {
+		header.Set("If-Match", version)
+	} else {
+		header.Set("If-None-Match", "*")
+
+		if err := w.client.MkdirAll(path.Dir(name), 0o755); err != nil {
+			tracing.RecordError(span, err)
+			return err
+		}
+	}
+
+	resp, err := w.do(ctx, http.MethodPut, name, header, r)
+	if err != nil {
+		tracing.RecordError(span, err)
+		return err
+	}
+	_ = resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusPreconditionFailed:
+		return ErrConflict
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		err := fmt.Errorf("unexpected status writing %q: %s", name, resp.Status)
+		tracing.RecordError(span, err)
+		return err
+	}
+
+	return nil
+}
+
+// do makes a request for an object directly.
+func (w *WebDAV) do(ctx context.Context, method, name string, header http.Header, body io.Reader) (*http.Response, error) {
+	u := w.uri + (&url.URL{Path: path.Join("/", name)}).EscapedPath()
+
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	if w.user != "" {
+		req.SetBasicAuth(w.user, w.password)
+	}
+
+	return w.httpClient.Do(req)
+}
+
+func (w *WebDAV) ListObjects(ctx context.Context, dir string) ([]string, error) {
+	_, span := tracer.Start(ctx, "webdav.ListObjects", trace.WithAttributes(attribute.String("object.dir", dir)))
+	defer span.End()
+
+	infos, err := w.client.ReadDir(dir)
+	if err != nil {
+		if gowebdav.IsErrNotFound(err) {
+			return nil, nil
+		}
+
+		tracing.RecordError(span, err)
+		return nil, err
+	}
+
+	var names []string
+	for _, fi := range infos {
+		if fi.IsDir() || strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+
+		names = append(names, fi.Name())
+	}
+
+	return names, nil
 }
@@ -0,0 +1,256 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package api contains the types exchanged with the download mirror's HTTP
+// API.
+package api
+
+import "time"
+
+// CacheEntry describes a blob in the local cache.
+type CacheEntry struct {
+	ID         string    `json:"id"`
+	Size       int64     `json:"size"`
+	LastAccess time.Time `json:"lastAccess"`
+	Pinned     bool      `json:"pinned"`
+	Priority   int       `json:"priority"`
+	Hits       int64     `json:"hits"`
+}
+
+// CachePriority sets the eviction priority of a cached blob, lower priority
+// blobs are evicted first.
+type CachePriority struct {
+	Priority int `json:"priority"`
+}
+
+// CacheUsage describes the current usage of the local cache.
+type CacheUsage struct {
+	SizeBytes   int64 `json:"sizeBytes"`
+	MaxBytes    int64 `json:"maxBytes"`
+	Entries     int   `json:"entries"`
+	PinnedBytes int64 `json:"pinnedBytes"`
+	Pinned      int   `json:"pinned"`
+	// Memory is the usage of the in-memory hot tier, if enabled.
+	Memory *MemoryCacheUsage `json:"memory,omitempty"`
+}
+
+// MemoryCacheUsage describes the current usage of the in-memory hot tier.
+type MemoryCacheUsage struct {
+	SizeBytes int64 `json:"sizeBytes"`
+	MaxBytes  int64 `json:"maxBytes"`
+	Entries   int   `json:"entries"`
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"`
+}
+
+// TrimResult describes the outcome of trimming the local cache.
+type TrimResult struct {
+	Evicted      int   `json:"evicted"`
+	EvictedBytes int64 `json:"evictedBytes"`
+	SizeBytes    int64 `json:"sizeBytes"`
+}
+
+// PrefetchRequest is a request to pull blobs into the local cache ahead of
+// time, either by id or by label selector (eg. "release=v1.2.0,os=linux").
+type PrefetchRequest struct {
+	IDs      []string `json:"ids,omitempty"`
+	Selector string   `json:"selector,omitempty"`
+}
+
+// PrefetchFailure describes a blob that could not be prefetched.
+type PrefetchFailure struct {
+	ID    string `json:"id"`
+	Error string `json:"error"`
+}
+
+// PrefetchJob describes the progress of a prefetch job.
+type PrefetchJob struct {
+	ID         string            `json:"id"`
+	State      string            `json:"state"`
+	Total      int               `json:"total"`
+	Fetched    int               `json:"fetched"`
+	Cached     int               `json:"cached"`
+	Failed     int               `json:"failed"`
+	Bytes      int64             `json:"bytes"`
+	Failures   []PrefetchFailure `json:"failures,omitempty"`
+	StartedAt  time.Time         `json:"startedAt"`
+	FinishedAt *time.Time        `json:"finishedAt,omitempty"`
+}
+
+// Prefetch job states.
+const (
+	PrefetchStateRunning   = "running"
+	PrefetchStateCompleted = "completed"
+	PrefetchStateCancelled = "cancelled"
+)
+
+// Scrub problem types.
+const (
+	ScrubProblemMissing = "missing"
+	ScrubProblemCorrupt = "corrupt"
+	ScrubProblemError   = "error"
+)
+
+// ScrubProblem describes a missing or corrupt copy of a blob found by a scrub.
+type ScrubProblem struct {
+	ID string `json:"id"`
+	// Replica is the index of the upstream replica, zero is the primary.
+	Replica  int    `json:"replica"`
+	Problem  string `json:"problem"`
+	Error    string `json:"error,omitempty"`
+	Repaired bool   `json:"repaired"`
+	// RepairedFrom is the source of the repair (eg. "replica 1" or "cache").
+	RepairedFrom string `json:"repairedFrom,omitempty"`
+}
+
+// ScrubReport describes the outcome of a scrub of the upstream store.
+type ScrubReport struct {
+	State      string         `json:"state"`
+	Scanned    int            `json:"scanned"`
+	Total      int            `json:"total"`
+	Bytes      int64          `json:"bytes"`
+	Healthy    int            `json:"healthy"`
+	Skipped    int            `json:"skipped"`
+	Missing    int            `json:"missing"`
+	Corrupt    int            `json:"corrupt"`
+	Errors     int            `json:"errors"`
+	Repaired   int            `json:"repaired"`
+	Problems   []ScrubProblem `json:"problems,omitempty"`
+	Error      string         `json:"error,omitempty"`
+	StartedAt  time.Time      `json:"startedAt"`
+	FinishedAt *time.Time     `json:"finishedAt,omitempty"`
+}
+
+// Scrub states.
+const (
+	ScrubStateRunning   = "running"
+	ScrubStateCompleted = "completed"
+	ScrubStateCancelled = "cancelled"
+	ScrubStateFailed    = "failed"
+)
+
+// GoModuleInfo describes a version of a Go module, as returned by the
+// module proxy protocol's .info and @latest endpoints (hence the field
+// names).
+type GoModuleInfo struct {
+	Version string    `json:"Version"`
+	Time    time.Time `json:"Time"`
+}
+
+// Blob describes a stored blob.
+type Blob struct {
+	ID   string `json:"id"`
+	Name string `json:"name,omitempty"`
+	// URL is the immutable URL of the blob.
+	URL       string            `json:"url"`
+	Size      int64             `json:"size"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	SHA256    string            `json:"sha256,omitempty"`
+	SHA512    string            `json:"sha512,omitempty"`
+	CreatedAt time.Time         `json:"createdAt"`
+}
+
+// Quota is the storage used by a token, and its limits. Zero limits are
+// unlimited.
+type Quota struct {
+	Token    string `json:"token"`
+	Bytes    int64  `json:"bytes"`
+	Blobs    int64  `json:"blobs"`
+	MaxBytes int64  `json:"maxBytes,omitempty"`
+	MaxBlobs int64  `json:"maxBlobs,omitempty"`
+	// MaxBlobSize is the largest blob that can be uploaded.
+	MaxBlobSize int64 `json:"maxBlobSize,omitempty"`
+}
+
+// Alias is a mutable name that points at an immutable blob.
+type Alias struct {
+	Path string `json:"path"`
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// URL is the immutable URL of the blob the alias points at.
+	URL       string          `json:"url"`
+	Revision  int             `json:"revision"`
+	UpdatedAt time.Time       `json:"updatedAt"`
+	History   []AliasRevision `json:"history,omitempty"`
+}
+
+// AliasRevision is a past (or the current) target of an alias.
+type AliasRevision struct {
+	Revision   int       `json:"revision"`
+	ID         string    `json:"id"`
+	Name       string    `json:"name"`
+	UpdatedBy  string    `json:"updatedBy,omitempty"`
+	RollbackOf int       `json:"rollbackOf,omitempty"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+// AliasUpdate points an alias at a blob, or when Revision is set rolls it
+// back to the target of an earlier revision.
+type AliasUpdate struct {
+	ID string `json:"id,omitempty"`
+	// Name is the filename to serve the blob under, defaults to the name
+	// the blob was uploaded with.
+	Name     string `json:"name,omitempty"`
+	Revision int    `json:"revision,omitempty"`
+}
+
+// Release is the manifest of a release, a set of blobs (eg. one per
+// platform, plus checksums and signatures).
+type Release struct {
+	Product   string        `json:"product"`
+	Version   string        `json:"version"`
+	Files     []ReleaseFile `json:"files"`
+	CreatedBy string        `json:"createdBy,omitempty"`
+	CreatedAt time.Time     `json:"createdAt"`
+}
+
+// ReleaseFile is a file in a release.
+type ReleaseFile struct {
+	Name     string `json:"name"`
+	Platform string `json:"platform,omitempty"`
+	ID       string `json:"id"`
+	// URL is the immutable URL of the blob.
+	URL    string `json:"url"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// ReleaseRequest creates a release. Files are either uploaded alongside the
+// request (as multipart "file" parts named after the file), or refer to
+// existing blobs by id.
+type ReleaseRequest struct {
+	Files []ReleaseFileRequest `json:"files"`
+	// Channels are moved to the release once it has been created.
+	Channels []string `json:"channels,omitempty"`
+}
+
+// ReleaseFileRequest describes a file of a release being created.
+type ReleaseFileRequest struct {
+	Name     string `json:"name"`
+	Platform string `json:"platform,omitempty"`
+	// ID refers to an existing blob, rather than an uploaded file.
+	ID string `json:"id,omitempty"`
+}
+
+// ReleaseChannel points a channel of a product (eg. stable) at a release.
+type ReleaseChannel struct {
+	Product   string    `json:"product"`
+	Channel   string    `json:"channel"`
+	Version   string    `json:"version"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
@@ -0,0 +1,78 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/gpu-ninja/download-mirror/pkg/api"
+)
+
+// GetAlias returns an alias and its history.
+func (c *Client) GetAlias(ctx context.Context, path string) (*api.Alias, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, aliasPath(path), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var alias api.Alias
+	if err := c.do(req, &alias); err != nil {
+		return nil, err
+	}
+
+	return &alias, nil
+}
+
+// SetAlias points an alias at a blob. If name is empty, the blob is served
+// under the name it was uploaded with.
+func (c *Client) SetAlias(ctx context.Context, path, id, name string) (*api.Alias, error) {
+	return c.updateAlias(ctx, path, api.AliasUpdate{ID: id, Name: name})
+}
+
+// RollbackAlias points an alias back at the target of an earlier revision.
+func (c *Client) RollbackAlias(ctx context.Context, path string, revision int) (*api.Alias, error) {
+	return c.updateAlias(ctx, path, api.AliasUpdate{Revision: revision})
+}
+
+func (c *Client) updateAlias(ctx context.Context, path string, update api.AliasUpdate) (*api.Alias, error) {
+	body, err := json.Marshal(update)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := c.newRequest(ctx, http.MethodPut, aliasPath(path), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	var alias api.Alias
+	if err := c.do(req, &alias); err != nil {
+		return nil, err
+	}
+
+	return &alias, nil
+}
+
+func aliasPath(path string) string {
+	return "/aliases" + escapePath(strings.Split(strings.Trim(path, "/"), "/")...)
+}
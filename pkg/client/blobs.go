@@ -0,0 +1,171 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"context"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"sync"
+
+	"github.com/gpu-ninja/download-mirror/pkg/api"
+)
+
+// ProgressFunc is called as a transfer makes progress, with the number of
+// bytes transferred so far and the total (or -1 if it isn't known).
+type ProgressFunc func(transferred, total int64)
+
+// UploadOptions configures a blob upload.
+type UploadOptions struct {
+	// Labels are attached to the blob, so that it can be selected later.
+	Labels map[string]string
+	// Size is the size of the content, if known, for progress reporting.
+	Size int64
+	// Progress, if set, is called as the content is uploaded.
+	Progress ProgressFunc
+}
+
+// UploadBlob uploads the content of r as a blob with the given name.
+func (c *Client) UploadBlob(ctx context.Context, name string, r io.Reader, opts UploadOptions) (*api.Blob, error) {
+	if opts.Progress != nil {
+		total := opts.Size
+		if total <= 0 {
+			total = -1
+		}
+
+		r = &progressReader{r: r, progress: newProgress(opts.Progress, 0, total)}
+	}
+
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+
+	// Stream the form, so that large files aren't buffered in memory.
+	go func() {
+		pw.CloseWithError(func() error {
+			for key, value := range opts.Labels {
+				if err := mw.WriteField("label", key+"="+value); err != nil {
+					return err
+				}
+			}
+
+			w, err := mw.CreateFormFile("file", name)
+			if err != nil {
+				return err
+			}
+
+			if _, err := io.Copy(w, r); err != nil {
+				return err
+			}
+
+			return mw.Close()
+		}())
+	}()
+
+	req, err := c.newRequest(ctx, http.MethodPost, "/blob", pr)
+	if err != nil {
+		_ = pr.Close()
+		return nil, err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("Accept", "application/json")
+
+	var blob api.Blob
+	if err := c.do(req, &blob); err != nil {
+		_ = pr.Close()
+		return nil, err
+	}
+
+	return &blob, nil
+}
+
+// StatBlob returns the metadata of a blob.
+func (c *Client) StatBlob(ctx context.Context, id string) (*api.Blob, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, "/blob"+escapePath(id), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var blob api.Blob
+	if err := c.do(req, &blob); err != nil {
+		return nil, err
+	}
+
+	return &blob, nil
+}
+
+// OpenBlob returns the content of a blob.
+func (c *Client) OpenBlob(ctx context.Context, id string) (io.ReadCloser, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, blobPath(id, ""), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.open(req)
+}
+
+func blobPath(id, name string) string {
+	// The name only matters to browsers.
+	if name == "" {
+		name = "blob"
+	}
+
+	return "/blobs" + escapePath(id, name)
+}
+
+// progress tracks the bytes transferred by (possibly concurrent) readers and
+// writers.
+type progress struct {
+	mu          sync.Mutex
+	fn          ProgressFunc
+	transferred int64
+	total       int64
+}
+
+func newProgress(fn ProgressFunc, transferred, total int64) *progress {
+	p := &progress{fn: fn, transferred: transferred, total: total}
+	if fn != nil {
+		fn(transferred, total)
+	}
+
+	return p
+}
+
+func (p *progress) add(n int64) {
+	if p == nil || p.fn == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.transferred += n
+	p.fn(p.transferred, p.total)
+}
+
+type progressReader struct {
+	r        io.Reader
+	progress *progress
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.progress.add(int64(n))
+
+	return n, err
+}
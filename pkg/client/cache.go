@@ -0,0 +1,204 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/gpu-ninja/download-mirror/pkg/api"
+)
+
+// ListCache lists the entries in the mirror's local cache.
+func (c *Client) ListCache(ctx context.Context) ([]api.CacheEntry, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, "/admin/cache", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []api.CacheEntry
+	if err := c.do(req, &entries); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// CacheUsage returns the current usage of the mirror's local cache.
+func (c *Client) CacheUsage(ctx context.Context) (*api.CacheUsage, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, "/admin/cache/usage", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var usage api.CacheUsage
+	if err := c.do(req, &usage); err != nil {
+		return nil, err
+	}
+
+	return &usage, nil
+}
+
+// TrimCache triggers an immediate trim of the mirror's local cache.
+func (c *Client) TrimCache(ctx context.Context) (*api.TrimResult, error) {
+	req, err := c.newRequest(ctx, http.MethodPost, "/admin/cache/trim", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var result api.TrimResult
+	if err := c.do(req, &result); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// EvictCacheEntry removes a blob from the mirror's local cache.
+func (c *Client) EvictCacheEntry(ctx context.Context, id string) error {
+	req, err := c.newRequest(ctx, http.MethodDelete, "/admin/cache"+escapePath(id), nil)
+	if err != nil {
+		return err
+	}
+
+	return c.do(req, nil)
+}
+
+// PinCacheEntry prevents a blob from being evicted from the mirror's local
+// cache.
+func (c *Client) PinCacheEntry(ctx context.Context, id string) error {
+	req, err := c.newRequest(ctx, http.MethodPut, "/admin/cache"+escapePath(id, "pin"), nil)
+	if err != nil {
+		return err
+	}
+
+	return c.do(req, nil)
+}
+
+// UnpinCacheEntry allows a previously pinned blob to be evicted from the
+// mirror's local cache.
+func (c *Client) UnpinCacheEntry(ctx context.Context, id string) error {
+	req, err := c.newRequest(ctx, http.MethodDelete, "/admin/cache"+escapePath(id, "pin"), nil)
+	if err != nil {
+		return err
+	}
+
+	return c.do(req, nil)
+}
+
+// SetCacheEntryPriority sets the eviction priority of a blob in the mirror's
+// local cache, lower priority blobs are evicted first.
+func (c *Client) SetCacheEntryPriority(ctx context.Context, id string, priority int) error {
+	body, err := json.Marshal(api.CachePriority{Priority: priority})
+	if err != nil {
+		return err
+	}
+
+	req, err := c.newRequest(ctx, http.MethodPut, "/admin/cache"+escapePath(id, "priority"), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	return c.do(req, nil)
+}
+
+// Prefetch starts a background job that pulls the requested blobs into the
+// mirror's local cache.
+func (c *Client) Prefetch(ctx context.Context, prefetchReq api.PrefetchRequest) (*api.PrefetchJob, error) {
+	body, err := json.Marshal(prefetchReq)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := c.newRequest(ctx, http.MethodPost, "/admin/prefetch", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	var job api.PrefetchJob
+	if err := c.do(req, &job); err != nil {
+		return nil, err
+	}
+
+	return &job, nil
+}
+
+// ListPrefetchJobs lists recent prefetch jobs.
+func (c *Client) ListPrefetchJobs(ctx context.Context) ([]api.PrefetchJob, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, "/admin/prefetch", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var jobs []api.PrefetchJob
+	if err := c.do(req, &jobs); err != nil {
+		return nil, err
+	}
+
+	return jobs, nil
+}
+
+// PrefetchJob returns the progress of a prefetch job.
+func (c *Client) PrefetchJob(ctx context.Context, id string) (*api.PrefetchJob, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, "/admin/prefetch"+escapePath(id), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var job api.PrefetchJob
+	if err := c.do(req, &job); err != nil {
+		return nil, err
+	}
+
+	return &job, nil
+}
+
+// StartScrub starts a scrub of the mirror's upstream store.
+func (c *Client) StartScrub(ctx context.Context) (*api.ScrubReport, error) {
+	req, err := c.newRequest(ctx, http.MethodPost, "/admin/scrub", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var report api.ScrubReport
+	if err := c.do(req, &report); err != nil {
+		return nil, err
+	}
+
+	return &report, nil
+}
+
+// ScrubStatus returns the progress of the running scrub, or the report of the
+// most recent scrub.
+func (c *Client) ScrubStatus(ctx context.Context) (*api.ScrubReport, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, "/admin/scrub", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var report api.ScrubReport
+	if err := c.do(req, &report); err != nil {
+		return nil, err
+	}
+
+	return &report, nil
+}
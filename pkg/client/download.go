@@ -0,0 +1,322 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/gpu-ninja/download-mirror/pkg/api"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	// DefaultDownloadConcurrency is the default number of ranges of a blob
+	// that are downloaded in parallel.
+	DefaultDownloadConcurrency = 4
+	// DefaultChunkSize is the default size of each downloaded range.
+	DefaultChunkSize = 8 << 20
+)
+
+// errRangesUnsupported is returned when the server responds to a range
+// request with the whole blob (eg. because it isn't in its cache yet).
+var errRangesUnsupported = errors.New("server does not support range requests")
+
+// DownloadOptions configures a blob download.
+type DownloadOptions struct {
+	// Concurrency is the number of ranges downloaded in parallel.
+	Concurrency int
+	// ChunkSize is the size of each range.
+	ChunkSize int64
+	// Progress, if set, is called as the blob is downloaded.
+	Progress ProgressFunc
+}
+
+// DownloadBlob downloads a blob to path, in ranges that are fetched in
+// parallel. The content is written to <path>.part, and if the download is
+// interrupted it is resumed from the ranges that were completed the next time
+// it is attempted. The content is verified against the blob's SHA-256 digest
+// before it is moved into place.
+func (c *Client) DownloadBlob(ctx context.Context, id, path string, opts DownloadOptions) (*api.Blob, error) {
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = DefaultDownloadConcurrency
+	}
+
+	if opts.ChunkSize <= 0 {
+		opts.ChunkSize = DefaultChunkSize
+	}
+
+	blob, err := c.StatBlob(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &download{
+		client:    c,
+		blob:      blob,
+		statePath: path + ".part.json",
+	}
+
+	d.f, d.state, err = openPart(path+".part", d.statePath, blob, opts.ChunkSize)
+	if err != nil {
+		return nil, err
+	}
+	defer d.f.Close()
+
+	var completed int64
+	for i, done := range d.state.Done {
+		if done {
+			completed += d.chunkLength(i)
+		}
+	}
+
+	d.progress = newProgress(opts.Progress, completed, blob.Size)
+
+	err = d.ranges(ctx, opts.Concurrency)
+	if errors.Is(err, errRangesUnsupported) {
+		err = d.whole(ctx, opts.Progress)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := d.verify(); err != nil {
+		_ = os.Remove(d.f.Name())
+		_ = os.Remove(d.statePath)
+
+		return nil, err
+	}
+
+	if err := d.f.Close(); err != nil {
+		return nil, err
+	}
+
+	if err := os.Rename(d.f.Name(), path); err != nil {
+		return nil, err
+	}
+
+	_ = os.Remove(d.statePath)
+
+	return blob, nil
+}
+
+// downloadState records the completed ranges of a download, so that an
+// interrupted download can be resumed.
+type downloadState struct {
+	ID        string `json:"id"`
+	Size      int64  `json:"size"`
+	ChunkSize int64  `json:"chunkSize"`
+	Done      []bool `json:"done"`
+}
+
+// openPart opens the partial download of a blob, if there's no partial
+// download (or it is of something else) a new one is started.
+func openPart(partPath, statePath string, blob *api.Blob, chunkSize int64) (*os.File, *downloadState, error) {
+	f, err := os.OpenFile(partPath, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var state downloadState
+	if data, err := os.ReadFile(statePath); err == nil && json.Unmarshal(data, &state) == nil {
+		fi, err := f.Stat()
+		if err == nil && state.ID == blob.ID && state.Size == blob.Size && fi.Size() == blob.Size {
+			return f, &state, nil
+		}
+	}
+
+	state = downloadState{
+		ID:        blob.ID,
+		Size:      blob.Size,
+		ChunkSize: chunkSize,
+		Done:      make([]bool, (blob.Size+chunkSize-1)/chunkSize),
+	}
+
+	if err := f.Truncate(blob.Size); err != nil {
+		_ = f.Close()
+		return nil, nil, err
+	}
+
+	return f, &state, nil
+}
+
+type download struct {
+	client    *Client
+	blob      *api.Blob
+	f         *os.File
+	progress  *progress
+	statePath string
+
+	mu    sync.Mutex
+	state *downloadState
+}
+
+func (d *download) chunkLength(i int) int64 {
+	start := int64(i) * d.state.ChunkSize
+	if end := start + d.state.ChunkSize; end < d.state.Size {
+		return d.state.ChunkSize
+	}
+
+	return d.state.Size - start
+}
+
+// ranges downloads the incomplete ranges of the blob in parallel.
+func (d *download) ranges(ctx context.Context, concurrency int) error {
+	var pending []int
+	for i, done := range d.state.Done {
+		if !done {
+			pending = append(pending, i)
+		}
+	}
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	// Fetch the first range on its own, so that a server that doesn't
+	// support ranges isn't asked for the whole blob many times over.
+	if err := d.fetchRange(ctx, pending[0]); err != nil {
+		return err
+	}
+
+	g, gCtx := errgroup.WithContext(ctx)
+	g.SetLimit(concurrency)
+
+	for _, i := range pending[1:] {
+		i := i
+		g.Go(func() error {
+			return d.fetchRange(gCtx, i)
+		})
+	}
+
+	return g.Wait()
+}
+
+func (d *download) fetchRange(ctx context.Context, i int) error {
+	start, length := int64(i)*d.state.ChunkSize, d.chunkLength(i)
+
+	req, err := d.client.newRequest(ctx, http.MethodGet, blobPath(d.blob.ID, d.blob.Name), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, start+length-1))
+
+	resp, err := d.client.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse(resp); err != nil {
+		return err
+	} else if resp.StatusCode != http.StatusPartialContent {
+		return errRangesUnsupported
+	}
+
+	if !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", start)) {
+		return fmt.Errorf("unexpected content range: %q", resp.Header.Get("Content-Range"))
+	}
+
+	n, err := io.Copy(io.NewOffsetWriter(d.f, start),
+		&progressReader{r: io.LimitReader(resp.Body, length), progress: d.progress})
+	if err != nil {
+		return err
+	} else if n != length {
+		return fmt.Errorf("short read of range %d: %w", i, io.ErrUnexpectedEOF)
+	}
+
+	return d.markDone(i)
+}
+
+func (d *download) markDone(i int) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.state.Done[i] = true
+
+	data, err := json.Marshal(d.state)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(d.statePath, data, 0o644)
+}
+
+// whole downloads the blob in a single request.
+func (d *download) whole(ctx context.Context, fn ProgressFunc) error {
+	_ = os.Remove(d.statePath)
+
+	if _, err := d.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	if err := d.f.Truncate(0); err != nil {
+		return err
+	}
+
+	req, err := d.client.newRequest(ctx, http.MethodGet, blobPath(d.blob.ID, d.blob.Name), nil)
+	if err != nil {
+		return err
+	}
+
+	body, err := d.client.open(req)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	n, err := io.Copy(d.f, &progressReader{r: body, progress: newProgress(fn, 0, d.blob.Size)})
+	if err != nil {
+		return err
+	} else if n != d.blob.Size {
+		return fmt.Errorf("expected %d bytes but got %d: %w", d.blob.Size, n, io.ErrUnexpectedEOF)
+	}
+
+	return nil
+}
+
+// verify checks the downloaded content against the blob's SHA-256 digest.
+func (d *download) verify() error {
+	if d.blob.SHA256 == "" {
+		return nil
+	}
+
+	if _, err := d.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, d.f); err != nil {
+		return err
+	}
+
+	if actual := hex.EncodeToString(h.Sum(nil)); actual != d.blob.SHA256 {
+		return fmt.Errorf("checksum mismatch for blob %s, expected sha256 %s but got %s", d.blob.ID, d.blob.SHA256, actual)
+	}
+
+	return nil
+}
@@ -0,0 +1,237 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client_test
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"hash"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gpu-ninja/download-mirror/internal/cache"
+	"github.com/gpu-ninja/download-mirror/internal/cas"
+	"github.com/gpu-ninja/download-mirror/internal/meta"
+	"github.com/gpu-ninja/download-mirror/internal/securehash"
+	"github.com/gpu-ninja/download-mirror/internal/upstream"
+	"github.com/gpu-ninja/download-mirror/pkg/client"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestTransfers(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+
+	ups, err := upstream.NewFilesystem(t.TempDir())
+	require.NoError(t, err)
+
+	localCache, err := cache.New(logger, cache.Options{
+		Dir: t.TempDir(),
+		NewHash: func() hash.Hash {
+			return securehash.New([]byte("test"))
+		},
+		HashSize: securehash.Size,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, localCache.Close())
+	})
+
+	storage := cas.NewStorage(logger, localCache, ups, meta.NewStore(ups), cas.Options{})
+
+	var (
+		requests     atomic.Int64
+		ignoreRanges atomic.Bool
+	)
+
+	e := echo.New()
+	e.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			requests.Add(1)
+			if ignoreRanges.Load() {
+				c.Request().Header.Del("Range")
+			}
+
+			return next(c)
+		}
+	})
+	e.GET("/blobs/:id/:name", storage.Get)
+	e.GET("/blob/:id", storage.Stat)
+	e.POST("/blob", storage.Put)
+
+	srv := httptest.NewServer(e)
+	t.Cleanup(srv.Close)
+
+	ctx := context.Background()
+	c := client.New(srv.URL)
+
+	data := make([]byte, 100000)
+	_, err = io.ReadFull(rand.Reader, data)
+	require.NoError(t, err)
+
+	srcPath := filepath.Join(t.TempDir(), "data.bin")
+	require.NoError(t, os.WriteFile(srcPath, data, 0o644))
+
+	var uploaded int64
+	blob, err := c.UploadFile(ctx, srcPath, client.UploadOptions{
+		Labels: map[string]string{"os": "linux"},
+		Progress: func(transferred, total int64) {
+			uploaded = transferred
+		},
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, "data.bin", blob.Name)
+	assert.Equal(t, int64(len(data)), blob.Size)
+	assert.Equal(t, int64(len(data)), uploaded)
+	assert.NotEmpty(t, blob.SHA256)
+
+	t.Run("Stat", func(t *testing.T) {
+		stat, err := c.StatBlob(ctx, blob.ID)
+		require.NoError(t, err)
+
+		assert.Equal(t, blob.SHA256, stat.SHA256)
+		assert.Equal(t, map[string]string{"os": "linux"}, stat.Labels)
+	})
+
+	opts := client.DownloadOptions{ChunkSize: 10000, Concurrency: 3}
+
+	t.Run("Parallel Download", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "data.bin")
+
+		var downloaded int64
+		opts := opts
+		opts.Progress = func(transferred, total int64) {
+			downloaded = transferred
+		}
+
+		requests.Store(0)
+		_, err := c.DownloadBlob(ctx, blob.ID, path, opts)
+		require.NoError(t, err)
+
+		got, err := os.ReadFile(path)
+		require.NoError(t, err)
+		assert.Equal(t, data, got)
+		assert.Equal(t, int64(len(data)), downloaded)
+
+		// One stat and ten ranges.
+		assert.Equal(t, int64(11), requests.Load())
+
+		_, err = os.Stat(path + ".part")
+		assert.True(t, os.IsNotExist(err))
+	})
+
+	// writePartial simulates an interrupted download, where every range but
+	// the first was completed.
+	writePartial := func(t *testing.T, path string, content []byte) {
+		partial := append([]byte(nil), content...)
+		copy(partial, make([]byte, 10000))
+		require.NoError(t, os.WriteFile(path+".part", partial, 0o644))
+
+		done := make([]bool, 10)
+		for i := 1; i < len(done); i++ {
+			done[i] = true
+		}
+
+		state, err := json.Marshal(map[string]any{
+			"id":        blob.ID,
+			"size":      len(data),
+			"chunkSize": 10000,
+			"done":      done,
+		})
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(path+".part.json", state, 0o644))
+	}
+
+	t.Run("Resume", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "data.bin")
+		writePartial(t, path, data)
+
+		requests.Store(0)
+		_, err := c.DownloadBlob(ctx, blob.ID, path, opts)
+		require.NoError(t, err)
+
+		got, err := os.ReadFile(path)
+		require.NoError(t, err)
+		assert.Equal(t, data, got)
+
+		// One stat and the missing range.
+		assert.Equal(t, int64(2), requests.Load())
+	})
+
+	t.Run("Checksum Mismatch", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "data.bin")
+
+		corrupt := append([]byte(nil), data...)
+		corrupt[len(corrupt)-1] ^= 0xff
+		writePartial(t, path, corrupt)
+
+		_, err := c.DownloadBlob(ctx, blob.ID, path, opts)
+		require.ErrorContains(t, err, "checksum mismatch")
+
+		for _, p := range []string{path, path + ".part", path + ".part.json"} {
+			_, err = os.Stat(p)
+			assert.True(t, os.IsNotExist(err), p)
+		}
+	})
+
+	t.Run("Ranges Unsupported", func(t *testing.T) {
+		ignoreRanges.Store(true)
+		t.Cleanup(func() {
+			ignoreRanges.Store(false)
+		})
+
+		path := filepath.Join(t.TempDir(), "data.bin")
+
+		_, err := c.DownloadBlob(ctx, blob.ID, path, opts)
+		require.NoError(t, err)
+
+		got, err := os.ReadFile(path)
+		require.NoError(t, err)
+		assert.Equal(t, data, got)
+	})
+
+	t.Run("Upload Directory", func(t *testing.T) {
+		dir := t.TempDir()
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, "linux"), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "linux", "tool"), []byte("linux tool"), 0o644))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "README"), []byte("readme"), 0o644))
+
+		manifest, err := c.UploadDir(ctx, dir, client.UploadDirOptions{})
+		require.NoError(t, err)
+
+		require.Len(t, manifest.Files, 2)
+		assert.Equal(t, "README", manifest.Files[0].Path)
+		assert.Equal(t, "linux/tool", manifest.Files[1].Path)
+
+		body, err := c.OpenBlob(ctx, manifest.Files[1].ID)
+		require.NoError(t, err)
+		defer body.Close()
+
+		got, err := io.ReadAll(body)
+		require.NoError(t, err)
+		assert.Equal(t, "linux tool", string(got))
+	})
+}
@@ -0,0 +1,91 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"context"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"time"
+
+	"github.com/gpu-ninja/download-mirror/pkg/api"
+	"golang.org/x/mod/module"
+)
+
+// PublishGoModule publishes a version of a Go module to the mirror's module
+// proxy. If publishedAt is zero, the server records the time of publication.
+func (c *Client) PublishGoModule(ctx context.Context, modulePath, version string, mod, zip io.Reader, publishedAt time.Time) (*api.GoModuleInfo, error) {
+	escapedPath, err := module.EscapePath(modulePath)
+	if err != nil {
+		return nil, err
+	}
+
+	escapedVersion, err := module.EscapeVersion(version)
+	if err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+
+	// Stream the form, so that large module zips aren't buffered in memory.
+	go func() {
+		pw.CloseWithError(func() error {
+			if !publishedAt.IsZero() {
+				if err := mw.WriteField("time", publishedAt.UTC().Format(time.RFC3339)); err != nil {
+					return err
+				}
+			}
+
+			for _, file := range []struct {
+				field, name string
+				r           io.Reader
+			}{
+				{"mod", "go.mod", mod},
+				{"zip", version + ".zip", zip},
+			} {
+				w, err := mw.CreateFormFile(file.field, file.name)
+				if err != nil {
+					return err
+				}
+
+				if _, err := io.Copy(w, file.r); err != nil {
+					return err
+				}
+			}
+
+			return mw.Close()
+		}())
+	}()
+
+	req, err := c.newRequest(ctx, http.MethodPut, "/goproxy/"+escapedPath+"/@v/"+escapedVersion, pr)
+	if err != nil {
+		_ = pr.Close()
+		return nil, err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+
+	var info api.GoModuleInfo
+	if err := c.do(req, &info); err != nil {
+		_ = pr.Close()
+		return nil, err
+	}
+
+	return &info, nil
+}
@@ -0,0 +1,114 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/gpu-ninja/download-mirror/pkg/api"
+)
+
+// Manifest records the blobs a set of files (eg. a directory) was uploaded
+// as, so that they can be downloaded and verified later.
+type Manifest struct {
+	Files []ManifestFile `json:"files"`
+}
+
+// ManifestFile is an uploaded file.
+type ManifestFile struct {
+	// Path is the slash separated path of the file, relative to the uploaded
+	// directory.
+	Path   string `json:"path"`
+	ID     string `json:"id"`
+	URL    string `json:"url"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// UploadDirOptions configures a directory upload.
+type UploadDirOptions struct {
+	// Labels are attached to every uploaded blob.
+	Labels map[string]string
+	// Progress, if set, returns the function called as each file (named by
+	// its manifest path) is uploaded.
+	Progress func(path string) ProgressFunc
+}
+
+// UploadFile uploads a local file as a blob named after it.
+func (c *Client) UploadFile(ctx context.Context, path string, opts UploadOptions) (*api.Blob, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	opts.Size = fi.Size()
+
+	return c.UploadBlob(ctx, filepath.Base(path), f, opts)
+}
+
+// UploadDir uploads every regular file under dir (symbolic links aren't
+// followed), and returns a manifest of the uploaded blobs.
+func (c *Client) UploadDir(ctx context.Context, dir string, opts UploadDirOptions) (*Manifest, error) {
+	var manifest Manifest
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		uploadOpts := UploadOptions{Labels: opts.Labels}
+		if opts.Progress != nil {
+			uploadOpts.Progress = opts.Progress(rel)
+		}
+
+		blob, err := c.UploadFile(ctx, path, uploadOpts)
+		if err != nil {
+			return fmt.Errorf("failed to upload %s: %w", rel, err)
+		}
+
+		manifest.Files = append(manifest.Files, ManifestFile{
+			Path:   rel,
+			ID:     blob.ID,
+			URL:    blob.URL,
+			Size:   blob.Size,
+			SHA256: blob.SHA256,
+		})
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &manifest, nil
+}
@@ -0,0 +1,55 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/gpu-ninja/download-mirror/pkg/api"
+)
+
+// GetQuota returns the storage used by the client's token, and its quota.
+func (c *Client) GetQuota(ctx context.Context) (*api.Quota, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, "/quota", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var quota api.Quota
+	if err := c.do(req, &quota); err != nil {
+		return nil, err
+	}
+
+	return &quota, nil
+}
+
+// ListQuotas returns the storage used by every token, and their quotas.
+func (c *Client) ListQuotas(ctx context.Context) ([]api.Quota, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, "/admin/quotas", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var quotas []api.Quota
+	if err := c.do(req, &quotas); err != nil {
+		return nil, err
+	}
+
+	return quotas, nil
+}
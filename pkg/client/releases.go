@@ -0,0 +1,133 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+
+	"github.com/gpu-ninja/download-mirror/pkg/api"
+)
+
+// ReleaseUpload is a file uploaded as part of creating a release.
+type ReleaseUpload struct {
+	// Name is the filename of the file in the release.
+	Name   string
+	Reader io.Reader
+}
+
+// CreateRelease atomically creates a release from the uploaded files, and any
+// existing blobs referred to by the request.
+func (c *Client) CreateRelease(ctx context.Context, product, version string, releaseReq api.ReleaseRequest, uploads []ReleaseUpload) (*api.Release, error) {
+	body, err := json.Marshal(releaseReq)
+	if err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+
+	// Stream the form, so that large files aren't buffered in memory.
+	go func() {
+		pw.CloseWithError(func() error {
+			if err := mw.WriteField("release", string(body)); err != nil {
+				return err
+			}
+
+			for _, upload := range uploads {
+				w, err := mw.CreateFormFile("file", upload.Name)
+				if err != nil {
+					return err
+				}
+
+				if _, err := io.Copy(w, upload.Reader); err != nil {
+					return err
+				}
+			}
+
+			return mw.Close()
+		}())
+	}()
+
+	req, err := c.newRequest(ctx, http.MethodPost, "/releases"+escapePath(product, version), pr)
+	if err != nil {
+		_ = pr.Close()
+		return nil, err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+
+	var release api.Release
+	if err := c.do(req, &release); err != nil {
+		_ = pr.Close()
+		return nil, err
+	}
+
+	return &release, nil
+}
+
+// GetRelease returns the manifest of a release, the version can also be the
+// name of a channel.
+func (c *Client) GetRelease(ctx context.Context, product, version string) (*api.Release, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, "/releases"+escapePath(product, version), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var release api.Release
+	if err := c.do(req, &release); err != nil {
+		return nil, err
+	}
+
+	return &release, nil
+}
+
+// SetReleaseChannel points a release channel at a release.
+func (c *Client) SetReleaseChannel(ctx context.Context, product, channel, version string) (*api.ReleaseChannel, error) {
+	body, err := json.Marshal(api.ReleaseChannel{Version: version})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := c.newRequest(ctx, http.MethodPut, "/releases"+escapePath(product, "channels", channel), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	var rc api.ReleaseChannel
+	if err := c.do(req, &rc); err != nil {
+		return nil, err
+	}
+
+	return &rc, nil
+}
+
+// OpenReleaseFile returns the content of a file of a release, including the
+// generated manifest.json and SHA256SUMS files.
+func (c *Client) OpenReleaseFile(ctx context.Context, product, version, name string) (io.ReadCloser, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, "/releases"+escapePath(product, version, name), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.open(req)
+}
@@ -0,0 +1,77 @@
+/* SPDX-License-Identifier: Apache-2.0
+ *
+ * Copyright 2023 Damian Peckett <damian@pecke.tt>.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+)
+
+// signatureExtension is appended to the URL of a blob or release file to get
+// its minisign signature.
+const signatureExtension = ".minisig"
+
+// GetBlobSignature returns the minisign signature of a blob.
+func (c *Client) GetBlobSignature(ctx context.Context, id string) ([]byte, error) {
+	return c.getSignature(ctx, "/blobs"+escapePath(id+signatureExtension))
+}
+
+// PutBlobSignature uploads an offline minisign signature of a blob, it must be
+// made by a key the server trusts.
+func (c *Client) PutBlobSignature(ctx context.Context, id string, sig []byte) error {
+	return c.putSignature(ctx, "/blobs"+escapePath(id+signatureExtension), sig)
+}
+
+// GetReleaseSignature returns the minisign signature of a release file (eg.
+// manifest.json or SHA256SUMS).
+func (c *Client) GetReleaseSignature(ctx context.Context, product, version, name string) ([]byte, error) {
+	return c.getSignature(ctx, "/releases"+escapePath(product, version, name+signatureExtension))
+}
+
+// PutReleaseSignature uploads an offline minisign signature of a release file,
+// it must be made by a key the server trusts.
+func (c *Client) PutReleaseSignature(ctx context.Context, product, version, name string, sig []byte) error {
+	return c.putSignature(ctx, "/releases"+escapePath(product, version, name+signatureExtension), sig)
+}
+
+func (c *Client) getSignature(ctx context.Context, path string) ([]byte, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := c.open(req)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	return io.ReadAll(body)
+}
+
+func (c *Client) putSignature(ctx context.Context, path string, sig []byte) error {
+	req, err := c.newRequest(ctx, http.MethodPut, path, bytes.NewReader(sig))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain")
+
+	return c.do(req, nil)
+}